@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// accessLog is the access_log file of one or more listeners: a record per
+// relayed or failed connection, in the log_format, whatever the log level.
+// Records are written whole in one write, so listeners can share a file.
+type accessLog struct {
+	path string
+	file *rotatingFile
+	json *slog.Logger
+}
+
+// accessLogs are the open access_log files by path. Listeners of one
+// configuration and of the previous one share them.
+var accessLogs struct {
+	mu    sync.Mutex
+	files map[string]*accessLog
+}
+
+// openAccessLog returns the access log at path, opening it unless it is
+// open already.
+func openAccessLog(path string) (*accessLog, error) {
+	accessLogs.mu.Lock()
+	defer accessLogs.mu.Unlock()
+	if a, ok := accessLogs.files[path]; ok {
+		return a, nil
+	}
+	f, err := openRotating(path, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	a := &accessLog{path: path, file: f, json: slog.New(slog.NewJSONHandler(f, nil))}
+	if accessLogs.files == nil {
+		accessLogs.files = make(map[string]*accessLog)
+	}
+	accessLogs.files[path] = a
+	return a, nil
+}
+
+// closeAccessLogs closes the access logs no entry of cfg writes to (all of
+// them for nil). Records of connections still open on a removed listener
+// are lost.
+func closeAccessLogs(cfg *Config) {
+	used := make(map[string]bool)
+	if cfg != nil {
+		for _, e := range cfg.Proxies {
+			used[e.AccessLog] = true
+		}
+	}
+	accessLogs.mu.Lock()
+	defer accessLogs.mu.Unlock()
+	for path, a := range accessLogs.files {
+		if !used[path] {
+			a.file.Close()
+			delete(accessLogs.files, path)
+		}
+	}
+}
+
+// reopenAccessLogs reopens the access logs at their paths, after logrotate
+// moved them away, and returns the paths in order.
+func reopenAccessLogs() ([]string, error) {
+	accessLogs.mu.Lock()
+	defer accessLogs.mu.Unlock()
+	paths := make([]string, 0, len(accessLogs.files))
+	for path := range accessLogs.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := accessLogs.files[path].file.reopen(); err != nil {
+			return paths, fmt.Errorf("access log %s: %w", path, err)
+		}
+	}
+	return paths, nil
+}
+
+// record appends msg ("[component:port/name] text") with fields. It is a
+// no-op on nil.
+func (a *accessLog) record(msg string, fields []slog.Attr) {
+	if a == nil {
+		return
+	}
+	if jsonLogs.Load() {
+		msg, attrs := jsonRecord(msg, fields)
+		a.json.LogAttrs(context.Background(), slog.LevelInfo, msg, attrs...)
+		return
+	}
+	a.file.Write([]byte(time.Now().Format("2006/01/02 15:04:05 ") + textRecord(msg, fields) + "\n"))
+}
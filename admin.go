@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// adminMaxBody bounds request bodies of the admin API.
+const adminMaxBody = 1 << 20
+
+// validateAdmin validates the admin block.
+func validateAdmin(ac *AdminConfig) error {
+	if ac.Listen == "" && ac.GRPCListen == "" && !ac.Persist {
+		return fmt.Errorf("config: admin: 'listen' or 'grpc_listen' is required (e.g. \"127.0.0.1:9090\")")
+	}
+	for name, addr := range map[string]string{"listen": ac.Listen, "grpc_listen": ac.GRPCListen} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("config: admin: invalid %s %q: %w", name, addr, err)
+		}
+	}
+	if ac.Listen != "" && ac.Listen == ac.GRPCListen {
+		return fmt.Errorf("config: admin: listen and grpc_listen must differ")
+	}
+	return validateAdminAuth(ac)
+}
+
+// adminServer serves the HTTP management API on admin.listen.
+type adminServer struct {
+	listen string
+	tls    bool
+	http   *http.Server
+}
+
+// update starts, moves or stops the API to match ac (nil: disabled), and
+// restarts it when TLS is turned on or off. A failure to listen on a new
+// address keeps the previous listener.
+func (a *adminServer) update(ac *AdminConfig, c *controller) error {
+	listen := ""
+	if ac != nil {
+		listen = ac.Listen
+	}
+	secure := c.sec.tls.Load() != nil
+	if listen == a.listen && secure == a.tls {
+		return nil
+	}
+	var srv *http.Server
+	if listen != "" {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		srv = &http.Server{Handler: adminHandler(c, false), ReadHeaderTimeout: 10 * time.Second}
+		go srv.Serve(c.sec.listener(ln))
+		logInfo("[admin] REST API listening on %s%s", ln.Addr(), tlsNote(secure))
+		c.sec.warnOpen("REST API", ln.Addr())
+	}
+	if old := a.http; old != nil {
+		// Shut down in the background: the request that triggered this
+		// update may still be writing its response.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			old.Shutdown(ctx)
+		}()
+		logInfo("[admin] REST API stopped listening on %s", a.listen)
+	}
+	a.listen, a.tls, a.http = listen, secure, srv
+	return nil
+}
+
+func tlsNote(secure bool) string {
+	if secure {
+		return " (TLS)"
+	}
+	return ""
+}
+
+// listenerInfo is the API representation of one listener.
+type listenerInfo struct {
+	Port   int            `json:"port"`
+	Name   string         `json:"name,omitempty"`
+	Paused bool           `json:"paused"`
+	Stats  listenerStats  `json:"stats"`
+	Config map[string]any `json:"config"`
+
+	OffSchedule bool `json:"off_schedule,omitempty"` // outside the windows of its schedule: closing new connections
+}
+
+type listenerStats struct {
+	ConnectionsTotal     int64            `json:"connections_total"`
+	ConnectionsActive    int64            `json:"connections_active"`
+	ConnectionsDenied    int64            `json:"connections_denied"`            // closed on accept by allow_clients / deny_clients
+	ConnectionsLimited   int64            `json:"connections_rate_limited"`      // closed on accept by rate_limit
+	ConnectionsCapped    int64            `json:"connections_capped"`            // closed on accept by max_connections
+	ConnectionsQueued    int64            `json:"connections_queued,omitempty"`  // with workers: waiting for a handler
+	ConnectionsDropped   int64            `json:"connections_dropped,omitempty"` // with workers: closed as the queue was full or for waiting too long
+	AcceptErrors         int64            `json:"accept_errors"`                 // failed accepts, each pausing the accept loop
+	AcceptFDExhausted    int64            `json:"accept_fd_exhausted"`           // of accept_errors, for want of file descriptors
+	ConnectErrors        int64            `json:"connect_errors"`
+	ConnectErrorsByClass map[string]int64 `json:"connect_errors_by_class,omitempty"` // refused, net_unreachable, host_unreachable, timeout, dns, denied, other
+	BytesUp              int64            `json:"bytes_up"`
+	BytesDown            int64            `json:"bytes_down"`
+	BytesSpliced         int64            `json:"bytes_spliced"`               // of bytes_up and bytes_down, moved by splice(2) or the sockmap
+	BytesBuffered        int64            `json:"bytes_buffered"`              // and through userspace buffers
+	ConnectionsMPTCP     int64            `json:"connections_mptcp,omitempty"` // with mptcp: connections to targets using Multipath TCP
+
+	Quota   *quotaStatus `json:"quota,omitempty"` // with a quota: its use in the current period
+	Latency latencyStats `json:"latency"`
+}
+
+// adminHandler routes the API:
+//
+//	GET    /api/v1/listeners         all listeners with their stats
+//	POST   /api/v1/listeners         add entries (body: one proxy entry)
+//	GET    /api/v1/listeners/{port}  one listener
+//	PUT    /api/v1/listeners/{port}  replace its entry
+//	DELETE /api/v1/listeners/{port}  remove it
+//	POST   /api/v1/listeners/{port}/pause, .../resume
+//	POST   /api/v1/reload            reload from the config source (?discard=true: without API changes)
+//	GET    /api/v1/status            daemon status
+//	GET    /api/v1/connections       connections being relayed (?port=N)
+//	DELETE /api/v1/connections/{id}  close one
+//	GET    /api/v1/domains           top destination domains (?top=N, ?by=bytes|bytes_up|bytes_down|connections)
+//	GET    /api/v1/events            connection events as server-sent events (?port=N, ?type=open,close,failed)
+//	POST   /api/v1/rotate            reopen the -log-file, audit log and access logs
+//	GET    /api/v1/log-level         log level in effect and configured
+//	PUT    /api/v1/log-level         override it at runtime (body: level, ttl)
+//	DELETE /api/v1/log-level         end the override, back to log_level
+//	GET    /api/v1/health            outbound addresses and their health
+//	GET    /api/v1/users             users with their stats
+//	GET    /api/v1/errors            recent connection failures, newest first
+//	GET    /api/v1/bans              client bans in effect
+//	POST   /api/v1/bans              ban an IP or CIDR (body: cidr, ttl, reason)
+//	DELETE /api/v1/bans/{cidr}       lift a ban
+//	GET    /dashboard/               the web dashboard (see dashboard.go)
+//	POST   /api/v1/debug/dump        write goroutine and heap dumps to -state-dir (admin.debug)
+//	GET    /debug/pprof/             net/http/pprof (admin.debug)
+//	GET    /healthz                  liveness: the daemon answers
+//	GET    /readyz                   readiness: all listeners bound and addresses usable
+func adminHandler(c *controller, local bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, daemonStatus(c))
+	})
+	mux.HandleFunc("/api/v1/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		port := 0
+		if p := r.URL.Query().Get("port"); p != "" {
+			var err error
+			if port, err = strconv.Atoi(p); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", p))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, activeConns.list(port))
+	})
+	mux.HandleFunc("/api/v1/connections/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, "DELETE")
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/v1/connections/"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusNotFound, errors.New("invalid connection id"))
+			return
+		}
+		conn, ok := activeConns.kill(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("no such connection (it may have closed)"))
+			return
+		}
+		auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "connection.kill", Target: strconv.FormatUint(id, 10),
+			Changes: []string{fmt.Sprintf("%s → %s on :%d", conn.Client, conn.Target, conn.Port)}})
+		logInfo("[admin] closed connection %d: %s → %s on :%d", conn.ID, conn.Client, conn.Target, conn.Port)
+		writeJSON(w, http.StatusOK, conn)
+	})
+	mux.HandleFunc("/api/v1/domains", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		d := c.srv.domains()
+		if d == nil {
+			writeError(w, http.StatusNotFound, errDomainStatsDisabled)
+			return
+		}
+		n := defaultDomainTop
+		if t := r.URL.Query().Get("top"); t != "" {
+			var err error
+			if n, err = strconv.Atoi(t); err != nil || n < 1 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid top %q", t))
+				return
+			}
+		}
+		by := r.URL.Query().Get("by")
+		if by == "" {
+			by = "bytes"
+		}
+		report, err := d.top(n, by)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+	mux.HandleFunc("/api/v1/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		streamEvents(w, r)
+	})
+	mux.HandleFunc("/api/v1/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		audit, auditErr := auditLog.reopen()
+		if auditErr != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("audit log: %w", auditErr))
+			return
+		}
+		access, accessErr := reopenAccessLogs()
+		if accessErr != nil {
+			writeError(w, http.StatusInternalServerError, accessErr)
+			return
+		}
+		path, err := reopenLogFile()
+		switch {
+		case err != nil && path != "":
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		case err != nil && audit == "" && len(access) == 0:
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		resp := map[string]any{}
+		if path != "" {
+			logInfo("[admin] reopened log file %s", path)
+			resp["log_file"] = path
+		}
+		if audit != "" {
+			logInfo("[admin] reopened audit log %s", audit)
+			resp["audit_log"] = audit
+		}
+		if len(access) > 0 {
+			logInfo("[admin] reopened %d access logs", len(access))
+			resp["access_logs"] = access
+		}
+		auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "rotate"})
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.HandleFunc("/api/v1/log-level", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, logLevelState())
+		case http.MethodPut:
+			setRuntimeLogLevel(w, r)
+		case http.MethodDelete:
+			before := logLevelState()
+			if resetLogLevel() {
+				auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "log_level.reset",
+					Changes: []string{fmt.Sprintf("log level %s → %s", before.Level, before.Configured)}})
+				logInfo("[admin] log level back to %s from log_level", before.Configured)
+			}
+			writeJSON(w, http.StatusOK, logLevelState())
+		default:
+			methodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	})
+	mux.HandleFunc("/api/v1/debug/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		if !debugEnabled(c) {
+			writeError(w, http.StatusNotFound, errDebugDisabled)
+			return
+		}
+		if c.state.Dir == "" {
+			writeError(w, http.StatusConflict, errors.New("dumps are written to -state-dir, which is not set"))
+			return
+		}
+		info, err := writeDump(c.state.Dir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logInfo("[admin] wrote %s and %s", info.Goroutines, info.Heap)
+		auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "debug.dump"})
+		writeJSON(w, http.StatusOK, info)
+	})
+	mux.Handle("/debug/", debugHandler(c))
+	mux.HandleFunc("/api/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, outboundStatus(c))
+	})
+	mux.HandleFunc("/api/v1/users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, c.srv.users().list())
+	})
+	mux.HandleFunc("/api/v1/errors", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		out := []failureInfo{}
+		for _, ev := range connFailures.list() {
+			out = append(out, failureInfo{Time: ev.Time, Port: ev.Port, Name: ev.Name, Client: ev.Client, Target: ev.Target, Error: ev.Error, Class: ev.Class})
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+	mux.HandleFunc("/api/v1/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			out := []banInfo{}
+			for _, b := range clientBans.list() {
+				out = append(out, newBanInfo(b))
+			}
+			writeJSON(w, http.StatusOK, out)
+		case http.MethodPost:
+			addBan(c, w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	})
+	mux.HandleFunc("/api/v1/bans/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, "DELETE")
+			return
+		}
+		prefix, err := parseBanTarget(strings.TrimPrefix(r.URL.Path, "/api/v1/bans/"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if !clientBans.remove(prefix) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s is not banned", prefix))
+			return
+		}
+		auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "unban", Target: prefix.String()})
+		logInfo("[ban] %s unbanned", prefix)
+		c.bansChanged()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/v1/listeners", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, listeners(c, 0))
+		case http.MethodPost:
+			addListeners(c, w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	})
+	mux.HandleFunc("/api/v1/listeners/", func(w http.ResponseWriter, r *http.Request) {
+		arg, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/listeners/"), "/")
+		port, err := strconv.Atoi(arg)
+		if err != nil || port < 1 || port > 65535 {
+			writeError(w, http.StatusNotFound, errors.New("invalid port"))
+			return
+		}
+		if action != "" {
+			if action != "pause" && action != "resume" {
+				writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", action))
+				return
+			}
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, "POST")
+				return
+			}
+			if err := c.setPaused(actorOf(r.Context()), port, action == "pause"); err != nil {
+				writeEditError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, listeners(c, port)[0])
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			found := listeners(c, port)
+			if len(found) == 0 {
+				writeError(w, http.StatusNotFound, errNoListener)
+				return
+			}
+			writeJSON(w, http.StatusOK, found[0])
+		case http.MethodPut:
+			replaceListener(c, w, r, port)
+		case http.MethodDelete:
+			removeListener(c, w, r, port)
+		default:
+			methodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	})
+	mux.HandleFunc("/api/v1/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		reload := c.reload
+		if discard, _ := strconv.ParseBool(r.URL.Query().Get("discard")); discard {
+			reload = c.discardChanges
+		}
+		by := actorOf(r.Context())
+		if err := reload(by, "requested by "+by); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, listeners(c, 0))
+	})
+	return withPublic(c, c.sec.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logInfo("[admin] %s %s by %s", r.Method, r.URL.Path, actorOf(r.Context()))
+		}
+		mux.ServeHTTP(w, r)
+	}), local))
+}
+
+// withPublic serves, next to api, the paths that need no credentials: the
+// dashboard page, which holds no data, and the health probes, which load
+// balancers and Kubernetes call without any.
+func withPublic(c *controller, api http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", api)
+	mux.Handle("/debug/", api)
+	mux.HandleFunc("/dashboard/", serveDashboard)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, probeInfo{Status: "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		if problems := readinessProblems(c); len(problems) > 0 {
+			writeJSON(w, http.StatusServiceUnavailable, probeInfo{Status: "not ready", Problems: problems})
+			return
+		}
+		writeJSON(w, http.StatusOK, probeInfo{Status: "ready"})
+	})
+	mux.HandleFunc("/", redirectDashboard)
+	return mux
+}
+
+// probeInfo is the response of /healthz and /readyz.
+type probeInfo struct {
+	Status   string   `json:"status"` // ok, ready or not ready
+	Problems []string `json:"problems,omitempty"`
+}
+
+// readinessProblems returns why the proxy should not get traffic yet: a
+// listener of the running configuration without its socket, or an outbound
+// address that is not assigned or not usable yet (duplicate address
+// detection). Paused listeners count as ready; pausing is deliberate.
+func readinessProblems(c *controller) []string {
+	cfg := c.srv.config()
+	if cfg == nil {
+		return []string{"starting"}
+	}
+	var problems []string
+	for _, port := range c.srv.unbound() {
+		problems = append(problems, fmt.Sprintf("listener :%d is not bound", port))
+	}
+	addrs, err := addressProblems(cfg.Interface, outboundEntries(cfg))
+	if err != nil {
+		addrs = []string{err.Error()}
+	}
+	return append(problems, addrs...)
+}
+
+// statusInfo is the API representation of the daemon status.
+type statusInfo struct {
+	PID               int       `json:"pid"`
+	Started           time.Time `json:"started"`
+	Uptime            string    `json:"uptime"`
+	Config            string    `json:"config"`
+	Listeners         int       `json:"listeners"`
+	ConnectionsActive int64     `json:"connections_active"`
+	LogLevel          string    `json:"log_level"`
+	LogLevelConfig    string    `json:"log_level_configured,omitempty"` // log_level, while overridden at runtime
+
+	Relay         string `json:"relay"`                    // splice, buffered, io_uring or sockmap
+	PipeSize      int64  `json:"pipe_size,omitempty"`      // of splice pipes, set by relay.pipe_size
+	SockmapRelays int    `json:"sockmap_relays,omitempty"` // connections forwarded in the kernel now
+	BytesSpliced  int64  `json:"bytes_spliced"`            // of the open listeners' bytes, moved by splice(2) or the sockmap
+	BytesBuffered int64  `json:"bytes_buffered"`           // and through userspace buffers
+}
+
+func daemonStatus(c *controller) statusInfo {
+	ll := logLevelState()
+	st := statusInfo{
+		PID:      os.Getpid(),
+		Started:  c.started,
+		Uptime:   time.Since(c.started).Round(time.Second).String(),
+		Config:   c.path,
+		LogLevel: ll.Level,
+		Relay:    relayMode(),
+		PipeSize: relayPipeSize.Load(),
+
+		SockmapRelays: openSockmap.relays(),
+	}
+	if ll.Override {
+		st.LogLevelConfig = ll.Configured
+	}
+	for _, ps := range c.srv.status() {
+		st.Listeners++
+		st.ConnectionsActive += ps.stats.Active.Load()
+		spliced := ps.stats.Spliced.Load()
+		st.BytesSpliced += spliced
+		st.BytesBuffered += ps.stats.BytesUp.Load() + ps.stats.BytesDown.Load() - spliced
+	}
+	return st
+}
+
+// listeners returns the open listeners, or only the one on port if not 0.
+func listeners(c *controller, port int) []listenerInfo {
+	refs := c.srv.config().secretRefs
+	out := []listenerInfo{}
+	for _, ps := range c.srv.status() {
+		if port != 0 && ps.entry.Port != port {
+			continue
+		}
+		var quota *quotaStatus
+		if ps.entry.Quota != nil {
+			quota = ps.stats.Quota.status(ps.entry.Quota)
+		}
+		spliced := ps.stats.Spliced.Load() // first: bytes are added to it last
+		up, down := ps.stats.BytesUp.Load(), ps.stats.BytesDown.Load()
+		out = append(out, listenerInfo{
+			Port:   ps.entry.Port,
+			Name:   ps.entry.Name,
+			Paused: ps.entry.Paused,
+			Stats: listenerStats{
+				ConnectionsTotal:     ps.stats.Total.Load(),
+				ConnectionsActive:    ps.stats.Active.Load(),
+				ConnectionsDenied:    ps.stats.Denied.Load(),
+				ConnectionsLimited:   ps.stats.Limited.Load(),
+				ConnectionsCapped:    ps.stats.Capped.Load(),
+				ConnectionsQueued:    ps.stats.Queued.Load(),
+				ConnectionsDropped:   ps.stats.Dropped.Load(),
+				AcceptErrors:         ps.stats.AcceptErrors.Load(),
+				AcceptFDExhausted:    ps.stats.FDExhausted.Load(),
+				ConnectErrors:        ps.stats.Failed.Load(),
+				ConnectErrorsByClass: ps.stats.DialErrors.byClass(),
+				BytesUp:              up,
+				BytesDown:            down,
+				BytesSpliced:         spliced,
+				BytesBuffered:        up + down - spliced,
+				ConnectionsMPTCP:     ps.stats.MPTCP.Load(),
+				Quota:                quota,
+				Latency: latencyStats{
+					Handshake: ps.stats.Handshake.snapshot().info(),
+					DNS:       ps.stats.DNS.snapshot().info(),
+					Dial:      ps.stats.Dial.snapshot().info(),
+					Session:   ps.stats.Session.snapshot().info(),
+				},
+			},
+			Config:      entryFields(ps.entry, refs),
+			OffSchedule: !ps.entry.Schedule.open(time.Now()),
+		})
+	}
+	return out
+}
+
+// entryFields returns the YAML fields of e as recorded in running.yaml:
+// secrets masked, empty options left out.
+func entryFields(e ProxyEntry, refs map[string]string) map[string]any {
+	var n yaml.Node
+	if err := n.Encode(effectiveEntry(e)); err != nil {
+		return nil
+	}
+	maskSecrets(&n, refs)
+	pruneEmpty(&n)
+	var m map[string]any
+	n.Decode(&m)
+	return m
+}
+
+// addListeners adds the entry in the request body and responds with the
+// new listeners.
+func addListeners(c *controller, w http.ResponseWriter, r *http.Request) {
+	entry, err := readEntry(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	added, err := c.addEntry(actorOf(r.Context()), entry)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	out := []listenerInfo{}
+	for _, e := range added {
+		out = append(out, listeners(c, e.Port)...)
+	}
+	writeJSON(w, http.StatusCreated, out)
+}
+
+// replaceListener replaces the entry of port with the one in the body.
+func replaceListener(c *controller, w http.ResponseWriter, r *http.Request, port int) {
+	entry, err := readEntry(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := c.replaceEntry(actorOf(r.Context()), port, entry); err != nil {
+		writeEditError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listeners(c, port)[0])
+}
+
+func removeListener(c *controller, w http.ResponseWriter, r *http.Request, port int) {
+	if err := c.removeEntry(actorOf(r.Context()), port); err != nil {
+		writeEditError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// outboundInfo is the API representation of one outbound address.
+type outboundInfo struct {
+	Address   string     `json:"address"`
+	Ports     []int      `json:"ports"` // listeners whose pool holds it
+	State     string     `json:"state"` // healthy, unhealthy or unchecked (no health_check)
+	LastProbe *time.Time `json:"last_probe,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	ConnectErrors map[string]int64 `json:"connect_errors,omitempty"` // by class, of connections from it on any listener
+}
+
+// outboundStatus returns the outbound addresses of all listeners, in
+// address order.
+func outboundStatus(c *controller) []outboundInfo {
+	health := c.srv.health()
+	byAddr := make(map[string]*outboundInfo)
+	var addrs []string
+	for _, ps := range c.srv.status() {
+		for _, out := range ps.entry.Outbound {
+			info, ok := byAddr[out.IPv6]
+			if !ok {
+				state, last := health.state(out.IPv6)
+				info = &outboundInfo{Address: out.IPv6, State: state, ConnectErrors: outboundErrors.byClass(out.IPv6)}
+				if last != nil {
+					info.LastProbe = &last.time
+					if last.err != nil {
+						info.LastError = last.err.Error()
+					}
+				}
+				byAddr[out.IPv6] = info
+				addrs = append(addrs, out.IPv6)
+			}
+			info.Ports = append(info.Ports, ps.entry.Port)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		a, _ := netip.ParseAddr(addrs[i])
+		b, _ := netip.ParseAddr(addrs[j])
+		return a.Less(b)
+	})
+	out := make([]outboundInfo, len(addrs))
+	for i, a := range addrs {
+		out[i] = *byAddr[a]
+	}
+	return out
+}
+
+// eventInfo is the API representation of a connection event.
+type eventInfo struct {
+	Type       string    `json:"type"` // open, close or failed
+	Time       time.Time `json:"time"`
+	Port       int       `json:"port"`
+	Name       string    `json:"name,omitempty"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"` // logged in as, on listeners with auth
+	Target     string    `json:"target"`
+	Outbound   string    `json:"outbound,omitempty"`
+	BytesUp    int64     `json:"bytes_up,omitempty"`    // close
+	BytesDown  int64     `json:"bytes_down,omitempty"`  // close
+	DurationMS int64     `json:"duration_ms,omitempty"` // close: time since open
+	Error      string    `json:"error,omitempty"`       // failed
+	Class      string    `json:"class,omitempty"`       // failed: refused, timeout, dns, ...
+}
+
+// sseKeepalive is the time between comments sent on an idle event stream,
+// so proxies and load balancers do not close it.
+const sseKeepalive = 15 * time.Second
+
+// sseEventBuffer is the number of events queued per event stream; more are
+// dropped while the client falls behind.
+const sseEventBuffer = 1024
+
+// streamEvents sends connection events as server-sent events, one
+// "event: <type>" with a JSON eventInfo each, until the client goes away.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	port := 0
+	if p := r.URL.Query().Get("port"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", p))
+			return
+		}
+		port = n
+	}
+	types := map[string]bool{}
+	if t := r.URL.Query().Get("type"); t != "" {
+		for _, typ := range strings.Split(t, ",") {
+			if typ != eventOpen && typ != eventClose && typ != eventFailed {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid event type %q (open, close or failed)", typ))
+				return
+			}
+			types[typ] = true
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	events, cancel := connEvents.subscribe(sseEventBuffer)
+	defer cancel()
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // nginx: pass events through at once
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": superproxy connection events\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-events:
+			if (port != 0 && ev.Port != port) || (len(types) > 0 && !types[ev.Type]) {
+				continue
+			}
+			data, _ := json.Marshal(eventInfo{
+				Type: ev.Type, Time: ev.Time, Port: ev.Port, Name: ev.Name,
+				Client: ev.Client, User: ev.User, Target: ev.Target, Outbound: ev.Outbound,
+				BytesUp: ev.BytesUp, BytesDown: ev.BytesDown,
+				DurationMS: ev.Duration.Milliseconds(), Error: ev.Error, Class: ev.Class,
+			})
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// failureInfo is the API representation of a connection failure.
+type failureInfo struct {
+	Time   time.Time `json:"time"`
+	Port   int       `json:"port"`
+	Name   string    `json:"name,omitempty"`
+	Client string    `json:"client"`
+	Target string    `json:"target"`
+	Error  string    `json:"error"`
+	Class  string    `json:"class"`
+}
+
+// banInfo is the API representation of a client ban.
+type banInfo struct {
+	CIDR      string     `json:"cidr"`
+	Reason    string     `json:"reason,omitempty"`
+	Added     time.Time  `json:"added"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Remaining string     `json:"remaining,omitempty"`
+	Closed    *int       `json:"connections_closed,omitempty"` // POST only
+}
+
+func newBanInfo(b clientBan) banInfo {
+	info := banInfo{CIDR: b.Prefix.String(), Reason: b.Reason, Added: b.Added}
+	if !b.Expires.IsZero() {
+		info.Expires = &b.Expires
+		info.Remaining = time.Until(b.Expires).Round(time.Second).String()
+	}
+	return info
+}
+
+// logLevelRequest is the body of PUT /api/v1/log-level.
+type logLevelRequest struct {
+	Level string `yaml:"level"` // debug, info, warn or error
+	TTL   string `yaml:"ttl"`   // duration; empty or 0: until reset
+}
+
+// setRuntimeLogLevel overrides the log level with the one in the request
+// body.
+func setRuntimeLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, adminMaxBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid log level request: %w", err))
+		return
+	}
+	if req.Level == "" {
+		writeError(w, http.StatusBadRequest, errors.New("log level: level is required"))
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("log level: invalid ttl %q", req.TTL))
+			return
+		}
+	}
+	before := logLevelState().Level
+	overrideLogLevel(level, ttl)
+	until := "until reset"
+	if ttl > 0 {
+		until = "for " + ttl.String()
+	}
+	auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "log_level.set",
+		Changes: []string{fmt.Sprintf("log level %s → %s %s", before, levelStrings[level], until)}})
+	logAt(max(level, levelInfo), "[admin] log level set to %s %s", levelStrings[level], until) // written at any level
+	writeJSON(w, http.StatusOK, logLevelState())
+}
+
+// banRequest is the body of POST /api/v1/bans.
+type banRequest struct {
+	CIDR   string `yaml:"cidr"`   // IP address or CIDR
+	TTL    string `yaml:"ttl"`    // duration; empty or 0: until unbanned
+	Reason string `yaml:"reason"` // free text, shown in the list and log
+}
+
+// addBan bans the client range in the request body and closes its
+// connections.
+func addBan(c *controller, w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, adminMaxBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ban: %w", err))
+		return
+	}
+	if req.CIDR == "" {
+		writeError(w, http.StatusBadRequest, errors.New("ban: cidr is required"))
+		return
+	}
+	prefix, err := parseBanTarget(req.CIDR)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("ban: %w", err))
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("ban: invalid ttl %q", req.TTL))
+			return
+		}
+	}
+	b, closed := ban(prefix, ttl, req.Reason)
+	auditLog.record(auditEntry{Actor: actorOf(r.Context()), Action: "ban", Target: prefix.String(),
+		Changes: []string{fmt.Sprintf("ttl %s, reason %q, %d connections closed", req.TTL, req.Reason, closed)}})
+	c.bansChanged()
+	info := newBanInfo(b)
+	info.Closed = &closed
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// readEntry decodes a proxy entry from the request body, as YAML or JSON.
+// Unknown fields are rejected, so a misspelled option is not silently lost.
+func readEntry(r *http.Request) (ProxyEntry, error) {
+	var entry ProxyEntry
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, adminMaxBody))
+	if err != nil {
+		return entry, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&entry); err != nil {
+		if err == io.EOF {
+			return entry, errors.New("request body must be a proxy entry")
+		}
+		return entry, fmt.Errorf("invalid proxy entry: %w", err)
+	}
+	return entry, nil
+}
+
+func writeEditError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, errNoListener) {
+		status = http.StatusNotFound
+	}
+	writeError(w, status, err)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
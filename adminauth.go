@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// minTokenLength is the shortest accepted admin.tokens value.
+const minTokenLength = 16
+
+// adminAuth checks the credentials of admin API requests: a bearer token
+// from admin.tokens or a client certificate verified against
+// admin.tls.client_ca. Without either configured, the API is open.
+type adminAuth struct {
+	tokens map[[32]byte]string // SHA-256 of the token → its name
+	mtls   bool
+}
+
+func newAdminAuth(ac *AdminConfig) *adminAuth {
+	a := &adminAuth{}
+	if ac == nil {
+		return a
+	}
+	if len(ac.Tokens) > 0 {
+		a.tokens = make(map[[32]byte]string, len(ac.Tokens))
+		for name, token := range ac.Tokens {
+			a.tokens[sha256.Sum256([]byte(token))] = name
+		}
+	}
+	a.mtls = ac.TLS != nil && ac.TLS.ClientCA != ""
+	return a
+}
+
+// required reports whether requests must authenticate.
+func (a *adminAuth) required() bool {
+	return len(a.tokens) > 0 || a.mtls
+}
+
+// identify returns who presents the credentials, or "" if none are valid.
+// Tokens are compared by hash, so the lookup time does not depend on how
+// much of a guess matches.
+func (a *adminAuth) identify(bearer string, state *tls.ConnectionState) string {
+	if state != nil && len(state.VerifiedChains) > 0 {
+		cert := state.VerifiedChains[0][0]
+		name := cert.Subject.CommonName
+		if name == "" && len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+		return "cert:" + name
+	}
+	if bearer != "" {
+		if name, ok := a.tokens[sha256.Sum256([]byte(bearer))]; ok {
+			return "token:" + name
+		}
+	}
+	return ""
+}
+
+// validateAdminAuth validates the tokens and TLS files of the admin block.
+func validateAdminAuth(ac *AdminConfig) error {
+	seen := make(map[string]string, len(ac.Tokens))
+	for name, token := range ac.Tokens {
+		if !validEntryName(name) {
+			return fmt.Errorf("config: admin: token name %q may only contain letters, digits, '.', '_' and '-'", name)
+		}
+		if len(token) < minTokenLength {
+			return fmt.Errorf("config: admin: tokens.%s: must be at least %d characters", name, minTokenLength)
+		}
+		if other, ok := seen[token]; ok {
+			return fmt.Errorf("config: admin: tokens %s and %s are the same", other, name)
+		}
+		seen[token] = name
+	}
+	if ac.TLS != nil {
+		if _, err := adminTLSConfig(ac.TLS); err != nil {
+			return fmt.Errorf("config: admin: tls: %w", err)
+		}
+	}
+	return nil
+}
+
+// adminTLSConfig loads the certificate, key and client CA of tc.
+func adminTLSConfig(tc *AdminTLSConfig) (*tls.Config, error) {
+	if tc.Cert == "" || tc.Key == "" {
+		return nil, errors.New("'cert' and 'key' are required")
+	}
+	cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if tc.ClientCA != "" {
+		pem, err := os.ReadFile(tc.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client_ca %s: no PEM certificates", tc.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		// A token may stand in for a certificate; the handler then
+		// insists on one or the other.
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// adminSecurity holds the credentials checks and TLS settings shared by the
+// REST and gRPC listeners. They are replaced on every apply, so a reload
+// picks up renewed certificates and changed tokens without moving the
+// listeners.
+type adminSecurity struct {
+	auth atomic.Pointer[adminAuth]
+	tls  atomic.Pointer[tls.Config] // nil: plaintext
+}
+
+// update loads the settings of ac (nil: open, plaintext).
+func (s *adminSecurity) update(ac *AdminConfig) error {
+	var tlsCfg *tls.Config
+	if ac != nil && ac.TLS != nil {
+		var err error
+		if tlsCfg, err = adminTLSConfig(ac.TLS); err != nil {
+			return fmt.Errorf("admin: tls: %w", err)
+		}
+	}
+	s.auth.Store(newAdminAuth(ac))
+	s.tls.Store(tlsCfg)
+	return nil
+}
+
+// listener wraps ln in TLS if it is configured.
+func (s *adminSecurity) listener(ln net.Listener) net.Listener {
+	if s.tls.Load() == nil {
+		return ln
+	}
+	return tls.NewListener(ln, &tls.Config{GetConfigForClient: s.clientConfig})
+}
+
+func (s *adminSecurity) clientConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cfg := s.tls.Load()
+	if cfg == nil {
+		return nil, errors.New("admin API TLS was turned off")
+	}
+	return cfg, nil
+}
+
+// warnOpen logs a warning when the API on addr accepts anyone without
+// being limited to the loopback interface.
+func (s *adminSecurity) warnOpen(api string, addr net.Addr) {
+	if ta, ok := addr.(*net.TCPAddr); ok && !ta.IP.IsLoopback() && !s.auth.Load().required() {
+		logWarn("[admin] %s on %s has no authentication; set admin.tokens or admin.tls.client_ca", api, addr)
+	}
+}
+
+// actorKey is the context key of the authenticated actor of a request.
+type actorKey struct{}
+
+// actorOf returns who made the request carried by ctx.
+func actorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return "unknown"
+}
+
+// authenticate wraps the REST API: requests without valid credentials are
+// refused (and audited); the others carry their actor in the context.
+// Clients of the control socket are trusted, as the socket is only open
+// to the daemon's user.
+func (s *adminSecurity) authenticate(next http.Handler, local bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var actor string
+		switch auth := s.auth.Load(); {
+		case local:
+			actor = "control socket"
+		case !auth.required():
+			actor = "anonymous (" + r.RemoteAddr + ")"
+		default:
+			bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if actor = auth.identify(bearer, r.TLS); actor == "" {
+				logWarn("[admin] unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				auditLog.record(auditEntry{Actor: "unauthenticated (" + r.RemoteAddr + ")", Action: r.Method + " " + r.URL.Path, Error: "unauthorized"})
+				webhooks.authFailed(r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="superproxy"`)
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized: a valid bearer token or client certificate is required"))
+				return
+			}
+			actor += " (" + r.RemoteAddr + ")"
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, actor)))
+	})
+}
+
+// grpcOptions returns the server options applying s to the gRPC API.
+func (s *adminSecurity) grpcOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, err := s.grpcActor(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := s.grpcActor(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &actorStream{ServerStream: ss, ctx: ctx})
+		}),
+	}
+	if s.tls.Load() != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{GetConfigForClient: s.clientConfig})))
+	}
+	return opts
+}
+
+// grpcActor authenticates a gRPC call like authenticate does a request,
+// with the token in the authorization metadata.
+func (s *adminSecurity) grpcActor(ctx context.Context, method string) (context.Context, error) {
+	remote := "unknown"
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	auth := s.auth.Load()
+	actor := "anonymous (" + remote + ")"
+	if auth.required() {
+		var bearer string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if v := md.Get("authorization"); len(v) > 0 {
+				bearer, _ = strings.CutPrefix(v[0], "Bearer ")
+			}
+		}
+		id := auth.identify(bearer, state)
+		if id == "" {
+			logWarn("[admin] unauthorized gRPC %s from %s", method, remote)
+			auditLog.record(auditEntry{Actor: "unauthenticated (" + remote + ")", Action: method, Error: "unauthorized"})
+			webhooks.authFailed(remote)
+			return nil, status.Error(codes.Unauthenticated, "a valid bearer token or client certificate is required")
+		}
+		actor = id + " (" + remote + ")"
+	}
+	return context.WithValue(ctx, actorKey{}, actor), nil
+}
+
+// actorStream is a server stream whose context carries the actor.
+type actorStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *actorStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,380 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: admin.proto
+
+// gRPC management API of superproxy, served on admin.grpc_listen. It offers
+// the listener operations of the REST API on admin.listen, plus a stream of
+// connection events. Proxy entries carry the options of the config file,
+// under the same names.
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ProxyAdmin_ListListeners_FullMethodName    = "/superproxy.admin.v1.ProxyAdmin/ListListeners"
+	ProxyAdmin_GetListener_FullMethodName      = "/superproxy.admin.v1.ProxyAdmin/GetListener"
+	ProxyAdmin_AddListeners_FullMethodName     = "/superproxy.admin.v1.ProxyAdmin/AddListeners"
+	ProxyAdmin_ReplaceListener_FullMethodName  = "/superproxy.admin.v1.ProxyAdmin/ReplaceListener"
+	ProxyAdmin_RemoveListener_FullMethodName   = "/superproxy.admin.v1.ProxyAdmin/RemoveListener"
+	ProxyAdmin_Reload_FullMethodName           = "/superproxy.admin.v1.ProxyAdmin/Reload"
+	ProxyAdmin_WatchConnections_FullMethodName = "/superproxy.admin.v1.ProxyAdmin/WatchConnections"
+)
+
+// ProxyAdminClient is the client API for ProxyAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProxyAdminClient interface {
+	// ListListeners returns all listeners in port order.
+	ListListeners(ctx context.Context, in *ListListenersRequest, opts ...grpc.CallOption) (*ListListenersResponse, error)
+	// GetListener returns one listener (NOT_FOUND if the port is not open).
+	GetListener(ctx context.Context, in *GetListenerRequest, opts ...grpc.CallOption) (*Listener, error)
+	// AddListeners adds an entry; a port range or prefix adds several
+	// listeners. The response holds the new listeners.
+	AddListeners(ctx context.Context, in *AddListenersRequest, opts ...grpc.CallOption) (*ListListenersResponse, error)
+	// ReplaceListener replaces the entry of a listener.
+	ReplaceListener(ctx context.Context, in *ReplaceListenerRequest, opts ...grpc.CallOption) (*Listener, error)
+	// RemoveListener closes a listener; its active connections finish
+	// undisturbed.
+	RemoveListener(ctx context.Context, in *RemoveListenerRequest, opts ...grpc.CallOption) (*RemoveListenerResponse, error)
+	// Reload re-reads the config source, like SIGHUP, and returns the
+	// listeners now running (FAILED_PRECONDITION if the config is invalid).
+	Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ListListenersResponse, error)
+	// WatchConnections streams connection events until the client cancels.
+	// Events are dropped, not queued, while the client falls behind.
+	WatchConnections(ctx context.Context, in *WatchConnectionsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ConnectionEvent], error)
+}
+
+type proxyAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProxyAdminClient(cc grpc.ClientConnInterface) ProxyAdminClient {
+	return &proxyAdminClient{cc}
+}
+
+func (c *proxyAdminClient) ListListeners(ctx context.Context, in *ListListenersRequest, opts ...grpc.CallOption) (*ListListenersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListListenersResponse)
+	err := c.cc.Invoke(ctx, ProxyAdmin_ListListeners_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) GetListener(ctx context.Context, in *GetListenerRequest, opts ...grpc.CallOption) (*Listener, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Listener)
+	err := c.cc.Invoke(ctx, ProxyAdmin_GetListener_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) AddListeners(ctx context.Context, in *AddListenersRequest, opts ...grpc.CallOption) (*ListListenersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListListenersResponse)
+	err := c.cc.Invoke(ctx, ProxyAdmin_AddListeners_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) ReplaceListener(ctx context.Context, in *ReplaceListenerRequest, opts ...grpc.CallOption) (*Listener, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Listener)
+	err := c.cc.Invoke(ctx, ProxyAdmin_ReplaceListener_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) RemoveListener(ctx context.Context, in *RemoveListenerRequest, opts ...grpc.CallOption) (*RemoveListenerResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemoveListenerResponse)
+	err := c.cc.Invoke(ctx, ProxyAdmin_RemoveListener_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ListListenersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListListenersResponse)
+	err := c.cc.Invoke(ctx, ProxyAdmin_Reload_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) WatchConnections(ctx context.Context, in *WatchConnectionsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ConnectionEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ProxyAdmin_ServiceDesc.Streams[0], ProxyAdmin_WatchConnections_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchConnectionsRequest, ConnectionEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ProxyAdmin_WatchConnectionsClient = grpc.ServerStreamingClient[ConnectionEvent]
+
+// ProxyAdminServer is the server API for ProxyAdmin service.
+// All implementations must embed UnimplementedProxyAdminServer
+// for forward compatibility.
+type ProxyAdminServer interface {
+	// ListListeners returns all listeners in port order.
+	ListListeners(context.Context, *ListListenersRequest) (*ListListenersResponse, error)
+	// GetListener returns one listener (NOT_FOUND if the port is not open).
+	GetListener(context.Context, *GetListenerRequest) (*Listener, error)
+	// AddListeners adds an entry; a port range or prefix adds several
+	// listeners. The response holds the new listeners.
+	AddListeners(context.Context, *AddListenersRequest) (*ListListenersResponse, error)
+	// ReplaceListener replaces the entry of a listener.
+	ReplaceListener(context.Context, *ReplaceListenerRequest) (*Listener, error)
+	// RemoveListener closes a listener; its active connections finish
+	// undisturbed.
+	RemoveListener(context.Context, *RemoveListenerRequest) (*RemoveListenerResponse, error)
+	// Reload re-reads the config source, like SIGHUP, and returns the
+	// listeners now running (FAILED_PRECONDITION if the config is invalid).
+	Reload(context.Context, *ReloadRequest) (*ListListenersResponse, error)
+	// WatchConnections streams connection events until the client cancels.
+	// Events are dropped, not queued, while the client falls behind.
+	WatchConnections(*WatchConnectionsRequest, grpc.ServerStreamingServer[ConnectionEvent]) error
+	mustEmbedUnimplementedProxyAdminServer()
+}
+
+// UnimplementedProxyAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedProxyAdminServer struct{}
+
+func (UnimplementedProxyAdminServer) ListListeners(context.Context, *ListListenersRequest) (*ListListenersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListListeners not implemented")
+}
+func (UnimplementedProxyAdminServer) GetListener(context.Context, *GetListenerRequest) (*Listener, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetListener not implemented")
+}
+func (UnimplementedProxyAdminServer) AddListeners(context.Context, *AddListenersRequest) (*ListListenersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddListeners not implemented")
+}
+func (UnimplementedProxyAdminServer) ReplaceListener(context.Context, *ReplaceListenerRequest) (*Listener, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplaceListener not implemented")
+}
+func (UnimplementedProxyAdminServer) RemoveListener(context.Context, *RemoveListenerRequest) (*RemoveListenerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveListener not implemented")
+}
+func (UnimplementedProxyAdminServer) Reload(context.Context, *ReloadRequest) (*ListListenersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedProxyAdminServer) WatchConnections(*WatchConnectionsRequest, grpc.ServerStreamingServer[ConnectionEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchConnections not implemented")
+}
+func (UnimplementedProxyAdminServer) mustEmbedUnimplementedProxyAdminServer() {}
+func (UnimplementedProxyAdminServer) testEmbeddedByValue()                    {}
+
+// UnsafeProxyAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProxyAdminServer will
+// result in compilation errors.
+type UnsafeProxyAdminServer interface {
+	mustEmbedUnimplementedProxyAdminServer()
+}
+
+func RegisterProxyAdminServer(s grpc.ServiceRegistrar, srv ProxyAdminServer) {
+	// If the following call pancis, it indicates UnimplementedProxyAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ProxyAdmin_ServiceDesc, srv)
+}
+
+func _ProxyAdmin_ListListeners_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListListenersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).ListListeners(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyAdmin_ListListeners_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).ListListeners(ctx, req.(*ListListenersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_GetListener_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetListenerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).GetListener(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyAdmin_GetListener_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).GetListener(ctx, req.(*GetListenerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_AddListeners_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddListenersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).AddListeners(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyAdmin_AddListeners_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).AddListeners(ctx, req.(*AddListenersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_ReplaceListener_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplaceListenerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).ReplaceListener(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyAdmin_ReplaceListener_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).ReplaceListener(ctx, req.(*ReplaceListenerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_RemoveListener_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveListenerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).RemoveListener(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyAdmin_RemoveListener_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).RemoveListener(ctx, req.(*RemoveListenerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_Reload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyAdmin_Reload_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).Reload(ctx, req.(*ReloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_WatchConnections_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchConnectionsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProxyAdminServer).WatchConnections(m, &grpc.GenericServerStream[WatchConnectionsRequest, ConnectionEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ProxyAdmin_WatchConnectionsServer = grpc.ServerStreamingServer[ConnectionEvent]
+
+// ProxyAdmin_ServiceDesc is the grpc.ServiceDesc for ProxyAdmin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ProxyAdmin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "superproxy.admin.v1.ProxyAdmin",
+	HandlerType: (*ProxyAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListListeners",
+			Handler:    _ProxyAdmin_ListListeners_Handler,
+		},
+		{
+			MethodName: "GetListener",
+			Handler:    _ProxyAdmin_GetListener_Handler,
+		},
+		{
+			MethodName: "AddListeners",
+			Handler:    _ProxyAdmin_AddListeners_Handler,
+		},
+		{
+			MethodName: "ReplaceListener",
+			Handler:    _ProxyAdmin_ReplaceListener_Handler,
+		},
+		{
+			MethodName: "RemoveListener",
+			Handler:    _ProxyAdmin_RemoveListener_Handler,
+		},
+		{
+			MethodName: "Reload",
+			Handler:    _ProxyAdmin_Reload_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchConnections",
+			Handler:       _ProxyAdmin_WatchConnections_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "admin.proto",
+}
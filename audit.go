@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// auditEntry is one line of the audit log: an administrative action, who
+// asked for it and what it changed.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`            // e.g. "token:alice", "cert:ops.example.com", "control socket", "signal"
+	Action  string    `json:"action"`           // e.g. "listener.add", "reload", "ban"
+	Target  string    `json:"target,omitempty"` // port, CIDR or connection the action applies to
+	Changes []string  `json:"changes,omitempty"`
+	Error   string    `json:"error,omitempty"` // the action failed or was denied
+}
+
+// auditFile is the admin.audit_log JSON-lines file. Entries are only ever
+// appended; it is rotated under log_rotation, and ctl rotate reopens it
+// like the -log-file.
+type auditFile struct {
+	mu   sync.Mutex
+	path string
+	file *rotatingFile
+}
+
+// auditLog is the audit log of the running daemon.
+var auditLog auditFile
+
+// setPath opens path for appending, or closes the log if path is empty.
+// The open file is kept if path is unchanged.
+func (a *auditFile) setPath(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if path == a.path {
+		return nil
+	}
+	return a.openLocked(path)
+}
+
+// reopen reopens the log at its path, after logrotate moved it away, and
+// returns the path ("" when there is no audit log).
+func (a *auditFile) reopen() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		return "", nil
+	}
+	return a.path, a.file.reopen()
+}
+
+func (a *auditFile) openLocked(path string) error {
+	var f *rotatingFile
+	if path != "" {
+		var err error
+		if f, err = openRotating(path, 0o600); err != nil {
+			return err
+		}
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.path, a.file = path, f
+	return nil
+}
+
+// record appends e, stamped with the current time, to the audit log.
+// Without an audit log the entry is dropped; the daemon log already has a
+// line for each admin request.
+func (a *auditFile) record(e auditEntry) {
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(line); err != nil {
+		logError("[audit] writing %s: %v", a.path, err)
+	}
+}
+
+// auditPath returns the audit log path of ac (nil: none).
+func auditPath(ac *AdminConfig) string {
+	if ac == nil {
+		return ""
+	}
+	return ac.AuditLog
+}
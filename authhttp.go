@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// auth_http defaults, for the options an auth_http block leaves out.
+const (
+	defaultAuthHTTPTimeout   = 5 * time.Second
+	defaultAuthHTTPCacheTTL  = 5 * time.Minute
+	defaultAuthHTTPDenyTTL   = 30 * time.Second
+	defaultAuthHTTPCacheSize = 10000
+)
+
+// authRequest is the JSON body POSTed to auth_http.url per login.
+type authRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Client   string `json:"client"`   // IP of the client
+	Listener string `json:"listener"` // the entry's tag, e.g. "10001/acme"
+	Port     int    `json:"port"`
+}
+
+// authBackend checks logins with the HTTP service of auth_http: a 2xx
+// answer allows the login, 401 or 403 denies it, anything else is an
+// outage that refuses the login without counting against the client.
+// Decisions are cached per credentials, client and listener.
+type authBackend struct {
+	mu     sync.Mutex
+	cfg    *AuthHTTPConfig // nil: off
+	client *http.Client
+	cache  *loginCache
+}
+
+// authHTTP is the auth_http backend of the running daemon.
+var authHTTP authBackend
+
+// update applies a validated auth_http block (nil: off), forgetting the
+// cached decisions.
+func (b *authBackend) update(cfg *AuthHTTPConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg, b.cache = cfg, nil
+	if cfg == nil {
+		return
+	}
+	b.client = &http.Client{Timeout: cfg.Timeout}
+	b.cache = newLoginCache(cfg.CacheSize)
+}
+
+// enabled reports whether auth_http is configured.
+func (b *authBackend) enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg != nil
+}
+
+// check asks the service (or its cache) whether name may log in with
+// password from client on entry. It returns the account of an allowed
+// user without limits, and an error if the service could not decide.
+func (b *authBackend) check(name string, password []byte, client net.Addr, entry ProxyEntry) (*account, bool, error) {
+	ip := client.String()
+	if ta, ok := client.(*net.TCPAddr); ok {
+		ip = ta.AddrPort().Addr().Unmap().String()
+	}
+	key := loginKey(name, string(password), ip, entry.tag())
+
+	b.mu.Lock()
+	cfg, hc, cache := b.cfg, b.client, b.cache
+	b.mu.Unlock()
+	if cfg == nil {
+		return nil, false, fmt.Errorf("auth_http is off")
+	}
+	allow, cached := cache.get(key)
+	if !cached {
+		var err error
+		allow, err = askAuthService(hc, cfg, authRequest{
+			Username: name, Password: string(password), Client: ip, Listener: entry.tag(), Port: entry.Port,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		cache.put(key, allow, cfg.CacheTTL, cfg.DenyTTL)
+	}
+	if !allow {
+		return nil, false, nil
+	}
+	return externalAccount(name), true, nil
+}
+
+// askAuthService POSTs req to the service and reports its decision.
+func askAuthService(client *http.Client, cfg *AuthHTTPConfig, req authRequest) (bool, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set("User-Agent", "superproxy")
+	for k, v := range cfg.Headers {
+		hr.Header.Set(k, v)
+	}
+	resp, err := client.Do(hr)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err // without the URL, which may hold a credential
+		}
+		return false, fmt.Errorf("auth_http: POST %s: %w", redactURL(cfg.URL), err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("auth_http: POST %s: %s", redactURL(cfg.URL), resp.Status)
+}
+
+// validateAuthHTTP validates the auth_http block and fills in its defaults.
+func validateAuthHTTP(c *AuthHTTPConfig) error {
+	u, err := url.Parse(c.URL)
+	if c.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("config: auth_http: 'url' must be an http:// or https:// URL")
+	}
+	if c.Timeout < 0 || c.CacheTTL < 0 || c.DenyTTL < 0 || c.CacheSize < 0 {
+		return fmt.Errorf("config: auth_http: values must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultAuthHTTPTimeout
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = defaultAuthHTTPCacheTTL
+	}
+	if c.DenyTTL == 0 {
+		c.DenyTTL = defaultAuthHTTPDenyTTL
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultAuthHTTPCacheSize
+	}
+	return nil
+}
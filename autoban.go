@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Auto-ban defaults, for the options an auto_ban block leaves out.
+const (
+	defaultAutoBanFailures = 10
+	defaultAutoBanWindow   = time.Minute
+	defaultAutoBanTime     = 10 * time.Minute
+)
+
+// autoBanSweep is the number of tracked clients past which those whose
+// window ended are forgotten.
+const autoBanSweep = 4096
+
+// autoBanner bans clients that fail the SOCKS5 handshake too often, like
+// fail2ban: failures within auto_ban.window are counted per client (or
+// per ipv6_prefix of IPv6 clients) on all listeners together, and reaching
+// auto_ban.failures bans the client for auto_ban.ban_time. Bans go to the
+// ban list, where the admin API lists and lifts them like any other.
+type autoBanner struct {
+	mu       sync.Mutex
+	cfg      *AutoBanConfig // nil: off
+	ignore   []netip.Prefix
+	failures map[netip.Prefix]*authFailures
+}
+
+// autoBan is the auto-banner of the running daemon.
+var autoBan autoBanner
+
+// update applies a validated auto_ban block (nil: off), forgetting the
+// failures counted so far.
+func (a *autoBanner) update(cfg *AutoBanConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg, a.ignore, a.failures = cfg, nil, nil
+	if cfg == nil {
+		return
+	}
+	for _, s := range cfg.Ignore {
+		a.ignore = append(a.ignore, netip.MustParsePrefix(s))
+	}
+}
+
+// failed counts a failed handshake of the client at addr on listener tag
+// and bans the client once it reached auto_ban.failures.
+func (a *autoBanner) failed(addr net.Addr, tag string) {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	ip := ta.AddrPort().Addr().Unmap().WithZone("")
+	now := time.Now()
+	a.mu.Lock()
+	cfg := a.cfg
+	if cfg == nil {
+		a.mu.Unlock()
+		return
+	}
+	for _, p := range a.ignore {
+		if p.Contains(ip) {
+			a.mu.Unlock()
+			return
+		}
+	}
+	bits := ip.BitLen()
+	if ip.Is6() && cfg.IPv6Prefix > 0 {
+		bits = cfg.IPv6Prefix
+	}
+	client, _ := ip.Prefix(bits)
+	if a.failures == nil {
+		a.failures = make(map[netip.Prefix]*authFailures)
+	}
+	f := a.failures[client]
+	if f == nil || now.Sub(f.first) > cfg.Window {
+		if len(a.failures) >= autoBanSweep {
+			for k, old := range a.failures {
+				if now.Sub(old.first) > cfg.Window {
+					delete(a.failures, k)
+				}
+			}
+		}
+		f = &authFailures{first: now}
+		a.failures[client] = f
+	}
+	f.count++
+	banNow := f.count >= cfg.Failures
+	if banNow {
+		delete(a.failures, client)
+	}
+	a.mu.Unlock()
+	if banNow {
+		ban(client, cfg.BanTime, fmt.Sprintf("auto: %d failed handshakes within %s, the last on :%s", cfg.Failures, cfg.Window, tag))
+	}
+}
+
+// validateAutoBan validates the auto_ban block and fills in its defaults.
+func validateAutoBan(ab *AutoBanConfig) error {
+	if ab.Failures < 0 || ab.Window < 0 || ab.BanTime < 0 {
+		return fmt.Errorf("config: auto_ban: values must not be negative")
+	}
+	if ab.IPv6Prefix < 0 || ab.IPv6Prefix > 128 {
+		return fmt.Errorf("config: auto_ban: ipv6_prefix %d must be between 1 and 128", ab.IPv6Prefix)
+	}
+	if err := validateClientList("ignore", ab.Ignore); err != nil {
+		return fmt.Errorf("config: auto_ban.%w", err)
+	}
+	if ab.Failures == 0 {
+		ab.Failures = defaultAutoBanFailures
+	}
+	if ab.Window == 0 {
+		ab.Window = defaultAutoBanWindow
+	}
+	if ab.BanTime == 0 {
+		ab.BanTime = defaultAutoBanTime
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bandwidthChunk is the most a limited relay reads at once, so a slow
+// rate is paced in small steps rather than in 32 KiB bursts.
+const bandwidthChunk = 16 * 1024
+
+// bandwidthBurst is how much unused rate a limited relay may save up, in
+// time at the limit.
+const bandwidthBurst = 250 * time.Millisecond
+
+// rateUnits are the units of bandwidth values, in bytes: decimal bits and
+// bytes, and binary bytes.
+var rateUnits = map[string]float64{
+	"bit": 1.0 / 8, "kbit": 1e3 / 8, "mbit": 1e6 / 8, "gbit": 1e9 / 8,
+	"b": 1, "kb": 1e3, "mb": 1e6, "gb": 1e9,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30,
+}
+
+// parseRate parses a bandwidth such as "10mbit", "1.5MB/s" or "512KiB"
+// into bytes per second.
+func parseRate(s string) (float64, error) {
+	v := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	i := strings.IndexFunc(v, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q (expected e.g. 10mbit or 2MB)", s)
+	}
+	n, err := strconv.ParseFloat(v[:i], 64)
+	unit, ok := rateUnits[strings.TrimSpace(v[i:])]
+	if err != nil || !ok || n <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q (expected e.g. 10mbit or 2MB)", s)
+	}
+	return n * unit, nil
+}
+
+// formatRate formats bytes per second in bits, e.g. "10Mbit/s".
+func formatRate(bps float64) string {
+	bits := bps * 8
+	for _, u := range []struct {
+		name string
+		size float64
+	}{{"Gbit", 1e9}, {"Mbit", 1e6}, {"kbit", 1e3}} {
+		if bits >= u.size {
+			return strconv.FormatFloat(bits/u.size, 'f', -1, 64) + u.name + "/s"
+		}
+	}
+	return strconv.FormatFloat(bits, 'f', -1, 64) + "bit/s"
+}
+
+// byteRate paces one direction of a relay, or all of them, to rate bytes
+// per second with a token bucket. A writer that takes more than the bucket
+// holds goes into debt and waits until it is paid back, along with the
+// debt of the writers before it, so writers sharing a bucket are served in
+// turn, one chunk at a time.
+//
+// A nil *byteRate does not limit.
+type byteRate struct {
+	rate, burst float64
+
+	next *byteRate // also paced by it: a user's egress_limit (nil: none)
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// egressLimit is the egress_limit of the running configuration (nil: none),
+// shared by every relay paced through userspace.
+var egressLimit atomic.Pointer[byteRate]
+
+// setEgressLimit applies the egress_limit of a validated configuration,
+// keeping the running bucket if the rate did not change.
+func setEgressLimit(cfg *Config) {
+	if cur := egressLimit.Load(); cur != nil && cur.rate == cfg.egressRate {
+		return
+	}
+	egressLimit.Store(newByteRate(cfg.egressRate))
+	if cfg.egressRate > 0 {
+		logInfo("[main] egress limited to %s", formatRate(cfg.egressRate))
+	}
+}
+
+// newByteRate returns a limiter of rate bytes per second, or nil if rate is
+// 0.
+func newByteRate(rate float64) *byteRate {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(rate*bandwidthBurst.Seconds(), bandwidthChunk)
+	return &byteRate{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// sharedRate returns r (nil: none) also paced by the shared limiter,
+// which is returned itself if r is nil.
+func sharedRate(r, shared *byteRate) *byteRate {
+	if r == nil {
+		return shared
+	}
+	r.next = shared
+	return r
+}
+
+// wait takes n bytes from the bucket, sleeping while it is in debt, then
+// from the next one.
+func (r *byteRate) wait(n int) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate) - float64(n)
+	r.last = now
+	debt := r.tokens
+	r.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / r.rate * float64(time.Second)))
+	}
+	r.next.wait(n)
+}
+
+// shapedWriter writes to w at the pace of its connection's rate (nil: none)
+// and of the egress limit in effect. Wrapping a *net.TCPConn in it also
+// keeps io.Copy from splicing, which would bypass the limits.
+type shapedWriter struct {
+	w    io.Writer
+	rate *byteRate
+}
+
+func (s shapedWriter) Write(p []byte) (int, error) {
+	s.rate.wait(len(p))
+	egressLimit.Load().wait(len(p))
+	return s.w.Write(p)
+}
+
+// validateEgressLimit parses the egress_limit of cfg.
+func validateEgressLimit(cfg *Config) error {
+	cfg.egressRate = 0
+	if cfg.EgressLimit == "" {
+		return nil
+	}
+	rate, err := parseRate(cfg.EgressLimit)
+	if err != nil {
+		return fmt.Errorf("config: egress_limit: %w", err)
+	}
+	cfg.egressRate = rate
+	return nil
+}
+
+// bandwidthSummary describes bc for entry summaries, e.g.
+// "10Mbit/s up, 50Mbit/s down".
+func bandwidthSummary(bc *BandwidthConfig) string {
+	var parts []string
+	if bc.up > 0 {
+		parts = append(parts, formatRate(bc.up)+" up")
+	}
+	if bc.down > 0 {
+		parts = append(parts, formatRate(bc.down)+" down")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validateBandwidth parses a bandwidth block; up and down default to rate.
+func validateBandwidth(bc *BandwidthConfig) error {
+	var both float64
+	var err error
+	if bc.Rate != "" {
+		if both, err = parseRate(bc.Rate); err != nil {
+			return fmt.Errorf("rate: %w", err)
+		}
+	}
+	bc.up, bc.down = both, both
+	if bc.Up != "" {
+		if bc.up, err = parseRate(bc.Up); err != nil {
+			return fmt.Errorf("up: %w", err)
+		}
+	}
+	if bc.Down != "" {
+		if bc.down, err = parseRate(bc.Down); err != nil {
+			return fmt.Errorf("down: %w", err)
+		}
+	}
+	if bc.up == 0 && bc.down == 0 {
+		return fmt.Errorf("set rate, up and/or down")
+	}
+	return nil
+}
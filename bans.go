@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientBan is one banned client address range.
+type clientBan struct {
+	Prefix  netip.Prefix
+	Reason  string
+	Added   time.Time
+	Expires time.Time // zero: until unbanned
+}
+
+func (b clientBan) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// banList holds the client bans applied on every listener, set at runtime
+// through the admin API. Bans are grouped by prefix length, so a check is
+// one map lookup per distinct length rather than a scan of every ban.
+type banList struct {
+	mu    sync.RWMutex
+	byLen map[int]map[netip.Prefix]clientBan
+	n     atomic.Int32 // number of bans, read without the lock on accept
+}
+
+// clientBans is the ban list of the running daemon.
+var clientBans banList
+
+// parseBanTarget parses an IP address or CIDR into the prefix it bans.
+func parseBanTarget(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	ip = ip.Unmap().WithZone("")
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// active reports whether any ban is set.
+func (l *banList) active() bool {
+	return l.n.Load() > 0
+}
+
+// add sets ban, replacing an existing ban of the same prefix.
+func (l *banList) add(ban clientBan) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byLen == nil {
+		l.byLen = make(map[int]map[netip.Prefix]clientBan)
+	}
+	bans := l.byLen[ban.Prefix.Bits()]
+	if bans == nil {
+		bans = make(map[netip.Prefix]clientBan)
+		l.byLen[ban.Prefix.Bits()] = bans
+	}
+	bans[ban.Prefix] = ban
+	l.pruneLocked(time.Now())
+}
+
+// remove lifts the ban of prefix and reports whether there was one.
+func (l *banList) remove(prefix netip.Prefix) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bans := l.byLen[prefix.Bits()]
+	if _, ok := bans[prefix]; !ok {
+		return false
+	}
+	delete(bans, prefix)
+	l.pruneLocked(time.Now())
+	return true
+}
+
+// list returns the bans in effect, by prefix.
+func (l *banList) list() []clientBan {
+	l.mu.Lock()
+	l.pruneLocked(time.Now())
+	var out []clientBan
+	for _, bans := range l.byLen {
+		for _, b := range bans {
+			out = append(out, b)
+		}
+	}
+	l.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].Prefix, out[j].Prefix
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+	return out
+}
+
+// pruneLocked drops expired bans and empty length groups; l.mu is held.
+func (l *banList) pruneLocked(now time.Time) {
+	n := 0
+	for bits, bans := range l.byLen {
+		for p, b := range bans {
+			if b.expired(now) {
+				delete(bans, p)
+				logInfo("[ban] %s expired", p)
+			}
+		}
+		if len(bans) == 0 {
+			delete(l.byLen, bits)
+		}
+		n += len(bans)
+	}
+	l.n.Store(int32(n))
+}
+
+// match returns the ban covering ip, if any.
+func (l *banList) match(ip netip.Addr) (clientBan, bool) {
+	ip = ip.Unmap().WithZone("")
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for bits, bans := range l.byLen {
+		p, err := ip.Prefix(bits)
+		if err != nil {
+			continue // longer than ip's family
+		}
+		if b, ok := bans[p]; ok && !b.expired(now) {
+			return b, true
+		}
+	}
+	return clientBan{}, false
+}
+
+// banned reports whether the client at addr is banned.
+func (l *banList) banned(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	_, found := l.match(ta.AddrPort().Addr())
+	return found
+}
+
+// ban bans prefix for ttl (0: until unbanned) and closes the connections of
+// clients inside it, returning the ban and the number closed.
+func ban(prefix netip.Prefix, ttl time.Duration, reason string) (clientBan, int) {
+	b := clientBan{Prefix: prefix, Reason: reason, Added: time.Now()}
+	if ttl > 0 {
+		b.Expires = b.Added.Add(ttl)
+	}
+	clientBans.add(b)
+	closed := activeConns.killClients(prefix)
+	how := "until unbanned"
+	if ttl > 0 {
+		how = "for " + ttl.String()
+	}
+	if reason != "" {
+		how += " (" + reason + ")"
+	}
+	logInfo("[ban] %s banned %s; %d connections closed", prefix, how, closed)
+	return b, closed
+}
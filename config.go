@@ -4,75 +4,1208 @@ import (
 	"fmt"
 	"net"
 	"os"
-
-	"gopkg.in/yaml.v3"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// ProxyEntry defines a single SOCKS5 listener with a fixed outbound IPv6.
+// defaultDialAttempts is the number of resolved addresses tried per domain
+// target when dial_attempts is omitted.
+const defaultDialAttempts = 4
+
+// maxAcceptors bounds the acceptors of an entry, each a socket of its port.
+const maxAcceptors = 256
+
+// ProxyEntry defines a single SOCKS5 listener with a fixed outbound IPv6,
+// or a weighted pool of outbound IPv6 addresses.
 type ProxyEntry struct {
-	IPv6 string `yaml:"ipv6"`
-	Port int    `yaml:"port"`
+	Name string `yaml:"name"` // optional: label in logs, e.g. customer-acme-1
+
+	// Paused keeps the port open but closes new connections right away;
+	// active connections, the entry and its counters are kept.
+	Paused bool `yaml:"paused"`
+
+	IPv6       string          `yaml:"ipv6"`
+	Outbound   []OutboundAddr  `yaml:"outbound"` // alternative to ipv6: weighted pool
+	Port       int             `yaml:"port"`
+	BindDevice string          `yaml:"bind_device"` // optional: force egress via this NIC
+	Mark       uint32          `yaml:"mark"`        // optional: fwmark of target sockets, for policy routing
+	Resolver   *ResolverConfig `yaml:"resolver"`    // optional: DNS servers for domain targets
+	Resolve    string          `yaml:"resolve"`     // ipv6-only (default), ipv4-only or prefer-ipv6
+
+	// DialAttempts caps how many resolved addresses of a domain target are
+	// tried before replying host unreachable (default 4).
+	DialAttempts int `yaml:"dial_attempts"`
+
+	Destinations *DestinationConfig `yaml:"destinations"` // optional: destination address policy
+
+	// Rules route CONNECTs: the first rule matching the target decides
+	// whether it is dialed directly, blocked, sent through an upstream
+	// chain or rewritten to another target.
+	Rules []RouteRule `yaml:"rules"`
+
+	// AllowClients, if set, restricts the listener to clients inside these
+	// ranges; DenyClients refuses clients inside them (CIDRs or bare IPs).
+	// Both are checked on accept, before the handshake, along with the
+	// global lists.
+	AllowClients []string `yaml:"allow_clients"`
+	DenyClients  []string `yaml:"deny_clients"`
+
+	// Auth requires clients to log in with the name and password of an
+	// account of the users section (RFC 1929); the outbound addresses and
+	// limits of the account then apply to the session.
+	Auth bool `yaml:"auth"`
+
+	// AuthBackend checks the logins of a listener with auth: "users" (the
+	// default: the users section, users_file and auth_http), "ldap" or
+	// "radius".
+	AuthBackend string `yaml:"auth_backend"`
+
+	// AllowCountries and DenyCountries filter clients by the country of
+	// their address (ISO 3166-1 codes such as "DE"), AllowASNs and DenyASNs
+	// by its autonomous system, looked up in the geoip databases on accept.
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+	AllowASNs      []uint32 `yaml:"allow_asns"`
+	DenyASNs       []uint32 `yaml:"deny_asns"`
+
+	// RateLimit limits new connections per client IP and to the listener
+	// as a whole; connections over it are closed on accept.
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+
+	// Bandwidth limits the throughput of each connection of the listener.
+	Bandwidth *BandwidthConfig `yaml:"bandwidth"`
+
+	// MaxConnections caps the connections the listener serves at once
+	// (0: no cap); more are closed on accept.
+	MaxConnections int `yaml:"max_connections"`
+
+	// Congestion is the TCP congestion control algorithm of the listener's
+	// client and target connections, e.g. bbr (Linux; default: the
+	// system's).
+	Congestion string `yaml:"congestion"`
+
+	// DSCP marks the packets of the listener's client and target
+	// connections with a Differentiated Services code point, a name such
+	// as ef or af41 or a number 0-63, for QoS downstream (Linux).
+	DSCP string `yaml:"dscp"`
+
+	// MPTCP dials targets with Multipath TCP where the kernel supports it,
+	// falling back to TCP for targets that do not (Linux 5.6+).
+	MPTCP bool `yaml:"mptcp"`
+
+	// Timeouts bounds the SOCKS5 handshake and the dial to the target.
+	Timeouts *TimeoutConfig `yaml:"timeouts"`
+
+	// KeepAlive tunes the TCP keepalive of connections to targets, and the
+	// TCP_USER_TIMEOUT of those and of the clients'.
+	KeepAlive *KeepAliveConfig `yaml:"keepalive"`
+
+	// FastOpen enables TCP Fast Open for clients of the listener and for
+	// its dials to targets (Linux).
+	FastOpen *FastOpenConfig `yaml:"fast_open"`
+
+	// Workers caps the goroutines handling the listener's connections;
+	// those accepted beyond wait in a queue for one to finish.
+	Workers *WorkersConfig `yaml:"workers"`
+
+	// Accept tunes the accept queue of the listener's sockets.
+	Accept *AcceptConfig `yaml:"accept"`
+
+	// Buffer sizes the buffers its connections are relayed through when they
+	// are not spliced, in place of relay.buffer.
+	Buffer *BufferConfig `yaml:"buffer"`
+
+	// SocketBuffers sizes the kernel's send and receive buffers of the
+	// connections of clients and of those to targets, in place of the
+	// kernel's autotuning.
+	SocketBuffers *SocketBuffersConfig `yaml:"socket_buffers"`
+
+	// Acceptors is the number of listening sockets opened for the port with
+	// SO_REUSEPORT (Linux), each with its own accept loop, so the kernel
+	// spreads new connections across cores (default 1).
+	Acceptors int `yaml:"acceptors"`
+
+	// Quota caps the traffic of the listener per day or month; once it is
+	// used up, the listener closes its connections until the next period.
+	Quota *QuotaConfig `yaml:"quota"`
+
+	// Schedule limits new connections to weekly windows, e.g. business
+	// hours; outside them the listener closes new connections on accept.
+	Schedule *ScheduleConfig `yaml:"schedule"`
+
+	// AccessLog is a file receiving a record of every connection of the
+	// listener, e.g. "/var/log/superproxy/{{ .listener }}.log".
+	AccessLog string `yaml:"access_log"`
+
+	// Ports expands the entry into one listener per port of a range such as
+	// "20000-20999". Each port takes the next address of IPv6Prefix, or the
+	// matching address of IPv6List; with Outbound, all ports share the pool.
+	Ports      string   `yaml:"ports"`
+	IPv6Prefix string   `yaml:"ipv6_prefix"`
+	IPv6List   []string `yaml:"ipv6_list"`
+
+	// Prefix generates Count listeners on consecutive ports from StartPort,
+	// each with its own address derived deterministically from the prefix.
+	Prefix    string `yaml:"prefix"`
+	Count     int    `yaml:"count"`
+	StartPort int    `yaml:"start_port"`
+
+	origin     string // name in errors for entries from included files
+	listenHost string // copied from Config.ListenHost
+	bufferSize int    // resolved from Buffer and relay.buffer by validation
+	bufferPool bool   // likewise
+	dscp       int    // parsed from DSCP by validation
+}
+
+// TimeoutConfig bounds the phases of a session before the relay, which
+// is closed on expiry.
+type TimeoutConfig struct {
+	Handshake time.Duration `yaml:"handshake"` // accept to a complete SOCKS5 request, login included (default 10s)
+	Dial      time.Duration `yaml:"dial"`      // connecting to the target, all attempts and addresses together (default 15s)
+}
+
+// KeepAliveConfig tunes TCP keepalive probes: after Idle without traffic,
+// one every Interval, dropping the connection after Count unanswered ones
+// (Linux; elsewhere only Disable applies). UserTimeout bounds how long
+// sent data or probes may go unacknowledged, on the client socket too.
+type KeepAliveConfig struct {
+	Disable     bool          `yaml:"disable"`      // no keepalive probes
+	Idle        time.Duration `yaml:"idle"`         // default 30s, whole seconds
+	Interval    time.Duration `yaml:"interval"`     // default 10s, whole seconds
+	Count       int           `yaml:"count"`        // default 3
+	UserTimeout time.Duration `yaml:"user_timeout"` // TCP_USER_TIMEOUT, Linux (0: the kernel's, minutes of retransmissions)
+}
+
+// FastOpenConfig enables TCP Fast Open: a peer holding a cookie from an
+// earlier connection sends its first data with the SYN, saving a round
+// trip before it arrives.
+type FastOpenConfig struct {
+	Listen  bool `yaml:"listen"`  // accept data in the SYNs of clients (TCP_FASTOPEN)
+	Connect bool `yaml:"connect"` // send the first data to targets in the SYN (TCP_FASTOPEN_CONNECT)
+	Queue   int  `yaml:"queue"`   // listen: SYNs with data pending per socket (default 256)
+}
+
+// WorkersConfig bounds the handlers of a listener's connections, each of
+// which serves one from the handshake to the end of its relay.
+type WorkersConfig struct {
+	Max          int           `yaml:"max"`           // handlers at once
+	Queue        int           `yaml:"queue"`         // connections waiting for one (default: max); more are closed
+	QueueTimeout time.Duration `yaml:"queue_timeout"` // closing those that waited this long (default: the handshake timeout)
+}
+
+// AcceptConfig tunes the queue of connections the kernel completed and
+// the listener has yet to accept.
+type AcceptConfig struct {
+	Backlog int           `yaml:"backlog"` // length of the queue (default: net.core.somaxconn, which also caps it)
+	Defer   time.Duration `yaml:"defer"`   // accept a connection once the client sent data, or after this long (TCP_DEFER_ACCEPT)
+}
+
+// SocketBuffersConfig sizes the socket buffers of a listener's connections
+// (SO_SNDBUF, SO_RCVBUF). A size turns off the kernel's autotuning of that
+// buffer, which the kernel then doubles for its bookkeeping and caps at
+// net.core.wmem_max or net.core.rmem_max.
+type SocketBuffersConfig struct {
+	Client *SocketBufferSizes `yaml:"client"` // connections of clients, set on the listening sockets they inherit them from
+	Target *SocketBufferSizes `yaml:"target"` // connections to targets, set before connecting
+}
+
+// SocketBufferSizes are the buffer sizes of one side of a connection, e.g.
+// "4MiB"; unset, the kernel autotunes the buffer.
+type SocketBufferSizes struct {
+	Send    string `yaml:"send"`    // SO_SNDBUF
+	Receive string `yaml:"receive"` // SO_RCVBUF
+
+	send, receive int // parsed by validation
+}
+
+// BandwidthConfig limits each connection to a rate per direction, e.g.
+// "10mbit" or "2MB" (per second). Limited connections are relayed through
+// userspace instead of splice(2).
+type BandwidthConfig struct {
+	Rate string `yaml:"rate"` // both directions
+	Up   string `yaml:"up"`   // client → target (default: rate)
+	Down string `yaml:"down"` // target → client (default: rate)
+
+	up, down float64 // bytes per second (0: not limited), set by validation
+}
+
+// QuotaConfig is the traffic, up and down together, a listener may relay
+// in each period, e.g. "500GB" a month. Periods start at midnight UTC.
+type QuotaConfig struct {
+	Limit  string `yaml:"limit"`  // e.g. "500GB" or "1.5TiB"
+	Period string `yaml:"period"` // daily or monthly (default)
+
+	limit int64 // bytes, set by validation
+}
+
+// ScheduleConfig is the weekly windows in which a listener accepts new
+// connections, such as "mon-fri 09:00-18:00", in Timezone (an IANA name,
+// default UTC). Connections open when a window ends are not closed.
+type ScheduleConfig struct {
+	Timezone string   `yaml:"timezone"`
+	Windows  []string `yaml:"windows"`
+
+	loc     *time.Location   // set by validation
+	windows []scheduleWindow // set by validation
+}
+
+// UserConfig is an account that logs in to listeners with auth. Its
+// sessions leave from its own outbound addresses if set (ipv6, or a
+// weighted outbound pool; default: those of the listener) and share its
+// limits on every listener.
+type UserConfig struct {
+	Name     string         `yaml:"name"`
+	Password string         `yaml:"password"` // plaintext or a secret reference
+	IPv6     string         `yaml:"ipv6"`
+	Outbound []OutboundAddr `yaml:"outbound"`
+	Ports    []int          `yaml:"ports"` // listeners it may log in to (default: all with auth)
+
+	Bandwidth      *BandwidthConfig `yaml:"bandwidth"`       // of each connection, instead of the listener's
+	MaxConnections int              `yaml:"max_connections"` // on all listeners together (0: no cap)
+	Quota          *QuotaConfig     `yaml:"quota"`           // on all listeners together
+	EgressLimit    string           `yaml:"egress_limit"`    // data all its connections send together per second
+
+	egressRate float64 // bytes per second (0: no limit), set by validation
+}
+
+// RateLimitConfig sets token buckets for new connections: Rate per second
+// with bursts of Burst per client IP, and ListenerRate / ListenerBurst for
+// all clients of the listener together. A rate of 0 is not limited.
+type RateLimitConfig struct {
+	Rate          float64 `yaml:"rate"`           // connections per second per client IP
+	Burst         int     `yaml:"burst"`          // default: a second's worth, at least 1
+	ListenerRate  float64 `yaml:"listener_rate"`  // connections per second to the listener
+	ListenerBurst int     `yaml:"listener_burst"` // default: a second's worth, at least 1
+}
+
+// DestinationConfig restricts which destinations a listener dials. Address
+// rules apply to IP-literal targets and to every resolved address; domain
+// rules to domain targets, before they are resolved. Internal ranges and
+// the host's own addresses are refused even without the block, unless
+// AllowInternal is set.
+type DestinationConfig struct {
+	AllowInternal bool `yaml:"allow_internal"` // dial internal ranges and the host's own addresses
+
+	DenyPrivate bool     `yaml:"deny_private"` // the default: loopback, link-local, RFC 1918, ULA, CGNAT, multicast
+	DenyCIDRs   []string `yaml:"deny_cidrs"`   // additional blocked ranges (bare IPs allowed)
+	DenyDomains []string `yaml:"deny_domains"` // names, "*.example.com" (any subdomain) or other glob patterns
+	AllowPorts  []string `yaml:"allow_ports"`  // only these ports or ranges ("8000-8999"), if set
+	DenyPorts   []string `yaml:"deny_ports"`   // refused ports or ranges, e.g. 25
+
+	// AllowCIDRs and AllowDomains, if either is set, make the listener
+	// allowlist-only: it dials only addresses in AllowCIDRs and domains of
+	// AllowDomains (same patterns as DenyDomains), and still refuses those
+	// the deny rules match.
+	AllowCIDRs   []string `yaml:"allow_cidrs"`
+	AllowDomains []string `yaml:"allow_domains"`
+
+	// SNI applies deny_domains to IP-literal targets on SNIPorts too, by
+	// the server name of the TLS ClientHello the client sends first;
+	// RequireSNI also refuses those whose first bytes carry no server name.
+	SNI        bool  `yaml:"sni"`
+	SNIPorts   []int `yaml:"sni_ports"` // default [443]
+	RequireSNI bool  `yaml:"require_sni"`
+}
+
+// RouteRule is one of a listener's rules. It matches a target if the
+// target is in Domains or CIDRs (any target, without either) and on Ports.
+type RouteRule struct {
+	Domains []string `yaml:"domains"` // domain targets, as in deny_domains
+	CIDRs   []string `yaml:"cidrs"`   // IP-literal targets in these ranges
+	Ports   []string `yaml:"ports"`   // destination ports or ranges (default: all)
+
+	Action   string `yaml:"action"`   // direct (default), block, upstream or rewrite
+	Upstream string `yaml:"upstream"` // upstream: name of one of the upstreams
+	Rewrite  string `yaml:"rewrite"`  // rewrite: new host[:port], or :port
+	Outbound string `yaml:"outbound"` // not with block: dial from this IPv6 instead of the pool's
+}
+
+// UpstreamConfig is a chain of proxies, connected through in order, that
+// rules can send CONNECTs to by name.
+type UpstreamConfig struct {
+	Name  string   `yaml:"name"`
+	Chain []string `yaml:"chain"` // socks5://[user:pass@]host:port or http://[user:pass@]host:port
+}
+
+// OutboundAddr is one member of a weighted outbound pool.
+type OutboundAddr struct {
+	IPv6   string `yaml:"ipv6"`
+	Weight int    `yaml:"weight"` // relative share of connections; default 1
+}
+
+// ResolverConfig replaces the system resolver for a listener's domain targets.
+type ResolverConfig struct {
+	Protocol   string        `yaml:"protocol"`    // dns (default), dot or doh
+	Servers    []string      `yaml:"servers"`     // IP[:port] for dns/dot, https URLs for doh; tried in rotation
+	ServerName string        `yaml:"server_name"` // dot: TLS name to verify (default: the server IP)
+	Timeout    time.Duration `yaml:"timeout"`     // overall lookup timeout (default 5s)
+
+	// BindOutbound sends queries from the connection's outbound IPv6, so the
+	// resolver sees the same egress identity as the target.
+	BindOutbound bool `yaml:"bind_outbound"`
+
+	ECS *ECSConfig `yaml:"ecs"` // optional: EDNS Client Subnet control
+}
+
+// ECSConfig controls the EDNS Client Subnet option sent with queries.
+type ECSConfig struct {
+	Mode   string `yaml:"mode"`   // outbound, subnet or strip
+	Prefix int    `yaml:"prefix"` // outbound: prefix length of the outbound address (default 56)
+	Subnet string `yaml:"subnet"` // subnet: fixed client subnet, e.g. 2001:db8:100::/48
+}
+
+// DNSCacheConfig enables the shared in-process DNS cache.
+type DNSCacheConfig struct {
+	Size        int           `yaml:"size"`         // max cached responses (default 10000)
+	MinTTL      time.Duration `yaml:"min_ttl"`      // floor for record TTLs (default 0)
+	MaxTTL      time.Duration `yaml:"max_ttl"`      // ceiling for record TTLs (default 1h)
+	NegativeTTL time.Duration `yaml:"negative_ttl"` // ceiling for NXDOMAIN/NODATA (default 30s)
+}
+
+// FailCacheConfig enables the shared cache of recent connection failures.
+type FailCacheConfig struct {
+	Size int           `yaml:"size"` // max remembered destinations (default 10000)
+	TTL  time.Duration `yaml:"ttl"`  // how long a failure is remembered (default 5s)
+}
+
+// HealthCheckConfig enables periodic probing of outbound addresses.
+type HealthCheckConfig struct {
+	Target   string        `yaml:"target"`   // host:port to TCP-connect to from each address
+	Interval time.Duration `yaml:"interval"` // time between probe rounds (default 30s)
+	Timeout  time.Duration `yaml:"timeout"`  // per-probe connect timeout (default 5s)
+	Fall     int           `yaml:"fall"`     // consecutive failures before exclusion (default 3)
+	Rise     int           `yaml:"rise"`     // consecutive successes before re-adding (default 2)
+}
+
+// TracingConfig exports a trace of each SOCKS5 session over OTLP/HTTP.
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint"`     // OTLP/HTTP collector, e.g. http://localhost:4318 (/v1/traces is added)
+	Headers     map[string]string `yaml:"headers"`      // sent with every export, e.g. an API key
+	SampleRate  float64           `yaml:"sample_rate"`  // fraction of sessions traced (default 1)
+	ServiceName string            `yaml:"service_name"` // service.name resource attribute (default superproxy)
+}
+
+// StatsDConfig publishes the listener counters to a StatsD server.
+type StatsDConfig struct {
+	Address   string            `yaml:"address"`   // host:port (UDP), e.g. 127.0.0.1:8125
+	Prefix    string            `yaml:"prefix"`    // metric name prefix (default superproxy)
+	Interval  time.Duration     `yaml:"interval"`  // time between flushes (default 10s)
+	DogStatsD bool              `yaml:"dogstatsd"` // tag metrics with port and name instead of naming them by port
+	Tags      map[string]string `yaml:"tags"`      // dogstatsd: tags added to every metric, e.g. env: prod
+}
+
+// IPFIXConfig exports a flow record per relayed connection to an IPFIX
+// collector.
+type IPFIXConfig struct {
+	Collector         string        `yaml:"collector"`          // host[:port] (UDP, default port 4739)
+	ObservationDomain uint32        `yaml:"observation_domain"` // observation domain ID of the messages
+	TemplateRefresh   time.Duration `yaml:"template_refresh"`   // resend the templates this often (default 1m)
+}
+
+// DomainStatsConfig counts traffic by destination domain.
+type DomainStatsConfig struct {
+	Size     int   `yaml:"size"`      // domains counted by name (default 10000); later ones are summed up as other
+	SNI      bool  `yaml:"sni"`       // name IP targets by the server name of their TLS ClientHello
+	SNIPorts []int `yaml:"sni_ports"` // with sni: target ports whose ClientHello is read (default [443])
+}
+
+// LogRotationConfig rotates the -log-file, the audit log and the access
+// logs: a file is renamed to <path>.<time> and a new one started.
+type LogRotationConfig struct {
+	MaxSizeMB int           `yaml:"max_size_mb"` // rotate before a file exceeds this size (0: no limit)
+	Interval  time.Duration `yaml:"interval"`    // also rotate at each multiple of this, e.g. 24h at midnight UTC (0: never)
+	Keep      int           `yaml:"keep"`        // rotated files kept per log (default 7)
+	MaxAge    time.Duration `yaml:"max_age"`     // delete rotated files older than this (0: no limit)
+	Compress  bool          `yaml:"compress"`    // gzip rotated files
+}
+
+// LogSamplingConfig limits high-volume log messages (accept errors,
+// handshake failures, connect failures, banned, denied or rate limited
+// clients, connections over max_connections and slow sessions) per
+// listener.
+type LogSamplingConfig struct {
+	Interval   time.Duration `yaml:"interval"`   // sampling window (default 1s)
+	First      int           `yaml:"first"`      // messages of a class written per window (default 20)
+	Thereafter int           `yaml:"thereafter"` // then every Nth (0: none)
+	Disabled   bool          `yaml:"disabled"`   // write all messages
+}
+
+// RelayConfig tunes the relay. On Linux, connections without a bandwidth
+// or egress limit are relayed with splice(2) through a pipe per direction,
+// without copying their data into the process, or through io_uring.
+type RelayConfig struct {
+	PipeSize    string        `yaml:"pipe_size"`    // capacity of each pipe, e.g. 1MiB (default: the kernel's, 64KiB)
+	Buffered    bool          `yaml:"buffered"`     // relay through userspace buffers instead of splice(2)
+	IOUring     bool          `yaml:"io_uring"`     // relay through an io_uring ring (experimental, Linux 5.7+)
+	RingEntries int           `yaml:"ring_entries"` // submission queue size of the ring (default 4096)
+	Sockmap     bool          `yaml:"sockmap"`      // forward established relays in the kernel through a BPF sockmap (experimental, Linux 5.10+)
+	SockmapSize int           `yaml:"sockmap_size"` // relays the sockmap holds at once (default 16384)
+	Buffer      *BufferConfig `yaml:"buffer"`
+	pipeSize    int           // bytes (0: default), set by validation
+}
+
+// BufferConfig sizes the userspace buffers connections are relayed through
+// when they are not spliced: paced connections, those relayed through
+// io_uring, and all of them off Linux or with relay.buffered. Each
+// direction of a connection takes one.
+type BufferConfig struct {
+	Size string `yaml:"size"` // e.g. 4KiB or 1MiB, 1KiB-16MiB (default 32KiB)
+	Pool *bool  `yaml:"pool"` // reuse idle buffers (default true); false allocates one per copy, left to the GC
+	size int    // bytes (0: default), set by validation
+}
+
+// SlowLogConfig logs sessions with a phase slower than its threshold, and
+// relays that stall (0: a check is off).
+type SlowLogConfig struct {
+	Handshake time.Duration `yaml:"handshake"`  // accept to a complete SOCKS5 request
+	Dial      time.Duration `yaml:"dial"`       // resolving and connecting to the target
+	FirstByte time.Duration `yaml:"first_byte"` // relay start to the first byte from the target
+	Stall     time.Duration `yaml:"stall"`      // the target silent this long after the client sent data (Linux)
+}
+
+// GeoIPConfig locates the GeoIP databases, in MaxMind DB format (.mmdb):
+// GeoLite2 or GeoIP2 Country or City, and ASN. They are read on startup and
+// again on reloads after the files changed.
+type GeoIPConfig struct {
+	Country string `yaml:"country"` // e.g. /var/lib/GeoIP/GeoLite2-Country.mmdb
+	ASN     string `yaml:"asn"`     // e.g. /var/lib/GeoIP/GeoLite2-ASN.mmdb
+}
+
+// AutoBanConfig bans a client for BanTime once it failed Failures SOCKS5
+// handshakes within Window: malformed or unsupported requests, or no
+// acceptable auth method.
+type AutoBanConfig struct {
+	Failures   int           `yaml:"failures"`    // default 10
+	Window     time.Duration `yaml:"window"`      // default 1m
+	BanTime    time.Duration `yaml:"ban_time"`    // default 10m
+	IPv6Prefix int           `yaml:"ipv6_prefix"` // count and ban IPv6 clients by this prefix, e.g. 64 (default: the address)
+	Ignore     []string      `yaml:"ignore"`      // clients never banned (CIDRs or bare IPs)
+}
+
+// AuthHTTPConfig asks an HTTP service whether a login is allowed: it gets
+// a JSON POST with the username, password, client IP and listener, and
+// answers 2xx to allow or 401/403 to deny.
+type AuthHTTPConfig struct {
+	URL       string            `yaml:"url"`        // receives a JSON POST per login
+	Headers   map[string]string `yaml:"headers"`    // sent with every request, e.g. Authorization
+	Timeout   time.Duration     `yaml:"timeout"`    // per request (default 5s)
+	CacheTTL  time.Duration     `yaml:"cache_ttl"`  // how long an allow is remembered (default 5m)
+	DenyTTL   time.Duration     `yaml:"deny_ttl"`   // how long a deny is remembered (default 30s)
+	CacheSize int               `yaml:"cache_size"` // decisions remembered (default 10000)
+}
+
+// LDAPConfig checks a login by binding to an LDAP or Active Directory
+// server as the user, found with a DN template or a search, and optionally
+// requires membership of a group. {user} in the templates and filters is
+// the username, {dn} the DN of the user.
+type LDAPConfig struct {
+	URL          string        `yaml:"url"`           // ldap://host[:389] or ldaps://host[:636]
+	StartTLS     bool          `yaml:"start_tls"`     // ldap://: upgrade the connection with StartTLS before binding
+	CA           string        `yaml:"ca"`            // PEM CA bundle verifying the server (default: system roots)
+	BindDN       string        `yaml:"bind_dn"`       // account searching for users and groups (default: anonymous)
+	BindPassword string        `yaml:"bind_password"` // its password
+	UserDN       string        `yaml:"user_dn"`       // DN template to bind with directly, e.g. uid={user},ou=people,dc=example,dc=com
+	BaseDN       string        `yaml:"base_dn"`       // without user_dn: subtree searched for the user
+	UserFilter   string        `yaml:"user_filter"`   // search filter (default (uid={user}); AD: (sAMAccountName={user}))
+	GroupDN      string        `yaml:"group_dn"`      // group the user must be in (optional)
+	GroupFilter  string        `yaml:"group_filter"`  // membership test on group_dn (default (|(member={dn})(uniqueMember={dn})(memberUid={user})))
+	Timeout      time.Duration `yaml:"timeout"`       // per login (default 5s)
+	CacheTTL     time.Duration `yaml:"cache_ttl"`     // how long an allow is remembered (default 5m)
+	DenyTTL      time.Duration `yaml:"deny_ttl"`      // how long a deny is remembered (default 30s)
+	CacheSize    int           `yaml:"cache_size"`    // decisions remembered (default 10000)
+}
+
+// RADIUSConfig checks a login with an Access-Request to a RADIUS server
+// (RFC 2865) and, with accounting, reports the sessions of the users it
+// allowed with Accounting-Start and -Stop records (RFC 2866).
+type RADIUSConfig struct {
+	Server           string        `yaml:"server"`            // host[:1812]
+	Secret           string        `yaml:"secret"`            // shared secret
+	NASIdentifier    string        `yaml:"nas_identifier"`    // NAS-Identifier sent (default: the hostname)
+	Timeout          time.Duration `yaml:"timeout"`           // per attempt (default 3s)
+	Retries          *int          `yaml:"retries"`           // retransmissions after a timeout (default 2; 0: a single attempt)
+	Accounting       bool          `yaml:"accounting"`        // send Accounting-Start/Stop records with the bytes of each session
+	AccountingServer string        `yaml:"accounting_server"` // host[:1813] (default: the host of server, port 1813)
+}
+
+// SyslogConfig sends the log to a local or remote syslog server as RFC 5424
+// records.
+type SyslogConfig struct {
+	Address  string `yaml:"address"`  // local (default), unix:///path, udp://host[:514], tcp://host[:514] or tls://host[:6514]
+	Facility string `yaml:"facility"` // daemon (default), local0..local7, user, ...
+	Tag      string `yaml:"tag"`      // APP-NAME (default superproxy)
+	CA       string `yaml:"ca"`       // tls: PEM CA bundle verifying the server (default: system roots)
+	Only     bool   `yaml:"only"`     // log to syslog only, not also to stderr or the -log-file
+}
+
+// LokiConfig ships the log to Grafana Loki.
+type LokiConfig struct {
+	URL       string            `yaml:"url"`        // e.g. http://loki:3100 (the push API path is added when the URL has none)
+	Labels    map[string]string `yaml:"labels"`     // stream labels besides level, component and host (default job: superproxy)
+	Headers   map[string]string `yaml:"headers"`    // sent with every request, e.g. X-Scope-OrgID
+	BatchSize int               `yaml:"batch_size"` // records per push (default 1000)
+	BatchWait time.Duration     `yaml:"batch_wait"` // longest a record waits for a full batch (default 1s)
+	Timeout   time.Duration     `yaml:"timeout"`    // per request (default 10s)
+}
+
+// ElasticsearchConfig ships the log to Elasticsearch (or OpenSearch)
+// through the bulk API.
+type ElasticsearchConfig struct {
+	URL       string            `yaml:"url"`        // e.g. https://user:pass@es:9200 (/_bulk is added when the URL has no path)
+	Index     string            `yaml:"index"`      // index or data stream; {layout} parts are UTC time layouts (default superproxy-{2006.01.02})
+	Headers   map[string]string `yaml:"headers"`    // sent with every request, e.g. Authorization: ApiKey ...
+	BatchSize int               `yaml:"batch_size"` // records per request (default 1000)
+	BatchWait time.Duration     `yaml:"batch_wait"` // longest a record waits for a full batch (default 1s)
+	Timeout   time.Duration     `yaml:"timeout"`    // per request (default 10s)
+}
+
+// WebhookConfig is a URL notified of operational events.
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`     // receives a JSON POST per event
+	Events  []string          `yaml:"events"`  // events sent (default: all)
+	Headers map[string]string `yaml:"headers"` // sent with every request, e.g. Authorization
+	Timeout time.Duration     `yaml:"timeout"` // per request (default 5s)
+}
+
+// AdminConfig enables the management APIs.
+type AdminConfig struct {
+	Listen     string `yaml:"listen"`      // REST API host:port, e.g. 127.0.0.1:9090
+	GRPCListen string `yaml:"grpc_listen"` // gRPC API host:port, e.g. 127.0.0.1:9091
+	Persist    bool   `yaml:"persist"`     // keep API changes in -state-dir across reloads and restarts
+
+	// Tokens maps names to bearer tokens; with tokens or a client CA set,
+	// every request must authenticate.
+	Tokens   map[string]string `yaml:"tokens"`
+	TLS      *AdminTLSConfig   `yaml:"tls"`
+	AuditLog string            `yaml:"audit_log"` // append-only JSON-lines log of administrative actions
+	Debug    bool              `yaml:"debug"`     // serve /debug/pprof/ and allow ctl dump
+}
+
+// AdminTLSConfig serves the admin APIs over TLS, optionally verifying
+// client certificates (mTLS).
+type AdminTLSConfig struct {
+	Cert     string `yaml:"cert"`      // PEM certificate (chain)
+	Key      string `yaml:"key"`       // PEM private key
+	ClientCA string `yaml:"client_ca"` // PEM CA bundle that signs client certificates
 }
 
 // Config is the top-level YAML configuration.
 type Config struct {
-	Interface string       `yaml:"interface"`
-	Proxies   []ProxyEntry `yaml:"proxies"`
+	Interface   string             `yaml:"interface"`
+	ListenHost  string             `yaml:"listen_host"`  // optional: listen address for all entries (default all)
+	LogLevel    string             `yaml:"log_level"`    // debug, info (default), warn or error
+	LogFormat   string             `yaml:"log_format"`   // text (default) or json
+	LogRotation *LogRotationConfig `yaml:"log_rotation"` // optional: rotate the -log-file, audit log and access logs
+	Syslog      *SyslogConfig      `yaml:"syslog"`       // optional: also send the log to syslog
+	LogSampling *LogSamplingConfig `yaml:"log_sampling"` // optional: tune the sampling of high-volume messages
+	SlowLog     *SlowLogConfig     `yaml:"slow_log"`     // optional: log slow and stalled sessions
+	Resolver    *ResolverConfig    `yaml:"resolver"`     // optional: default for entries without their own
+	DNSCache    *DNSCacheConfig    `yaml:"dns_cache"`    // optional: shared response cache
+	Hosts       map[string]string  `yaml:"hosts"`        // optional: domain → IP, consulted before DNS
+	Upstreams   []UpstreamConfig   `yaml:"upstreams"`    // optional: proxy chains for rules with action upstream
+	FailCache   *FailCacheConfig   `yaml:"fail_cache"`   // optional: fail fast on recently dead targets
+	HealthCheck *HealthCheckConfig `yaml:"health_check"` // optional
+	Tracing     *TracingConfig     `yaml:"tracing"`      // optional: OpenTelemetry traces of sessions
+	StatsD      *StatsDConfig      `yaml:"statsd"`       // optional: StatsD / DogStatsD metrics
+	IPFIX       *IPFIXConfig       `yaml:"ipfix"`        // optional: flow records to an IPFIX collector
+	Webhooks    []WebhookConfig    `yaml:"webhooks"`     // optional: notified of operational events
+	DomainStats *DomainStatsConfig `yaml:"domain_stats"` // optional: traffic by destination domain
+	Admin       *AdminConfig       `yaml:"admin"`        // optional: management APIs
+	Proxies     []ProxyEntry       `yaml:"proxies"`
+
+	// Loki and Elastic also ship the log, to Grafana Loki and to
+	// Elasticsearch (optional).
+	Loki    *LokiConfig          `yaml:"loki"`
+	Elastic *ElasticsearchConfig `yaml:"elasticsearch"`
+
+	// AllowClients and DenyClients filter the clients of every listener,
+	// in addition to the lists of each entry: a client must pass both.
+	AllowClients []string `yaml:"allow_clients"`
+	DenyClients  []string `yaml:"deny_clients"`
+
+	// GeoIP names the MaxMind DB files the allow_countries / deny_countries
+	// and allow_asns / deny_asns of entries are looked up in (optional).
+	GeoIP *GeoIPConfig `yaml:"geoip"`
+
+	// AutoBan bans clients that fail the SOCKS5 handshake repeatedly, on
+	// any listener (optional).
+	AutoBan *AutoBanConfig `yaml:"auto_ban"`
+
+	// Users are the accounts listeners with auth accept (optional).
+	Users []UserConfig `yaml:"users"`
+
+	// UsersFile is an htpasswd-style file of further users, "name:bcrypt
+	// hash" per line, re-read whenever it changes (optional).
+	UsersFile string `yaml:"users_file"`
+
+	// AuthHTTP checks the logins of users neither of the above knows with
+	// an HTTP service (optional).
+	AuthHTTP *AuthHTTPConfig `yaml:"auth_http"`
+
+	// LDAP checks the logins of listeners with auth_backend ldap by
+	// binding to a directory server as the user (optional).
+	LDAP *LDAPConfig `yaml:"ldap"`
+
+	// RADIUS checks the logins of listeners with auth_backend radius and
+	// optionally meters their sessions with RADIUS accounting (optional).
+	RADIUS *RADIUSConfig `yaml:"radius"`
+
+	// MaxConnections caps the connections served by all listeners together
+	// (0: no cap), besides the max_connections of each entry.
+	MaxConnections int `yaml:"max_connections"`
+
+	// MaxOpenFiles is the open file limit (RLIMIT_NOFILE) to raise the
+	// process to (Linux; 0: its hard limit). Above the hard limit it needs
+	// CAP_SYS_RESOURCE.
+	MaxOpenFiles int `yaml:"max_open_files"`
+
+	// EgressLimit caps the data all relays send together, in both
+	// directions, e.g. "900mbit" (per second).
+	EgressLimit string  `yaml:"egress_limit"`
+	egressRate  float64 // bytes per second (0: no limit), set by validation
+
+	// Relay tunes how the data of unpaced connections is moved between
+	// their sockets (optional).
+	Relay *RelayConfig `yaml:"relay"`
+
+	// Defaults holds entry options (not addresses or ports) inherited by
+	// every proxy entry that does not set them itself.
+	Defaults *ProxyEntry `yaml:"defaults"`
+
+	// Vars are substituted for {{ .name }} in the string values of proxy
+	// entries, along with each entry's {{ .i }} and {{ .port }}.
+	Vars map[string]string `yaml:"vars"`
+
+	// Include names more config files (glob patterns, relative to this
+	// file) whose proxies and hosts are merged into this configuration.
+	Include stringList `yaml:"include"`
+
+	secretRefs map[string]string // resolved secret value → its reference
 }
 
-// LoadConfig reads and validates the YAML configuration file.
-func LoadConfig(path string) (*Config, error) {
+// readConfigFile reads, expands and decodes one config file without
+// validating it.
+func readConfigFile(path, format string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read config: %w", err)
 	}
+	return parseConfigData(path, format, data)
+}
+
+// parseConfigData expands and decodes the contents of the config file at
+// path (a file name or URL, used for format detection and errors).
+func parseConfigData(path, format string, data []byte) (*Config, error) {
+	format, err := configFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = expandEnv(data); err != nil {
+		return nil, err
+	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parse config: %w", err)
+	if err := decodeConfig(data, format, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// loadOptions control how LoadConfig reads the configuration. Format is
+// yaml, json or toml; if empty it is detected from the file extension. The
+// other fields, when set, override the config field of the same name, so
+// one file can serve several environments (command-line flags).
+type loadOptions struct {
+	Format     string
+	Interface  string
+	ListenHost string
+	LogLevel   string
+	LogFormat  string
+	Remote     remoteOptions // for http(s):// config URLs
+}
+
+// LoadConfig reads and validates the configuration file. path may be an
+// http(s) URL, fetched anew on every load.
+func LoadConfig(path string, opts loadOptions) (*Config, error) {
+	var c *Config
+	var err error
+	if isRemoteConfig(path) {
+		var data []byte
+		if data, err = fetchConfig(path, opts.Remote); err == nil {
+			c, err = parseConfigData(path, opts.Format, data)
+		}
+	} else {
+		c, err = readConfigFile(path, opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := *c
+	if err := loadIncludes(&cfg, path); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(&cfg); err != nil {
+		return nil, err
+	}
+
+	if opts.Interface != "" {
+		cfg.Interface = opts.Interface
+	}
+	if opts.ListenHost != "" {
+		cfg.ListenHost = opts.ListenHost
+	}
+	if opts.LogLevel != "" {
+		cfg.LogLevel = opts.LogLevel
 	}
+	if opts.LogFormat != "" {
+		cfg.LogFormat = opts.LogFormat
+	}
+
+	if err := validateConfig(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
 
+// validateConfig validates cfg and fills in every default, expanding
+// templates, ranges and prefixes into one entry per listener.
+func validateConfig(cfg *Config) error {
 	if cfg.Interface == "" {
-		return nil, fmt.Errorf("config: 'interface' is required (e.g. eth0)")
+		return fmt.Errorf("config: 'interface' is required (e.g. eth0)")
+	}
+
+	if cfg.ListenHost != "" {
+		ip := net.ParseIP(cfg.ListenHost)
+		if ip == nil {
+			return fmt.Errorf("config: listen_host %q must be an IP address", cfg.ListenHost)
+		}
+		cfg.ListenHost = ip.String()
+	}
+
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("config: log_level: %w", err)
+	}
+	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+	if err := validLogFormat(cfg.LogFormat); err != nil {
+		return fmt.Errorf("config: log_format: %w", err)
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = logFormatText
+	}
+
+	if cfg.Resolver != nil {
+		if err := validateResolver(cfg.Resolver); err != nil {
+			return fmt.Errorf("config: resolver: %w", err)
+		}
+	}
+
+	if err := validateEgressLimit(cfg); err != nil {
+		return err
+	}
+	if cfg.Relay != nil {
+		if err := validateRelay(cfg.Relay); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxOpenFiles < 0 {
+		return fmt.Errorf("config: max_open_files %d must not be negative", cfg.MaxOpenFiles)
+	}
+	if cfg.MaxConnections < 0 {
+		return fmt.Errorf("config: max_connections %d must not be negative", cfg.MaxConnections)
+	}
+	if err := validateClientList("allow_clients", cfg.AllowClients); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if err := validateClientList("deny_clients", cfg.DenyClients); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	if len(cfg.Hosts) > 0 {
+		hosts, err := validateHosts(cfg.Hosts)
+		if err != nil {
+			return err
+		}
+		cfg.Hosts = hosts
+	}
+
+	if cfg.DNSCache != nil {
+		if err := validateDNSCache(cfg.DNSCache); err != nil {
+			return err
+		}
+	}
+
+	if cfg.FailCache != nil {
+		if err := validateFailCache(cfg.FailCache); err != nil {
+			return err
+		}
+	}
+
+	if cfg.HealthCheck != nil {
+		if err := validateHealthCheck(cfg.HealthCheck); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Tracing != nil {
+		if err := validateTracing(cfg.Tracing); err != nil {
+			return err
+		}
+	}
+
+	if cfg.IPFIX != nil {
+		if err := validateIPFIX(cfg.IPFIX); err != nil {
+			return err
+		}
+	}
+	if cfg.StatsD != nil {
+		if err := validateStatsD(cfg.StatsD); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Syslog != nil {
+		if err := validateSyslog(cfg.Syslog); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Loki != nil {
+		if err := validateLoki(cfg.Loki); err != nil {
+			return err
+		}
+	}
+	if cfg.Elastic != nil {
+		if err := validateElasticsearch(cfg.Elastic); err != nil {
+			return err
+		}
+	}
+	if cfg.GeoIP != nil {
+		if err := validateGeoIP(cfg.GeoIP); err != nil {
+			return err
+		}
+	}
+	if cfg.AutoBan != nil {
+		if err := validateAutoBan(cfg.AutoBan); err != nil {
+			return err
+		}
+	}
+	if cfg.SlowLog != nil {
+		if err := validateSlowLog(cfg.SlowLog); err != nil {
+			return err
+		}
+	}
+	if cfg.LogSampling != nil {
+		if err := validateLogSampling(cfg.LogSampling); err != nil {
+			return err
+		}
+	}
+	if cfg.LogRotation != nil {
+		if err := validateLogRotation(cfg.LogRotation); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DomainStats != nil {
+		if err := validateDomainStats(cfg.DomainStats); err != nil {
+			return err
+		}
+	}
+
+	if err := validateWebhooks(cfg.Webhooks); err != nil {
+		return err
+	}
+
+	if cfg.Admin != nil {
+		if err := validateAdmin(cfg.Admin); err != nil {
+			return err
+		}
+	}
+
+	if err := validateUpstreams(cfg.Upstreams); err != nil {
+		return err
 	}
 
 	if len(cfg.Proxies) == 0 {
-		return nil, fmt.Errorf("config: at least one proxy entry is required")
+		return fmt.Errorf("config: at least one proxy entry is required")
+	}
+
+	if cfg.Defaults != nil {
+		if err := applyDefaults(cfg.Proxies, cfg.Defaults); err != nil {
+			return err
+		}
+	}
+
+	if err := validateVars(cfg.Vars); err != nil {
+		return err
 	}
 
+	proxies, names, err := expandPorts(cfg.Proxies, cfg.Vars)
+	if err != nil {
+		return err
+	}
+	cfg.Proxies = proxies
+
 	seen := make(map[string]struct{}, len(cfg.Proxies))
 	seenPorts := make(map[int]struct{}, len(cfg.Proxies))
+	seenNames := make(map[string]struct{}, len(cfg.Proxies))
 
 	for i, p := range cfg.Proxies {
-		// Validate IPv6
-		ip := net.ParseIP(p.IPv6)
-		if ip == nil {
-			return nil, fmt.Errorf("config: proxies[%d]: invalid IP address %q", i, p.IPv6)
-		}
-		if ip.To4() != nil {
-			return nil, fmt.Errorf("config: proxies[%d]: %q is IPv4, only IPv6 is supported", i, p.IPv6)
-		}
+		// A single ipv6 is shorthand for a one-address pool
+		switch {
+		case p.IPv6 != "" && len(p.Outbound) > 0:
+			return fmt.Errorf("config: %s: 'ipv6' and 'outbound' are mutually exclusive", names[i])
+		case p.IPv6 == "" && len(p.Outbound) == 0:
+			return fmt.Errorf("config: %s: one of 'ipv6' or 'outbound' is required", names[i])
+		case p.IPv6 != "":
+			ip, err := parseEntryIPv6(p.IPv6)
+			if err != nil {
+				return fmt.Errorf("config: %s: %w", names[i], err)
+			}
+			cfg.Proxies[i].IPv6 = ip
 
-		// Normalize the IPv6 string
-		cfg.Proxies[i].IPv6 = ip.String()
+			// Check duplicate IPv6 (pools may share addresses, single entries may not)
+			if _, ok := seen[ip]; ok {
+				return fmt.Errorf("config: %s: duplicate IPv6 %q", names[i], p.IPv6)
+			}
+			seen[ip] = struct{}{}
+			cfg.Proxies[i].Outbound = []OutboundAddr{{IPv6: ip, Weight: 1}}
+		default:
+			if err := validatePool(p.Outbound); err != nil {
+				return fmt.Errorf("config: %s.%w", names[i], err)
+			}
+		}
 
 		// Validate port
 		if p.Port < 1 || p.Port > 65535 {
-			return nil, fmt.Errorf("config: proxies[%d]: port %d out of range (1-65535)", i, p.Port)
-		}
-
-		// Check duplicate IPv6
-		if _, ok := seen[cfg.Proxies[i].IPv6]; ok {
-			return nil, fmt.Errorf("config: proxies[%d]: duplicate IPv6 %q", i, p.IPv6)
+			return fmt.Errorf("config: %s: port %d out of range (1-65535)", names[i], p.Port)
 		}
-		seen[cfg.Proxies[i].IPv6] = struct{}{}
 
 		// Check duplicate port
 		if _, ok := seenPorts[p.Port]; ok {
-			return nil, fmt.Errorf("config: proxies[%d]: duplicate port %d", i, p.Port)
+			return fmt.Errorf("config: %s: duplicate port %d", names[i], p.Port)
 		}
 		seenPorts[p.Port] = struct{}{}
+
+		if p.Name != "" {
+			if !validEntryName(p.Name) {
+				return fmt.Errorf("config: %s: name %q may only contain letters, digits, '.', '_' and '-'", names[i], p.Name)
+			}
+			if _, ok := seenNames[p.Name]; ok {
+				return fmt.Errorf("config: %s: duplicate name %q", names[i], p.Name)
+			}
+			seenNames[p.Name] = struct{}{}
+		}
+		cfg.Proxies[i].listenHost = cfg.ListenHost
+
+		if p.Resolver != nil {
+			if err := validateResolver(p.Resolver); err != nil {
+				return fmt.Errorf("config: %s.resolver: %w", names[i], err)
+			}
+		} else {
+			cfg.Proxies[i].Resolver = cfg.Resolver
+		}
+
+		if p.Destinations != nil {
+			if err := validateDestinations(p.Destinations); err != nil {
+				return fmt.Errorf("config: %s.destinations: %w", names[i], err)
+			}
+		}
+		if err := validateRules(p.Rules, cfg.Upstreams); err != nil {
+			return fmt.Errorf("config: %s.%w", names[i], err)
+		}
+		if p.MaxConnections < 0 {
+			return fmt.Errorf("config: %s: max_connections %d must not be negative", names[i], p.MaxConnections)
+		}
+		if p.Congestion != "" && !validCongestion(p.Congestion) {
+			return fmt.Errorf("config: %s: invalid congestion control %q", names[i], p.Congestion)
+		}
+		if p.DSCP != "" {
+			v, err := parseDSCP(p.DSCP)
+			if err != nil {
+				return fmt.Errorf("config: %s: dscp: %w", names[i], err)
+			}
+			cfg.Proxies[i].dscp = v
+		}
+		if p.Timeouts != nil {
+			if err := validateTimeouts(p.Timeouts); err != nil {
+				return fmt.Errorf("config: %s.timeouts: %w", names[i], err)
+			}
+		}
+		if p.KeepAlive != nil {
+			if err := validateKeepAlive(p.KeepAlive); err != nil {
+				return fmt.Errorf("config: %s.keepalive: %w", names[i], err)
+			}
+		}
+		if p.FastOpen != nil {
+			if err := validateFastOpen(p.FastOpen); err != nil {
+				return fmt.Errorf("config: %s.fast_open: %w", names[i], err)
+			}
+		}
+		if p.Workers != nil {
+			if err := validateWorkers(p.Workers); err != nil {
+				return fmt.Errorf("config: %s.workers: %w", names[i], err)
+			}
+		}
+		if p.Accept != nil {
+			if err := validateAccept(p.Accept); err != nil {
+				return fmt.Errorf("config: %s.accept: %w", names[i], err)
+			}
+		}
+		if p.Buffer != nil {
+			if err := validateBuffer(p.Buffer); err != nil {
+				return fmt.Errorf("config: %s.%w", names[i], err)
+			}
+		}
+		cfg.Proxies[i].bufferSize, cfg.Proxies[i].bufferPool = resolveBuffer(p.Buffer, cfg.Relay)
+		if p.SocketBuffers != nil {
+			if err := validateSocketBuffers(p.SocketBuffers); err != nil {
+				return fmt.Errorf("config: %s.socket_buffers.%w", names[i], err)
+			}
+		}
+		switch {
+		case p.Acceptors < 0 || p.Acceptors > maxAcceptors:
+			return fmt.Errorf("config: %s: acceptors %d out of range (1-%d)", names[i], p.Acceptors, maxAcceptors)
+		case p.Acceptors == 0:
+			cfg.Proxies[i].Acceptors = 1
+		}
+		if p.Bandwidth != nil {
+			if err := validateBandwidth(p.Bandwidth); err != nil {
+				return fmt.Errorf("config: %s.bandwidth: %w", names[i], err)
+			}
+		}
+		if p.RateLimit != nil {
+			if err := validateRateLimit(p.RateLimit); err != nil {
+				return fmt.Errorf("config: %s.rate_limit: %w", names[i], err)
+			}
+		}
+		if p.Quota != nil {
+			if err := validateQuota(p.Quota); err != nil {
+				return fmt.Errorf("config: %s.quota: %w", names[i], err)
+			}
+		}
+		if p.Schedule != nil {
+			if err := validateSchedule(p.Schedule); err != nil {
+				return fmt.Errorf("config: %s.schedule: %w", names[i], err)
+			}
+		}
+		switch p.AuthBackend {
+		case "", authBackendUsers:
+		case authBackendLDAP:
+			if cfg.LDAP == nil {
+				return fmt.Errorf("config: %s: auth_backend ldap needs an ldap block", names[i])
+			}
+		case authBackendRADIUS:
+			if cfg.RADIUS == nil {
+				return fmt.Errorf("config: %s: auth_backend radius needs a radius block", names[i])
+			}
+		default:
+			return fmt.Errorf("config: %s: unknown auth_backend %q (expected %s, %s or %s)", names[i], p.AuthBackend, authBackendUsers, authBackendLDAP, authBackendRADIUS)
+		}
+		if p.AuthBackend != "" && !p.Auth {
+			return fmt.Errorf("config: %s: auth_backend needs auth: true", names[i])
+		}
+		if err := validateClientList("allow_clients", p.AllowClients); err != nil {
+			return fmt.Errorf("config: %s.%w", names[i], err)
+		}
+		if err := validateClientList("deny_clients", p.DenyClients); err != nil {
+			return fmt.Errorf("config: %s.%w", names[i], err)
+		}
+		if err := validateGeoRules(&cfg.Proxies[i], cfg.GeoIP); err != nil {
+			return fmt.Errorf("config: %s.%w", names[i], err)
+		}
+
+		if p.DialAttempts < 0 {
+			return fmt.Errorf("config: %s: dial_attempts %d must not be negative", names[i], p.DialAttempts)
+		}
+		if p.DialAttempts == 0 {
+			cfg.Proxies[i].DialAttempts = defaultDialAttempts
+		}
+
+		switch p.Resolve {
+		case "":
+			cfg.Proxies[i].Resolve = resolveIPv6Only
+		case resolveIPv6Only, resolveIPv4Only, resolvePreferIPv6:
+		default:
+			return fmt.Errorf("config: %s: unknown resolve policy %q (expected ipv6-only, ipv4-only or prefer-ipv6)", names[i], p.Resolve)
+		}
 	}
 
-	return &cfg, nil
+	if cfg.AuthHTTP != nil {
+		if err := validateAuthHTTP(cfg.AuthHTTP); err != nil {
+			return err
+		}
+	}
+	if cfg.LDAP != nil {
+		if err := validateLDAP(cfg.LDAP); err != nil {
+			return err
+		}
+	}
+	if cfg.RADIUS != nil {
+		if err := validateRADIUS(cfg.RADIUS); err != nil {
+			return err
+		}
+	}
+	return validateUsers(cfg)
+}
+
+// validatePool normalizes the addresses of a weighted outbound pool in
+// place and gives them the default weight.
+func validatePool(pool []OutboundAddr) error {
+	inPool := make(map[string]struct{}, len(pool))
+	for j, a := range pool {
+		ip, err := parseEntryIPv6(a.IPv6)
+		if err != nil {
+			return fmt.Errorf("outbound[%d]: %w", j, err)
+		}
+		if a.Weight < 0 {
+			return fmt.Errorf("outbound[%d]: weight %d must not be negative", j, a.Weight)
+		}
+		if a.Weight == 0 {
+			pool[j].Weight = 1
+		}
+		if _, ok := inPool[ip]; ok {
+			return fmt.Errorf("outbound[%d]: duplicate IPv6 %q in pool", j, a.IPv6)
+		}
+		inPool[ip] = struct{}{}
+		pool[j].IPv6 = ip
+	}
+	return nil
+}
+
+// tag identifies the entry in logs: its port, and its name if set
+// ("10001/customer-acme-1").
+func (e ProxyEntry) tag() string {
+	if e.Name != "" {
+		return fmt.Sprintf("%d/%s", e.Port, e.Name)
+	}
+	return strconv.Itoa(e.Port)
+}
+
+// validEntryName reports whether name is usable as a label: letters,
+// digits, '.', '_' and '-'.
+func validEntryName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// parseEntryIPv6 validates a configured outbound address and returns its
+// normalized string form.
+func parseEntryIPv6(s string) (string, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip.To4() != nil {
+		return "", fmt.Errorf("%q is IPv4, only IPv6 is supported", s)
+	}
+	return ip.String(), nil
 }
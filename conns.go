@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// liveConn is a relayed connection in the connection table. Addresses are
+// kept as handed out by the net package and only formatted when listed.
+type liveConn struct {
+	id       uint64
+	port     int
+	name     string
+	user     string   // logged in as ("": no auth)
+	conn     net.Conn // client side
+	remote   net.Conn
+	host     string // target as requested
+	dport    uint16
+	outbound net.Addr
+	started  time.Time
+}
+
+// close shuts both sides of c down and closes them, which ends its relay.
+// Shutting down first also ends the io_uring operations pending on the
+// duplicates of their descriptors the ring relays through.
+func (c *liveConn) close() {
+	for _, nc := range []net.Conn{c.conn, c.remote} {
+		if tc, ok := nc.(*net.TCPConn); ok {
+			tc.CloseRead()
+			tc.CloseWrite()
+		}
+		nc.Close()
+	}
+}
+
+// connTable tracks the connections being relayed on every port.
+type connTable struct {
+	mu    sync.Mutex
+	next  uint64
+	conns map[uint64]*liveConn
+}
+
+// activeConns is the table of the running daemon.
+var activeConns connTable
+
+// add registers c and returns its id.
+func (t *connTable) add(c *liveConn) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[uint64]*liveConn)
+	}
+	t.next++
+	c.id = t.next
+	t.conns[c.id] = c
+	return c.id
+}
+
+func (t *connTable) remove(id uint64) {
+	t.mu.Lock()
+	delete(t.conns, id)
+	t.mu.Unlock()
+}
+
+// kill closes both sides of connection id, which ends its relay, and
+// reports whether it was found.
+func (t *connTable) kill(id uint64) (connInfo, bool) {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return connInfo{}, false
+	}
+	info := c.info(time.Now())
+	c.close()
+	return info, true
+}
+
+// killClients closes the connections of clients inside prefix and returns
+// how many there were.
+func (t *connTable) killClients(prefix netip.Prefix) int {
+	t.mu.Lock()
+	var conns []*liveConn
+	for _, c := range t.conns {
+		if ta, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok && prefix.Contains(ta.AddrPort().Addr().Unmap()) {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	return len(conns)
+}
+
+// killPort closes the connections of port and returns how many there were.
+func (t *connTable) killPort(port int) int {
+	t.mu.Lock()
+	var conns []*liveConn
+	for _, c := range t.conns {
+		if c.port == port {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	return len(conns)
+}
+
+// killUser closes the connections of the user name and returns how many
+// there were.
+func (t *connTable) killUser(name string) int {
+	t.mu.Lock()
+	var conns []*liveConn
+	for _, c := range t.conns {
+		if c.user == name {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	return len(conns)
+}
+
+// connInfo is the listed form of a live connection. Bytes are counted by
+// the kernel on the client socket, including the SOCKS5 handshake, and are
+// only available on Linux.
+type connInfo struct {
+	ID        uint64    `json:"id"`
+	Port      int       `json:"port"`
+	Name      string    `json:"name,omitempty"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target"`
+	Outbound  string    `json:"outbound"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Started   time.Time `json:"started"`
+	Age       string    `json:"age"`
+}
+
+func (c *liveConn) info(now time.Time) connInfo {
+	up, down, _ := connBytes(c.conn)
+	return connInfo{
+		ID:        c.id,
+		Port:      c.port,
+		Name:      c.name,
+		Client:    c.conn.RemoteAddr().String(),
+		User:      c.user,
+		Target:    net.JoinHostPort(c.host, strconv.Itoa(int(c.dport))),
+		Outbound:  c.outbound.String(),
+		BytesUp:   up,
+		BytesDown: down,
+		Started:   c.started,
+		Age:       now.Sub(c.started).Round(time.Second).String(),
+	}
+}
+
+// snapshot returns copies of the live connections, in no order.
+func (t *connTable) snapshot() []liveConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]liveConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, *c)
+	}
+	return conns
+}
+
+// list returns the connections on port (0: all), oldest first.
+func (t *connTable) list(port int) []connInfo {
+	t.mu.Lock()
+	conns := make([]liveConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		if port == 0 || c.port == port {
+			conns = append(conns, *c)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	now := time.Now()
+	out := make([]connInfo, len(conns))
+	for i := range conns {
+		out[i] = conns[i].info(now)
+	}
+	return out
+}
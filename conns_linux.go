@@ -0,0 +1,51 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// connBytes returns the bytes received from and acknowledged by the peer of
+// conn so far, as counted by the kernel (TCP_INFO), so live connections
+// report their traffic without leaving the splice(2) relay.
+func connBytes(conn net.Conn) (in, out int64, ok bool) {
+	info := tcpInfo(conn)
+	if info == nil {
+		return 0, 0, false
+	}
+	return int64(info.Bytes_received), int64(info.Bytes_acked), true
+}
+
+// connIdle returns how long ago data was last sent to and received from
+// the peer of conn, as recorded by the kernel (TCP_INFO).
+func connIdle(conn net.Conn) (sent, received time.Duration, ok bool) {
+	info := tcpInfo(conn)
+	if info == nil {
+		return 0, 0, false
+	}
+	return time.Duration(info.Last_data_sent) * time.Millisecond, time.Duration(info.Last_data_recv) * time.Millisecond, true
+}
+
+// tcpInfo returns the TCP_INFO of conn, or nil if it has none.
+func tcpInfo(conn net.Conn) *unix.TCPInfo {
+	tc, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		return nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info *unix.TCPInfo
+	raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return nil
+	}
+	return info
+}
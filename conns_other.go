@@ -0,0 +1,20 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// connBytes is not available on non-Linux platforms: live connections
+// report their bytes only when they close.
+func connBytes(conn net.Conn) (in, out int64, ok bool) {
+	return 0, 0, false
+}
+
+// connIdle is not available on non-Linux platforms: relays are not checked
+// for stalls.
+func connIdle(conn net.Conn) (sent, received time.Duration, ok bool) {
+	return 0, 0, false
+}
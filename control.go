@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// controller serializes changes to the running configuration: reloads from
+// the config source, rollbacks and edits through the admin API.
+type controller struct {
+	mu    sync.Mutex
+	srv   *server
+	admin *adminServer
+	grpc  *grpcAdmin
+	stats *statsdSink
+	sec   adminSecurity
+	path  string // config source
+	opts  loadOptions
+	state stateOptions
+
+	// source is the config last loaded from the source, without the API
+	// changes that admin.persist records against it.
+	source *Config
+
+	started time.Time // process start, for status
+}
+
+// Every change is made on behalf of an actor, recorded in the audit log:
+// "signal", "watch", "control socket" or the authenticated API client.
+
+// reload re-reads the config source and applies it, with the recorded API
+// changes if admin.persist is set. An invalid config leaves the running
+// configuration in place.
+func (c *controller) reload(by, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logInfo("[reload] %s, reloading %s", reason, c.path)
+	run, src, err := loadSource(c.path, c.opts, c.state.Dir)
+	return c.applyLoaded(by, "reload", run, src, err)
+}
+
+// discardChanges reloads the config source without the API changes and
+// forgets those recorded by admin.persist. Bans are kept.
+func (c *controller) discardChanges(by, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logInfo("[reload] %s, discarding API changes and reloading %s", reason, c.path)
+	cfg, err := LoadConfig(c.path, c.opts)
+	if err := c.applyLoaded(by, "reload.discard", cfg, cfg, err); err != nil {
+		return err
+	}
+	c.persist()
+	return nil
+}
+
+// rollback applies the version staged by ctl rollback. Like any reload it
+// lasts until the next one: fix the config before sending SIGHUP again.
+func (c *controller) rollback() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Dir == "" {
+		logWarn("[reload] SIGUSR2 received, but rollback requires -state-dir")
+		return
+	}
+	path := filepath.Join(c.state.Dir, rollbackFile)
+	if _, err := os.Stat(path); err != nil {
+		logWarn("[reload] SIGUSR2 received, but no rollback is staged: %v", err)
+		return
+	}
+	defer os.Remove(path)
+	logInfo("[reload] rollback requested, reloading %s", path)
+	cfg, err := LoadConfig(path, loadOptions{})
+	if c.applyLoaded("signal", "rollback", cfg, nil, err) == nil {
+		logWarn("[reload] rolled back; the next reload reads the config source again")
+	}
+}
+
+// applyLoaded applies cfg unless loading it failed with err, and then
+// remembers src (if not nil) as the config source; c.mu is held.
+func (c *controller) applyLoaded(by, action string, cfg, src *Config, err error) error {
+	before := c.srv.config()
+	if err == nil {
+		err = c.apply(cfg)
+	}
+	if err != nil {
+		auditLog.record(auditEntry{Actor: by, Action: action, Error: err.Error()})
+		logError("[reload] %v; keeping running configuration", err)
+		return err
+	}
+	auditLog.record(auditEntry{Actor: by, Action: action, Changes: diffConfigs(before, cfg)})
+	if src != nil {
+		c.source = src
+	}
+	logInfo("[reload] now running %d proxy entries", len(cfg.Proxies))
+	return nil
+}
+
+// edit applies a change to the running configuration, made by fn on a
+// copy of it, after validating the result. New entries inherit defaults and
+// vars like those of the config source. The change lasts until the next
+// reload from the source, unless admin.persist records it. The attempt is
+// audited as action on target.
+func (c *controller) edit(by, action, target string, fn func(cfg *Config) error) (*Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	running := c.srv.config()
+	next, err := c.editLocked(running, fn)
+	if err != nil {
+		auditLog.record(auditEntry{Actor: by, Action: action, Target: target, Error: err.Error()})
+		return nil, err
+	}
+	auditLog.record(auditEntry{Actor: by, Action: action, Target: target, Changes: diffConfigs(running, next)})
+	c.persist()
+	return next, nil
+}
+
+func (c *controller) editLocked(running *Config, fn func(cfg *Config) error) (*Config, error) {
+	next := effectiveConfig(running)
+	next.Defaults, next.Vars = running.Defaults, running.Vars
+	if err := fn(next); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(next); err != nil {
+		return nil, err
+	}
+	if err := c.apply(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// bansChanged records the bans after a ban or unban.
+func (c *controller) bansChanged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.persist()
+}
+
+// persist records how the running listeners differ from the config source,
+// and the bans, in the state directory if admin.persist is set; c.mu is
+// held.
+func (c *controller) persist() {
+	running := c.srv.config()
+	if c.state.Dir == "" || !persistEnabled(running) {
+		return
+	}
+	d := &dynamicState{Bans: savedBans()}
+	d.Proxies, d.Removed = listenerChanges(c.source, running)
+	if err := saveDynamic(c.state.Dir, d, running.secretRefs); err != nil {
+		logWarn("[admin] recording API changes in %s: %v", c.state.Dir, err)
+	}
+}
+
+// addEntry adds entry to the running configuration and returns the entries
+// it expanded to (several for ports or prefix).
+func (c *controller) addEntry(by string, entry ProxyEntry) ([]ProxyEntry, error) {
+	var before int
+	cfg, err := c.edit(by, "listener.add", "", func(cfg *Config) error {
+		before = len(cfg.Proxies)
+		cfg.Proxies = append(cfg.Proxies, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Proxies[before:], nil
+}
+
+// replaceEntry replaces the entry of port.
+func (c *controller) replaceEntry(by string, port int, entry ProxyEntry) error {
+	if entry.Port != 0 && entry.Port != port {
+		return fmt.Errorf("port %d of the entry does not match %d", entry.Port, port)
+	}
+	if entry.Ports != "" || entry.Prefix != "" {
+		return errors.New("'ports' and 'prefix' cannot replace a single listener; add them instead")
+	}
+	entry.Port = port
+	_, err := c.edit(by, "listener.replace", strconv.Itoa(port), func(cfg *Config) error {
+		i := entryIndex(cfg.Proxies, port)
+		if i < 0 {
+			return errNoListener
+		}
+		cfg.Proxies[i] = entry
+		return nil
+	})
+	return err
+}
+
+// setPaused pauses or resumes the listener on port.
+func (c *controller) setPaused(by string, port int, paused bool) error {
+	action := "listener.resume"
+	if paused {
+		action = "listener.pause"
+	}
+	_, err := c.edit(by, action, strconv.Itoa(port), func(cfg *Config) error {
+		i := entryIndex(cfg.Proxies, port)
+		if i < 0 {
+			return errNoListener
+		}
+		cfg.Proxies[i].Paused = paused
+		return nil
+	})
+	return err
+}
+
+// removeEntry removes the entry of port; the listener's active connections
+// finish undisturbed.
+func (c *controller) removeEntry(by string, port int) error {
+	_, err := c.edit(by, "listener.remove", strconv.Itoa(port), func(cfg *Config) error {
+		i := entryIndex(cfg.Proxies, port)
+		if i < 0 {
+			return errNoListener
+		}
+		cfg.Proxies = append(cfg.Proxies[:i], cfg.Proxies[i+1:]...)
+		return nil
+	})
+	return err
+}
+
+func entryIndex(entries []ProxyEntry, port int) int {
+	for i, e := range entries {
+		if e.Port == port {
+			return i
+		}
+	}
+	return -1
+}
+
+// errNoListener is returned by edits naming a port that is not configured.
+var errNoListener = errors.New("no listener on this port")
+
+// apply makes the validated cfg the running configuration; c.mu is held.
+func (c *controller) apply(cfg *Config) error {
+	if runtime.GOOS == "linux" {
+		if err := EnsureIPv6Addresses(cfg.Interface, outboundEntries(cfg)); err != nil {
+			return fmt.Errorf("failed to ensure IPv6 addresses: %w", err)
+		}
+	}
+	if err := c.srv.apply(cfg); err != nil {
+		return err
+	}
+	setLogLevel(cfg.LogLevel)
+	setLogFormat(cfg.LogFormat)
+	setLogRotation(cfg.LogRotation)
+	logSampling.update(cfg.LogSampling)
+	setSlowLog(cfg.SlowLog)
+	autoBan.update(cfg.AutoBan)
+	passwordFile.update(cfg.UsersFile)
+	authHTTP.update(cfg.AuthHTTP)
+	ldapAuth.update(cfg.LDAP)
+	radiusAuth.update(cfg.RADIUS)
+	if err := syslogOut.update(cfg.Syslog); err != nil {
+		logError("[syslog] %v; keeping the previous syslog output", err)
+	}
+	updateLoki(cfg.Loki)
+	updateElasticsearch(cfg.Elastic)
+	if err := c.sec.update(cfg.Admin); err != nil {
+		logError("[admin] %v; keeping the previous credentials and certificates", err)
+	}
+	if err := auditLog.setPath(auditPath(cfg.Admin)); err != nil {
+		logError("[audit] %v; keeping the previous audit log", err)
+	}
+	webhooks.update(cfg.Webhooks)
+	if err := c.admin.update(cfg.Admin, c); err != nil {
+		logError("[admin] %v; keeping the previous admin listener", err)
+	}
+	if err := c.grpc.update(cfg.Admin, c); err != nil {
+		logError("[admin] %v; keeping the previous gRPC listener", err)
+	}
+	if err := c.stats.update(cfg.StatsD, c.srv); err != nil {
+		logError("[statsd] %v; keeping the previous settings", err)
+	}
+	if err := flowExport.update(cfg.IPFIX); err != nil {
+		logError("[ipfix] %v; keeping the previous settings", err)
+	}
+	recordRunning(c.state, cfg)
+	return nil
+}
+
+// recordRunning saves cfg to the state directory, if one is configured.
+func recordRunning(state stateOptions, cfg *Config) {
+	if state.Dir == "" {
+		return
+	}
+	if err := saveRunningConfig(state.Dir, state.History, cfg); err != nil {
+		logWarn("[main] recording running configuration in %s: %v", state.Dir, err)
+	}
+}
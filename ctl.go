@@ -0,0 +1,591 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCtl implements `superproxy ctl <command>`, which operates on a running
+// daemon through its state directory: its control socket, history and pid
+// file.
+func runCtl(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	stateDir := fs.String("state-dir", defaultStateDir, "state directory of the daemon (-state-dir)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: superproxy ctl [-state-dir dir] <command>")
+		fmt.Fprintln(fs.Output(), "commands:")
+		fmt.Fprintln(fs.Output(), "  status                daemon status")
+		fmt.Fprintln(fs.Output(), "  reload [-discard]     reload the configuration, like SIGHUP (-discard: drop API changes)")
+		fmt.Fprintln(fs.Output(), "  stats                 connection and byte counters per listener")
+		fmt.Fprintln(fs.Output(), "  domains [-n N] [-by order]")
+		fmt.Fprintln(fs.Output(), "                        top destination domains by bytes (or bytes_up, bytes_down, connections) (domain_stats)")
+		fmt.Fprintln(fs.Output(), "  errors                connect errors by class per listener and outbound address")
+		fmt.Fprintln(fs.Output(), "  latency [port]        handshake, DNS, dial and session time percentiles per listener")
+		fmt.Fprintln(fs.Output(), "  users                 connection and byte counters per user")
+		fmt.Fprintln(fs.Output(), "  connections [port]    connections being relayed")
+		fmt.Fprintln(fs.Output(), "  events [port]         follow connections as they open, close and fail")
+		fmt.Fprintln(fs.Output(), "  kill <id>...          close connections (ids from connections)")
+		fmt.Fprintln(fs.Output(), "  pause <port>...       close new connections to listeners, keeping them open")
+		fmt.Fprintln(fs.Output(), "  resume <port>...      accept connections on paused listeners again")
+		fmt.Fprintln(fs.Output(), "  rotate                reopen the -log-file, audit log and access logs (after logrotate moved them)")
+		fmt.Fprintln(fs.Output(), "  log-level [-ttl d] [level|reset]")
+		fmt.Fprintln(fs.Output(), "                        show or set the log level at runtime (reset: back to log_level)")
+		fmt.Fprintln(fs.Output(), "  ban [-ttl d] [-reason text] <ip|cidr>...")
+		fmt.Fprintln(fs.Output(), "                        refuse clients on every listener and close their connections")
+		fmt.Fprintln(fs.Output(), "  unban <ip|cidr>...    lift bans")
+		fmt.Fprintln(fs.Output(), "  bans                  bans in effect")
+		fmt.Fprintln(fs.Output(), "  dump                  write goroutine and heap dumps to the state directory (admin.debug)")
+		fmt.Fprintln(fs.Output(), "  history               applied configuration versions")
+		fmt.Fprintln(fs.Output(), "  show <version>        print a version")
+		fmt.Fprintln(fs.Output(), "  rollback [version]    apply a version (default: the previous one)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+
+	switch cmd {
+	case "status", "reload", "stats", "errors", "domains", "latency", "users", "connections", "events", "kill", "pause", "resume", "rotate", "log-level", "ban", "unban", "bans", "dump":
+		return ctlSocketCommand(newCtlClient(*stateDir), cmd, rest, w)
+
+	case "history":
+		versions, err := listVersions(*stateDir)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("no versions recorded in %s", *stateDir)
+		}
+		for i, v := range versions {
+			mark := ""
+			if i == len(versions)-1 {
+				mark = "  (running)"
+			}
+			fmt.Fprintf(w, "%6d  %s%s\n", v.Number, v.Recorded.Format("2006-01-02 15:04:05"), mark)
+		}
+		return nil
+
+	case "show":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: superproxy ctl show <version>")
+		}
+		v, err := ctlVersion(*stateDir, rest[0])
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(v.Path)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+
+	case "rollback":
+		if len(rest) > 1 {
+			return fmt.Errorf("usage: superproxy ctl rollback [version]")
+		}
+		arg := "0"
+		if len(rest) == 1 {
+			arg = rest[0]
+		}
+		v, err := ctlVersion(*stateDir, arg)
+		if err != nil {
+			return err
+		}
+		pid, err := readPIDFile(*stateDir)
+		if err != nil {
+			return err
+		}
+		// Validate before staging: the daemon would keep running anyway,
+		// but the operator should learn about it here.
+		if _, err := LoadConfig(v.Path, loadOptions{}); err != nil {
+			return fmt.Errorf("version %d: %w", v.Number, err)
+		}
+		data, err := os.ReadFile(v.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(*stateDir, rollbackFile), data, 0o600); err != nil {
+			return err
+		}
+		if err := signalRollback(pid); err != nil {
+			return fmt.Errorf("signal daemon (pid %d): %w", pid, err)
+		}
+		fmt.Fprintf(w, "rollback to version %d requested (pid %d); see the daemon log for the result\n", v.Number, pid)
+		return nil
+	}
+	fs.Usage()
+	os.Exit(2)
+	return nil
+}
+
+// ctlVersion looks up the version named by arg ("0": the previous one).
+func ctlVersion(dir, arg string) (configVersion, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return configVersion{}, fmt.Errorf("invalid version %q", arg)
+	}
+	return findVersion(dir, n)
+}
+
+// ctlSocketCommand runs the ctl commands served by the daemon's control
+// socket.
+func ctlSocketCommand(c *ctlClient, cmd string, args []string, w io.Writer) error {
+	switch cmd {
+	case "status":
+		var st statusInfo
+		if err := c.call(http.MethodGet, "/api/v1/status", &st); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "pid:          %d\n", st.PID)
+		fmt.Fprintf(w, "config:       %s\n", st.Config)
+		fmt.Fprintf(w, "uptime:       %s (since %s)\n", st.Uptime, st.Started.Format("2006-01-02 15:04:05"))
+		if st.LogLevelConfig != "" {
+			fmt.Fprintf(w, "log level:    %s (set at runtime; log_level %s)\n", st.LogLevel, st.LogLevelConfig)
+		} else {
+			fmt.Fprintf(w, "log level:    %s\n", st.LogLevel)
+		}
+		fmt.Fprintf(w, "listeners:    %d\n", st.Listeners)
+		fmt.Fprintf(w, "connections:  %d active\n", st.ConnectionsActive)
+		relay := st.Relay
+		if st.PipeSize > 0 {
+			relay += " (pipes of " + formatBytes(st.PipeSize) + ")"
+		}
+		if st.SockmapRelays > 0 {
+			relay += fmt.Sprintf(" (%d connections in the kernel)", st.SockmapRelays)
+		}
+		if total := st.BytesSpliced + st.BytesBuffered; total > 0 {
+			relay += fmt.Sprintf(", %s spliced, %s buffered (%.1f%% spliced)", formatBytes(st.BytesSpliced), formatBytes(st.BytesBuffered), float64(st.BytesSpliced)*100/float64(total))
+		}
+		fmt.Fprintf(w, "relay:        %s\n", relay)
+		return nil
+
+	case "reload":
+		path := "/api/v1/reload"
+		switch {
+		case len(args) == 1 && args[0] == "-discard":
+			path += "?discard=true"
+		case len(args) > 0:
+			return fmt.Errorf("usage: superproxy ctl reload [-discard]")
+		}
+		var running []listenerInfo
+		if err := c.call(http.MethodPost, path, &running); err != nil {
+			return fmt.Errorf("reload failed, keeping running configuration: %w", err)
+		}
+		fmt.Fprintf(w, "reloaded; %d listeners running\n", len(running))
+		return nil
+
+	case "stats":
+		var ls []listenerInfo
+		if err := c.call(http.MethodGet, "/api/v1/listeners", &ls); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "PORT\tNAME\tSTATE\tTOTAL\tACTIVE\tERRORS\tUP\tDOWN\t")
+		for _, l := range ls {
+			st := l.Stats
+			state := "open"
+			switch {
+			case l.Paused:
+				state = "paused"
+			case st.Quota != nil && st.Quota.Exceeded:
+				state = "over quota"
+			case l.OffSchedule:
+				state = "off schedule"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t\n", l.Port, l.Name, state,
+				st.ConnectionsTotal, st.ConnectionsActive, st.ConnectErrors, formatBytes(st.BytesUp), formatBytes(st.BytesDown))
+		}
+		return tw.Flush()
+
+	case "domains":
+		dfs := flag.NewFlagSet("ctl domains", flag.ContinueOnError)
+		dfs.SetOutput(w)
+		n := dfs.Int("n", defaultDomainTop, "number of domains")
+		by := dfs.String("by", "bytes", "order: bytes, bytes_up, bytes_down or connections")
+		if err := dfs.Parse(args); err != nil {
+			return err
+		}
+		if dfs.NArg() > 0 {
+			return fmt.Errorf("usage: superproxy ctl domains [-n N] [-by order]")
+		}
+		var report domainReport
+		if err := c.call(http.MethodGet, fmt.Sprintf("/api/v1/domains?top=%d&by=%s", *n, url.QueryEscape(*by)), &report); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DOMAIN\tCONNECTIONS\tUP\tDOWN")
+		rows := append(report.Domains,
+			domainInfo{Domain: "(other domains)", Connections: report.Other.Connections, BytesUp: report.Other.BytesUp, BytesDown: report.Other.BytesDown},
+			domainInfo{Domain: "(IP, no name)", Connections: report.NoName.Connections, BytesUp: report.NoName.BytesUp, BytesDown: report.NoName.BytesDown})
+		for _, d := range rows {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", d.Domain, d.Connections, formatBytes(d.BytesUp), formatBytes(d.BytesDown))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d domains counted since %s\n", report.Tracked, report.Since.Local().Format("2006-01-02 15:04:05"))
+		return nil
+
+	case "errors":
+		var ls []listenerInfo
+		if err := c.call(http.MethodGet, "/api/v1/listeners", &ls); err != nil {
+			return err
+		}
+		var outs []outboundInfo
+		if err := c.call(http.MethodGet, "/api/v1/health", &outs); err != nil {
+			return err
+		}
+		header := strings.ToUpper(strings.Join(dialErrorClasses[:], "\t"))
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "PORT\tNAME\t"+header+"\t")
+		for _, l := range ls {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", l.Port, l.Name, classCounts(l.Stats.ConnectErrorsByClass))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "OUTBOUND\t"+header+"\t")
+		for _, o := range outs {
+			fmt.Fprintf(tw, "%s\t%s\n", o.Address, classCounts(o.ConnectErrors))
+		}
+		return tw.Flush()
+
+	case "users":
+		var users []userInfo
+		if err := c.call(http.MethodGet, "/api/v1/users", &users); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "NAME\tACTIVE\tTOTAL\tUP\tDOWN\tEGRESS\tQUOTA\t")
+		for _, u := range users {
+			quota := "-"
+			if q := u.Quota; q != nil {
+				quota = formatSize(q.Used) + " / " + formatSize(q.Limit) + " " + q.Period
+				if q.Exceeded {
+					quota += " (exceeded)"
+				}
+			}
+			egress := "-"
+			if u.EgressLimit != "" {
+				egress = u.EgressLimit
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n", u.Name, u.ConnectionsActive, u.ConnectionsTotal,
+				formatBytes(u.BytesUp), formatBytes(u.BytesDown), egress, quota)
+		}
+		return tw.Flush()
+
+	case "latency":
+		path := "/api/v1/listeners"
+		if len(args) > 1 {
+			return fmt.Errorf("usage: superproxy ctl latency [port]")
+		}
+		if len(args) == 1 {
+			if _, err := strconv.Atoi(args[0]); err != nil {
+				return fmt.Errorf("invalid port %q", args[0])
+			}
+			path += "/" + args[0]
+		}
+		var ls []listenerInfo
+		if len(args) == 1 {
+			var l listenerInfo
+			if err := c.call(http.MethodGet, path, &l); err != nil {
+				return err
+			}
+			ls = append(ls, l)
+		} else if err := c.call(http.MethodGet, path, &ls); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "PORT\tNAME\tPHASE\tCOUNT\tMEAN\tP50\tP90\tP99\t")
+		for _, l := range ls {
+			lat := l.Stats.Latency
+			for i, h := range []latencyInfo{lat.Handshake, lat.DNS, lat.Dial, lat.Session} {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t\n", l.Port, l.Name, latencyPhases[i], h.Count,
+					formatMillis(h.MeanMS), formatMillis(h.P50MS), formatMillis(h.P90MS), formatMillis(h.P99MS))
+			}
+		}
+		return tw.Flush()
+
+	case "connections":
+		path := "/api/v1/connections"
+		if len(args) > 1 {
+			return fmt.Errorf("usage: superproxy ctl connections [port]")
+		}
+		if len(args) == 1 {
+			if _, err := strconv.Atoi(args[0]); err != nil {
+				return fmt.Errorf("invalid port %q", args[0])
+			}
+			path += "?port=" + args[0]
+		}
+		var conns []connInfo
+		if err := c.call(http.MethodGet, path, &conns); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPORT\tCLIENT\tUSER\tTARGET\tOUTBOUND\tUP\tDOWN\tAGE")
+		for _, cn := range conns {
+			user := cn.User
+			if user == "" {
+				user = "-"
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", cn.ID, cn.Port, cn.Client, user, cn.Target, cn.Outbound,
+				formatBytes(cn.BytesUp), formatBytes(cn.BytesDown), cn.Age)
+		}
+		return tw.Flush()
+
+	case "events":
+		path := "/api/v1/events"
+		if len(args) > 1 {
+			return fmt.Errorf("usage: superproxy ctl events [port]")
+		}
+		if len(args) == 1 {
+			if _, err := strconv.Atoi(args[0]); err != nil {
+				return fmt.Errorf("invalid port %q", args[0])
+			}
+			path += "?port=" + args[0]
+		}
+		return c.stream(path, func(data []byte) error {
+			var ev eventInfo
+			if err := json.Unmarshal(data, &ev); err != nil {
+				return err
+			}
+			client := ev.Client
+			if ev.User != "" {
+				client += " (" + ev.User + ")"
+			}
+			line := fmt.Sprintf("%s  %-6s :%d  %s → %s", ev.Time.Local().Format("15:04:05.000"), ev.Type, ev.Port, client, ev.Target)
+			if ev.Outbound != "" {
+				line += " via " + ev.Outbound
+			}
+			switch ev.Type {
+			case eventClose:
+				line += fmt.Sprintf("  up %s down %s after %s", formatBytes(ev.BytesUp), formatBytes(ev.BytesDown),
+					(time.Duration(ev.DurationMS) * time.Millisecond).String())
+			case eventFailed:
+				line += ": " + ev.Error
+			}
+			_, err := fmt.Fprintln(w, line)
+			return err
+		})
+
+	case "kill":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: superproxy ctl kill <id>...")
+		}
+		for _, id := range args {
+			if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+				return fmt.Errorf("invalid connection id %q", id)
+			}
+		}
+		var failed int
+		for _, id := range args {
+			var cn connInfo
+			if err := c.call(http.MethodDelete, "/api/v1/connections/"+id, &cn); err != nil {
+				fmt.Fprintf(w, "%s: %v\n", id, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(w, "closed %d: %s → %s on :%d after %s\n", cn.ID, cn.Client, cn.Target, cn.Port, cn.Age)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d connections not closed", failed, len(args))
+		}
+		return nil
+
+	case "pause", "resume":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: superproxy ctl %s <port>...", cmd)
+		}
+		for _, port := range args {
+			if _, err := strconv.Atoi(port); err != nil {
+				return fmt.Errorf("invalid port %q", port)
+			}
+		}
+		for _, port := range args {
+			var l listenerInfo
+			if err := c.call(http.MethodPost, "/api/v1/listeners/"+port+"/"+cmd, &l); err != nil {
+				return fmt.Errorf("%s: %w", port, err)
+			}
+			fmt.Fprintf(w, "%s %s\n", cmd+"d", ProxyEntry{Name: l.Name, Port: l.Port}.tag())
+		}
+		return nil
+
+	case "rotate":
+		var resp struct {
+			LogFile    string   `json:"log_file"`
+			AuditLog   string   `json:"audit_log"`
+			AccessLogs []string `json:"access_logs"`
+		}
+		if err := c.call(http.MethodPost, "/api/v1/rotate", &resp); err != nil {
+			return err
+		}
+		for _, path := range append([]string{resp.LogFile, resp.AuditLog}, resp.AccessLogs...) {
+			if path != "" {
+				fmt.Fprintf(w, "reopened %s\n", path)
+			}
+		}
+		return nil
+
+	case "dump":
+		var info dumpInfo
+		if err := c.call(http.MethodPost, "/api/v1/debug/dump", &info); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d goroutines: %s\n", info.GoroutineCount, info.Goroutines)
+		fmt.Fprintf(w, "heap (%s in use): %s\n", formatBytes(int64(info.HeapInuse)), info.Heap)
+		return nil
+
+	case "log-level":
+		lfs := flag.NewFlagSet("ctl log-level", flag.ContinueOnError)
+		lfs.SetOutput(w)
+		ttl := lfs.Duration("ttl", 0, "go back to log_level after this long (default: until reset)")
+		if err := lfs.Parse(args); err != nil {
+			return err
+		}
+		var ll logLevelInfo
+		var err error
+		switch {
+		case lfs.NArg() > 1:
+			return fmt.Errorf("usage: superproxy ctl log-level [-ttl d] [debug|info|warn|error|reset]")
+		case lfs.NArg() == 0:
+			err = c.call(http.MethodGet, "/api/v1/log-level", &ll)
+		case lfs.Arg(0) == "reset":
+			err = c.call(http.MethodDelete, "/api/v1/log-level", &ll)
+		default:
+			if _, err := parseLogLevel(lfs.Arg(0)); err != nil {
+				return err
+			}
+			req := map[string]string{"level": lfs.Arg(0)}
+			if *ttl > 0 {
+				req["ttl"] = ttl.String()
+			}
+			err = c.send(http.MethodPut, "/api/v1/log-level", req, &ll)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case !ll.Override:
+			fmt.Fprintf(w, "log level %s (log_level)\n", ll.Level)
+		case ll.Until != nil:
+			fmt.Fprintf(w, "log level %s until %s, then log_level %s\n", ll.Level, ll.Until.Format("2006-01-02 15:04:05"), ll.Configured)
+		default:
+			fmt.Fprintf(w, "log level %s until reset (log_level %s)\n", ll.Level, ll.Configured)
+		}
+		return nil
+
+	case "ban":
+		bfs := flag.NewFlagSet("ctl ban", flag.ContinueOnError)
+		bfs.SetOutput(w)
+		ttl := bfs.Duration("ttl", 0, "lift the ban after this long (default: until unbanned)")
+		reason := bfs.String("reason", "", "note shown in bans and the log")
+		if err := bfs.Parse(args); err != nil {
+			return err
+		}
+		if bfs.NArg() == 0 {
+			return fmt.Errorf("usage: superproxy ctl ban [-ttl d] [-reason text] <ip|cidr>...")
+		}
+		for _, t := range bfs.Args() {
+			if _, err := parseBanTarget(t); err != nil {
+				return err
+			}
+		}
+		for _, t := range bfs.Args() {
+			req := map[string]string{"cidr": t, "reason": *reason}
+			if *ttl > 0 {
+				req["ttl"] = ttl.String()
+			}
+			var b banInfo
+			if err := c.send(http.MethodPost, "/api/v1/bans", req, &b); err != nil {
+				return fmt.Errorf("%s: %w", t, err)
+			}
+			until := "until unbanned"
+			if b.Expires != nil {
+				until = "until " + b.Expires.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "banned %s %s; %d connections closed\n", b.CIDR, until, *b.Closed)
+		}
+		return nil
+
+	case "unban":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: superproxy ctl unban <ip|cidr>...")
+		}
+		for _, t := range args {
+			prefix, err := parseBanTarget(t)
+			if err != nil {
+				return err
+			}
+			if err := c.call(http.MethodDelete, "/api/v1/bans/"+prefix.String(), nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "unbanned %s\n", prefix)
+		}
+		return nil
+
+	case "bans":
+		var bans []banInfo
+		if err := c.call(http.MethodGet, "/api/v1/bans", &bans); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "CIDR\tADDED\tREMAINING\tREASON")
+		for _, b := range bans {
+			remaining := "-"
+			if b.Remaining != "" {
+				remaining = b.Remaining
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", b.CIDR, b.Added.Format("2006-01-02 15:04:05"), remaining, b.Reason)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// formatBytes renders n in binary units (1.5 MiB).
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatMillis formats a latency in milliseconds like a duration, to 10µs.
+func formatMillis(ms float64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.Duration(ms * float64(time.Millisecond)).Round(10 * time.Microsecond).String()
+}
+
+// classCounts formats counts by error class as tab-terminated cells in
+// dialErrorClasses order.
+func classCounts(counts map[string]int64) string {
+	var b strings.Builder
+	for _, class := range dialErrorClasses {
+		fmt.Fprintf(&b, "%d\t", counts[class])
+	}
+	return b.String()
+}
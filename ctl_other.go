@@ -0,0 +1,11 @@
+// +build !unix
+
+package main
+
+import "errors"
+
+// signalRollback fails: the daemon learns of a staged version through
+// SIGUSR2, a Unix signal.
+func signalRollback(pid int) error {
+	return errors.New("rollback needs a Unix signal (SIGUSR2) to reach the daemon")
+}
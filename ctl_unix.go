@@ -0,0 +1,11 @@
+// +build unix
+
+package main
+
+import "syscall"
+
+// signalRollback tells the daemon pid to apply the version staged by ctl
+// rollback (SIGUSR2).
+func signalRollback(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// controlSocket is the unix socket in the state directory serving the admin
+// API to ctl, so local management needs no TCP port.
+const controlSocket = "control.sock"
+
+// ctlTimeout bounds one ctl request; a reload may have to fetch a remote
+// config.
+const ctlTimeout = remoteConfigTimeout + 10*time.Second
+
+// serveControlSocket serves the admin API on <dir>/control.sock, readable
+// by the daemon's user only, and returns the function that removes it.
+func serveControlSocket(dir string, c *controller) (func(), error) {
+	path := filepath.Join(dir, controlSocket)
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use: another daemon with this -state-dir?", path)
+	}
+	os.Remove(path) // stale, from a daemon that did not exit cleanly
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	srv := &http.Server{Handler: adminHandler(c, true), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	logInfo("[main] control socket %s", path)
+	return func() { srv.Close() }, nil
+}
+
+// ctlClient calls the admin API of the daemon through its control socket.
+type ctlClient struct {
+	path string
+	http *http.Client
+}
+
+func newCtlClient(dir string) *ctlClient {
+	path := filepath.Join(dir, controlSocket)
+	return &ctlClient{
+		path: path,
+		http: &http.Client{
+			Timeout: ctlTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// call sends a request to the API path and decodes the JSON response into
+// out (if not nil). API errors are returned with their message.
+func (c *ctlClient) call(method, path string, out any) error {
+	return c.send(method, path, nil, out)
+}
+
+// send is call with in (if not nil) sent as the JSON request body.
+func (c *ctlClient) send(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://superproxy"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			return fmt.Errorf("daemon not running with this -state-dir? %w", op)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return responseError(method, path, resp.Status, data)
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// responseError returns the message of an API error response.
+func responseError(method, path, status string, data []byte) error {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+		return errors.New(apiErr.Error)
+	}
+	return fmt.Errorf("%s %s: %s", method, path, status)
+}
+
+// stream reads the server-sent events of the API path, calling fn with
+// the data of each, until the daemon closes the stream or fn fails.
+func (c *ctlClient) stream(path string, fn func(data []byte) error) error {
+	hc := *c.http
+	hc.Timeout = 0 // the stream is open for as long as the command runs
+	resp, err := hc.Get("http://superproxy" + path)
+	if err != nil {
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			return fmt.Errorf("daemon not running with this -state-dir? %w", op)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return responseError(http.MethodGet, path, resp.Status, data)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+			if err := fn([]byte(data)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("daemon closed the event stream")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// dumpDir is the directory, inside -state-dir, of the dumps written by
+// ctl dump.
+const dumpDir = "dumps"
+
+// debugEnabled reports whether the running configuration sets admin.debug.
+func debugEnabled(c *controller) bool {
+	cfg := c.srv.config()
+	return cfg != nil && cfg.Admin != nil && cfg.Admin.Debug
+}
+
+// errDebugDisabled answers debug requests while admin.debug is off.
+var errDebugDisabled = errors.New("debug endpoints are disabled; set admin.debug")
+
+// debugHandler serves net/http/pprof on /debug/pprof/ while admin.debug is
+// set. It is mounted behind the API's authentication.
+func debugHandler(c *controller) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index) // also the named profiles: heap, goroutine, allocs, ...
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !debugEnabled(c) {
+			writeError(w, http.StatusNotFound, errDebugDisabled)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// dumpInfo is the API representation of the files written by a dump.
+type dumpInfo struct {
+	Goroutines     string `json:"goroutines"` // stack traces of all goroutines (text)
+	Heap           string `json:"heap"`       // heap profile (pprof, after a GC)
+	GoroutineCount int    `json:"goroutine_count"`
+	HeapInuse      uint64 `json:"heap_inuse_bytes"`
+}
+
+// writeDump writes the stacks of all goroutines and a heap profile to
+// <dir>/dumps, named by the current time, for later analysis with
+// go tool pprof.
+func writeDump(dir string) (dumpInfo, error) {
+	var info dumpInfo
+	out := filepath.Join(dir, dumpDir)
+	if err := os.MkdirAll(out, 0o700); err != nil {
+		return info, err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	info.Goroutines = filepath.Join(out, "goroutines-"+stamp+".txt")
+	info.Heap = filepath.Join(out, "heap-"+stamp+".pb.gz")
+	info.GoroutineCount = runtime.NumGoroutine()
+
+	if err := writeProfile(info.Goroutines, "goroutine", 2); err != nil {
+		return info, err
+	}
+	runtime.GC() // heap profiles show the state as of the last GC
+	if err := writeProfile(info.Heap, "heap", 0); err != nil {
+		return info, err
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	info.HeapInuse = ms.HeapInuse
+	return info, nil
+}
+
+func writeProfile(path, name string, debug int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := rpprof.Lookup(name).WriteTo(f, debug); err != nil {
+		f.Close()
+		return fmt.Errorf("%s profile: %w", name, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// entryOnlyFields are the ProxyEntry fields that identify a listener (its
+// addresses and ports) or set its state, and therefore cannot come from
+// defaults.
+var entryOnlyFields = map[string]bool{
+	"Name": true, "Paused": true, "IPv6": true, "Outbound": true, "Port": true,
+	"Ports": true, "IPv6Prefix": true, "IPv6List": true,
+	"Prefix": true, "Count": true, "StartPort": true,
+}
+
+// applyDefaults fills every option an entry leaves unset (zero) from the
+// defaults block. Options are inherited whole: an entry that sets
+// destinations replaces the default block rather than merging into it.
+// New ProxyEntry options are covered automatically.
+func applyDefaults(entries []ProxyEntry, defaults *ProxyEntry) error {
+	d := reflect.ValueOf(defaults).Elem()
+	t := d.Type()
+	for f := 0; f < t.NumField(); f++ {
+		field := t.Field(f)
+		if entryOnlyFields[field.Name] && !d.Field(f).IsZero() {
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			return fmt.Errorf("config: defaults: '%s' must be set per entry", name)
+		}
+	}
+
+	for i := range entries {
+		e := reflect.ValueOf(&entries[i]).Elem()
+		for f := 0; f < t.NumField(); f++ {
+			if !t.Field(f).IsExported() || entryOnlyFields[t.Field(f).Name] {
+				continue
+			}
+			if e.Field(f).IsZero() && !d.Field(f).IsZero() {
+				e.Field(f).Set(d.Field(f))
+			}
+		}
+	}
+	return nil
+}
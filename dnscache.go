@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS cache defaults, used when the corresponding field is omitted.
+const (
+	defaultDNSCacheSize   = 10000
+	defaultDNSMaxTTL      = time.Hour
+	defaultDNSNegativeTTL = 30 * time.Second
+)
+
+// dnsCache is an in-process cache of DNS responses shared by all listeners.
+// It works at the message level, between the Go resolver and the transport,
+// so it serves every resolver protocol alike. Entries live for the smallest
+// answer TTL clamped to [min_ttl, max_ttl]; NXDOMAIN and empty answers are
+// cached for the SOA negative TTL (RFC 2308), capped at negative_ttl.
+//
+// A nil *dnsCache caches nothing.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]dnsCacheEntry
+
+	size   int
+	minTTL time.Duration
+	maxTTL time.Duration
+	negTTL time.Duration
+}
+
+type dnsCacheKey struct {
+	resolver string // protocol and servers asked: listeners with other resolvers may get other answers
+	name     string // lowercased FQDN
+	qtype    dnsmessage.Type
+	qclass   dnsmessage.Class
+	ecs      string // raw ECS option data, if any: answers vary by client subnet
+}
+
+type dnsCacheEntry struct {
+	msg     []byte
+	expires time.Time
+}
+
+// newDNSCache returns a cache for cfg, or nil if cfg is nil (caching disabled).
+func newDNSCache(cfg *DNSCacheConfig) *dnsCache {
+	if cfg == nil {
+		return nil
+	}
+	return &dnsCache{
+		entries: make(map[dnsCacheKey]dnsCacheEntry),
+		size:    cfg.Size,
+		minTTL:  cfg.MinTTL,
+		maxTTL:  cfg.MaxTTL,
+		negTTL:  cfg.NegativeTTL,
+	}
+}
+
+// wrap returns an exchange that answers from the cache when possible and
+// otherwise calls next, storing cacheable responses. Responses are cached
+// for resolver, the identity of the resolver next asks, which they are
+// only served to.
+func (c *dnsCache) wrap(resolver string, next exchangeFunc) exchangeFunc {
+	if c == nil {
+		return next
+	}
+	return func(ctx context.Context, msg []byte) ([]byte, error) {
+		key, ok := cacheKey(msg)
+		if !ok {
+			return next(ctx, msg)
+		}
+		key.resolver = resolver
+		if resp := c.get(key, msg[0], msg[1]); resp != nil {
+			return resp, nil
+		}
+		resp, err := next(ctx, msg)
+		if err == nil {
+			c.put(key, resp)
+		}
+		return resp, err
+	}
+}
+
+// cacheKey extracts the key of a single-question query.
+func cacheKey(msg []byte) (dnsCacheKey, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return dnsCacheKey{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsCacheKey{}, false
+	}
+	if _, err := p.Question(); err != dnsmessage.ErrSectionDone {
+		return dnsCacheKey{}, false
+	}
+	key := dnsCacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, qclass: q.Class}
+
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsCacheKey{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return dnsCacheKey{}, false
+	}
+	for {
+		hdr, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsCacheKey{}, false
+		}
+		if hdr.Type != dnsmessage.TypeOPT {
+			if err := p.SkipAdditional(); err != nil {
+				return dnsCacheKey{}, false
+			}
+			continue
+		}
+		opt, err := p.OPTResource()
+		if err != nil {
+			return dnsCacheKey{}, false
+		}
+		for _, o := range opt.Options {
+			if o.Code == ednsOptionECS {
+				key.ecs = string(o.Data)
+			}
+		}
+	}
+	return key, true
+}
+
+// get returns a copy of the cached response with its ID rewritten to the
+// query's, or nil on a miss.
+func (c *dnsCache) get(key dnsCacheKey, id0, id1 byte) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !time.Now().Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	resp := make([]byte, len(e.msg))
+	copy(resp, e.msg)
+	resp[0], resp[1] = id0, id1
+	return resp
+}
+
+// put stores resp if it is cacheable: a complete NOERROR or NXDOMAIN answer.
+func (c *dnsCache) put(key dnsCacheKey, resp []byte) {
+	ttl, ok := c.ttl(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = dnsCacheEntry{msg: resp, expires: now.Add(ttl)}
+}
+
+// evict drops expired entries, then arbitrary ones until there is room for
+// one more. Map iteration order makes the latter effectively random.
+// Caller holds c.mu.
+func (c *dnsCache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
+
+// ttl computes how long resp may be cached.
+func (c *dnsCache) ttl(resp []byte) (time.Duration, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || h.Truncated {
+		return 0, false
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return 0, false // SERVFAIL, REFUSED, ...: retry next time
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return 0, false
+	}
+	if h.RCode == dnsmessage.RCodeSuccess && len(answers) > 0 {
+		minTTL := answers[0].Header.TTL
+		for _, rr := range answers[1:] {
+			if rr.Header.TTL < minTTL {
+				minTTL = rr.Header.TTL
+			}
+		}
+		return clampDuration(time.Duration(minTTL)*time.Second, c.minTTL, c.maxTTL), true
+	}
+
+	// Negative answer: TTL from the SOA in the authority section, if any.
+	neg := c.negTTL
+	for {
+		hdr, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if hdr.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				break
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			break
+		}
+		soaTTL := hdr.TTL
+		if soa.MinTTL < soaTTL {
+			soaTTL = soa.MinTTL
+		}
+		neg = clampDuration(time.Duration(soaTTL)*time.Second, c.minTTL, c.negTTL)
+		break
+	}
+	return neg, true
+}
+
+// clampDuration limits d to [lo, hi].
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	if d < lo {
+		d = lo
+	}
+	if d > hi {
+		d = hi
+	}
+	return d
+}
+
+// validateDNSCache applies defaults and validates the dns_cache block.
+func validateDNSCache(dc *DNSCacheConfig) error {
+	if dc.Size < 0 || dc.MinTTL < 0 || dc.MaxTTL < 0 || dc.NegativeTTL < 0 {
+		return fmt.Errorf("config: dns_cache: size and TTLs must not be negative")
+	}
+	if dc.Size == 0 {
+		dc.Size = defaultDNSCacheSize
+	}
+	if dc.MaxTTL == 0 {
+		dc.MaxTTL = defaultDNSMaxTTL
+	}
+	if dc.NegativeTTL == 0 {
+		dc.NegativeTTL = defaultDNSNegativeTTL
+	}
+	if dc.MinTTL > dc.MaxTTL {
+		return fmt.Errorf("config: dns_cache: min_ttl %s exceeds max_ttl %s", dc.MinTTL, dc.MaxTTL)
+	}
+	return nil
+}
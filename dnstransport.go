@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxDNSMessage is the largest DNS message (RFC 1035 TCP framing limit).
+const maxDNSMessage = 65535
+
+// exchangeFunc sends one DNS query message and returns the response message.
+type exchangeFunc func(ctx context.Context, msg []byte) ([]byte, error)
+
+// msgConn adapts a message-level exchange to the stream framing used by the
+// Go resolver. Each length-prefixed query written to the conn is passed to
+// exchange; the response is queued, again length-prefixed, for the
+// following Read. This lets every transport (and the cache) sit behind
+// net.Resolver.Dial regardless of how it moves bytes.
+type msgConn struct {
+	exchange exchangeFunc
+	deadline time.Time
+
+	wbuf bytes.Buffer // partial query being written
+	rbuf bytes.Buffer // framed responses waiting to be read
+}
+
+func newMsgConn(exchange exchangeFunc) *msgConn {
+	return &msgConn{exchange: exchange}
+}
+
+// Write buffers framed queries and performs one exchange per complete
+// message. The exchange runs synchronously; the Go resolver always writes a
+// full query before reading.
+func (c *msgConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()[:2]))
+		if c.wbuf.Len() < 2+n {
+			break
+		}
+		msg := make([]byte, n)
+		copy(msg, c.wbuf.Bytes()[2:2+n])
+		c.wbuf.Next(2 + n)
+
+		ctx := context.Background()
+		if !c.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+			defer cancel()
+		}
+		resp, err := c.exchange(ctx, msg)
+		if err != nil {
+			return 0, err
+		}
+		var hdr [2]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(resp)))
+		c.rbuf.Write(hdr[:])
+		c.rbuf.Write(resp)
+	}
+	return len(b), nil
+}
+
+func (c *msgConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *msgConn) Close() error                       { return nil }
+func (c *msgConn) LocalAddr() net.Addr                { return msgAddr{} }
+func (c *msgConn) RemoteAddr() net.Addr               { return msgAddr{} }
+func (c *msgConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *msgConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *msgConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+// msgAddr is the placeholder address of a msgConn.
+type msgAddr struct{}
+
+func (msgAddr) Network() string { return "dns" }
+func (msgAddr) String() string  { return "dns" }
+
+// exchangeDNS performs a plain DNS exchange over UDP, retrying over TCP if
+// the response is truncated (RFC 7766). Queries are sent from src if non-nil.
+func exchangeDNS(ctx context.Context, src net.IP, server string, msg []byte) ([]byte, error) {
+	var ud net.Dialer
+	if src != nil {
+		ud.LocalAddr = &net.UDPAddr{IP: src}
+	}
+	conn, err := ud.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that don't answer our query ID.
+		if n < 12 || buf[0] != msg[0] || buf[1] != msg[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 { // TC bit clear
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tcp, err := tcpDialer(src).DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	return exchangeStream(ctx, tcp, msg)
+}
+
+// exchangeDoT performs a DNS-over-TLS (RFC 7858) exchange, from src if non-nil.
+func exchangeDoT(ctx context.Context, src net.IP, cfg *tls.Config, server string, msg []byte) ([]byte, error) {
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(server)
+		cfg = cfg.Clone()
+		cfg.ServerName = host // verify against the IP SAN
+	}
+	td := tls.Dialer{NetDialer: tcpDialer(src), Config: cfg}
+	conn, err := td.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(ctx, conn, msg)
+}
+
+// tcpDialer returns a dialer bound to src, or an unbound one if src is nil.
+func tcpDialer(src net.IP) *net.Dialer {
+	d := &net.Dialer{}
+	if src != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	return d
+}
+
+// exchangeStream writes a length-prefixed query on conn and reads the
+// length-prefixed response.
+func exchangeStream(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, errors.New("short DNS response")
+	}
+	return resp, nil
+}
+
+// exchangeDoH POSTs one DNS message as "application/dns-message" (RFC 8484).
+func exchangeDoH(ctx context.Context, client *http.Client, url string, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh %s: HTTP %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDNSMessage {
+		return nil, fmt.Errorf("doh %s: response exceeds %d bytes", url, maxDNSMessage)
+	}
+	return body, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// globMeta are the characters that make a domain rule a pattern.
+const globMeta = "*?["
+
+// domainSet matches domains against a list of rules, compiled so a check
+// costs a few map lookups whatever the size of the list:
+//
+//	example.com     the name itself, looked up in names
+//	*.example.com   any subdomain, by looking up each parent in parents
+//	.example.com    the name and any subdomain (names and parents)
+//	ads*.example.*  a glob pattern, and
+//	/^ad[0-9]+\./   an RE2 regular expression, both merged into one
+//	                regexp that scans the name once
+type domainSet struct {
+	names   map[string]bool
+	parents map[string]bool
+	pattern *regexp.Regexp // the globs and regexps (nil: none)
+}
+
+// newDomainSet compiles validated, normalized rules.
+func newDomainSet(rules []string) domainSet {
+	var s domainSet
+	var patterns []string
+	add := func(m *map[string]bool, name string) {
+		if *m == nil {
+			*m = make(map[string]bool)
+		}
+		(*m)[name] = true
+	}
+	for _, d := range rules {
+		if re, ok := domainRegexp(d); ok {
+			patterns = append(patterns, "(?i:"+re+")")
+			continue
+		}
+		parent, sub := strings.CutPrefix(d, "*.")
+		suffix, dot := strings.CutPrefix(d, ".")
+		switch {
+		case sub && !strings.ContainsAny(parent, globMeta):
+			add(&s.parents, parent)
+		case dot && !strings.ContainsAny(suffix, globMeta):
+			add(&s.names, suffix)
+			add(&s.parents, suffix)
+		case !strings.ContainsAny(d, globMeta):
+			add(&s.names, d)
+		default:
+			patterns = append(patterns, "^"+globRegexp(d)+"$")
+		}
+	}
+	if len(patterns) > 0 {
+		s.pattern = regexp.MustCompile(strings.Join(patterns, "|"))
+	}
+	return s
+}
+
+func (s *domainSet) empty() bool {
+	return s.names == nil && s.parents == nil && s.pattern == nil
+}
+
+// match reports whether the normalized host matches a rule.
+func (s *domainSet) match(host string) bool {
+	if s.names[host] {
+		return true
+	}
+	if s.parents != nil {
+		for i := 0; i < len(host); i++ {
+			if host[i] == '.' && s.parents[host[i+1:]] {
+				return true
+			}
+		}
+	}
+	return s.pattern != nil && s.pattern.MatchString(host)
+}
+
+// domainRegexp returns the expression of a "/regexp/" rule. Like any RE2
+// expression, it matches anywhere in the name unless anchored with ^ or $.
+func domainRegexp(rule string) (string, bool) {
+	if len(rule) < 3 || rule[0] != '/' || rule[len(rule)-1] != '/' {
+		return "", false
+	}
+	return rule[1 : len(rule)-1], true
+}
+
+// globRegexp translates a validated path.Match pattern into a regexp; as
+// names hold no '/', '*' matches any run of characters.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			// A class, in which a '\\' makes the next character literal.
+			b.WriteByte('[')
+			k := i + 1
+			if k < len(glob) && glob[k] == '^' {
+				b.WriteByte('^')
+				k++
+			}
+			for ; k < len(glob) && glob[k] != ']'; k++ {
+				c := glob[k]
+				escaped := c == '\\' && k+1 < len(glob)
+				if escaped {
+					k++
+					c = glob[k]
+				}
+				switch {
+				case c == '[' || c == ']' || c == '\\' || escaped && !isAlnum(c):
+					b.WriteString(`\` + string(c))
+				default:
+					b.WriteByte(c)
+				}
+			}
+			b.WriteByte(']')
+			i = k
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// normalizeDomainRules validates the domain rules of the list name in
+// place: names and patterns lower-cased and without a trailing dot, and
+// "/regexp/" rules as they are.
+func normalizeDomainRules(name string, list []string) error {
+	for i, d := range list {
+		if re, ok := domainRegexp(d); ok {
+			if _, err := regexp.Compile(re); err != nil {
+				return fmt.Errorf("%s[%d]: invalid regexp %q: %w", name, i, d, err)
+			}
+			continue
+		}
+		d = normalizeHost(d)
+		if d == "" || d == "." || strings.Contains(d, "/") || strings.HasPrefix(d, "..") {
+			return fmt.Errorf("%s[%d]: invalid domain %q", name, i, list[i])
+		}
+		if _, err := path.Match(d, ""); err != nil {
+			return fmt.Errorf("%s[%d]: invalid pattern %q", name, i, list[i])
+		}
+		list[i] = d
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domain accounting defaults and limits.
+const (
+	defaultDomainStatsSize = 10000
+	defaultDomainTop       = 20
+	sniTimeout             = time.Second // for the client's first bytes after the SOCKS5 reply
+)
+
+// domainStats counts relayed connections and bytes by destination domain:
+// the name of domain (ATYP 3) requests, or for IP targets on the SNI ports
+// the server name of the TLS ClientHello. Only size domains are counted
+// by name; later ones are summed up as other.
+type domainStats struct {
+	size     int
+	sniPorts map[uint16]bool
+
+	mu      sync.Mutex
+	since   time.Time
+	domains map[string]*domainCount
+	other   domainCount // domains beyond size
+	noName  domainCount // IP targets without a server name
+}
+
+type domainCount struct {
+	conns, up, down int64
+}
+
+// newDomainStats returns the accounting for cfg, or nil if cfg is nil.
+func newDomainStats(cfg *DomainStatsConfig) *domainStats {
+	if cfg == nil {
+		return nil
+	}
+	d := &domainStats{size: cfg.Size, since: time.Now(), domains: make(map[string]*domainCount)}
+	if cfg.SNI {
+		d.sniPorts = make(map[uint16]bool, len(cfg.SNIPorts))
+		for _, p := range cfg.SNIPorts {
+			d.sniPorts[uint16(p)] = true
+		}
+	}
+	return d
+}
+
+// sniffs reports whether the server name of connections to host:port is to
+// be read from the TLS ClientHello. It is false on nil.
+func (d *domainStats) sniffs(host string, port uint16) bool {
+	return d != nil && d.sniPorts[port] && net.ParseIP(host) != nil
+}
+
+// add counts a relayed connection to domain ("" for an IP target without a
+// server name). It is a no-op on nil.
+func (d *domainStats) add(domain string, up, down int64) {
+	if d == nil {
+		return
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := &d.noName
+	if domain != "" {
+		var ok bool
+		if c, ok = d.domains[domain]; !ok {
+			c = &d.other
+			if len(d.domains) < d.size {
+				c = new(domainCount)
+				d.domains[domain] = c
+			}
+		}
+	}
+	c.conns++
+	c.up += up
+	c.down += down
+}
+
+// domainInfo is the API representation of the traffic to one domain.
+type domainInfo struct {
+	Domain      string `json:"domain,omitempty"`
+	Connections int64  `json:"connections"`
+	BytesUp     int64  `json:"bytes_up"`
+	BytesDown   int64  `json:"bytes_down"`
+}
+
+// domainReport is the API representation of the domain accounting.
+type domainReport struct {
+	Since   time.Time    `json:"since"`
+	Tracked int          `json:"tracked"` // domains counted by name
+	Domains []domainInfo `json:"domains"` // the top ones
+	Other   domainInfo   `json:"other"`   // domains beyond domain_stats.size
+	NoName  domainInfo   `json:"no_name"` // IP targets without a server name
+}
+
+// domainOrders are the orders of top, by the field they sort on.
+var domainOrders = map[string]func(a, b domainInfo) bool{
+	"bytes":       func(a, b domainInfo) bool { return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown },
+	"bytes_up":    func(a, b domainInfo) bool { return a.BytesUp > b.BytesUp },
+	"bytes_down":  func(a, b domainInfo) bool { return a.BytesDown > b.BytesDown },
+	"connections": func(a, b domainInfo) bool { return a.Connections > b.Connections },
+}
+
+// top returns the n busiest domains by the given order (see domainOrders).
+func (d *domainStats) top(n int, by string) (domainReport, error) {
+	less, ok := domainOrders[by]
+	if !ok {
+		return domainReport{}, fmt.Errorf("invalid order %q (bytes, bytes_up, bytes_down or connections)", by)
+	}
+	d.mu.Lock()
+	r := domainReport{
+		Since:   d.since,
+		Tracked: len(d.domains),
+		Domains: make([]domainInfo, 0, len(d.domains)),
+		Other:   d.other.info(""),
+		NoName:  d.noName.info(""),
+	}
+	for name, c := range d.domains {
+		r.Domains = append(r.Domains, c.info(name))
+	}
+	d.mu.Unlock()
+	sort.Slice(r.Domains, func(i, j int) bool {
+		a, b := r.Domains[i], r.Domains[j]
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return a.Domain < b.Domain
+	})
+	if len(r.Domains) > n {
+		r.Domains = r.Domains[:n]
+	}
+	return r, nil
+}
+
+func (c domainCount) info(name string) domainInfo {
+	return domainInfo{Domain: name, Connections: c.conns, BytesUp: c.up, BytesDown: c.down}
+}
+
+// errDomainStatsDisabled answers domain queries without domain_stats.
+var errDomainStatsDisabled = errors.New("domain accounting is disabled; set domain_stats")
+
+// readClientHello reads what the client sends first, up to a complete TLS
+// record or len(buf) bytes, waiting at most sniTimeout, and returns the
+// bytes read and the server name if they are a ClientHello with one. The
+// bytes must be passed on to the target.
+func readClientHello(client net.Conn, buf []byte) (int, string) {
+	client.SetReadDeadline(time.Now().Add(sniTimeout))
+	defer client.SetReadDeadline(time.Time{})
+	n := 0
+	for n < len(buf) {
+		m, err := client.Read(buf[n:])
+		n += m
+		if err != nil || (n > 0 && buf[0] != 0x16) || (n >= 5 && n >= 5+int(binary.BigEndian.Uint16(buf[3:5]))) {
+			break
+		}
+	}
+	return n, parseSNI(buf[:n])
+}
+
+// parseSNI returns the server name of the TLS ClientHello that data starts
+// with, or "" if it is not one or has none.
+func parseSNI(data []byte) string {
+	// Record header: type 22 (handshake), version, length
+	if len(data) < 5 || data[0] != 0x16 {
+		return ""
+	}
+	b := data[5:]
+	if l := int(binary.BigEndian.Uint16(data[3:5])); l < len(b) {
+		b = b[:l]
+	}
+	// Handshake header: type 1 (ClientHello), 24-bit length
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[4:]
+	// client_version, random
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+	// session_id, cipher_suites, compression_methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(b) < lenBytes {
+			return ""
+		}
+		l := int(b[0])
+		if lenBytes == 2 {
+			l = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < lenBytes+l {
+			return ""
+		}
+		b = b[lenBytes+l:]
+	}
+	// extensions
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return ""
+		}
+		ext := b[4 : 4+l]
+		b = b[4+l:]
+		if typ != 0 { // server_name
+			continue
+		}
+		// server_name_list length, then entries of type, length, name
+		if len(ext) < 2 {
+			return ""
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType, nl := ext[0], int(binary.BigEndian.Uint16(ext[1:]))
+			if len(ext) < 3+nl {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(ext[3 : 3+nl])
+			}
+			ext = ext[3+nl:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// validateDomainStats validates the domain_stats block and fills in its
+// defaults.
+func validateDomainStats(dc *DomainStatsConfig) error {
+	if dc.Size < 0 {
+		return fmt.Errorf("config: domain_stats: size must not be negative")
+	}
+	if dc.Size == 0 {
+		dc.Size = defaultDomainStatsSize
+	}
+	if dc.SNI && len(dc.SNIPorts) == 0 {
+		dc.SNIPorts = []int{443}
+	}
+	for _, p := range dc.SNIPorts {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("config: domain_stats: invalid sni_ports entry %d", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dynamicFile is the name, inside -state-dir, of the changes made through
+// the admin API that admin.persist keeps across reloads and restarts.
+const dynamicFile = "dynamic.yaml"
+
+// dynamicState is the content of dynamic.yaml: how the running listeners
+// differ from the config source, and the client bans.
+type dynamicState struct {
+	Proxies []ProxyEntry `yaml:"proxies"` // entries added or changed, one per listener
+	Removed []int        `yaml:"removed"` // ports of source entries removed
+	Bans    []savedBan   `yaml:"bans"`
+}
+
+// savedBan is a client ban as recorded in dynamic.yaml.
+type savedBan struct {
+	CIDR    string    `yaml:"cidr"`
+	Reason  string    `yaml:"reason"`
+	Added   time.Time `yaml:"added"`
+	Expires time.Time `yaml:"expires,omitempty"` // zero: until unbanned
+}
+
+// persistEnabled reports whether cfg asks for API changes to be kept.
+func persistEnabled(cfg *Config) bool {
+	return cfg.Admin != nil && cfg.Admin.Persist
+}
+
+// loadDynamic reads dynamic.yaml from dir; a missing file is an empty state.
+func loadDynamic(dir string) (*dynamicState, error) {
+	var d dynamicState
+	data, err := os.ReadFile(filepath.Join(dir, dynamicFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("%s: %w", dynamicFile, err)
+	}
+	return &d, nil
+}
+
+// saveDynamic replaces dynamic.yaml in dir atomically. Secrets are written
+// as the references they were resolved from, as in running.yaml.
+func saveDynamic(dir string, d *dynamicState, refs map[string]string) error {
+	var doc yaml.Node
+	if err := doc.Encode(d); err != nil {
+		return err
+	}
+	maskSecrets(&doc, refs)
+	pruneEmpty(&doc)
+	data, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	header := "# Changes made through the admin API, applied over the config source\n" +
+		"# (admin.persist). Edit only while the daemon is stopped.\n"
+	data = append([]byte(header), data...)
+
+	tmp, err := os.CreateTemp(dir, "."+dynamicFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, dynamicFile))
+}
+
+// loadSource loads the config source and, if it sets admin.persist, applies
+// the API changes recorded in dir over it. It returns the config to run
+// and the source config it was made from.
+func loadSource(path string, opts loadOptions, dir string) (run, src *Config, err error) {
+	src, err = LoadConfig(path, opts)
+	if err != nil || dir == "" || !persistEnabled(src) {
+		return src, src, err
+	}
+	d, err := loadDynamic(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("state: %w", err)
+	}
+	if run, err = withDynamic(src, d); err != nil {
+		return nil, nil, fmt.Errorf("state: %s (fix or remove it): %w", filepath.Join(dir, dynamicFile), err)
+	}
+	if len(d.Proxies)+len(d.Removed) > 0 {
+		logInfo("[admin] applying %d changed and %d removed listeners recorded in %s", len(d.Proxies), len(d.Removed), dynamicFile)
+	}
+	return run, src, nil
+}
+
+// withDynamic returns src with the listener changes of d applied and
+// validated.
+func withDynamic(src *Config, d *dynamicState) (*Config, error) {
+	if len(d.Proxies) == 0 && len(d.Removed) == 0 {
+		return src, nil
+	}
+	overlay := Config{Proxies: append([]ProxyEntry(nil), d.Proxies...)}
+	if err := resolveSecrets(&overlay); err != nil {
+		return nil, err
+	}
+	next := effectiveConfig(src)
+	next.Defaults, next.Vars = src.Defaults, src.Vars
+	next.secretRefs = make(map[string]string, len(src.secretRefs)+len(overlay.secretRefs))
+	for _, refs := range []map[string]string{src.secretRefs, overlay.secretRefs} {
+		for value, ref := range refs {
+			next.secretRefs[value] = ref
+		}
+	}
+
+	removed := make(map[int]bool, len(d.Removed))
+	for _, port := range d.Removed {
+		removed[port] = true
+	}
+	kept := next.Proxies[:0]
+	for _, e := range next.Proxies {
+		if !removed[e.Port] {
+			kept = append(kept, e)
+		}
+	}
+	next.Proxies = kept
+	for _, e := range overlay.Proxies {
+		if i := entryIndex(next.Proxies, e.Port); i >= 0 {
+			next.Proxies[i] = e
+		} else {
+			next.Proxies = append(next.Proxies, e)
+		}
+	}
+	if err := validateConfig(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// listenerChanges returns the entries of running that are new or differ
+// from those of src, and the ports of src that running no longer has.
+func listenerChanges(src, running *Config) (changed []ProxyEntry, removed []int) {
+	srcPorts := make(map[int]ProxyEntry, len(src.Proxies))
+	for _, e := range src.Proxies {
+		srcPorts[e.Port] = e
+	}
+	for _, e := range running.Proxies {
+		old, ok := srcPorts[e.Port]
+		if !ok || !reflect.DeepEqual(yamlFields(effectiveEntry(old)), yamlFields(effectiveEntry(e))) {
+			changed = append(changed, effectiveEntry(e))
+		}
+		delete(srcPorts, e.Port)
+	}
+	for _, e := range src.Proxies {
+		if _, ok := srcPorts[e.Port]; ok {
+			removed = append(removed, e.Port)
+		}
+	}
+	return changed, removed
+}
+
+// savedBans returns the bans in effect in their dynamic.yaml form.
+func savedBans() []savedBan {
+	var out []savedBan
+	for _, b := range clientBans.list() {
+		out = append(out, savedBan{CIDR: b.Prefix.String(), Reason: b.Reason, Added: b.Added, Expires: b.Expires})
+	}
+	return out
+}
+
+// restoreBans sets the recorded bans that have not expired yet.
+func restoreBans(bans []savedBan) error {
+	now := time.Now()
+	n := 0
+	for _, sb := range bans {
+		prefix, err := netip.ParsePrefix(sb.CIDR)
+		if err != nil {
+			return fmt.Errorf("state: %s: invalid ban %q", dynamicFile, sb.CIDR)
+		}
+		b := clientBan{Prefix: prefix.Masked(), Reason: sb.Reason, Added: sb.Added, Expires: sb.Expires}
+		if b.expired(now) {
+			continue
+		}
+		clientBans.add(b)
+		n++
+	}
+	if n > 0 {
+		logInfo("[ban] restored %d bans from %s", n, dynamicFile)
+	}
+	return nil
+}
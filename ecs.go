@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// EDNS Client Subnet (RFC 7871).
+const (
+	ednsOptionECS    = 8
+	ednsUDPSize      = 1232 // DNS flag day 2020 recommendation
+	defaultECSPrefix = 56   // RFC 7871 recommended maximum for IPv6
+)
+
+// ECS modes (resolver.ecs.mode).
+const (
+	ecsOutbound = "outbound" // subnet of the connection's outbound address
+	ecsSubnet   = "subnet"   // fixed subnet
+	ecsStrip    = "strip"    // SOURCE PREFIX-LENGTH 0: ask upstream not to use client info
+)
+
+// ecsPolicy rewrites outgoing queries to carry a chosen ECS option in place
+// of whatever the query had. A nil *ecsPolicy leaves queries untouched.
+type ecsPolicy struct {
+	mode   string
+	prefix int
+	subnet *net.IPNet // ecsSubnet
+}
+
+// newECSPolicy builds a policy from a validated config block, or returns
+// nil if cfg is nil.
+func newECSPolicy(cfg *ECSConfig) *ecsPolicy {
+	if cfg == nil {
+		return nil
+	}
+	e := &ecsPolicy{mode: cfg.Mode, prefix: cfg.Prefix}
+	if cfg.Mode == ecsSubnet {
+		_, e.subnet, _ = net.ParseCIDR(cfg.Subnet)
+	}
+	return e
+}
+
+// apply returns msg with its ECS option set according to the policy. src is
+// the connection's outbound address (ecsOutbound). On any parse failure, or
+// without a source in outbound mode, msg is returned unchanged.
+func (e *ecsPolicy) apply(msg []byte, src net.IP) []byte {
+	if e == nil {
+		return msg
+	}
+
+	var data []byte
+	switch e.mode {
+	case ecsOutbound:
+		if src == nil {
+			return msg
+		}
+		data = ecsOptionData(src, e.prefix)
+	case ecsSubnet:
+		ones, _ := e.subnet.Mask.Size()
+		data = ecsOptionData(e.subnet.IP, ones)
+	case ecsStrip:
+		data = ecsOptionData(net.IPv6zero, 0)
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg
+	}
+
+	var opt *dnsmessage.OPTResource
+	for i := range m.Additionals {
+		if o, ok := m.Additionals[i].Body.(*dnsmessage.OPTResource); ok {
+			opt = o
+			break
+		}
+	}
+	if opt == nil {
+		var hdr dnsmessage.ResourceHeader
+		if err := hdr.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return msg
+		}
+		opt = &dnsmessage.OPTResource{}
+		m.Additionals = append(m.Additionals, dnsmessage.Resource{Header: hdr, Body: opt})
+	}
+
+	options := opt.Options[:0]
+	for _, o := range opt.Options {
+		if o.Code != ednsOptionECS {
+			options = append(options, o)
+		}
+	}
+	opt.Options = append(options, dnsmessage.Option{Code: ednsOptionECS, Data: data})
+
+	packed, err := m.Pack()
+	if err != nil {
+		return msg
+	}
+	return packed
+}
+
+// ecsOptionData encodes an ECS option: FAMILY, SOURCE PREFIX-LENGTH,
+// SCOPE PREFIX-LENGTH (0 in queries) and the address truncated to prefix.
+func ecsOptionData(ip net.IP, prefix int) []byte {
+	family, addr, bits := uint16(2), ip.To16(), 128
+	if v4 := ip.To4(); v4 != nil {
+		family, addr, bits = 1, v4, 32
+	}
+	masked := addr.Mask(net.CIDRMask(prefix, bits))
+	data := []byte{byte(family >> 8), byte(family), byte(prefix), 0}
+	return append(data, masked[:(prefix+7)/8]...)
+}
+
+// validateECS applies defaults and validates an ecs block.
+func validateECS(ec *ECSConfig) error {
+	switch ec.Mode {
+	case ecsOutbound:
+		if ec.Prefix == 0 {
+			ec.Prefix = defaultECSPrefix
+		}
+		if ec.Prefix < 1 || ec.Prefix > 128 {
+			return fmt.Errorf("ecs: prefix %d out of range (1-128)", ec.Prefix)
+		}
+	case ecsSubnet:
+		_, n, err := net.ParseCIDR(ec.Subnet)
+		if err != nil {
+			return fmt.Errorf("ecs: invalid subnet %q", ec.Subnet)
+		}
+		ec.Subnet = n.String()
+	case ecsStrip:
+	default:
+		return fmt.Errorf("ecs: unknown mode %q (expected outbound, subnet or strip)", ec.Mode)
+	}
+	if ec.Mode != ecsOutbound && ec.Prefix != 0 {
+		return fmt.Errorf("ecs: prefix is only valid with mode outbound")
+	}
+	return nil
+}
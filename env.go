@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envRef matches ${VAR} and ${VAR:-default}, or an escaped $${.
+var envRef = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv substitutes environment variables in the raw config file:
+// ${VAR} is replaced by the value of VAR, and ${VAR:-default} by default
+// when VAR is unset or empty. $${ produces a literal ${. Referencing an
+// unset variable without a default is an error, so a missing secret cannot
+// silently become an empty value.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+	out := envRef.ReplaceAllFunc(data, func(ref []byte) []byte {
+		if string(ref) == "$${" {
+			return []byte("${")
+		}
+		m := envRef.FindSubmatch(ref)
+		name := string(m[1])
+		if v := os.Getenv(name); v != "" {
+			return []byte(v)
+		}
+		if m[2] != nil {
+			return m[3]
+		}
+		if _, ok := os.LookupEnv(name); !ok {
+			missing = append(missing, name)
+		}
+		return nil
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("config: environment variable %s is not set", missing[0])
+	}
+	return out, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Classes of connect errors, indexes into dialErrorCounts.
+const (
+	classRefused = iota
+	classNetUnreachable
+	classHostUnreachable
+	classTimeout
+	classDNS
+	classDenied // the destination policy or resolve policy refused the target
+	classOther
+	numDialErrorClasses
+)
+
+// dialErrorClasses are the names of the classes, in the API, StatsD and ctl.
+var dialErrorClasses = [numDialErrorClasses]string{"refused", "net_unreachable", "host_unreachable", "timeout", "dns", "denied", "other"}
+
+// dnsFailure marks an error of resolving a domain target. It reads like the
+// error it wraps.
+type dnsFailure struct{ err error }
+
+func (e dnsFailure) Error() string { return e.err.Error() }
+func (e dnsFailure) Unwrap() error { return e.err }
+
+// dialErrorClass classifies an error returned by listener.dial. Of several
+// failed attempts, the last one decides.
+func dialErrorClass(err error) int {
+	var dns dnsFailure
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dns):
+		return classDNS
+	case errors.Is(err, errDestinationDenied), errors.Is(err, errIPv4Target):
+		return classDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return classRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return classNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return classHostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return classTimeout
+	}
+	return classOther
+}
+
+// dialErrorCounts counts connect errors by class.
+type dialErrorCounts [numDialErrorClasses]atomic.Int64
+
+// byClass returns the classes that occurred with their counts.
+func (c *dialErrorCounts) byClass() map[string]int64 {
+	var out map[string]int64
+	for i := range c {
+		if n := c[i].Load(); n > 0 {
+			if out == nil {
+				out = make(map[string]int64, numDialErrorClasses)
+			}
+			out[dialErrorClasses[i]] = n
+		}
+	}
+	return out
+}
+
+// outboundErrorTable counts connect errors by the outbound address they
+// were dialed from, across all listeners and reloads.
+type outboundErrorTable struct {
+	m sync.Map // normalized IP string → *dialErrorCounts
+}
+
+// outboundErrors are the connect errors of the running daemon by outbound
+// address.
+var outboundErrors outboundErrorTable
+
+func (t *outboundErrorTable) add(ip net.IP, class int) {
+	key := ip.String()
+	v, ok := t.m.Load(key)
+	if !ok {
+		v, _ = t.m.LoadOrStore(key, new(dialErrorCounts))
+	}
+	v.(*dialErrorCounts)[class].Add(1)
+}
+
+// byClass returns the counts of ip (an address as in the config), nil if
+// it had no errors.
+func (t *outboundErrorTable) byClass(ip string) map[string]int64 {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	v, ok := t.m.Load(parsed.String())
+	if !ok {
+		return nil
+	}
+	return v.(*dialErrorCounts).byClass()
+}
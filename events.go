@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection event types.
+const (
+	eventOpen   = "open"   // the target was dialed and the relay started
+	eventClose  = "close"  // the relay ended
+	eventFailed = "failed" // the target could not be dialed
+)
+
+// connEvent is one connection event, delivered to watchers such as the
+// gRPC WatchConnections stream.
+type connEvent struct {
+	Type      string
+	Time      time.Time
+	Port      int
+	Name      string
+	Client    string // client address
+	User      string // logged in as, on listeners with auth
+	Target    string // host:port requested by the client
+	Outbound  string // local address of the outgoing connection
+	BytesUp   int64
+	BytesDown int64
+	Duration  time.Duration // close: time since open
+	Error     string        // failed
+	Class     string        // failed: refused, timeout, dns, ... (see dialErrorClasses)
+}
+
+// eventHub fans connection events out to subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses the event.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan connEvent]struct{}
+	n    atomic.Int32 // len(subs), read without the lock on the hot path
+}
+
+// connEvents carries the events of every listener.
+var connEvents eventHub
+
+// active reports whether anyone is subscribed; events need not be built
+// otherwise.
+func (h *eventHub) active() bool {
+	return h.n.Load() > 0
+}
+
+// subscribe returns a channel receiving events, buffered for size of them,
+// and the function that ends the subscription.
+func (h *eventHub) subscribe(size int) (<-chan connEvent, func()) {
+	ch := make(chan connEvent, size)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan connEvent]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	h.n.Store(int32(len(h.subs)))
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.n.Store(int32(len(h.subs)))
+		h.mu.Unlock()
+	}
+}
+
+// recentFailures is the number of connection failures kept for the admin
+// API and dashboard.
+const recentFailures = 100
+
+// failureLog keeps the most recent connection failures in a ring.
+type failureLog struct {
+	mu   sync.Mutex
+	ring [recentFailures]connEvent
+	n    int // failures added so far
+}
+
+// connFailures holds the recent failures of every listener.
+var connFailures failureLog
+
+func (f *failureLog) add(ev connEvent) {
+	f.mu.Lock()
+	f.ring[f.n%recentFailures] = ev
+	f.n++
+	f.mu.Unlock()
+}
+
+// list returns the kept failures, newest first.
+func (f *failureLog) list() []connEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := min(f.n, recentFailures)
+	out := make([]connEvent, n)
+	for i := range out {
+		out[i] = f.ring[(f.n-1-i)%recentFailures]
+	}
+	return out
+}
+
+// publish delivers ev to every subscriber with room for it.
+func (h *eventHub) publish(ev connEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// expandPorts replaces every entry with a port range or a generated prefix
+// by one entry per port. It returns the expanded entries and, for each, the
+// name used in validation errors: "proxies[3]" (prefixed by the file for
+// included entries), or "proxies[3] (port 20005)" for an entry generated
+// from a range or prefix. Templates in the entries are rendered with vars.
+func expandPorts(entries []ProxyEntry, vars map[string]string) ([]ProxyEntry, []string, error) {
+	out := make([]ProxyEntry, 0, len(entries))
+	names := make([]string, 0, len(entries))
+	for i, e := range entries {
+		name := fmt.Sprintf("proxies[%d]", i)
+		if e.origin != "" {
+			name = e.origin
+		}
+		var (
+			first, count int
+			addrs        []string
+			err          error
+		)
+		switch {
+		case e.Prefix != "":
+			first, count = e.StartPort, e.Count
+			addrs, err = prefixAddresses(e)
+		case e.Ports != "":
+			var last int
+			first, last, err = parsePortRange(e.Ports)
+			if err == nil && e.Port != 0 {
+				err = fmt.Errorf("'port' and 'ports' are mutually exclusive")
+			}
+			if err == nil {
+				count = last - first + 1
+				addrs, err = rangeAddresses(e, count)
+			}
+		default:
+			if e.IPv6Prefix != "" || len(e.IPv6List) > 0 {
+				return nil, nil, fmt.Errorf("config: %s: 'ipv6_prefix' and 'ipv6_list' require 'ports'", name)
+			}
+			if e.Count != 0 || e.StartPort != 0 {
+				return nil, nil, fmt.Errorf("config: %s: 'count' and 'start_port' require 'prefix'", name)
+			}
+			if err := renderEntry(&e, vars, 1); err != nil {
+				return nil, nil, fmt.Errorf("config: %s: %w", name, err)
+			}
+			out = append(out, e)
+			names = append(names, name)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("config: %s: %w", name, err)
+		}
+
+		for n := 0; n < count; n++ {
+			p := e
+			p.Port = first + n
+			p.Ports, p.IPv6Prefix, p.IPv6List = "", "", nil
+			p.Prefix, p.Count, p.StartPort = "", 0, 0
+			if e.Name != "" && !isTemplate(e.Name) {
+				p.Name = fmt.Sprintf("%s-%d", e.Name, n+1) // names stay unique
+			}
+			if addrs != nil {
+				p.IPv6 = addrs[n]
+			} else {
+				p.Outbound = append([]OutboundAddr(nil), e.Outbound...)
+			}
+			pname := fmt.Sprintf("%s (port %d)", name, p.Port)
+			if err := renderEntry(&p, vars, n+1); err != nil {
+				return nil, nil, fmt.Errorf("config: %s: %w", pname, err)
+			}
+			out = append(out, p)
+			names = append(names, pname)
+		}
+	}
+	return out, names, nil
+}
+
+// parsePortRange parses "first-last" (or a single port).
+func parsePortRange(s string) (first, last int, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	first, err = strconv.Atoi(strings.TrimSpace(lo))
+	if err == nil {
+		last = first
+		if isRange {
+			last, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q (expected e.g. 20000-20999)", s)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("port range %q out of range (1-65535, first <= last)", s)
+	}
+	return first, last, nil
+}
+
+// rangeAddresses returns the outbound address of each of the count ports
+// of a range entry, or nil if the ports share the entry's outbound pool or
+// render their own from an ipv6 template.
+func rangeAddresses(e ProxyEntry, count int) ([]string, error) {
+	sources := 0
+	for _, set := range []bool{e.IPv6 != "", e.IPv6Prefix != "", len(e.IPv6List) > 0, len(e.Outbound) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("'ports' requires exactly one of 'ipv6_prefix', 'ipv6_list', 'outbound' or an 'ipv6' template")
+	}
+
+	switch {
+	case e.IPv6 != "":
+		if isTemplate(e.IPv6) {
+			return nil, nil // rendered per port
+		}
+		return nil, fmt.Errorf("'ports' cannot share one 'ipv6'; use 'ipv6_prefix', 'ipv6_list', 'outbound' or a template")
+	case len(e.IPv6List) > 0:
+		if len(e.IPv6List) != count {
+			return nil, fmt.Errorf("ipv6_list has %d addresses for %d ports", len(e.IPv6List), count)
+		}
+		return e.IPv6List, nil
+	case e.IPv6Prefix != "":
+		_, prefix, err := net.ParseCIDR(e.IPv6Prefix)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6_prefix %q", e.IPv6Prefix)
+		}
+		addrs := make([]string, count)
+		for n := range addrs {
+			ip, ok := nthAddress(prefix, uint64(n)+1) // skip the subnet-router anycast address
+			if !ok {
+				return nil, fmt.Errorf("ipv6_prefix %s has fewer than %d host addresses", prefix, count)
+			}
+			addrs[n] = ip.String()
+		}
+		return addrs, nil
+	}
+	return nil, nil
+}
+
+// prefixAddresses derives count distinct addresses from the entry's prefix.
+// The interface identifier of the n-th address is taken from
+// SHA-256(prefix, n), so the set is stable across restarts and reloads but
+// scattered over the prefix rather than sequential, and therefore not
+// trivially enumerable from one known address.
+func prefixAddresses(e ProxyEntry) ([]string, error) {
+	switch {
+	case e.Port != 0 || e.Ports != "":
+		return nil, fmt.Errorf("'prefix' generates ports from 'start_port'; 'port' and 'ports' are not allowed")
+	case e.IPv6 != "" || len(e.Outbound) > 0 || e.IPv6Prefix != "" || len(e.IPv6List) > 0:
+		return nil, fmt.Errorf("'prefix' generates the outbound addresses; 'ipv6', 'outbound', 'ipv6_prefix' and 'ipv6_list' are not allowed")
+	case e.Count < 1:
+		return nil, fmt.Errorf("'prefix' requires a positive 'count'")
+	case e.StartPort < 1 || e.StartPort+e.Count-1 > 65535:
+		return nil, fmt.Errorf("start_port %d with count %d exceeds the port range 1-65535", e.StartPort, e.Count)
+	}
+	_, prefix, err := net.ParseCIDR(e.Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid prefix %q", e.Prefix)
+	}
+	ones, _ := prefix.Mask.Size()
+	if hostBits := 128 - ones; hostBits < 32 && uint64(e.Count) > (uint64(1)<<hostBits)-1 {
+		return nil, fmt.Errorf("prefix %s has fewer than %d host addresses", prefix, e.Count)
+	}
+
+	addrs := make([]string, 0, e.Count)
+	seen := make(map[string]struct{}, e.Count)
+	var buf [8]byte
+	for n := uint64(0); len(addrs) < e.Count; n++ {
+		binary.BigEndian.PutUint64(buf[:], n)
+		sum := sha256.Sum256(append([]byte(prefix.String()), buf[:]...))
+		ip := make(net.IP, net.IPv6len)
+		for b := range ip {
+			ip[b] = prefix.IP[b] | sum[b]&^prefix.Mask[b]
+		}
+		if ip.Equal(prefix.IP) {
+			continue // subnet-router anycast address
+		}
+		if _, dup := seen[ip.String()]; dup {
+			continue
+		}
+		seen[ip.String()] = struct{}{}
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Connection failure cache defaults, used when the corresponding field is omitted.
+const (
+	defaultFailCacheSize = 10000
+	defaultFailCacheTTL  = 5 * time.Second
+)
+
+// failCache remembers destinations that recently refused connections or
+// were unreachable, so repeated requests for them fail immediately instead
+// of spending an ephemeral port and a connect attempt each time. Only
+// ECONNREFUSED and ENETUNREACH are cached: they are definite answers from
+// the network, unlike timeouts.
+//
+// A nil *failCache caches nothing.
+type failCache struct {
+	mu      sync.Mutex
+	entries map[string]failCacheEntry // "[ip]:port"
+
+	size int
+	ttl  time.Duration
+}
+
+type failCacheEntry struct {
+	err     syscall.Errno
+	expires time.Time
+}
+
+// newFailCache returns a cache for cfg, or nil if cfg is nil (caching disabled).
+func newFailCache(cfg *FailCacheConfig) *failCache {
+	if cfg == nil {
+		return nil
+	}
+	return &failCache{
+		entries: make(map[string]failCacheEntry),
+		size:    cfg.Size,
+		ttl:     cfg.TTL,
+	}
+}
+
+// check returns the cached failure for addr, or nil if there is none.
+func (c *failCache) check(addr string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[addr]
+	if ok && !time.Now().Before(e.expires) {
+		delete(c.entries, addr)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return fmt.Errorf("dial tcp %s: %w (cached)", addr, e.err)
+}
+
+// record caches err for addr if it is a cacheable failure.
+func (c *failCache) record(addr string, err error) {
+	if c == nil {
+		return
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) || (errno != syscall.ECONNREFUSED && errno != syscall.ENETUNREACH) {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[addr]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[addr] = failCacheEntry{err: errno, expires: now.Add(c.ttl)}
+}
+
+// evict drops expired entries, then arbitrary ones until there is room for
+// one more. Caller holds c.mu.
+func (c *failCache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
+
+// validateFailCache applies defaults and validates the fail_cache block.
+func validateFailCache(fc *FailCacheConfig) error {
+	if fc.Size < 0 || fc.TTL < 0 {
+		return fmt.Errorf("config: fail_cache: size and ttl must not be negative")
+	}
+	if fc.Size == 0 {
+		fc.Size = defaultFailCacheSize
+	}
+	if fc.TTL == 0 {
+		fc.TTL = defaultFailCacheTTL
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats (-format).
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+	formatTOML = "toml"
+)
+
+// configFormat returns the format of path: format if set, otherwise
+// detected from the file (or URL path) extension, defaulting to YAML.
+func configFormat(path, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case formatYAML, "yml":
+		return formatYAML, nil
+	case formatJSON:
+		return formatJSON, nil
+	case formatTOML:
+		return formatTOML, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown config format %q (expected yaml, json or toml)", format)
+	}
+	if isRemoteConfig(path) {
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON, nil
+	case ".toml":
+		return formatTOML, nil
+	}
+	return formatYAML, nil
+}
+
+// decodeConfig parses data in the given format into cfg. JSON and TOML are
+// decoded generically and re-encoded as YAML, so every format shares the
+// YAML field names and value syntax (durations such as "30s" are strings).
+func decodeConfig(data []byte, format string, cfg *Config) error {
+	var doc any
+	switch format {
+	case formatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+		doc = jsonNumbers(doc)
+	case formatTOML:
+		var m map[string]any
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return err
+		}
+		doc = m
+	default:
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return err
+		}
+		rewriteSecretTags(&root)
+		if root.Kind == 0 {
+			return nil // empty document
+		}
+		return root.Decode(cfg)
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(out, cfg)
+}
+
+// jsonNumbers replaces json.Number values with int64 or float64, which
+// re-encode as YAML numbers rather than strings.
+func jsonNumbers(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
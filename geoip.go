@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MaxMind DB data types (https://maxmind.github.io/MaxMind-DB/).
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbArray    = 11
+	mmdbBool     = 14
+)
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB data")
+
+// mmdbMaxDepth bounds the nesting of maps and arrays, as libmaxminddb does.
+const mmdbMaxDepth = 512
+
+// geoDB is a MaxMind DB file (GeoLite2 / GeoIP2 Country, City or ASN, or a
+// compatible database such as DB-IP's), read into memory whole.
+type geoDB struct {
+	path    string
+	modTime time.Time
+	size    int64
+	dbType  string // database_type of the metadata, e.g. "GeoLite2-Country"
+	built   time.Time
+
+	tree       []byte
+	data       mmdbData // data section
+	nodeCount  uint32
+	recordSize int // bits per record: 24, 28 or 32
+	ipVersion  int
+	ipv4Start  uint32 // node of ::/96 in an IPv6 tree, where IPv4 lookups start
+}
+
+// openGeoDB reads and checks the MaxMind DB at path.
+func openGeoDB(path string) (*geoDB, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(raw, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	meta := mmdbData(raw[i+len(mmdbMetadataMarker):])
+	db := &geoDB{path: path, modTime: fi.ModTime(), size: fi.Size()}
+	nodes, err1 := meta.uintAt(meta.lookup(0, "node_count"))
+	recordSize, err2 := meta.uintAt(meta.lookup(0, "record_size"))
+	ipVersion, err3 := meta.uintAt(meta.lookup(0, "ip_version"))
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	db.dbType, _ = meta.stringAt(meta.lookup(0, "database_type"))
+	if epoch, err := meta.uintAt(meta.lookup(0, "build_epoch")); err == nil {
+		db.built = time.Unix(int64(epoch), 0).UTC()
+	}
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported IP version %d", path, ipVersion)
+	}
+	treeSize := int(nodes) * int(recordSize) / 4
+	if nodes > uint64(i) || treeSize+16 > i {
+		return nil, fmt.Errorf("%s: search tree larger than the file", path)
+	}
+	db.tree, db.data = raw[:treeSize], mmdbData(raw[treeSize+16:i])
+	db.nodeCount, db.recordSize, db.ipVersion = uint32(nodes), int(recordSize), int(ipVersion)
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *geoDB) record(node uint32, bit byte) uint32 {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[int(node)*6+int(bit)*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		b := db.tree[int(node)*7:]
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	}
+	b := db.tree[int(node)*8+int(bit)*4:]
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// find returns the offset of the data record of ip in the data section, or
+// -1 if the database has none.
+func (db *geoDB) find(ip netip.Addr) int {
+	ip = ip.Unmap()
+	addr, bits, node := ip.As16(), 128, uint32(0)
+	key := addr[:]
+	if ip.Is4() {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+		key, bits = key[12:], 32
+	} else if db.ipVersion == 4 {
+		return -1
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		node = db.record(node, key[i/8]>>(7-i%8)&1)
+	}
+	if node <= db.nodeCount {
+		return -1
+	}
+	return int(node-db.nodeCount) - 16
+}
+
+// country returns the ISO 3166-1 code of the country of ip ("" if unknown):
+// where it is, or else where its network is registered.
+func (db *geoDB) country(ip netip.Addr) string {
+	off := db.find(ip)
+	if off < 0 {
+		return ""
+	}
+	if code, err := db.data.stringAt(db.data.lookup(off, "country", "iso_code")); err == nil {
+		return code
+	}
+	code, _ := db.data.stringAt(db.data.lookup(off, "registered_country", "iso_code"))
+	return code
+}
+
+// asn returns the autonomous system number of ip (0 if unknown).
+func (db *geoDB) asn(ip netip.Addr) uint32 {
+	off := db.find(ip)
+	if off < 0 {
+		return 0
+	}
+	n, _ := db.data.uintAt(db.data.lookup(off, "autonomous_system_number"))
+	return uint32(n)
+}
+
+// mmdbData is a data section of a MaxMind DB, to which its pointers are
+// relative. It is read in place, without decoding whole records.
+type mmdbData []byte
+
+// field decodes the control bytes at off, following a pointer: it returns
+// the type and size of the value and the offset of its payload, and next,
+// the offset after the field if it was a pointer (0 otherwise).
+func (d mmdbData) field(off int) (typ, size, payload, next int, err error) {
+	if off < 0 || off >= len(d) {
+		return 0, 0, 0, 0, errMMDBCorrupt
+	}
+	c := d[off]
+	off++
+	typ = int(c >> 5)
+	if typ == mmdbPointer {
+		ss := int(c>>3) & 3
+		if off+ss+1 > len(d) {
+			return 0, 0, 0, 0, errMMDBCorrupt
+		}
+		p := int(c & 7)
+		if ss == 3 {
+			p = 0
+		}
+		for _, b := range d[off : off+ss+1] {
+			p = p<<8 | int(b)
+		}
+		p += [4]int{0, 2048, 526336, 0}[ss]
+		// A pointer to a pointer is invalid, and following it could loop
+		if p >= len(d) || d[p]>>5 == mmdbPointer {
+			return 0, 0, 0, 0, errMMDBCorrupt
+		}
+		typ, size, payload, _, err = d.field(p)
+		return typ, size, payload, off + ss + 1, err
+	}
+	if typ == mmdbExtended {
+		if off >= len(d) {
+			return 0, 0, 0, 0, errMMDBCorrupt
+		}
+		typ = 7 + int(d[off])
+		off++
+	}
+	size = int(c & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(d) {
+			return 0, 0, 0, 0, errMMDBCorrupt
+		}
+		v := 0
+		for _, b := range d[off : off+n] {
+			v = v<<8 | int(b)
+		}
+		size = [3]int{29, 285, 65821}[n-1] + v
+		off += n
+	}
+	return typ, size, off, 0, nil
+}
+
+// skip returns the offset after the field at off.
+func (d mmdbData) skip(off int) (int, error) {
+	return d.skipNested(off, 0)
+}
+
+// skipNested skips the field at off, nested depth maps and arrays deep.
+func (d mmdbData) skipNested(off, depth int) (int, error) {
+	if depth > mmdbMaxDepth {
+		return 0, errMMDBCorrupt
+	}
+	typ, size, payload, next, err := d.field(off)
+	if err != nil || next > 0 {
+		return next, err
+	}
+	switch typ {
+	case mmdbMap, mmdbArray:
+		n := size
+		if typ == mmdbMap {
+			n *= 2
+		}
+		off = payload
+		for i := 0; i < n; i++ {
+			if off, err = d.skipNested(off, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return off, nil
+	case mmdbBool:
+		return payload, nil
+	}
+	if payload+size > len(d) {
+		return 0, errMMDBCorrupt
+	}
+	return payload + size, nil
+}
+
+// lookup returns the offset of the value at path in the map at off, or -1
+// if there is none.
+func (d mmdbData) lookup(off int, path ...string) int {
+	for _, key := range path {
+		typ, size, payload, _, err := d.field(off)
+		if err != nil || typ != mmdbMap {
+			return -1
+		}
+		off = payload
+		found := false
+		for i := 0; i < size && !found; i++ {
+			k, err := d.stringAt(off)
+			if off, err = d.skip(off); err != nil {
+				return -1
+			}
+			if found = k == key; !found {
+				if off, err = d.skip(off); err != nil {
+					return -1
+				}
+			}
+		}
+		if !found {
+			return -1
+		}
+	}
+	return off
+}
+
+// stringAt decodes the string at off.
+func (d mmdbData) stringAt(off int) (string, error) {
+	typ, size, payload, _, err := d.field(off)
+	if err != nil {
+		return "", err
+	}
+	if typ != mmdbString || payload+size > len(d) {
+		return "", errMMDBCorrupt
+	}
+	return string(d[payload : payload+size]), nil
+}
+
+// uintAt decodes the unsigned integer at off.
+func (d mmdbData) uintAt(off int) (uint64, error) {
+	typ, size, payload, _, err := d.field(off)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+	default:
+		return 0, errMMDBCorrupt
+	}
+	if size > 8 || payload+size > len(d) {
+		return 0, errMMDBCorrupt
+	}
+	var v uint64
+	for _, b := range d[payload : payload+size] {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// geoIP holds the databases of the geoip block, shared by all listeners.
+type geoIP struct {
+	cfg     GeoIPConfig
+	country *geoDB // nil: none configured
+	asn     *geoDB
+}
+
+// loadGeoIP opens the databases of gc, reusing those of old whose files
+// did not change. It returns nil if gc is nil.
+func loadGeoIP(gc *GeoIPConfig, old *geoIP) (*geoIP, error) {
+	if gc == nil {
+		return nil, nil
+	}
+	g := &geoIP{cfg: *gc}
+	reuse := func(path string, cur *geoDB) (*geoDB, error) {
+		if path == "" {
+			return nil, nil
+		}
+		if cur != nil && cur.path == path {
+			if fi, err := os.Stat(path); err == nil && fi.ModTime().Equal(cur.modTime) && fi.Size() == cur.size {
+				return cur, nil
+			}
+		}
+		db, err := openGeoDB(path)
+		if err != nil {
+			return nil, err
+		}
+		logInfo("[geoip] loaded %s (%s, built %s)", path, db.dbType, db.built.Format("2006-01-02"))
+		return db, nil
+	}
+	var oldCountry, oldASN *geoDB
+	if old != nil {
+		oldCountry, oldASN = old.country, old.asn
+	}
+	var err error
+	if g.country, err = reuse(gc.Country, oldCountry); err != nil {
+		return nil, fmt.Errorf("geoip.country: %w", err)
+	}
+	if g.asn, err = reuse(gc.ASN, oldASN); err != nil {
+		return nil, fmt.Errorf("geoip.asn: %w", err)
+	}
+	return g, nil
+}
+
+// same reports whether g has the databases loadGeoIP would open for gc.
+func (g *geoIP) same(gc *GeoIPConfig) bool {
+	if g == nil || gc == nil {
+		return g == nil && gc == nil
+	}
+	if !reflect.DeepEqual(g.cfg, *gc) {
+		return false
+	}
+	for _, db := range []*geoDB{g.country, g.asn} {
+		if db == nil {
+			continue
+		}
+		if fi, err := os.Stat(db.path); err != nil || !fi.ModTime().Equal(db.modTime) || fi.Size() != db.size {
+			return false
+		}
+	}
+	return true
+}
+
+// geoPolicy restricts the clients of a listener by the country and
+// autonomous system of their address, checked on accept along with the
+// client lists. A deny match refuses; a non-empty allow list refuses every
+// address outside it, including addresses the database does not know.
+//
+// A nil *geoPolicy allows everything.
+type geoPolicy struct {
+	geo            *geoIP
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	allowASNs      map[uint32]bool
+	denyASNs       map[uint32]bool
+}
+
+// newGeoPolicy builds the policy of a validated entry, or returns nil if it
+// has no country or ASN rules.
+func newGeoPolicy(entry ProxyEntry, geo *geoIP) *geoPolicy {
+	if len(entry.AllowCountries)+len(entry.DenyCountries)+len(entry.AllowASNs)+len(entry.DenyASNs) == 0 || geo == nil {
+		return nil
+	}
+	set := func(codes []string) map[string]bool {
+		if len(codes) == 0 {
+			return nil
+		}
+		m := make(map[string]bool, len(codes))
+		for _, c := range codes {
+			m[c] = true
+		}
+		return m
+	}
+	asns := func(list []uint32) map[uint32]bool {
+		if len(list) == 0 {
+			return nil
+		}
+		m := make(map[uint32]bool, len(list))
+		for _, n := range list {
+			m[n] = true
+		}
+		return m
+	}
+	return &geoPolicy{
+		geo:            geo,
+		allowCountries: set(entry.AllowCountries),
+		denyCountries:  set(entry.DenyCountries),
+		allowASNs:      asns(entry.AllowASNs),
+		denyASNs:       asns(entry.DenyASNs),
+	}
+}
+
+// allows reports whether the client at addr may connect.
+func (p *geoPolicy) allows(addr net.Addr) bool {
+	if p == nil {
+		return true
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := ta.AddrPort().Addr().Unmap()
+	if p.allowCountries != nil || p.denyCountries != nil {
+		code := p.geo.country.country(ip)
+		if p.denyCountries[code] || p.allowCountries != nil && !p.allowCountries[code] {
+			return false
+		}
+	}
+	if p.allowASNs != nil || p.denyASNs != nil {
+		asn := p.geo.asn.asn(ip)
+		if p.denyASNs[asn] || p.allowASNs != nil && !p.allowASNs[asn] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateGeoRules normalizes the country codes of an entry and checks that
+// the databases its rules need are configured.
+func validateGeoRules(p *ProxyEntry, gc *GeoIPConfig) error {
+	for _, list := range []struct {
+		name  string
+		codes []string
+	}{{"allow_countries", p.AllowCountries}, {"deny_countries", p.DenyCountries}} {
+		for i, c := range list.codes {
+			c = strings.ToUpper(strings.TrimSpace(c))
+			if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+				return fmt.Errorf("%s[%d]: %q is not an ISO 3166-1 alpha-2 country code", list.name, i, list.codes[i])
+			}
+			list.codes[i] = c
+		}
+		if len(list.codes) > 0 && (gc == nil || gc.Country == "") {
+			return fmt.Errorf("%s needs a country database (geoip.country)", list.name)
+		}
+	}
+	if len(p.AllowASNs)+len(p.DenyASNs) > 0 && (gc == nil || gc.ASN == "") {
+		return fmt.Errorf("allow_asns / deny_asns need an ASN database (geoip.asn)")
+	}
+	return nil
+}
+
+// validateGeoIP validates the geoip block; the databases are opened when
+// the configuration is applied.
+func validateGeoIP(gc *GeoIPConfig) error {
+	if gc.Country == "" && gc.ASN == "" {
+		return fmt.Errorf("config: geoip: set country and/or asn")
+	}
+	return nil
+}
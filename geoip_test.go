@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbKey encodes a short MaxMind DB string.
+func mmdbKey(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func TestMMDBDataCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"self pointer", []byte{0x20, 0x00}},
+		{"pointer cycle", []byte{0x20, 0x02, 0x20, 0x00}},
+		{"pointer past the end", []byte{0x20, 0x10}},
+		{"truncated pointer", []byte{0x28}},
+		{"truncated string", []byte{0x45, 'a'}},
+		{"truncated map", []byte{0xe2, 0x41, 'b'}},
+		{"nested too deep", bytes.Repeat([]byte{0x01, 0x04}, 2*mmdbMaxDepth)},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := mmdbData(tt.data)
+			if _, err := d.skip(0); err != errMMDBCorrupt {
+				t.Errorf("skip: err = %v, want errMMDBCorrupt", err)
+			}
+			if _, err := d.stringAt(0); err == nil {
+				t.Errorf("stringAt: no error")
+			}
+			if off := d.lookup(0, "a"); off >= 0 {
+				t.Errorf("lookup = %d, want -1", off)
+			}
+		})
+	}
+}
+
+// testGeoDB returns a database of IPv4 version whose one node sends every
+// address to a record {country: {iso_code: "DE"}}, reached by a pointer.
+func testGeoDB() []byte {
+	var data []byte
+	data = append(data, 0xe1) // map of 1
+	data = append(data, mmdbKey("country")...)
+	data = append(data, 0x20, 0x0b) // pointer to offset 11
+	data = append(data, 0xe1)
+	data = append(data, mmdbKey("iso_code")...)
+	data = append(data, mmdbKey("DE")...)
+
+	file := []byte{0, 0, 17, 0, 0, 17} // node 0: both records are data offset 0
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, 0xe3)
+	file = append(file, mmdbKey("node_count")...)
+	file = append(file, 0xa1, 1)
+	file = append(file, mmdbKey("record_size")...)
+	file = append(file, 0xa1, 24)
+	file = append(file, mmdbKey("ip_version")...)
+	file = append(file, 0xa1, 4)
+	return file
+}
+
+func TestOpenGeoDB(t *testing.T) {
+	valid := testGeoDB()
+	marker := bytes.Index(valid, mmdbMetadataMarker)
+	tests := []struct {
+		name    string
+		file    []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"empty", nil, true},
+		{"no metadata", valid[:marker], true},
+		{"truncated metadata", valid[:len(valid)-5], true},
+		{"truncated tree", valid[marker-10:], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.mmdb")
+			if err := os.WriteFile(path, tt.file, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			db, err := openGeoDB(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openGeoDB: err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := db.country(netip.MustParseAddr("192.0.2.1")); got != "DE" {
+				t.Errorf("country = %q, want DE", got)
+			}
+		})
+	}
+}
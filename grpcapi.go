@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go-proxy-ipv6-pool/adminpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v3"
+)
+
+// grpcEventBuffer is the number of events queued per WatchConnections
+// stream; more are dropped while the client falls behind.
+const grpcEventBuffer = 1024
+
+// grpcAdmin serves the gRPC management API on admin.grpc_listen.
+type grpcAdmin struct {
+	listen string
+	tls    bool
+	srv    *grpc.Server
+}
+
+// update starts, moves or stops the API to match ac (nil: disabled), like
+// adminServer.update.
+func (g *grpcAdmin) update(ac *AdminConfig, c *controller) error {
+	listen := ""
+	if ac != nil {
+		listen = ac.GRPCListen
+	}
+	secure := c.sec.tls.Load() != nil
+	if listen == g.listen && secure == g.tls {
+		return nil
+	}
+	var srv *grpc.Server
+	if listen != "" {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return fmt.Errorf("admin: grpc: %w", err)
+		}
+		srv = grpc.NewServer(c.sec.grpcOptions()...)
+		adminpb.RegisterProxyAdminServer(srv, &grpcService{c: c})
+		go srv.Serve(ln)
+		logInfo("[admin] gRPC API listening on %s%s", ln.Addr(), tlsNote(secure))
+		c.sec.warnOpen("gRPC API", ln.Addr())
+	}
+	if old := g.srv; old != nil {
+		// Let unary calls finish; event streams only end when cut off.
+		go func() {
+			t := time.AfterFunc(10*time.Second, old.Stop)
+			old.GracefulStop()
+			t.Stop()
+		}()
+		logInfo("[admin] gRPC API stopped listening on %s", g.listen)
+	}
+	g.listen, g.tls, g.srv = listen, secure, srv
+	return nil
+}
+
+// grpcService implements adminpb.ProxyAdminServer on the controller.
+type grpcService struct {
+	adminpb.UnimplementedProxyAdminServer
+	c *controller
+}
+
+func (s *grpcService) ListListeners(context.Context, *adminpb.ListListenersRequest) (*adminpb.ListListenersResponse, error) {
+	return listenersPB(listeners(s.c, 0))
+}
+
+func (s *grpcService) GetListener(_ context.Context, req *adminpb.GetListenerRequest) (*adminpb.Listener, error) {
+	found := listeners(s.c, int(req.Port))
+	if req.Port == 0 || len(found) == 0 {
+		return nil, status.Error(codes.NotFound, errNoListener.Error())
+	}
+	return listenerPB(found[0])
+}
+
+func (s *grpcService) AddListeners(ctx context.Context, req *adminpb.AddListenersRequest) (*adminpb.ListListenersResponse, error) {
+	entry, err := entryFromPB(req.Entry)
+	if err != nil {
+		return nil, err
+	}
+	added, err := s.c.addEntry(actorOf(ctx), entry)
+	if err != nil {
+		return nil, editStatus(err)
+	}
+	var out []listenerInfo
+	for _, e := range added {
+		out = append(out, listeners(s.c, e.Port)...)
+	}
+	return listenersPB(out)
+}
+
+func (s *grpcService) ReplaceListener(ctx context.Context, req *adminpb.ReplaceListenerRequest) (*adminpb.Listener, error) {
+	entry, err := entryFromPB(req.Entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.c.replaceEntry(actorOf(ctx), int(req.Port), entry); err != nil {
+		return nil, editStatus(err)
+	}
+	return listenerPB(listeners(s.c, int(req.Port))[0])
+}
+
+func (s *grpcService) RemoveListener(ctx context.Context, req *adminpb.RemoveListenerRequest) (*adminpb.RemoveListenerResponse, error) {
+	if err := s.c.removeEntry(actorOf(ctx), int(req.Port)); err != nil {
+		return nil, editStatus(err)
+	}
+	return &adminpb.RemoveListenerResponse{}, nil
+}
+
+func (s *grpcService) Reload(ctx context.Context, _ *adminpb.ReloadRequest) (*adminpb.ListListenersResponse, error) {
+	by := actorOf(ctx)
+	if err := s.c.reload(by, "gRPC request by "+by); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return listenersPB(listeners(s.c, 0))
+}
+
+func (s *grpcService) WatchConnections(req *adminpb.WatchConnectionsRequest, stream adminpb.ProxyAdmin_WatchConnectionsServer) error {
+	events, cancel := connEvents.subscribe(grpcEventBuffer)
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			if req.Port != 0 && ev.Port != int(req.Port) {
+				continue
+			}
+			if err := stream.Send(eventPB(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// editStatus maps an edit error to its gRPC status.
+func editStatus(err error) error {
+	if errors.Is(err, errNoListener) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// The messages mirror the config options under the same names, so entries
+// convert through their JSON form: that of the REST API.
+
+func listenersPB(infos []listenerInfo) (*adminpb.ListListenersResponse, error) {
+	resp := &adminpb.ListListenersResponse{}
+	for _, info := range infos {
+		l, err := listenerPB(info)
+		if err != nil {
+			return nil, err
+		}
+		resp.Listeners = append(resp.Listeners, l)
+	}
+	return resp, nil
+}
+
+func listenerPB(info listenerInfo) (*adminpb.Listener, error) {
+	data, err := json.Marshal(info.Config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	entry := &adminpb.ProxyEntry{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, entry); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &adminpb.Listener{
+		Port:  int32(info.Port),
+		Name:  info.Name,
+		Entry: entry,
+		Stats: &adminpb.ListenerStats{
+			ConnectionsTotal:  info.Stats.ConnectionsTotal,
+			ConnectionsActive: info.Stats.ConnectionsActive,
+			ConnectErrors:     info.Stats.ConnectErrors,
+			BytesUp:           info.Stats.BytesUp,
+			BytesDown:         info.Stats.BytesDown,
+		},
+	}, nil
+}
+
+func entryFromPB(pb *adminpb.ProxyEntry) (ProxyEntry, error) {
+	var entry ProxyEntry
+	if pb == nil {
+		return entry, status.Error(codes.InvalidArgument, "entry is required")
+	}
+	data, err := (protojson.MarshalOptions{UseProtoNames: true}).Marshal(pb)
+	if err != nil {
+		return entry, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := yaml.Unmarshal(data, &entry); err != nil {
+		return entry, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid proxy entry: %v", err))
+	}
+	return entry, nil
+}
+
+func eventPB(ev connEvent) *adminpb.ConnectionEvent {
+	pb := &adminpb.ConnectionEvent{
+		Time:      timestamppb.New(ev.Time),
+		Port:      int32(ev.Port),
+		Name:      ev.Name,
+		Client:    ev.Client,
+		Target:    ev.Target,
+		Outbound:  ev.Outbound,
+		BytesUp:   ev.BytesUp,
+		BytesDown: ev.BytesDown,
+		Error:     ev.Error,
+	}
+	switch ev.Type {
+	case eventOpen:
+		pb.Type = adminpb.ConnectionEvent_OPEN
+	case eventClose:
+		pb.Type = adminpb.ConnectionEvent_CLOSE
+		pb.Duration = durationpb.New(ev.Duration)
+	case eventFailed:
+		pb.Type = adminpb.ConnectionEvent_FAILED
+	}
+	return pb
+}
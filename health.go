@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check defaults, used when the corresponding field is omitted.
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthFall     = 3
+	defaultHealthRise     = 2
+
+	// maxConcurrentProbes bounds the number of in-flight probe dials per round.
+	maxConcurrentProbes = 64
+)
+
+// healthChecker periodically probes every outbound address by opening a TCP
+// connection to the check target from that address. Addresses failing Fall
+// consecutive probes are marked unhealthy and skipped by outbound pools
+// until they pass Rise consecutive probes again.
+//
+// A nil *healthChecker reports every address as healthy.
+type healthChecker struct {
+	cfg   HealthCheckConfig
+	addrs map[string]*addrHealth // keyed by normalized IP; fixed after construction
+	stop  chan struct{}
+}
+
+// addrHealth is the state of one outbound address. Only the checker
+// goroutine touches fails/rises; healthy is read from the connection path.
+type addrHealth struct {
+	ip      net.IP
+	healthy atomic.Bool
+	last    atomic.Pointer[probeResult] // nil until the first probe
+	fails   int
+	rises   int
+}
+
+// probeResult is the outcome of a probe, kept for the admin API.
+type probeResult struct {
+	time time.Time
+	err  error
+}
+
+// newHealthChecker returns a checker for all outbound addresses in entries,
+// or nil if cfg is nil (health checking disabled).
+func newHealthChecker(cfg *HealthCheckConfig, entries []ProxyEntry) *healthChecker {
+	if cfg == nil {
+		return nil
+	}
+	h := &healthChecker{cfg: *cfg, addrs: make(map[string]*addrHealth), stop: make(chan struct{})}
+	for _, entry := range entries {
+		for _, out := range entry.Outbound {
+			if _, ok := h.addrs[out.IPv6]; ok {
+				continue
+			}
+			a := &addrHealth{ip: net.ParseIP(out.IPv6)}
+			a.healthy.Store(true) // optimistic until proven otherwise
+			h.addrs[out.IPv6] = a
+		}
+	}
+	return h
+}
+
+// Healthy reports whether ip currently passes health checks. Addresses the
+// checker does not know about are considered healthy.
+func (h *healthChecker) Healthy(ip net.IP) bool {
+	if h == nil {
+		return true
+	}
+	a, ok := h.addrs[ip.String()]
+	return !ok || a.healthy.Load()
+}
+
+// Run probes all addresses every interval until Stop is called.
+func (h *healthChecker) Run() {
+	logInfo("[health] checking %d outbound addresses via %s every %s", len(h.addrs), h.cfg.Target, h.cfg.Interval)
+
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		h.probeAll()
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run after the current probe round. It is a no-op on nil.
+func (h *healthChecker) Stop() {
+	if h != nil {
+		close(h.stop)
+	}
+}
+
+// inherit copies the health of addresses also known to old, so a reload
+// does not return failing addresses to their pools. old may be nil.
+func (h *healthChecker) inherit(old *healthChecker) {
+	if h == nil || old == nil {
+		return
+	}
+	for ip, a := range h.addrs {
+		if o, ok := old.addrs[ip]; ok {
+			a.healthy.Store(o.healthy.Load())
+		}
+	}
+}
+
+// probeAll runs one round of probes with bounded concurrency.
+func (h *healthChecker) probeAll() {
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	for _, a := range h.addrs {
+		a := a
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			h.record(a, h.probe(a.ip))
+		}()
+	}
+	wg.Wait()
+}
+
+// probe opens and immediately closes a TCP connection to the target from ip.
+func (h *healthChecker) probe(ip net.IP) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	conn, err := dialer.DialContext(ctx, "tcp", h.cfg.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// state returns the health of ip ("healthy", "unhealthy" or, for
+// addresses not checked, "unchecked") and its last probe, if any.
+func (h *healthChecker) state(ip string) (string, *probeResult) {
+	if h == nil {
+		return "unchecked", nil
+	}
+	a, ok := h.addrs[ip]
+	if !ok {
+		return "unchecked", nil
+	}
+	if !a.healthy.Load() {
+		return "unhealthy", a.last.Load()
+	}
+	return "healthy", a.last.Load()
+}
+
+// record applies a probe result and logs state transitions.
+func (h *healthChecker) record(a *addrHealth, err error) {
+	a.last.Store(&probeResult{time: time.Now(), err: err})
+	if err != nil {
+		a.rises = 0
+		a.fails++
+		if a.healthy.Load() && a.fails >= h.cfg.Fall {
+			a.healthy.Store(false)
+			logWarn("[health] %s marked unhealthy after %d failed probes: %v", a.ip, a.fails, err)
+			webhooks.notify(hookUnhealthy, fmt.Sprintf("%s marked unhealthy after %d failed probes of %s: %v", a.ip, a.fails, h.cfg.Target, err),
+				map[string]any{"ipv6": a.ip.String(), "target": h.cfg.Target, "failed_probes": a.fails, "error": err.Error()})
+		}
+		return
+	}
+
+	a.fails = 0
+	if a.healthy.Load() {
+		return
+	}
+	a.rises++
+	if a.rises >= h.cfg.Rise {
+		a.healthy.Store(true)
+		a.rises = 0
+		logInfo("[health] %s recovered, returning to pools", a.ip)
+		webhooks.notify(hookRecovered, fmt.Sprintf("%s recovered, returning to pools", a.ip),
+			map[string]any{"ipv6": a.ip.String(), "target": h.cfg.Target})
+	}
+}
+
+// validateHealthCheck applies defaults and validates the health_check block.
+func validateHealthCheck(hc *HealthCheckConfig) error {
+	if hc.Target == "" {
+		return fmt.Errorf("config: health_check: 'target' is required (e.g. \"[2001:4860:4860::8888]:443\")")
+	}
+	if _, _, err := net.SplitHostPort(hc.Target); err != nil {
+		return fmt.Errorf("config: health_check: invalid target %q: %w", hc.Target, err)
+	}
+	if hc.Interval == 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defaultHealthTimeout
+	}
+	if hc.Fall == 0 {
+		hc.Fall = defaultHealthFall
+	}
+	if hc.Rise == 0 {
+		hc.Rise = defaultHealthRise
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.Fall < 0 || hc.Rise < 0 {
+		return fmt.Errorf("config: health_check: interval, timeout, fall and rise must not be negative")
+	}
+	if hc.Timeout > hc.Interval {
+		return fmt.Errorf("config: health_check: timeout %s exceeds interval %s", hc.Timeout, hc.Interval)
+	}
+	return nil
+}
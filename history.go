@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files kept in the state directory besides the running config.
+const (
+	historyDir   = "history"       // applied configs, one file per version
+	rollbackFile = "rollback.yaml" // version staged by ctl rollback
+	pidFile      = "superproxy.pid"
+)
+
+// defaultHistory is the number of applied configs kept (-state-history).
+const defaultHistory = 10
+
+// stateOptions control what the daemon records in its state directory.
+type stateOptions struct {
+	Dir     string // empty: nothing is recorded
+	History int    // applied configs kept for rollback
+}
+
+// configVersion is one applied config in the history.
+type configVersion struct {
+	Number   int
+	Path     string
+	Recorded time.Time
+}
+
+// recordVersion adds data, a running config snapshot, to the history in
+// dir unless it matches the latest version, and keeps the last keep
+// versions.
+func recordVersion(dir string, data []byte, keep int) error {
+	hdir := filepath.Join(dir, historyDir)
+	if err := os.MkdirAll(hdir, 0o700); err != nil {
+		return err
+	}
+	versions, err := listVersions(dir)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if n := len(versions); n > 0 {
+		latest, err := os.ReadFile(versions[n-1].Path)
+		if err == nil && bytes.Equal(snapshotBody(latest), snapshotBody(data)) {
+			return nil // reloaded without changes
+		}
+		next = versions[n-1].Number + 1
+	}
+	path := filepath.Join(hdir, fmt.Sprintf("%06d.yaml", next))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	versions = append(versions, configVersion{Number: next, Path: path})
+	for len(versions) > keep && keep > 0 {
+		os.Remove(versions[0].Path)
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// snapshotBody strips the header comment (pid and time) of a snapshot.
+func snapshotBody(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte("#")) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return data[i+1:]
+		}
+	}
+	return data
+}
+
+// listVersions returns the recorded versions in dir, oldest first.
+func listVersions(dir string) ([]configVersion, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, historyDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []configVersion
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".yaml"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".yaml") {
+			continue
+		}
+		v := configVersion{Number: n, Path: filepath.Join(dir, historyDir, e.Name())}
+		if info, err := e.Info(); err == nil {
+			v.Recorded = info.ModTime()
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number < versions[j].Number })
+	return versions, nil
+}
+
+// findVersion returns version n of the history in dir, or with n == 0 the
+// version before the latest (the one running before the last reload).
+func findVersion(dir string, n int) (configVersion, error) {
+	versions, err := listVersions(dir)
+	if err != nil {
+		return configVersion{}, err
+	}
+	if n == 0 {
+		if len(versions) < 2 {
+			return configVersion{}, fmt.Errorf("no previous version recorded in %s", dir)
+		}
+		return versions[len(versions)-2], nil
+	}
+	for _, v := range versions {
+		if v.Number == n {
+			return v, nil
+		}
+	}
+	return configVersion{}, fmt.Errorf("version %d not found in %s (see ctl history)", n, dir)
+}
+
+// writePIDFile records the daemon's pid so ctl can signal it.
+func writePIDFile(dir string) error {
+	return os.WriteFile(filepath.Join(dir, pidFile), []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// readPIDFile returns the pid of the daemon recording in dir.
+func readPIDFile(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, pidFile))
+	if err != nil {
+		return 0, fmt.Errorf("daemon not running with -state-dir %s? %w", dir, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usersFileDebounce is how long the users_file must be left alone after a
+// change before it is re-read, so a provisioning system rewriting it in
+// several steps triggers a single reload.
+const usersFileDebounce = time.Second
+
+// fileCreds is the contents of a users_file: bcrypt hashes by user name.
+type fileCreds struct {
+	data     []byte
+	hashes   map[string][]byte
+	accounts map[string]*account // for users only in the file
+	names    []string            // sorted
+
+	// verified holds, by user name, the loginKey of the password last
+	// found to match, so a client logging in again skips bcrypt.
+	verified sync.Map
+}
+
+// usersFile is the htpasswd-style users_file of the running configuration,
+// re-read whenever it changes on disk.
+type usersFile struct {
+	mu    sync.Mutex
+	path  string
+	stop  chan struct{} // ends the watch of path
+	creds atomic.Pointer[fileCreds]
+}
+
+// passwordFile is the users_file of the running daemon.
+var passwordFile usersFile
+
+// update switches to the users_file path ("": none), reading it now and
+// again whenever it changes. If it cannot be read, the users it held so
+// far stay in effect.
+func (f *usersFile) update(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if path == f.path {
+		if path != "" {
+			f.reload()
+		}
+		return
+	}
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+	f.path = path
+	if path == "" {
+		f.creds.Store(nil)
+		return
+	}
+	f.creds.Store(nil)
+	f.reload()
+	stop := make(chan struct{})
+	if err := watchUsersFile(path, stop, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.stop == stop {
+			f.reload()
+		}
+	}); err != nil {
+		logWarn("[users] %v; changes to %s apply on reload only", err, path)
+	}
+	f.stop = stop
+}
+
+// reload re-reads the file if its contents changed; f.mu is held.
+func (f *usersFile) reload() {
+	old := f.creds.Load()
+	data, err := os.ReadFile(f.path)
+	if err == nil && old != nil && bytes.Equal(data, old.data) {
+		return
+	}
+	var creds *fileCreds
+	if err == nil {
+		creds, err = parseUsersFile(data)
+	}
+	if err != nil {
+		logWarn("[users] users_file %s: %v; keeping the %d users read before", f.path, err, old.count())
+		return
+	}
+	f.creds.Store(creds)
+	logInfo("[users] read %d users from %s", len(creds.names), f.path)
+}
+
+// count returns the number of users in c (nil: none).
+func (c *fileCreds) count() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.names)
+}
+
+// verify checks password against the hash of the user name in the running
+// users_file. known reports whether the file has the user at all.
+func (f *usersFile) verify(name string, password []byte) (a *account, known, ok bool) {
+	c := f.creds.Load()
+	if c == nil {
+		return nil, false, false
+	}
+	p, known := c.hashes[name]
+	if !known {
+		return nil, false, false
+	}
+	a = c.accounts[name]
+	sum := loginKey(string(password))
+	if last, found := c.verified.Load(name); found && subtle.ConstantTimeCompare(last.([]byte), sum[:]) == 1 {
+		return a, true, true
+	}
+	if bcrypt.CompareHashAndPassword(p, password) != nil {
+		return a, true, false
+	}
+	c.verified.Store(name, sum[:])
+	return a, true, true
+}
+
+// parseUsersFile parses htpasswd-style lines "name:hash", with bcrypt
+// hashes ("htpasswd -B"); blank lines and lines starting with # are
+// skipped.
+func parseUsersFile(data []byte) (*fileCreds, error) {
+	c := &fileCreds{data: data, hashes: make(map[string][]byte), accounts: make(map[string]*account)}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		switch {
+		case !ok || name == "":
+			return nil, fmt.Errorf("line %d: expected name:hash", n)
+		case len(name) > 255:
+			return nil, fmt.Errorf("line %d: name is longer than 255 bytes", n)
+		}
+		if _, dup := c.hashes[name]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, name)
+		}
+		if err := checkBcrypt(hash); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %w", n, name, err)
+		}
+		c.hashes[name] = []byte(hash)
+		c.accounts[name] = &account{cfg: UserConfig{Name: name}, stats: statsOfUser(name)}
+		c.names = append(c.names, name)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(c.names)
+	return c, nil
+}
+
+// errBcryptHash rejects a malformed bcrypt hash.
+var errBcryptHash = errors.New("not a bcrypt hash ($2a$, $2b$ or $2y$)")
+
+// checkBcrypt reports whether h is a bcrypt hash "$2y$10$<salt><hash>" of
+// a version htpasswd writes, with a valid cost.
+func checkBcrypt(h string) error {
+	if len(h) != 60 || !strings.HasPrefix(h, "$2a$") && !strings.HasPrefix(h, "$2b$") && !strings.HasPrefix(h, "$2y$") {
+		return errBcryptHash
+	}
+	if _, err := bcrypt.Cost([]byte(h)); err != nil {
+		return errBcryptHash
+	}
+	return nil
+}
+
+// readUsersFile reads and parses the users_file at path.
+func readUsersFile(path string) (*fileCreds, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseUsersFile(data)
+}
+
+// watchUsersFile calls changed, debounced, after each change of the
+// directory holding path until stop is closed. The directory is watched
+// rather than the file, which provisioning tools usually replace.
+func watchUsersFile(path string, stop <-chan struct{}, changed func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch %s: %w", path, err)
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return fmt.Errorf("watch %s: %w", path, err)
+	}
+	go func() {
+		defer w.Close()
+		timer := time.NewTimer(usersFileDebounce)
+		timer.Stop()
+		base := filepath.Base(path)
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(ev.Name) == base || strings.HasPrefix(filepath.Base(ev.Name), "..") {
+					timer.Reset(usersFileDebounce) // the file, or a ConfigMap's ..data swap
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logWarn("[users] %v", err)
+			case <-timer.C:
+				changed()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stringList is a YAML string or list of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*l = stringList{n.Value}
+		return nil
+	}
+	var list []string
+	if err := n.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// includedFiles expands the include patterns of the config file at path.
+// Relative patterns are resolved against the directory of path; matches of
+// each pattern are taken in lexical order. A pattern matching nothing is
+// not an error, so an empty conf.d is fine.
+func includedFiles(path string, patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("config: include %q: %w", pattern, err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// loadIncludes merges the fragments named by cfg.Include into cfg. A
+// fragment may only contain proxies and hosts: its proxies are appended
+// after those of the main file, its hosts are added (a name defined twice is
+// an error). The fragment's format is detected from its extension.
+func loadIncludes(cfg *Config, path string) error {
+	if len(cfg.Include) > 0 && isRemoteConfig(path) {
+		return fmt.Errorf("config: include is not supported in a remote config")
+	}
+	files, err := includedFiles(path, cfg.Include)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		frag, err := readConfigFile(file, "")
+		if err != nil {
+			return err
+		}
+		rest := *frag
+		rest.Proxies, rest.Hosts = nil, nil
+		if !reflect.DeepEqual(rest, Config{}) {
+			return fmt.Errorf("config: %s: included files may only set 'proxies' and 'hosts'", file)
+		}
+
+		for i := range frag.Proxies {
+			frag.Proxies[i].origin = fmt.Sprintf("%s: proxies[%d]", file, i)
+		}
+		cfg.Proxies = append(cfg.Proxies, frag.Proxies...)
+
+		for name, ip := range frag.Hosts {
+			if _, dup := cfg.Hosts[name]; dup {
+				return fmt.Errorf("config: %s: hosts: %q is already defined", file, name)
+			}
+			if cfg.Hosts == nil {
+				cfg.Hosts = make(map[string]string)
+			}
+			cfg.Hosts[name] = ip
+		}
+	}
+	return nil
+}
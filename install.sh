@@ -197,7 +197,8 @@ Wants=network-online.target
 
 [Service]
 Type=simple
-ExecStart=/usr/superproxy/superproxy -config /etc/superproxy/config.yaml
+ExecStart=/usr/superproxy/superproxy -config /etc/superproxy/config.yaml -state-dir /var/lib/superproxy
+ExecReload=/bin/kill -HUP $MAINPID
 WorkingDirectory=/usr/superproxy
 
 # Restart policy
@@ -211,6 +212,8 @@ NoNewPrivileges=true
 ProtectSystem=strict
 ProtectHome=true
 ReadOnlyPaths=/etc/superproxy
+StateDirectory=superproxy
+LogsDirectory=superproxy
 PrivateTmp=true
 
 # Capabilities: bind low ports + manage network interfaces (ip addr add)
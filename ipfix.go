@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPFIX defaults and limits.
+const (
+	defaultIPFIXPort    = "4739"
+	defaultIPFIXRefresh = time.Minute
+	ipfixQueue          = 8192        // unsent flow records; more are dropped
+	ipfixMaxMessage     = 1432        // keeps datagrams within a 1500-byte MTU
+	ipfixFlushInterval  = time.Second // longest a record waits for a full message
+	ipfixVersion        = 10
+	ipfixTemplateBase   = 256   // template IDs 256..259, see ipfixTemplateID
+	ipfixReversePEN     = 29305 // RFC 5103 reverse information elements
+	ipfixEndOfFlow      = 3     // flowEndReason: end of flow detected
+)
+
+// flowRecord is the IPFIX flow of one relayed connection: from the client
+// to the target, translated to the outbound address.
+type flowRecord struct {
+	client, target, outbound *net.TCPAddr
+	up, down                 int64 // bytes client → target, target → client
+	start, end               time.Time
+}
+
+// ipfixSink exports flow records to an IPFIX collector (RFC 7011) over UDP.
+// Relays never block on it: a goroutine sends the records in batches, and
+// when the queue is full records are dropped.
+type ipfixSink struct {
+	mu      sync.Mutex
+	cfg     *IPFIXConfig
+	queue   chan flowRecord // nil while export is off
+	done    chan struct{}
+	on      atomic.Bool
+	dropped atomic.Int64
+	closed  bool
+}
+
+// flowExport is the IPFIX export of the running daemon.
+var flowExport ipfixSink
+
+// update applies a validated ipfix block (nil: none). Records already
+// queued go out over the previous socket.
+func (s *ipfixSink) update(cfg *IPFIXConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || reflect.DeepEqual(cfg, s.cfg) {
+		return nil
+	}
+	var conn net.Conn
+	if cfg != nil {
+		var err error
+		if conn, err = net.Dial("udp", cfg.Collector); err != nil {
+			return fmt.Errorf("ipfix: %w", err)
+		}
+	}
+	if s.queue != nil {
+		close(s.queue)
+		s.queue = nil
+	}
+	s.cfg = cfg
+	s.on.Store(cfg != nil)
+	if cfg == nil {
+		logInfo("[ipfix] stopped")
+		return nil
+	}
+	s.queue, s.done = make(chan flowRecord, ipfixQueue), make(chan struct{})
+	e := &ipfixEmitter{cfg: cfg, conn: conn, dropped: &s.dropped}
+	go e.run(s.queue, s.done)
+	logInfo("[ipfix] exporting flows to %s, observation domain %d", cfg.Collector, cfg.ObservationDomain)
+	return nil
+}
+
+// active reports whether flows are exported.
+func (s *ipfixSink) active() bool { return s.on.Load() }
+
+// export queues the flow record r.
+func (s *ipfixSink) export(r flowRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil {
+		return
+	}
+	select {
+	case s.queue <- r:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close stops the export, waiting up to timeout for queued records.
+func (s *ipfixSink) close(timeout time.Duration) {
+	s.mu.Lock()
+	s.closed = true
+	s.on.Store(false)
+	if s.queue == nil {
+		s.mu.Unlock()
+		return
+	}
+	close(s.queue)
+	s.queue = nil
+	done := s.done
+	s.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// ipfixEmitter is the goroutine behind an ipfixSink: it packs records into
+// messages of one data set per template, and resends the templates every
+// template_refresh, as UDP collectors forget them.
+type ipfixEmitter struct {
+	cfg     *IPFIXConfig
+	conn    net.Conn
+	dropped *atomic.Int64
+	seq     uint32 // data records sent before the current message
+	records uint32 // data records in the current message
+	msg     []byte
+	set     int // offset of the open data set in msg (0: none)
+	setID   uint16
+}
+
+func (e *ipfixEmitter) run(queue <-chan flowRecord, done chan<- struct{}) {
+	defer close(done)
+	defer e.conn.Close()
+	e.sendTemplates()
+	flush := time.NewTicker(ipfixFlushInterval)
+	defer flush.Stop()
+	refresh := time.NewTicker(e.cfg.TemplateRefresh)
+	defer refresh.Stop()
+	for {
+		select {
+		case r, ok := <-queue:
+			if !ok {
+				e.flush()
+				return
+			}
+			e.add(&r)
+		case <-flush.C:
+			e.flush()
+			if n := e.dropped.Swap(0); n > 0 {
+				logWarn("[ipfix] %d flow records dropped: the export queue was full", n)
+			}
+		case <-refresh.C:
+			e.flush()
+			e.sendTemplates()
+		}
+	}
+}
+
+// add appends r to the message being built, sending the message first if
+// r would not fit.
+func (e *ipfixEmitter) add(r *flowRecord) {
+	client6, target6 := r.client.IP.To4() == nil, r.target.IP.To4() == nil
+	id := ipfixTemplateID(client6, target6)
+	need := ipfixRecordLen(client6, target6)
+	if e.set == 0 || e.setID != id {
+		need += 4
+	}
+	if len(e.msg) > 0 && len(e.msg)+need > ipfixMaxMessage {
+		e.flush()
+	}
+	if len(e.msg) == 0 {
+		e.msg = append(e.msg[:0], make([]byte, 16)...) // header, filled in by flush
+	}
+	if e.set == 0 || e.setID != id {
+		e.closeSet()
+		e.set, e.setID = len(e.msg), id
+		e.msg = binary.BigEndian.AppendUint16(e.msg, id)
+		e.msg = append(e.msg, 0, 0) // set length, filled in by closeSet
+	}
+	e.msg = appendFlow(e.msg, r, client6, target6)
+	e.records++
+}
+
+// closeSet fills in the length of the open data set.
+func (e *ipfixEmitter) closeSet() {
+	if e.set != 0 {
+		binary.BigEndian.PutUint16(e.msg[e.set+2:], uint16(len(e.msg)-e.set))
+		e.set = 0
+	}
+}
+
+// flush sends the message being built.
+func (e *ipfixEmitter) flush() {
+	if len(e.msg) == 0 {
+		return
+	}
+	e.closeSet()
+	e.write(e.msg, e.seq)
+	e.seq += e.records
+	e.records = 0
+	e.msg = e.msg[:0]
+}
+
+// sendTemplates sends the templates of all four address family
+// combinations in a message of their own.
+func (e *ipfixEmitter) sendTemplates() {
+	msg := make([]byte, 16, 256)
+	set := len(msg)
+	msg = append(msg, 0, 2, 0, 0) // template set
+	for _, client6 := range []bool{false, true} {
+		for _, target6 := range []bool{false, true} {
+			fields := ipfixFields(client6, target6)
+			msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateID(client6, target6))
+			msg = binary.BigEndian.AppendUint16(msg, uint16(len(fields)))
+			for _, f := range fields {
+				if f.pen == 0 {
+					msg = binary.BigEndian.AppendUint16(msg, f.id)
+					msg = binary.BigEndian.AppendUint16(msg, f.length)
+					continue
+				}
+				msg = binary.BigEndian.AppendUint16(msg, f.id|0x8000)
+				msg = binary.BigEndian.AppendUint16(msg, f.length)
+				msg = binary.BigEndian.AppendUint32(msg, f.pen)
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+	e.write(msg, e.seq)
+}
+
+// write fills in the message header of msg and sends it.
+func (e *ipfixEmitter) write(msg []byte, seq uint32) {
+	binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(msg[8:], seq)
+	binary.BigEndian.PutUint32(msg[12:], e.cfg.ObservationDomain)
+	if _, err := e.conn.Write(msg); err != nil {
+		logDebug("[ipfix] sending to %s: %v", e.cfg.Collector, err)
+	}
+}
+
+// ipfixField is a field specifier of a template.
+type ipfixField struct {
+	id, length uint16
+	pen        uint32 // enterprise number (0: IANA)
+}
+
+// ipfixFields returns the fields of the template for a client and a target
+// (and outbound address) of the given families, in the order appendFlow
+// writes them.
+func ipfixFields(client6, target6 bool) []ipfixField {
+	src, dst, nat, clientLen, targetLen := uint16(8), uint16(12), uint16(225), uint16(4), uint16(4)
+	if client6 {
+		src, clientLen = 27, 16
+	}
+	if target6 {
+		dst, nat, targetLen = 28, 281, 16
+	}
+	return []ipfixField{
+		{id: src, length: clientLen},             // sourceIPv4Address / sourceIPv6Address
+		{id: 7, length: 2},                       // sourceTransportPort
+		{id: dst, length: targetLen},             // destinationIPv4Address / destinationIPv6Address
+		{id: 11, length: 2},                      // destinationTransportPort
+		{id: nat, length: targetLen},             // postNATSourceIPv4Address / postNATSourceIPv6Address
+		{id: 227, length: 2},                     // postNAPTSourceTransportPort
+		{id: 4, length: 1},                       // protocolIdentifier
+		{id: 1, length: 8},                       // octetDeltaCount
+		{id: 2, length: 8},                       // packetDeltaCount
+		{id: 1, length: 8, pen: ipfixReversePEN}, // reverse octetDeltaCount
+		{id: 2, length: 8, pen: ipfixReversePEN}, // reverse packetDeltaCount
+		{id: 152, length: 8},                     // flowStartMilliseconds
+		{id: 153, length: 8},                     // flowEndMilliseconds
+		{id: 136, length: 1},                     // flowEndReason
+	}
+}
+
+func ipfixTemplateID(client6, target6 bool) uint16 {
+	id := uint16(ipfixTemplateBase)
+	if client6 {
+		id += 2
+	}
+	if target6 {
+		id++
+	}
+	return id
+}
+
+// ipfixRecordLen returns the length of a data record of the template for
+// the given families.
+func ipfixRecordLen(client6, target6 bool) int {
+	n := 0
+	for _, f := range ipfixFields(client6, target6) {
+		n += int(f.length)
+	}
+	return n
+}
+
+// appendFlow appends the data record of r.
+func appendFlow(b []byte, r *flowRecord, client6, target6 bool) []byte {
+	b = appendFlowIP(b, r.client.IP, client6)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.client.Port))
+	b = appendFlowIP(b, r.target.IP, target6)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.target.Port))
+	b = appendFlowIP(b, r.outbound.IP, target6)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.outbound.Port))
+	b = append(b, 6) // TCP
+	b = binary.BigEndian.AppendUint64(b, uint64(r.up))
+	b = binary.BigEndian.AppendUint64(b, flowPackets(r.up, target6))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.down))
+	b = binary.BigEndian.AppendUint64(b, flowPackets(r.down, target6))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	return append(b, ipfixEndOfFlow)
+}
+
+// addrOf returns a as a TCP address, parsing it if it is of another type
+// (nil IP if it cannot be parsed).
+func addrOf(a net.Addr) *net.TCPAddr {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		return ta
+	}
+	ap, _ := netip.ParseAddrPort(a.String())
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// appendFlowIP appends ip in 16 or 4 bytes.
+func appendFlowIP(b []byte, ip net.IP, v6 bool) []byte {
+	if v6 {
+		if ip16 := ip.To16(); ip16 != nil {
+			return append(b, ip16...)
+		}
+		return append(b, make([]byte, 16)...)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(b, ip4...)
+	}
+	return append(b, make([]byte, 4)...)
+}
+
+// flowPackets estimates the packets that carried n bytes of payload on the
+// outbound side, as full segments of a 1500-byte MTU; the relay does not
+// see packets.
+func flowPackets(n int64, v6 bool) uint64 {
+	mss := int64(1460)
+	if v6 {
+		mss = 1440
+	}
+	return uint64((n + mss - 1) / mss)
+}
+
+// validateIPFIX validates the ipfix block and fills in its defaults.
+func validateIPFIX(ic *IPFIXConfig) error {
+	if ic.Collector == "" {
+		return fmt.Errorf("config: ipfix: 'collector' is required (e.g. \"192.0.2.10:4739\")")
+	}
+	if _, _, err := net.SplitHostPort(ic.Collector); err != nil {
+		ic.Collector = net.JoinHostPort(strings.Trim(ic.Collector, "[]"), defaultIPFIXPort)
+	}
+	if _, _, err := net.SplitHostPort(ic.Collector); err != nil {
+		return fmt.Errorf("config: ipfix: invalid collector %q: %w", ic.Collector, err)
+	}
+	if ic.TemplateRefresh < 0 {
+		return fmt.Errorf("config: ipfix: template_refresh must not be negative")
+	}
+	if ic.TemplateRefresh == 0 {
+		ic.TemplateRefresh = defaultIPFIXRefresh
+	}
+	return nil
+}
@@ -17,3 +17,19 @@ func ParseIPv6(s string) (net.IP, error) {
 	}
 	return ip, nil
 }
+
+// nthAddress returns the address n positions after the network address of
+// prefix, or false if that lies outside the prefix.
+func nthAddress(prefix *net.IPNet, n uint64) (net.IP, bool) {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	for i := net.IPv6len - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(ip[i]) + n&0xff
+		ip[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	if n > 0 || !prefix.Contains(ip) {
+		return nil, false
+	}
+	return ip, true
+}
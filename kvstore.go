@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key-value store config sources (-config consul://host:8500/key).
+const (
+	kvConsul = "consul"
+	kvEtcd   = "etcd"
+)
+
+const (
+	// kvWatchWait bounds one blocking query or watch stream; the watch is
+	// then re-established, which also detects a silently dead connection.
+	kvWatchWait = 5 * time.Minute
+
+	// kvRetryInterval is the pause after a failed watch request.
+	kvRetryInterval = 5 * time.Second
+)
+
+// kvSource is a config stored under one key of Consul KV or etcd, spelled
+// consul://host:port/key or etcd://[user:password@]host:port/key; the
+// scheme suffix +https (consul+https://...) selects TLS.
+type kvSource struct {
+	kind     string
+	base     string // http(s)://host:port
+	key      string
+	user     *url.Userinfo // etcd authentication
+	headers  []string      // e.g. X-Consul-Token: ${CONSUL_HTTP_TOKEN}
+	revision uint64        // Consul index / etcd revision of the last get
+}
+
+// parseKVSource parses path if it names a key-value store config.
+func parseKVSource(path string) (*kvSource, bool) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, false
+	}
+	kind, tls, _ := strings.Cut(u.Scheme, "+")
+	if (kind != kvConsul && kind != kvEtcd) || (tls != "" && tls != "https") {
+		return nil, false
+	}
+	scheme := "http"
+	if tls != "" {
+		scheme = "https"
+	}
+	return &kvSource{
+		kind: kind,
+		base: scheme + "://" + u.Host,
+		key:  strings.TrimPrefix(u.Path, "/"),
+		user: u.User,
+	}, true
+}
+
+// get reads the config stored under the key.
+func (s *kvSource) get() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+	if s.kind == kvConsul {
+		return s.consulGet(ctx, 0)
+	}
+	return s.etcdGet(ctx)
+}
+
+// wait blocks until the key changes after the last get, or kvWatchWait
+// passes, and reports whether it changed.
+func (s *kvSource) wait() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kvWatchWait+remoteConfigTimeout)
+	defer cancel()
+	if s.kind == kvConsul {
+		last := s.revision
+		if _, err := s.consulGet(ctx, last); err != nil {
+			return false, err
+		}
+		return s.revision != last, nil
+	}
+	return s.etcdWait(ctx)
+}
+
+// consulGet reads the key, as a blocking query if index is not 0.
+func (s *kvSource) consulGet(ctx context.Context, index uint64) ([]byte, error) {
+	u := s.base + "/v1/kv/" + s.key + "?raw"
+	if index != 0 {
+		u += fmt.Sprintf("&index=%d&wait=%ds", index, int(kvWatchWait.Seconds()))
+	}
+	body, header, err := requestURL(ctx, http.MethodGet, u, nil, s.headers)
+	if err != nil {
+		return nil, err
+	}
+	next, _ := strconv.ParseUint(header.Get("X-Consul-Index"), 10, 64)
+	if next < s.revision {
+		next = 0 // the index went backwards (e.g. a restored snapshot): start over
+	}
+	s.revision = next
+	return body, nil
+}
+
+// etcdHeaders returns the request headers, authenticating first if the
+// source has credentials.
+func (s *kvSource) etcdHeaders(ctx context.Context) ([]string, error) {
+	if s.user == nil {
+		return s.headers, nil
+	}
+	password, _ := s.user.Password()
+	req, _ := json.Marshal(map[string]string{"name": s.user.Username(), "password": password})
+	body, _, err := requestURL(ctx, http.MethodPost, s.base+"/v3/auth/authenticate", req, s.headers)
+	if err != nil {
+		return nil, fmt.Errorf("etcd authenticate: %w", err)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("etcd authenticate: %w", err)
+	}
+	return append([]string{"Authorization: " + resp.Token}, s.headers...), nil
+}
+
+// etcdGet reads the key through the etcd v3 JSON gateway.
+func (s *kvSource) etcdGet(ctx context.Context) ([]byte, error) {
+	headers, err := s.etcdHeaders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))})
+	body, _, err := requestURL(ctx, http.MethodPost, s.base+"/v3/kv/range", req, headers)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Value []byte `json:"value"` // base64 in JSON
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, fmt.Errorf("etcd: key %q not found", s.key)
+	}
+	s.revision, _ = strconv.ParseUint(resp.Header.Revision, 10, 64)
+	return resp.KVs[0].Value, nil
+}
+
+// etcdWait watches the key from the revision after the last get.
+func (s *kvSource) etcdWait(ctx context.Context) (bool, error) {
+	headers, err := s.etcdHeaders(ctx)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, kvWatchWait)
+	defer cancel()
+	req, _ := json.Marshal(map[string]any{"create_request": map[string]any{
+		"key":            base64.StdEncoding.EncodeToString([]byte(s.key)),
+		"start_revision": strconv.FormatUint(s.revision+1, 10),
+	}})
+	resp, err := openURL(ctx, http.MethodPost, s.base+"/v3/watch", req, headers)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// The response is a stream of JSON messages, the first confirming the
+	// watch; any message with events means the key changed.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Header struct {
+					Revision string `json:"revision"`
+				} `json:"header"`
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return false, nil // wait elapsed without changes
+			}
+			return false, fmt.Errorf("etcd watch: %w", err)
+		}
+		if msg.Error != nil {
+			return false, fmt.Errorf("etcd watch: %s", msg.Error.Message)
+		}
+		if len(msg.Result.Events) > 0 {
+			s.revision, _ = strconv.ParseUint(msg.Result.Header.Revision, 10, 64)
+			return true, nil
+		}
+	}
+}
+
+// watchKV watches the config key of a key-value store source and signals
+// on the returned channel when its value has changed and no further change
+// arrived for debounce, like watchConfig for files.
+func watchKV(path string, opts remoteOptions, debounce time.Duration) (<-chan struct{}, error) {
+	s, _ := parseKVSource(path)
+	s.headers = opts.Headers
+	last, err := s.get()
+	if err != nil {
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		for {
+			changed, err := s.wait()
+			if err != nil {
+				logWarn("[watch] %s: %v", path, err)
+				time.Sleep(kvRetryInterval)
+				// Start over from the current revision (the last one may
+				// have been compacted away); recheck for a missed change.
+				_, err = s.get()
+				changed = err == nil
+			}
+			if changed {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		for {
+			select {
+			case <-events:
+				timer.Reset(debounce)
+			case <-timer.C:
+				data, err := fetchConfig(path, opts)
+				if err != nil || bytes.Equal(data, last) {
+					continue // the reload would fail too, or nothing changed
+				}
+				last = data
+				select {
+				case changes <- struct{}{}:
+				default: // a reload is already pending
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
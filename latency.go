@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets. A
+// last bucket holds longer durations.
+var latencyBounds = [...]time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute,
+	15 * time.Minute, time.Hour,
+}
+
+const latencyBuckets = len(latencyBounds) + 1
+
+// latencyHistogram counts durations in fixed buckets. It is lock-free, so
+// the connection path only pays for two atomic adds per observation.
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Int64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// latencySnapshot is a copy of a histogram's counts, or the difference of
+// two copies.
+type latencySnapshot struct {
+	counts [latencyBuckets]int64
+	sum    time.Duration
+}
+
+func (h *latencyHistogram) snapshot() latencySnapshot {
+	var s latencySnapshot
+	for i := range h.counts {
+		s.counts[i] = h.counts[i].Load()
+	}
+	s.sum = time.Duration(h.sum.Load())
+	return s
+}
+
+// since returns what was observed after prev.
+func (s latencySnapshot) since(prev latencySnapshot) latencySnapshot {
+	for i := range s.counts {
+		s.counts[i] -= prev.counts[i]
+	}
+	s.sum -= prev.sum
+	return s
+}
+
+func (s latencySnapshot) count() int64 {
+	var n int64
+	for _, c := range s.counts {
+		n += c
+	}
+	return n
+}
+
+func (s latencySnapshot) mean() time.Duration {
+	n := s.count()
+	if n == 0 {
+		return 0
+	}
+	return s.sum / time.Duration(n)
+}
+
+// quantile estimates the q-quantile (0 < q <= 1) by interpolating within
+// its bucket. In the last bucket it returns the largest bound, the most
+// that is known.
+func (s latencySnapshot) quantile(q float64) time.Duration {
+	n := s.count()
+	if n == 0 {
+		return 0
+	}
+	rank := q * float64(n)
+	var seen float64
+	for i, c := range s.counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(latencyBounds) {
+			return latencyBounds[i-1]
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		return lower + time.Duration(float64(latencyBounds[i]-lower)*(rank-seen)/float64(c))
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// latencyInfo is the API representation of a latency histogram, in
+// milliseconds.
+type latencyInfo struct {
+	Count  int64   `json:"count"`
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P90MS  float64 `json:"p90_ms"`
+	P99MS  float64 `json:"p99_ms"`
+}
+
+func (s latencySnapshot) info() latencyInfo {
+	return latencyInfo{Count: s.count(), MeanMS: millis(s.mean()), P50MS: millis(s.quantile(0.5)), P90MS: millis(s.quantile(0.9)), P99MS: millis(s.quantile(0.99))}
+}
+
+// millis returns d in milliseconds, to the microsecond.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// latencyStats are the histograms of a listener.
+type latencyStats struct {
+	Handshake latencyInfo `json:"handshake"` // accept to a complete SOCKS5 request
+	DNS       latencyInfo `json:"dns"`       // resolving domain targets
+	Dial      latencyInfo `json:"dial"`      // connecting to the target, all attempts
+	Session   latencyInfo `json:"session"`   // accept to close, of relayed connections
+}
+
+// latencyPhases names the histograms of portStats, for StatsD and ctl.
+var latencyPhases = [...]string{"handshake", "dns", "dial", "session"}
+
+// latencies returns the histograms of st in latencyPhases order.
+func (st *portStats) latencies() [len(latencyPhases)]*latencyHistogram {
+	return [...]*latencyHistogram{&st.Handshake, &st.DNS, &st.Dial, &st.Session}
+}
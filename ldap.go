@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ldap defaults, for the options an ldap block leaves out.
+const (
+	defaultLDAPUserFilter  = "(uid={user})"
+	defaultLDAPGroupFilter = "(|(member={dn})(uniqueMember={dn})(memberUid={user}))"
+	defaultLDAPTimeout     = 5 * time.Second
+	defaultLDAPCacheTTL    = 5 * time.Minute
+	defaultLDAPDenyTTL     = 30 * time.Second
+	defaultLDAPCacheSize   = 10000
+)
+
+// Values of proxies[].auth_backend.
+const (
+	authBackendUsers = "users"
+	authBackendLDAP  = "ldap"
+)
+
+// LDAP (RFC 4511) elements, BER-encoded; every tag LDAP uses fits in one
+// byte.
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	ldapMaxMessage = 1 << 20 // bytes of a response read at most
+)
+
+var errBER = errors.New("ldap: malformed response")
+
+// ldapBackend checks the logins of listeners with auth_backend ldap: a
+// successful bind as the user (and membership of ldap.group_dn) allows the
+// login, invalid credentials deny it, anything else is an outage that
+// refuses the login without counting against the client. Decisions are
+// cached per credentials.
+type ldapBackend struct {
+	mu    sync.Mutex
+	cfg   *LDAPConfig // nil: off
+	tls   *tls.Config
+	err   error // of the TLS settings
+	cache *loginCache
+}
+
+// ldapAuth is the ldap backend of the running daemon.
+var ldapAuth ldapBackend
+
+// update applies a validated ldap block (nil: off), forgetting the cached
+// decisions.
+func (b *ldapBackend) update(cfg *LDAPConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg, b.tls, b.err, b.cache = cfg, nil, nil, nil
+	if cfg == nil {
+		return
+	}
+	b.tls, b.err = ldapTLSConfig(cfg)
+	b.cache = newLoginCache(cfg.CacheSize)
+}
+
+// check reports whether name may log in with password, and returns an
+// error if the directory could not decide.
+func (b *ldapBackend) check(name string, password []byte) (bool, error) {
+	if len(password) == 0 {
+		return false, nil // an unauthenticated bind, which servers accept (RFC 4513)
+	}
+	b.mu.Lock()
+	cfg, tc, err, cache := b.cfg, b.tls, b.err, b.cache
+	b.mu.Unlock()
+	switch {
+	case cfg == nil:
+		return false, fmt.Errorf("ldap is off")
+	case err != nil:
+		return false, err
+	}
+	key := loginKey(name, string(password))
+	if allow, ok := cache.get(key); ok {
+		return allow, nil
+	}
+	allow, err := ldapLogin(cfg, tc, name, string(password))
+	if err != nil {
+		return false, err
+	}
+	cache.put(key, allow, cfg.CacheTTL, cfg.DenyTTL)
+	return allow, nil
+}
+
+// ldapLogin binds to the directory as the user name, found from the
+// user_dn template or by a search, and checks its group membership.
+func ldapLogin(cfg *LDAPConfig, tc *tls.Config, name, password string) (bool, error) {
+	c, err := dialLDAP(cfg, tc, time.Now().Add(cfg.Timeout))
+	if err != nil {
+		return false, err
+	}
+	defer c.close()
+
+	var dn string
+	if cfg.UserDN != "" {
+		dn = expandLDAP(cfg.UserDN, name, "", escapeDN)
+	} else {
+		if err := c.serviceBind(cfg); err != nil {
+			return false, err
+		}
+		filter, err := compileFilter(expandLDAP(cfg.UserFilter, name, "", escapeFilter))
+		if err != nil {
+			return false, fmt.Errorf("ldap: user_filter: %w", err)
+		}
+		dns, err := c.search(cfg.BaseDN, ldapScopeSubtree, filter, 2)
+		switch {
+		case err != nil:
+			return false, err
+		case len(dns) == 0:
+			return false, nil
+		case len(dns) > 1:
+			return false, fmt.Errorf("ldap: several entries below %s match user %q", cfg.BaseDN, name)
+		}
+		dn = dns[0]
+	}
+
+	code, diag, err := c.bind(dn, password)
+	switch {
+	case err != nil:
+		return false, err
+	case code == ldapInvalidCredentials:
+		return false, nil
+	case code != ldapSuccess:
+		return false, ldapError("bind as "+dn, code, diag)
+	}
+	if cfg.GroupDN == "" {
+		return true, nil
+	}
+	if err := c.serviceBind(cfg); err != nil {
+		return false, err
+	}
+	filter, err := compileFilter(expandLDAP(cfg.GroupFilter, name, dn, escapeFilter))
+	if err != nil {
+		return false, fmt.Errorf("ldap: group_filter: %w", err)
+	}
+	dns, err := c.search(cfg.GroupDN, ldapScopeBase, filter, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(dns) > 0, nil
+}
+
+// ldapConn is a connection to a directory server, one request at a time.
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int // of the last request
+}
+
+// dialLDAP connects to the server of cfg, upgrading the connection with
+// StartTLS if configured, for requests until deadline.
+func dialLDAP(cfg *LDAPConfig, tc *tls.Config, deadline time.Time) (*ldapConn, error) {
+	u, _ := url.Parse(cfg.URL) // validated
+	d := net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(&d, "tcp", ldapAddress(u), tc)
+	} else {
+		conn, err = d.Dial("tcp", ldapAddress(u))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	conn.SetDeadline(deadline)
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if cfg.StartTLS {
+		if err := c.startTLS(tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ldapAddress returns the host:port of an ldap:// or ldaps:// URL.
+func ldapAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "ldaps" {
+		return net.JoinHostPort(u.Hostname(), "636")
+	}
+	return net.JoinHostPort(u.Hostname(), "389")
+}
+
+func (c *ldapConn) close() {
+	c.request(ber(ldapUnbindRequest))
+	c.conn.Close()
+}
+
+// request sends the protocol operation op as a new message and returns its
+// message ID.
+func (c *ldapConn) request(op []byte) (int, error) {
+	c.id++
+	_, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.id), op))
+	if err != nil {
+		return 0, fmt.Errorf("ldap: %w", err)
+	}
+	return c.id, nil
+}
+
+// response reads the next message, which must answer the request id, and
+// returns its protocol operation.
+func (c *ldapConn) response(id int) (berElement, error) {
+	msg, err := readBER(c.r)
+	if err != nil {
+		return berElement{}, fmt.Errorf("ldap: %w", err)
+	}
+	e, _, err := parseBER(msg)
+	if err != nil || e.tag != berSequence {
+		return berElement{}, errBER
+	}
+	parts, err := e.children()
+	if err != nil || len(parts) < 2 {
+		return berElement{}, errBER
+	}
+	switch got := parts[0].int(); {
+	case got == 0 && parts[1].tag == ldapExtendedResponse: // notice of disconnection
+		_, diag, _ := ldapResult(parts[1])
+		return berElement{}, fmt.Errorf("ldap: server closed the connection: %s", diag)
+	case got != id:
+		return berElement{}, fmt.Errorf("ldap: response to message %d, not %d", got, id)
+	}
+	return parts[1], nil
+}
+
+// bind authenticates the connection as dn with password (simple bind) and
+// returns the result code.
+func (c *ldapConn) bind(dn, password string) (code int, diag string, err error) {
+	id, err := c.request(ber(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, dn), berString(0x80, password)))
+	if err != nil {
+		return 0, "", err
+	}
+	op, err := c.response(id)
+	if err != nil {
+		return 0, "", err
+	}
+	if op.tag != ldapBindResponse {
+		return 0, "", errBER
+	}
+	return ldapResult(op)
+}
+
+// serviceBind binds as ldap.bind_dn, if set, for searches.
+func (c *ldapConn) serviceBind(cfg *LDAPConfig) error {
+	if cfg.BindDN == "" {
+		return nil
+	}
+	code, diag, err := c.bind(cfg.BindDN, cfg.BindPassword)
+	if err == nil && code != ldapSuccess {
+		err = ldapError("bind as "+cfg.BindDN, code, diag)
+	}
+	return err
+}
+
+// startTLS upgrades the connection to TLS (RFC 4511 section 4.14).
+func (c *ldapConn) startTLS(tc *tls.Config) error {
+	id, err := c.request(ber(ldapExtendedRequest, berString(0x80, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.response(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return errBER
+	}
+	code, diag, err := ldapResult(op)
+	if err != nil {
+		return err
+	}
+	if code != ldapSuccess {
+		return ldapError("StartTLS", code, diag)
+	}
+	conn := tls.Client(c.conn, tc)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("ldap: StartTLS: %w", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// search returns the DNs of up to limit entries matching the compiled
+// filter in scope of base. Referrals are not followed.
+func (c *ldapConn) search(base string, scope int, filter []byte, limit int) ([]string, error) {
+	id, err := c.request(ber(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, scope),
+		berInt(berEnumerated, 0), // never deref aliases
+		berInt(berInteger, limit),
+		berInt(berInteger, 0), // no time limit
+		ber(berBoolean, []byte{0}),
+		filter,
+		ber(berSequence, berString(berOctetString, "1.1")), // no attributes
+	))
+	if err != nil {
+		return nil, err
+	}
+	var dns []string
+	for {
+		op, err := c.response(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			parts, err := op.children()
+			if err != nil || len(parts) == 0 {
+				return nil, errBER
+			}
+			dns = append(dns, string(parts[0].data))
+		case ldapSearchReference:
+		case ldapSearchDone:
+			code, diag, err := ldapResult(op)
+			if err != nil {
+				return nil, err
+			}
+			if code != ldapSuccess && code != ldapSizeLimitExceeded {
+				return nil, ldapError("search "+base, code, diag)
+			}
+			return dns, nil
+		default:
+			return nil, errBER
+		}
+	}
+}
+
+// ldapResult returns the result code and diagnostic message of an
+// LDAPResult.
+func ldapResult(op berElement) (code int, diag string, err error) {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 || parts[0].tag != berEnumerated {
+		return 0, "", errBER
+	}
+	return parts[0].int(), string(parts[2].data), nil
+}
+
+func ldapError(op string, code int, diag string) error {
+	if diag != "" {
+		return fmt.Errorf("ldap: %s: result code %d: %s", op, code, diag)
+	}
+	return fmt.Errorf("ldap: %s: result code %d", op, code)
+}
+
+// ber encodes an element with tag holding the concatenated contents.
+func ber(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	out := []byte{tag}
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range contents {
+		out = append(out, c...)
+	}
+	return out
+}
+
+// berInt encodes the non-negative integer v.
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return ber(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return ber(tag, []byte(s))
+}
+
+// berElement is a decoded element: its tag and contents.
+type berElement struct {
+	tag  byte
+	data []byte
+}
+
+// parseBER splits the first element off b.
+func parseBER(b []byte) (e berElement, rest []byte, err error) {
+	if len(b) < 2 {
+		return e, nil, errBER
+	}
+	n, hdr := int(b[1]), 2
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 3 || len(b) < 2+k {
+			return e, nil, errBER
+		}
+		n = 0
+		for _, c := range b[2 : 2+k] {
+			n = n<<8 | int(c)
+		}
+		hdr += k
+	}
+	if len(b)-hdr < n {
+		return e, nil, errBER
+	}
+	return berElement{tag: b[0], data: b[hdr : hdr+n]}, b[hdr+n:], nil
+}
+
+// children decodes the elements a constructed element holds.
+func (e berElement) children() ([]berElement, error) {
+	var out []berElement
+	for b := e.data; len(b) > 0; {
+		c, rest, err := parseBER(b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+		b = rest
+	}
+	return out, nil
+}
+
+// int decodes a small non-negative INTEGER or ENUMERATED.
+func (e berElement) int() int {
+	n := 0
+	for _, c := range e.data {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+// readBER reads one element from r.
+func readBER(r *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 2, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 3 {
+			return nil, errBER
+		}
+		hdr = hdr[:2+k]
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+			return nil, err
+		}
+		n = 0
+		for _, c := range hdr[2:] {
+			n = n<<8 | int(c)
+		}
+	}
+	if n > ldapMaxMessage {
+		return nil, fmt.Errorf("response of %d bytes", n)
+	}
+	msg := make([]byte, len(hdr)+n)
+	copy(msg, hdr)
+	if _, err := io.ReadFull(r, msg[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// compileFilter encodes a search filter in the string form of RFC 4515,
+// e.g. (&(objectClass=person)(uid=jdoe)).
+func compileFilter(s string) ([]byte, error) {
+	f, rest, err := parseFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after the filter", rest)
+	}
+	return f, nil
+}
+
+// parseFilter encodes the parenthesized filter s starts with and returns
+// the rest of s.
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected ( at %q", s)
+	}
+	s = s[1:]
+	var f []byte
+	switch {
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "|"):
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		var subs [][]byte
+		for s = s[1:]; strings.HasPrefix(s, "("); {
+			sub, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			subs, s = append(subs, sub), rest
+		}
+		f = ber(tag, subs...)
+	case strings.HasPrefix(s, "!"):
+		sub, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		f, s = ber(0xa2, sub), rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("missing ) after %q", s)
+		}
+		item, err := parseFilterItem(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		f, s = item, s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("expected ) at %q", s)
+	}
+	return f, s[1:], nil
+}
+
+// parseFilterItem encodes a comparison such as uid=jdoe, cn=j*, mail=*,
+// uidNumber>=1000 or member:1.2.840.113556.1.4.1941:=cn=x.
+func parseFilterItem(item string) ([]byte, error) {
+	i := strings.IndexByte(item, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid item %q (expected attribute=value)", item)
+	}
+	attr, value := item[:i], item[i+1:]
+	var tag byte
+	switch attr[len(attr)-1] {
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	case ':':
+		return parseExtensible(item, attr[:len(attr)-1], value)
+	}
+	if !validAttribute(attr) {
+		return nil, fmt.Errorf("invalid attribute %q in %q", attr, item)
+	}
+	if tag == 0 {
+		if value == "*" {
+			return berString(0x87, attr), nil
+		}
+		if strings.Contains(value, "*") {
+			return parseSubstrings(item, attr, value)
+		}
+		tag = 0xa3
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", item, err)
+	}
+	return ber(tag, berString(berOctetString, attr), ber(berOctetString, v)), nil
+}
+
+// parseSubstrings encodes attr=value with wildcards in value.
+func parseSubstrings(item, attr, value string) ([]byte, error) {
+	pieces := strings.Split(value, "*")
+	var subs [][]byte
+	for i, p := range pieces {
+		if p == "" {
+			continue
+		}
+		v, err := unescapeFilter(p)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		tag := byte(0x81) // any
+		switch i {
+		case 0:
+			tag = 0x80 // initial
+		case len(pieces) - 1:
+			tag = 0x82 // final
+		}
+		subs = append(subs, ber(tag, v))
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("invalid substrings in %q", item)
+	}
+	return ber(0xa4, berString(berOctetString, attr), ber(berSequence, subs...)), nil
+}
+
+// parseExtensible encodes an extensible match, attr being
+// type[:dn][:rule] or [:dn]:rule.
+func parseExtensible(item, attr, value string) ([]byte, error) {
+	fields := strings.Split(attr, ":")
+	typ, dnAttributes, rule := fields[0], false, ""
+	for _, f := range fields[1:] {
+		if strings.EqualFold(f, "dn") {
+			dnAttributes = true
+		} else {
+			rule = f
+		}
+	}
+	if typ == "" && rule == "" || typ != "" && !validAttribute(typ) || rule != "" && !validAttribute(rule) {
+		return nil, fmt.Errorf("invalid extensible match %q", item)
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", item, err)
+	}
+	var parts [][]byte
+	if rule != "" {
+		parts = append(parts, berString(0x81, rule))
+	}
+	if typ != "" {
+		parts = append(parts, berString(0x82, typ))
+	}
+	parts = append(parts, ber(0x83, v))
+	if dnAttributes {
+		parts = append(parts, ber(0x84, []byte{0xff}))
+	}
+	return ber(0xa9, parts...), nil
+}
+
+// validAttribute reports whether s is an attribute description or OID:
+// letters, digits, '-', '.' and ';' options.
+func validAttribute(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == ';') {
+			return false
+		}
+	}
+	return true
+}
+
+// unescapeFilter decodes the \XX escapes of a filter value.
+func unescapeFilter(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("truncated escape")
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape \\%s", s[i+1:i+3])
+			}
+			out = append(out, byte(b))
+			i += 2
+		case '(', ')', '*':
+			return nil, fmt.Errorf("unescaped %q", c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// escapeFilter escapes s for use as a filter value (RFC 4515).
+func escapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeDN escapes s for use as an attribute value in a DN (RFC 4514).
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			b.WriteString("\\00")
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// expandLDAP replaces {user} and {dn} in a template, escaped with escape.
+func expandLDAP(tmpl, user, dn string, escape func(string) string) string {
+	return strings.NewReplacer("{user}", escape(user), "{dn}", escape(dn)).Replace(tmpl)
+}
+
+// ldapTLSConfig returns the TLS settings for the server of cfg.
+func ldapTLSConfig(cfg *LDAPConfig) (*tls.Config, error) {
+	u, _ := url.Parse(cfg.URL)
+	tc := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", cfg.CA)
+		}
+	}
+	return tc, nil
+}
+
+// validateLDAP validates the ldap block and fills in its defaults.
+func validateLDAP(c *LDAPConfig) error {
+	u, err := url.Parse(c.URL)
+	if c.URL == "" || err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return fmt.Errorf("config: ldap: 'url' must be an ldap:// or ldaps:// URL")
+	}
+	switch {
+	case c.StartTLS && u.Scheme == "ldaps":
+		return fmt.Errorf("config: ldap: start_tls is for ldap:// URLs; ldaps:// uses TLS already")
+	case c.UserDN == "" && c.BaseDN == "":
+		return fmt.Errorf("config: ldap: user_dn or base_dn is required")
+	case c.UserDN != "" && !strings.Contains(c.UserDN, "{user}"):
+		return fmt.Errorf("config: ldap: user_dn %q must contain {user}", c.UserDN)
+	case c.BindDN != "" && c.BindPassword == "":
+		return fmt.Errorf("config: ldap: bind_password is required with bind_dn")
+	case c.Timeout < 0 || c.CacheTTL < 0 || c.DenyTTL < 0 || c.CacheSize < 0:
+		return fmt.Errorf("config: ldap: values must not be negative")
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = defaultLDAPUserFilter
+	}
+	if c.GroupFilter == "" {
+		c.GroupFilter = defaultLDAPGroupFilter
+	}
+	if c.UserDN == "" && !strings.Contains(c.UserFilter, "{user}") {
+		return fmt.Errorf("config: ldap: user_filter %q must contain {user}", c.UserFilter)
+	}
+	if _, err := compileFilter(expandLDAP(c.UserFilter, "user", "cn=user", escapeFilter)); err != nil {
+		return fmt.Errorf("config: ldap: user_filter: %w", err)
+	}
+	if _, err := compileFilter(expandLDAP(c.GroupFilter, "user", "cn=user", escapeFilter)); err != nil {
+		return fmt.Errorf("config: ldap: group_filter: %w", err)
+	}
+	if _, err := ldapTLSConfig(c); err != nil {
+		return fmt.Errorf("config: ldap: ca: %w", err)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultLDAPTimeout
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = defaultLDAPCacheTTL
+	}
+	if c.DenyTTL == 0 {
+		c.DenyTTL = defaultLDAPDenyTTL
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultLDAPCacheSize
+	}
+	return nil
+}
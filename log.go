@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels (log_level, -log-level).
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]int32{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// levelStrings are the names of the levels, by level.
+var levelStrings = [...]string{"debug", "info", "warn", "error"}
+
+var slogLevels = [...]slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// Log formats (log_format, -log-format).
+const (
+	logFormatText = "text" // log package lines: date, time, "[component] message"
+	logFormatJSON = "json" // one JSON object per line (log/slog)
+)
+
+// logLevel is the minimum level written; messages below it are dropped.
+var logLevel atomic.Int32
+
+// jsonLogs is set while log_format is json.
+var jsonLogs atomic.Bool
+
+// jsonLogger writes the JSON records, to the output of the log package.
+var jsonLogger = slog.New(slog.NewJSONHandler(logWriter{}, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+// logWriter writes to the current output of the log package (stderr or the
+// -log-file).
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) { return log.Writer().Write(p) }
+
+func init() {
+	logLevel.Store(levelInfo)
+	levelOverride.configured = levelInfo
+}
+
+// parseLogLevel returns the level named s ("" is info).
+func parseLogLevel(s string) (int32, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	l, ok := levelNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+	}
+	return l, nil
+}
+
+// levelOverride is a level set at runtime (ctl log-level, the API,
+// SIGTTIN/SIGTTOU) that takes the place of log_level until it expires or
+// is reset; reloads keep it.
+var levelOverride struct {
+	mu         sync.Mutex
+	configured int32 // log_level
+	set        bool
+	until      time.Time // zero: until reset
+	timer      *time.Timer
+}
+
+// setLogLevel sets the configured minimum level from a validated name. It
+// takes effect unless a runtime override is set.
+func setLogLevel(s string) {
+	l, _ := parseLogLevel(s)
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+	levelOverride.configured = l
+	if !levelOverride.set {
+		logLevel.Store(l)
+	}
+}
+
+// overrideLogLevel sets the level at runtime, for ttl (0: until reset).
+func overrideLogLevel(l int32, ttl time.Duration) {
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+	o := &levelOverride
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	o.set, o.until = true, time.Time{}
+	logLevel.Store(l)
+	if ttl > 0 {
+		o.until = time.Now().Add(ttl)
+		var t *time.Timer
+		t = time.AfterFunc(ttl, func() {
+			o.mu.Lock()
+			if o.timer != t { // replaced or reset meanwhile
+				o.mu.Unlock()
+				return
+			}
+			o.set, o.timer = false, nil
+			logLevel.Store(o.configured)
+			o.mu.Unlock()
+			logInfo("[log] runtime log level expired, back to %s", levelStrings[o.configured])
+		})
+		o.timer = t
+	}
+}
+
+// resetLogLevel ends a runtime override, back to log_level. It reports
+// whether one was set.
+func resetLogLevel() bool {
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+	o := &levelOverride
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	wasSet := o.set
+	o.set = false
+	logLevel.Store(o.configured)
+	return wasSet
+}
+
+// stepLogLevel overrides the level with the next more verbose (delta -1)
+// or less verbose (+1) one, until reset; for SIGTTIN and SIGTTOU.
+func stepLogLevel(delta int32) {
+	l := min(max(logLevel.Load()+delta, levelDebug), levelError)
+	overrideLogLevel(l, 0)
+	logAt(max(l, levelInfo), "[log] log level set to %s by signal, until reset", levelStrings[l]) // written at any level
+}
+
+// logLevelInfo is the API representation of the log level.
+type logLevelInfo struct {
+	Level      string     `json:"level"`           // in effect
+	Configured string     `json:"configured"`      // log_level
+	Override   bool       `json:"override"`        // set at runtime
+	Until      *time.Time `json:"until,omitempty"` // when the override expires
+}
+
+func logLevelState() logLevelInfo {
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+	info := logLevelInfo{
+		Level:      levelStrings[logLevel.Load()],
+		Configured: levelStrings[levelOverride.configured],
+		Override:   levelOverride.set,
+	}
+	if !levelOverride.until.IsZero() && levelOverride.set {
+		until := levelOverride.until
+		info.Until = &until
+	}
+	return info
+}
+
+// setLogFormat selects the format from a validated name ("" is text).
+func setLogFormat(s string) {
+	jsonLogs.Store(s == logFormatJSON)
+}
+
+// logEnabled reports whether messages of level are written, so callers can
+// skip building the fields of logEvent.
+func logEnabled(level int32) bool { return level >= logLevel.Load() }
+
+func logAt(level int32, format string, args ...any) {
+	if logEnabled(level) {
+		logWrite(level, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+// logEvent logs msg ("[component] text", like the other log functions)
+// with fields: in JSON logs as fields of the record, in text appended as
+// key=value.
+func logEvent(level int32, msg string, fields ...slog.Attr) {
+	if logEnabled(level) {
+		logWrite(level, msg, fields)
+	}
+}
+
+// logWrite writes a message to the log and to syslog.
+func logWrite(level int32, msg string, fields []slog.Attr) {
+	if !syslogOut.exclusive() {
+		logLocal(level, msg, fields)
+	}
+	syslogOut.send(level, msg, fields)
+	lokiOut.send(level, msg, fields)
+	elasticOut.send(level, msg, fields)
+}
+
+// logLocal writes a message to stderr or the -log-file, in the log_format.
+func logLocal(level int32, msg string, fields []slog.Attr) {
+	if jsonLogs.Load() {
+		logJSON(level, msg, fields)
+		return
+	}
+	log.Print(textRecord(msg, fields))
+}
+
+// textRecord returns msg with the fields appended as key=value.
+func textRecord(msg string, fields []slog.Attr) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		v := f.Value.String()
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(" " + f.Key + "=" + v)
+	}
+	return b.String()
+}
+
+// logJSON writes a JSON record.
+func logJSON(level int32, msg string, fields []slog.Attr) {
+	msg, attrs := jsonRecord(msg, fields)
+	jsonLogger.LogAttrs(context.Background(), slogLevels[level], msg, attrs...)
+}
+
+// jsonRecord returns the message and fields of the JSON record of msg: its
+// "[component:port/name]" prefix becomes the component, port and listener
+// fields.
+func jsonRecord(msg string, fields []slog.Attr) (string, []slog.Attr) {
+	attrs := make([]slog.Attr, 0, len(fields)+3)
+	if tag, text, ok := strings.Cut(msg, "] "); ok && strings.HasPrefix(tag, "[") {
+		component, listener, _ := strings.Cut(tag[1:], ":")
+		attrs = append(attrs, slog.String("component", component))
+		if listener != "" {
+			port, name, _ := strings.Cut(listener, "/")
+			if n, err := strconv.Atoi(port); err == nil {
+				attrs = append(attrs, slog.Int("port", n))
+			}
+			if name != "" {
+				attrs = append(attrs, slog.String("listener", name))
+			}
+		}
+		msg = text
+	}
+	return msg, append(attrs, fields...)
+}
+
+// logFatal logs an error, also locally under syslog.only, and exits with
+// status 1.
+func logFatal(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logLocal(levelError, msg, nil)
+	syslogOut.send(levelError, msg, nil)
+	lokiOut.send(levelError, msg, nil)
+	elasticOut.send(levelError, msg, nil)
+	syslogOut.close(2 * time.Second)
+	closeLogShippers(2 * time.Second)
+	os.Exit(1)
+}
+
+// validLogFormat checks a log_format name.
+func validLogFormat(s string) error {
+	if s != "" && s != logFormatText && s != logFormatJSON {
+		return fmt.Errorf("unknown log format %q (expected text or json)", s)
+	}
+	return nil
+}
+
+func logDebug(format string, args ...any) { logAt(levelDebug, format, args...) }
+func logInfo(format string, args ...any)  { logAt(levelInfo, format, args...) }
+func logWarn(format string, args ...any)  { logAt(levelWarn, format, args...) }
+func logError(format string, args ...any) { logAt(levelError, format, args...) }
+
+// logOutput is the -log-file the log is written to; without one it goes to
+// stderr.
+var logOutput struct {
+	mu   sync.Mutex
+	file *rotatingFile
+}
+
+// openLogFile appends the log to path from now on, rotated under
+// log_rotation.
+func openLogFile(path string) error {
+	f, err := openRotating(path, 0o640)
+	if err != nil {
+		return err
+	}
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	log.SetOutput(f)
+	if logOutput.file != nil {
+		logOutput.file.Close()
+	}
+	logOutput.file = f
+	return nil
+}
+
+// reopenLogFile reopens the log file at its path, after logrotate moved it
+// away, and returns the path.
+func reopenLogFile() (string, error) {
+	logOutput.mu.Lock()
+	f := logOutput.file
+	logOutput.mu.Unlock()
+	if f == nil {
+		return "", errors.New("logging to stderr (no -log-file), nothing to reopen")
+	}
+	return f.path, f.reopen()
+}
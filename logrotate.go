@@ -0,0 +1,304 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log rotation defaults.
+const (
+	defaultRotationKeep = 7
+	rotationRetry       = time.Minute // after a failed rotation, before the next attempt
+	rotatedTimeFormat   = "20060102-150405"
+)
+
+// logRotation is the log_rotation policy of the running configuration (nil:
+// no built-in rotation), shared by the -log-file and the audit log.
+var logRotation atomic.Pointer[LogRotationConfig]
+
+// setLogRotation applies a validated log_rotation block (nil: none).
+func setLogRotation(rc *LogRotationConfig) {
+	logRotation.Store(rc)
+}
+
+// rotatingFile is a log file that is appended to and, under log_rotation,
+// renamed to <path>.<time> and replaced by a new file when it grows too
+// large or an interval begins. reopen serves external rotation (logrotate)
+// instead.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	perm    os.FileMode
+	file    *os.File
+	size    int64
+	period  time.Time // start of the interval the file was written in
+	retryAt time.Time // no rotation attempts before
+}
+
+// openRotating opens path for appending, creating it with perm.
+func openRotating(path string, perm os.FileMode) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, perm: perm}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return err
+	}
+	written := time.Now()
+	f.size = 0
+	if fi, err := file.Stat(); err == nil {
+		f.size = fi.Size()
+		if f.size > 0 {
+			written = fi.ModTime()
+		}
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.period = rotationPeriod(logRotation.Load(), written)
+	return nil
+}
+
+// rotationPeriod returns the start of the interval of rc containing t.
+func rotationPeriod(rc *LogRotationConfig, t time.Time) time.Time {
+	if rc == nil || rc.Interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(rc.Interval)
+}
+
+// Write appends p, first rotating the file if the policy asks for it.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rc := logRotation.Load(); rc != nil && f.size > 0 && f.due(rc, int64(len(p))) {
+		f.rotate(rc)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file must be rotated before n more bytes.
+func (f *rotatingFile) due(rc *LogRotationConfig, n int64) bool {
+	now := time.Now()
+	if now.Before(f.retryAt) {
+		return false
+	}
+	if rc.MaxSizeMB > 0 && f.size+n > int64(rc.MaxSizeMB)<<20 {
+		return true
+	}
+	return rc.Interval > 0 && !rotationPeriod(rc, now).Equal(f.period)
+}
+
+// rotate moves the file aside and opens a new one. It cannot log its
+// errors, as it may be rotating the log itself: they go to stderr, and
+// writing continues to the old file.
+func (f *rotatingFile) rotate(rc *LogRotationConfig) {
+	rotated := f.path + "." + time.Now().Format(rotatedTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = f.path + "." + time.Now().Format(rotatedTimeFormat) + "-" + strconv.Itoa(i)
+	}
+	err := os.Rename(f.path, rotated)
+	if err == nil {
+		err = f.open()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[logrotate] rotating %s: %v\n", f.path, err)
+		f.retryAt = time.Now().Add(rotationRetry)
+		return
+	}
+	go cleanRotated(f.path, rotated, rc)
+}
+
+// reopen reopens the file at its path, after logrotate moved it away.
+func (f *rotatingFile) reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// reopenLogs reopens the -log-file, the audit log and the access logs on
+// SIGUSR1, as ctl rotate does, for logrotate's postrotate script.
+func reopenLogs() {
+	if path, err := reopenLogFile(); err != nil && path != "" {
+		logError("[main] reopening log file %s: %v", path, err)
+	} else if path != "" {
+		logInfo("[main] reopened log file %s", path)
+	}
+	if path, err := auditLog.reopen(); err != nil {
+		logError("[audit] reopening %s: %v", path, err)
+	} else if path != "" {
+		logInfo("[main] reopened audit log %s", path)
+	}
+	if paths, err := reopenAccessLogs(); err != nil {
+		logError("[main] %v", err)
+	} else if len(paths) > 0 {
+		logInfo("[main] reopened %d access logs", len(paths))
+	}
+	auditLog.record(auditEntry{Actor: "signal", Action: "rotate"})
+}
+
+// housekeeping serializes cleanRotated runs.
+var housekeeping sync.Mutex
+
+// cleanRotated compresses the just rotated file if rc asks for it, then
+// deletes the rotated files of path beyond rc.Keep or older than rc.MaxAge.
+func cleanRotated(path, rotated string, rc *LogRotationConfig) {
+	housekeeping.Lock()
+	defer housekeeping.Unlock()
+	if rc.Compress {
+		if err := gzipFile(rotated); err != nil {
+			logWarn("[logrotate] compressing %s: %v", rotated, err)
+		}
+	}
+	old := rotatedFiles(path)
+	for i, name := range old {
+		expired := false
+		if rc.MaxAge > 0 {
+			if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > rc.MaxAge {
+				expired = true
+			}
+		}
+		if i >= rc.Keep || expired {
+			if err := os.Remove(name); err != nil {
+				logWarn("[logrotate] %v", err)
+			}
+		}
+	}
+}
+
+// rotatedFiles returns the rotated files of path, newest first.
+func rotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(globEscape(path) + ".*")
+	var out []string
+	for _, m := range matches {
+		if _, ok := rotatedSeq(m, path); ok {
+			out = append(out, m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return rotatedKey(out[i], path) > rotatedKey(out[j], path) })
+	return out
+}
+
+// rotatedKey orders rotated files by time, then by the counter of files
+// rotated within the same second.
+func rotatedKey(name, path string) string {
+	n, _ := rotatedSeq(name, path)
+	return fmt.Sprintf("%s-%06d", strings.TrimPrefix(name, path+".")[:len(rotatedTimeFormat)], n)
+}
+
+// rotatedSeq returns the counter of a rotated file of path (0 for the
+// first of its second), and whether name is one.
+func rotatedSeq(name, path string) (int, bool) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), ".gz")
+	if len(suffix) < len(rotatedTimeFormat) {
+		return 0, false
+	}
+	if _, err := time.Parse(rotatedTimeFormat, suffix[:len(rotatedTimeFormat)]); err != nil {
+		return 0, false
+	}
+	rest := suffix[len(rotatedTimeFormat):]
+	if rest == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(rest, "-"))
+	return n, err == nil && strings.HasPrefix(rest, "-") && n > 0
+}
+
+// globEscape quotes the pattern characters of path for filepath.Glob.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// gzipFile replaces name by name.gz.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	os.Chtimes(name+".gz", fi.ModTime(), fi.ModTime())
+	return os.Remove(name)
+}
+
+// rotationSummary describes when rc rotates, e.g. "at 100 MiB or every 24h0m0s".
+func rotationSummary(rc *LogRotationConfig) string {
+	var when []string
+	if rc.MaxSizeMB > 0 {
+		when = append(when, fmt.Sprintf("at %d MiB", rc.MaxSizeMB))
+	}
+	if rc.Interval > 0 {
+		when = append(when, "every "+rc.Interval.String())
+	}
+	return strings.Join(when, " or ")
+}
+
+// validateLogRotation validates the log_rotation block and fills in its
+// defaults.
+func validateLogRotation(rc *LogRotationConfig) error {
+	if rc.MaxSizeMB < 0 || rc.Interval < 0 || rc.Keep < 0 || rc.MaxAge < 0 {
+		return fmt.Errorf("config: log_rotation: values must not be negative")
+	}
+	if rc.MaxSizeMB == 0 && rc.Interval == 0 {
+		return fmt.Errorf("config: log_rotation: set max_size_mb, interval or both")
+	}
+	if rc.Interval > 0 && rc.Interval < time.Minute {
+		return fmt.Errorf("config: log_rotation: interval must be at least 1m, got %s", rc.Interval)
+	}
+	if rc.Keep == 0 {
+		rc.Keep = defaultRotationKeep
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// High-volume log classes, sampled per listener.
+const (
+	sampleAccept    = "accept error"
+	sampleHandshake = "handshake failed"
+	sampleConnect   = "connect failed"
+	sampleBanned    = "banned client"
+	sampleDenied    = "denied client"
+	sampleLimited   = "rate limited client"
+	sampleCapped    = "max connections"
+	sampleQueue     = "worker queue"
+	sampleSlow      = "slow session"
+	sampleUser      = "refused user"
+)
+
+// Log sampling defaults, in effect without a log_sampling block.
+const (
+	defaultSampleInterval = time.Second
+	defaultSampleFirst    = 20
+)
+
+// logSampling limits the messages of the classes above in the running
+// daemon.
+var logSampling logSampler
+
+// logSampler writes the first messages of a class and listener in each
+// interval, then every thereafter-th, and logs how many it suppressed once
+// the interval is over. A port scan or an accept loop failing on a full
+// file table can then not fill the disk.
+type logSampler struct {
+	policy atomic.Pointer[LogSamplingConfig] // nil: the defaults
+
+	mu      sync.Mutex
+	windows map[sampleKey]*sampleWindow
+	ticking bool
+}
+
+type sampleKey struct {
+	class string
+	tag   string // listener: "port/name"
+}
+
+type sampleWindow struct {
+	start      time.Time
+	level      int32
+	n          int64 // messages in the window
+	suppressed int64
+}
+
+var defaultSampling = LogSamplingConfig{Interval: defaultSampleInterval, First: defaultSampleFirst}
+
+// update applies a validated log_sampling block (nil: the defaults).
+func (s *logSampler) update(cfg *LogSamplingConfig) {
+	s.policy.Store(cfg)
+}
+
+// allow reports whether a message of class from listener tag, logged at
+// level, is to be written.
+func (s *logSampler) allow(class, tag string, level int32) bool {
+	p := s.policy.Load()
+	if p == nil {
+		p = &defaultSampling
+	}
+	if p.Disabled {
+		return true
+	}
+	now := time.Now()
+	key := sampleKey{class, tag}
+	s.mu.Lock()
+	w := s.windows[key]
+	var ended sampleWindow
+	if w == nil || now.Sub(w.start) >= p.Interval {
+		if w != nil {
+			ended = *w
+		}
+		if s.windows == nil {
+			s.windows = make(map[sampleKey]*sampleWindow)
+		}
+		w = &sampleWindow{start: now, level: level}
+		s.windows[key] = w
+	}
+	w.n++
+	ok := w.n <= int64(p.First) || p.Thereafter > 0 && (w.n-int64(p.First))%int64(p.Thereafter) == 0
+	if !ok {
+		w.suppressed++
+		if !s.ticking {
+			s.ticking = true
+			go s.tick(p.Interval)
+		}
+	}
+	s.mu.Unlock()
+	if ended.suppressed > 0 {
+		reportSuppressed(key, ended)
+	}
+	return ok
+}
+
+// tick reports the suppressed messages of ended windows and forgets those
+// windows, until none is left.
+func (s *logSampler) tick(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		var ended map[sampleKey]sampleWindow
+		s.mu.Lock()
+		for key, w := range s.windows {
+			if now.Sub(w.start) < interval {
+				continue
+			}
+			if w.suppressed > 0 {
+				if ended == nil {
+					ended = make(map[sampleKey]sampleWindow)
+				}
+				ended[key] = *w
+			}
+			delete(s.windows, key)
+		}
+		done := len(s.windows) == 0
+		if done {
+			s.ticking = false
+		}
+		s.mu.Unlock()
+		for key, w := range ended {
+			reportSuppressed(key, w)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func reportSuppressed(key sampleKey, w sampleWindow) {
+	logAt(w.level, "[socks5:%s] %d %q messages suppressed (%d in %s)", key.tag, w.suppressed, key.class, w.n,
+		time.Since(w.start).Round(time.Millisecond))
+}
+
+// samplingSummary describes ls, e.g. "first 20 per 1s, then 1 in 100".
+func samplingSummary(ls *LogSamplingConfig) string {
+	s := fmt.Sprintf("first %d per %s", ls.First, ls.Interval)
+	if ls.Thereafter > 0 {
+		s += fmt.Sprintf(", then 1 in %d", ls.Thereafter)
+	}
+	return s
+}
+
+// validateLogSampling validates the log_sampling block and fills in its
+// defaults.
+func validateLogSampling(sc *LogSamplingConfig) error {
+	if sc.Interval < 0 || sc.First < 0 || sc.Thereafter < 0 {
+		return fmt.Errorf("config: log_sampling: values must not be negative")
+	}
+	if sc.Interval == 0 {
+		sc.Interval = defaultSampleInterval
+	}
+	if sc.First == 0 {
+		sc.First = defaultSampleFirst
+	}
+	return nil
+}
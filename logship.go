@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log shipping defaults and limits.
+const (
+	defaultShipBatchSize = 1000
+	defaultShipBatchWait = time.Second
+	defaultShipTimeout   = 10 * time.Second
+	defaultShipIndex     = "superproxy-{2006.01.02}"
+	shipQueue            = 16384            // unsent records; more are dropped
+	shipMaxBatchBytes    = 1 << 20          // a batch is sent once its messages reach this size
+	shipMaxBackoff       = 30 * time.Second // between attempts to deliver a batch
+	shipDrainAttempts    = 3                // per batch once the shipper is stopped
+)
+
+// shipRecord is a log message waiting to be shipped.
+type shipRecord struct {
+	time   time.Time
+	level  int32
+	msg    string // without the [component:port/name] tag
+	fields []slog.Attr
+}
+
+// shipTarget is what Loki and Elasticsearch do differently: the request
+// a batch is sent in and how its response is judged.
+type shipTarget interface {
+	request(ctx context.Context, host string, batch []shipRecord) (*http.Request, error)
+	// check returns the error of a response, and whether sending the batch
+	// again could succeed.
+	check(resp *http.Response) (retry bool, err error)
+}
+
+// logShipper sends the log to Loki or Elasticsearch in batches. Logging
+// never blocks on it: a goroutine sends a batch once it is full or
+// batch_wait old, and retries it with backoff while the server fails.
+// Meanwhile records queue up, and when the queue is full they are dropped
+// and counted. Its own errors go to the local log only.
+type logShipper struct {
+	name    string
+	mu      sync.Mutex
+	cfg     any // the validated loki or elasticsearch block (nil: off)
+	run     *shipRun
+	closed  bool
+	on      atomic.Bool
+	dropped atomic.Int64
+}
+
+// shipRun is one configuration of a shipper, running until its queue is
+// closed.
+type shipRun struct {
+	queue    chan shipRecord
+	done     chan struct{}
+	draining atomic.Bool // the queue is closed: give up on failing batches
+}
+
+// lokiOut and elasticOut are the log shippers of the running daemon.
+var (
+	lokiOut    = logShipper{name: "loki"}
+	elasticOut = logShipper{name: "elasticsearch"}
+)
+
+// shipOptions are the batching settings both blocks have.
+type shipOptions struct {
+	url       string
+	headers   map[string]string
+	batchSize int
+	batchWait time.Duration
+	timeout   time.Duration
+}
+
+// updateLoki applies a validated loki block (nil: none).
+func updateLoki(lc *LokiConfig) {
+	if lc == nil {
+		lokiOut.update(nil, shipOptions{}, nil)
+		return
+	}
+	lokiOut.update(lc, shipOptions{lc.URL, lc.Headers, lc.BatchSize, lc.BatchWait, lc.Timeout}, &lokiTarget{cfg: lc})
+}
+
+// updateElasticsearch applies a validated elasticsearch block (nil: none).
+func updateElasticsearch(ec *ElasticsearchConfig) {
+	if ec == nil {
+		elasticOut.update(nil, shipOptions{}, nil)
+		return
+	}
+	elasticOut.update(ec, shipOptions{ec.URL, ec.Headers, ec.BatchSize, ec.BatchWait, ec.Timeout}, &elasticTarget{cfg: ec})
+}
+
+// update replaces the target (cfg nil: none). Records already queued go to
+// the previous one.
+func (s *logShipper) update(cfg any, o shipOptions, t shipTarget) {
+	s.mu.Lock()
+	if s.closed || reflect.DeepEqual(cfg, s.cfg) {
+		s.mu.Unlock()
+		return
+	}
+	if s.run != nil {
+		s.run.draining.Store(true)
+		close(s.run.queue)
+		s.run = nil
+	}
+	s.cfg = cfg
+	s.on.Store(cfg != nil)
+	if cfg != nil {
+		s.run = &shipRun{queue: make(chan shipRecord, shipQueue), done: make(chan struct{})}
+		go s.ship(s.run, o, t)
+	}
+	s.mu.Unlock()
+	// logged unlocked, as the message is shipped too
+	if cfg != nil {
+		logInfo("[%s] shipping the log to %s", s.name, redactURL(o.url))
+	} else {
+		logInfo("[%s] stopped", s.name)
+	}
+}
+
+// send queues a message ("[component:port/name] text", as logged).
+func (s *logShipper) send(level int32, msg string, fields []slog.Attr) {
+	if !s.on.Load() {
+		return
+	}
+	msg, attrs := jsonRecord(msg, fields)
+	r := shipRecord{time: time.Now(), level: level, msg: msg, fields: attrs}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run == nil {
+		return
+	}
+	select {
+	case s.run.queue <- r:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close stops shipping, waiting up to timeout for queued records.
+func (s *logShipper) close(timeout time.Duration) {
+	s.mu.Lock()
+	s.closed = true
+	s.on.Store(false)
+	run := s.run
+	s.run = nil
+	if run != nil {
+		run.draining.Store(true)
+		close(run.queue)
+	}
+	s.mu.Unlock()
+	if run == nil {
+		return
+	}
+	select {
+	case <-run.done:
+	case <-time.After(timeout):
+	}
+}
+
+// closeLogShippers stops both shippers, waiting up to timeout for each.
+func closeLogShippers(timeout time.Duration) {
+	lokiOut.close(timeout)
+	elasticOut.close(timeout)
+}
+
+func (s *logShipper) ship(run *shipRun, o shipOptions, t shipTarget) {
+	defer close(run.done)
+	client := &http.Client{}
+	host, _ := os.Hostname()
+	var batch []shipRecord
+	size := 0
+	wait := time.NewTimer(o.batchWait)
+	wait.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			s.deliver(client, run, o, t, host, batch)
+			batch, size = batch[:0], 0
+		}
+	}
+	for {
+		select {
+		case r, ok := <-run.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				wait.Reset(o.batchWait)
+			}
+			batch = append(batch, r)
+			size += len(r.msg) + 64*len(r.fields)
+			if len(batch) >= o.batchSize || size >= shipMaxBatchBytes {
+				wait.Stop()
+				flush()
+			}
+		case <-wait.C:
+			flush()
+		}
+	}
+}
+
+// deliver sends batch, retrying with backoff until it is accepted, refused
+// for good or, once the shipper is stopped, shipDrainAttempts failed.
+func (s *logShipper) deliver(client *http.Client, run *shipRun, o shipOptions, t shipTarget, host string, batch []shipRecord) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(client, o, t, host, batch)
+		if err == nil {
+			if n := s.dropped.Swap(0); n > 0 {
+				logLocal(levelWarn, fmt.Sprintf("[%s] %d log records dropped: the queue was full", s.name, n), nil)
+			}
+			return
+		}
+		if !retry || run.draining.Load() && attempt >= shipDrainAttempts {
+			logLocal(levelWarn, fmt.Sprintf("[%s] %d log records lost: %v", s.name, len(batch), err), nil)
+			return
+		}
+		if attempt == 1 {
+			logLocal(levelWarn, fmt.Sprintf("[%s] %v; retrying", s.name, err), nil)
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, shipMaxBackoff)
+	}
+}
+
+func (s *logShipper) post(client *http.Client, o shipOptions, t shipTarget, host string, batch []shipRecord) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	req, err := t.request(ctx, host, batch)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "superproxy")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	return t.check(resp)
+}
+
+// checkStatus judges a response by its status: 429 and 5xx are retried.
+func checkStatus(resp *http.Response) (bool, error) {
+	if resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s", resp.Status)
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		err = fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// appendJSONFields appends attrs as the members of a JSON object, after a
+// comma.
+func appendJSONFields(b []byte, attrs []slog.Attr) []byte {
+	for _, a := range attrs {
+		k, _ := json.Marshal(a.Key)
+		v, err := json.Marshal(a.Value.Any())
+		if err != nil {
+			v, _ = json.Marshal(a.Value.String())
+		}
+		b = append(append(append(append(b, ','), k...), ':'), v...)
+	}
+	return b
+}
+
+// lokiTarget pushes to the Loki push API: a stream per level and
+// component, with the JSON record as the line.
+type lokiTarget struct {
+	cfg *LokiConfig
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (t *lokiTarget) request(ctx context.Context, host string, batch []shipRecord) (*http.Request, error) {
+	var streams []*lokiStream
+	byKey := make(map[string]*lokiStream)
+	for _, r := range batch {
+		component, fields := "", r.fields
+		if len(fields) > 0 && fields[0].Key == "component" {
+			component, fields = fields[0].Value.String(), fields[1:]
+		}
+		key := levelStrings[r.level] + "\x00" + component
+		st := byKey[key]
+		if st == nil {
+			labels := map[string]string{"level": levelStrings[r.level], "host": host}
+			if component != "" {
+				labels["component"] = component
+			}
+			for k, v := range t.cfg.Labels {
+				labels[k] = v
+			}
+			st = &lokiStream{Stream: labels}
+			byKey[key] = st
+			streams = append(streams, st)
+		}
+		msg, _ := json.Marshal(r.msg)
+		line := appendJSONFields(append([]byte(`{"msg":`), msg...), fields)
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(r.time.UnixNano(), 10), string(append(line, '}'))})
+	}
+	body, err := json.Marshal(map[string]any{"streams": streams})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (t *lokiTarget) check(resp *http.Response) (bool, error) { return checkStatus(resp) }
+
+// elasticTarget indexes through the Elasticsearch bulk API: a document per
+// record, with ECS names for the common fields.
+type elasticTarget struct {
+	cfg *ElasticsearchConfig
+}
+
+func (t *elasticTarget) request(ctx context.Context, host string, batch []shipRecord) (*http.Request, error) {
+	var body []byte
+	hostJSON, _ := json.Marshal(host)
+	for _, r := range batch {
+		index, _ := json.Marshal(elasticIndex(t.cfg.Index, r.time))
+		body = append(append(append(body, `{"create":{"_index":`...), index...), "}}\n"...)
+		msg, _ := json.Marshal(r.msg)
+		body = append(body, `{"@timestamp":"`+r.time.UTC().Format(time.RFC3339Nano)+`","log.level":"`+levelStrings[r.level]+`","message":`...)
+		body = append(append(body, msg...), `,"host.name":`...)
+		body = appendJSONFields(append(body, hostJSON...), r.fields)
+		body = append(body, "}\n"...)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	return req, nil
+}
+
+// check also reports documents the bulk request could not index; they are
+// not sent again, as they would fail again.
+func (t *elasticTarget) check(resp *http.Response) (bool, error) {
+	if resp.StatusCode >= 300 {
+		return checkStatus(resp)
+	}
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || !result.Errors {
+		return false, nil
+	}
+	failed, reason := 0, ""
+	for _, item := range result.Items {
+		for _, res := range item {
+			if res.Status >= 300 {
+				failed++
+				if reason == "" {
+					reason = res.Error.Type + ": " + res.Error.Reason
+				}
+			}
+		}
+	}
+	logLocal(levelWarn, fmt.Sprintf("[elasticsearch] %d of %d log records not indexed: %s", failed, len(result.Items), reason), nil)
+	return false, nil
+}
+
+// elasticIndex returns the index of a record logged at t: the parts of
+// pattern in braces are time layouts, in UTC.
+func elasticIndex(pattern string, t time.Time) string {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(pattern, '{')
+		end := strings.IndexByte(pattern, '}')
+		if open < 0 || end < open {
+			b.WriteString(pattern)
+			return b.String()
+		}
+		b.WriteString(pattern[:open])
+		b.WriteString(t.UTC().Format(pattern[open+1 : end]))
+		pattern = pattern[end+1:]
+	}
+}
+
+// validateShipping validates the url and batching options of the loki or
+// elasticsearch block name, fills in their defaults and returns the URL
+// with apiPath added unless it has a path.
+func validateShipping(name, rawURL, apiPath string, batchSize *int, batchWait, timeout *time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if rawURL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("config: %s: 'url' must be an http:// or https:// URL", name)
+	}
+	if *batchSize < 0 || *batchWait < 0 || *timeout < 0 {
+		return "", fmt.Errorf("config: %s: values must not be negative", name)
+	}
+	if *batchSize == 0 {
+		*batchSize = defaultShipBatchSize
+	}
+	if *batchWait == 0 {
+		*batchWait = defaultShipBatchWait
+	}
+	if *timeout == 0 {
+		*timeout = defaultShipTimeout
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = apiPath
+	}
+	return u.String(), nil
+}
+
+// validateLoki validates the loki block and fills in its defaults.
+func validateLoki(lc *LokiConfig) error {
+	u, err := validateShipping("loki", lc.URL, "/loki/api/v1/push", &lc.BatchSize, &lc.BatchWait, &lc.Timeout)
+	if err != nil {
+		return err
+	}
+	lc.URL = u
+	if lc.Labels == nil {
+		lc.Labels = map[string]string{"job": defaultSyslogTag}
+	}
+	for k := range lc.Labels {
+		if !validLabelName(k) {
+			return fmt.Errorf("config: loki: label %q: names are letters, digits and _, not starting with a digit", k)
+		}
+	}
+	return nil
+}
+
+// validLabelName reports whether s is a Prometheus/Loki label name.
+func validLabelName(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validateElasticsearch validates the elasticsearch block and fills in its
+// defaults.
+func validateElasticsearch(ec *ElasticsearchConfig) error {
+	u, err := validateShipping("elasticsearch", ec.URL, "/_bulk", &ec.BatchSize, &ec.BatchWait, &ec.Timeout)
+	if err != nil {
+		return err
+	}
+	ec.URL = u
+	if ec.Index == "" {
+		ec.Index = defaultShipIndex
+	}
+	index := elasticIndex(ec.Index, time.Now())
+	if index != strings.ToLower(index) || strings.ContainsAny(index, ` "*\<|,>/?#:`) || strings.HasPrefix(index, "_") {
+		return fmt.Errorf("config: elasticsearch: invalid index %q: lowercase, without spaces or any of \"*\\<|,>/?#:, not starting with _", ec.Index)
+	}
+	return nil
+}
@@ -3,79 +3,523 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// defaultStateDir is the state directory of the packaged systemd unit.
+const defaultStateDir = "/var/lib/superproxy"
+
 func main() {
-	configPath := flag.String("config", "config.yaml", "path to YAML config file")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "print-config":
+			if err := printConfig(os.Stdout); err != nil {
+				logFatal("[main] %v", err)
+			}
+			return
+		case "show-running":
+			fs := flag.NewFlagSet("show-running", flag.ExitOnError)
+			stateDir := fs.String("state-dir", defaultStateDir, "directory where the daemon records its running configuration")
+			fs.Parse(os.Args[2:])
+			if err := printRunningConfig(os.Stdout, *stateDir); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		case "ctl":
+			if err := runCtl(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "ctl: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	configPath := flag.String("config", "config.yaml", "path to config file")
+	format := flag.String("format", "", "config file format: yaml, json or toml (default: from file extension)")
 	testConfig := flag.Bool("t", false, "test configuration and exit")
+	strict := flag.Bool("strict", false, "with -t: also report non-fatal issues (privileged ports, unrouted addresses, shared pools, low ulimit) and fail on any")
+	diff := flag.Bool("diff", false, "with -t: also list what a reload would change in the running configuration (needs -state-dir)")
+	var state stateOptions
+	flag.StringVar(&state.Dir, "state-dir", "", "directory where the running configuration and its history are recorded (e.g. /var/lib/superproxy)")
+	flag.IntVar(&state.History, "state-history", defaultHistory, "number of applied configurations kept in -state-dir for ctl rollback")
+	logFile := flag.String("log-file", "", "append the log to this file instead of stderr (reopened by ctl rotate)")
+	watch := flag.Bool("watch", false, "reload automatically when the config file changes")
+	watchDebounce := flag.Duration("watch-debounce", 2*time.Second, "quiet period after a config file change before reloading")
+	var opts loadOptions
+	flag.StringVar(&opts.Interface, "interface", "", "override the config's network interface")
+	flag.StringVar(&opts.ListenHost, "listen-host", "", "override the config's listen_host (address to accept SOCKS5 clients on)")
+	flag.StringVar(&opts.LogLevel, "log-level", "", "override the config's log_level: debug, info, warn or error")
+	flag.StringVar(&opts.LogFormat, "log-format", "", "override the config's log_format: text or json")
+	flag.Func("config-header", "HTTP header sent when -config is a URL, as \"Name: value\" (repeatable)", func(h string) error {
+		opts.Remote.Headers = append(opts.Remote.Headers, h)
+		return nil
+	})
+	flag.StringVar(&opts.Remote.SHA256, "config-sha256", "", "pin a remote config's SHA-256: hex digest, or URL of a sha256sum file")
 	flag.Parse()
+	opts.Format = *format
+	started := time.Now()
 
 	// Load configuration
-	cfg, err := LoadConfig(*configPath)
+	cfg, src, err := loadSource(*configPath, opts, state.Dir)
+	if err == nil && persistEnabled(cfg) && state.Dir == "" {
+		err = fmt.Errorf("config: admin: 'persist' requires -state-dir")
+	}
 	if err != nil {
 		if *testConfig {
 			fmt.Fprintf(os.Stderr, "configuration test FAILED: %v\n", err)
 			os.Exit(1)
 		}
-		log.Fatalf("[main] %v", err)
+		logFatal("[main] %v", err)
 	}
 
 	// Config test mode: validate and exit
 	if *testConfig {
 		fmt.Printf("configuration file %s test OK\n", *configPath)
 		fmt.Printf("  interface: %s\n", cfg.Interface)
+		if cfg.ListenHost != "" {
+			fmt.Printf("  listen:    %s\n", cfg.ListenHost)
+		}
+		fmt.Printf("  log level: %s (%s format)\n", cfg.LogLevel, cfg.LogFormat)
+		if rc := cfg.LogRotation; rc != nil {
+			fmt.Printf("  log rotation: %s, keep %d\n", rotationSummary(rc), rc.Keep)
+		}
+		if ls := cfg.LogSampling; ls != nil {
+			if ls.Disabled {
+				fmt.Printf("  log sampling: off\n")
+			} else {
+				fmt.Printf("  log sampling: %s\n", samplingSummary(ls))
+			}
+		}
+		if sc := cfg.Syslog; sc != nil {
+			address := sc.Address
+			if address == "" {
+				address = "local"
+			}
+			fmt.Printf("  syslog:    %s, facility %s, tag %s\n", address, sc.Facility, sc.Tag)
+		}
+		if lc := cfg.Loki; lc != nil {
+			fmt.Printf("  loki:      %s, batches of %d\n", redactURL(lc.URL), lc.BatchSize)
+		}
+		if ec := cfg.Elastic; ec != nil {
+			fmt.Printf("  elasticsearch: %s, index %s, batches of %d\n", redactURL(ec.URL), ec.Index, ec.BatchSize)
+		}
+		if cfg.MaxConnections > 0 {
+			fmt.Printf("  max connections: %d\n", cfg.MaxConnections)
+		}
+		if cfg.egressRate > 0 {
+			fmt.Printf("  egress:    at most %s\n", formatRate(cfg.egressRate))
+		}
+		if gc := cfg.GeoIP; gc != nil {
+			var dbs []string
+			if gc.Country != "" {
+				dbs = append(dbs, "country "+gc.Country)
+			}
+			if gc.ASN != "" {
+				dbs = append(dbs, "asn "+gc.ASN)
+			}
+			fmt.Printf("  geoip:     %s\n", strings.Join(dbs, ", "))
+		}
+		if ab := cfg.AutoBan; ab != nil {
+			fmt.Printf("  auto-ban:  %d failed handshakes within %s, for %s\n", ab.Failures, ab.Window, ab.BanTime)
+		}
+		if len(cfg.Users) > 0 {
+			fmt.Printf("  users:     %d accounts\n", len(cfg.Users))
+		}
+		if cfg.UsersFile != "" {
+			if creds, err := readUsersFile(cfg.UsersFile); err == nil {
+				fmt.Printf("  users:     %s (%d users)\n", cfg.UsersFile, creds.count())
+			}
+		}
+		if ah := cfg.AuthHTTP; ah != nil {
+			fmt.Printf("  auth http: %s, allows cached %s, denies %s\n", redactURL(ah.URL), ah.CacheTTL, ah.DenyTTL)
+		}
+		if lc := cfg.LDAP; lc != nil {
+			user := lc.UserDN
+			if user == "" {
+				user = lc.UserFilter + " below " + lc.BaseDN
+			}
+			if lc.StartTLS {
+				fmt.Printf("  ldap:      %s (StartTLS), users %s\n", lc.URL, user)
+			} else {
+				fmt.Printf("  ldap:      %s, users %s\n", lc.URL, user)
+			}
+			if lc.GroupDN != "" {
+				fmt.Printf("  ldap:      members of %s only\n", lc.GroupDN)
+			}
+		}
+		if rc := cfg.RADIUS; rc != nil {
+			fmt.Printf("  radius:    %s, nas %s, timeout %s x%d\n", rc.Server, nasIdentifier(rc), rc.Timeout, rc.attempts())
+			if rc.Accounting {
+				fmt.Printf("  radius:    accounting to %s\n", rc.AccountingServer)
+			}
+		}
+		if dc := cfg.DNSCache; dc != nil {
+			fmt.Printf("  dns cache: %d entries, ttl %s..%s, negative %s\n", dc.Size, dc.MinTTL, dc.MaxTTL, dc.NegativeTTL)
+		}
+		if len(cfg.Hosts) > 0 {
+			fmt.Printf("  hosts:     %d static overrides\n", len(cfg.Hosts))
+		}
+		if fc := cfg.FailCache; fc != nil {
+			fmt.Printf("  fail cache: %d entries, ttl %s\n", fc.Size, fc.TTL)
+		}
+		if hc := cfg.HealthCheck; hc != nil {
+			fmt.Printf("  health:    %s every %s (timeout %s, fall %d, rise %d)\n", hc.Target, hc.Interval, hc.Timeout, hc.Fall, hc.Rise)
+		}
+		if tc := cfg.Tracing; tc != nil {
+			u, _ := otlpTracesURL(tc.Endpoint)
+			fmt.Printf("  tracing:   %s to %s as %q\n", sampledSessions(tc.SampleRate), u, tc.ServiceName)
+		}
+		if sc := cfg.StatsD; sc != nil {
+			dialect := "statsd"
+			if sc.DogStatsD {
+				dialect = "dogstatsd"
+			}
+			fmt.Printf("  statsd:    %s %s.* every %s\n", dialect, sc.Prefix, sc.Interval)
+		}
+		if ic := cfg.IPFIX; ic != nil {
+			fmt.Printf("  ipfix:     flows to %s, observation domain %d\n", ic.Collector, ic.ObservationDomain)
+		}
+		for _, h := range cfg.Webhooks {
+			events := "all events"
+			if len(h.Events) > 0 {
+				events = strings.Join(h.Events, ", ")
+			}
+			fmt.Printf("  webhook:   %s (%s)\n", redactURL(h.URL), events)
+		}
+		if ac := cfg.Admin; ac != nil {
+			if ac.Listen != "" {
+				scheme := "http"
+				if ac.TLS != nil {
+					scheme = "https"
+				}
+				fmt.Printf("  admin:     %s://%s/api/v1/\n", scheme, ac.Listen)
+			}
+			if ac.GRPCListen != "" {
+				fmt.Printf("  admin:     grpc %s\n", ac.GRPCListen)
+			}
+			var auth []string
+			if len(ac.Tokens) > 0 {
+				auth = append(auth, fmt.Sprintf("%d token(s)", len(ac.Tokens)))
+			}
+			if ac.TLS != nil && ac.TLS.ClientCA != "" {
+				auth = append(auth, "client certificates")
+			}
+			if len(auth) > 0 {
+				fmt.Printf("  admin:     auth by %s\n", strings.Join(auth, " or "))
+			}
+			if ac.AuditLog != "" {
+				fmt.Printf("  admin:     audit log %s\n", ac.AuditLog)
+			}
+			if ac.Persist {
+				fmt.Printf("  admin:     API changes kept in %s\n", filepath.Join(state.Dir, dynamicFile))
+			}
+			if ac.Debug {
+				fmt.Printf("  admin:     debug endpoints (/debug/pprof/, ctl dump)\n")
+			}
+		}
 		fmt.Printf("  proxies:   %d\n", len(cfg.Proxies))
 		for _, entry := range cfg.Proxies {
-			fmt.Printf("    socks5://0.0.0.0:%-5d → %s\n", entry.Port, entry.IPv6)
+			fmt.Printf("    %s\n", entrySummary(entry))
+		}
+		if *strict {
+			warnings := strictWarnings(cfg)
+			for _, w := range warnings {
+				fmt.Printf("  warning: %s\n", w)
+			}
+			if len(warnings) > 0 {
+				fmt.Fprintf(os.Stderr, "configuration test FAILED: %d warning(s) in strict mode\n", len(warnings))
+				os.Exit(1)
+			}
+		}
+		if *diff {
+			if state.Dir == "" {
+				fmt.Fprintln(os.Stderr, "-diff requires -state-dir")
+				os.Exit(1)
+			}
+			running, err := loadRunningConfig(state.Dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "diff: %v\n", err)
+				os.Exit(1)
+			}
+			lines := diffConfigs(running, cfg)
+			fmt.Printf("reload would change %d item(s):\n", len(lines))
+			for _, line := range lines {
+				fmt.Printf("  %s\n", line)
+			}
 		}
 		os.Exit(0)
 	}
 
-	log.Printf("[main] loaded %d proxy entries from %s", len(cfg.Proxies), *configPath)
-	log.Printf("[main] interface: %s", cfg.Interface)
-	log.Printf("[main] GOMAXPROCS: %d", runtime.GOMAXPROCS(0))
-
-	// Auto-assign IPv6 addresses to the network interface
-	if runtime.GOOS == "linux" {
-		if err := EnsureIPv6Addresses(cfg.Interface, cfg.Proxies); err != nil {
-			log.Fatalf("[main] failed to ensure IPv6 addresses: %v", err)
+	setLogLevel(cfg.LogLevel)
+	setLogFormat(cfg.LogFormat)
+	setLogRotation(cfg.LogRotation)
+	logSampling.update(cfg.LogSampling)
+	setSlowLog(cfg.SlowLog)
+	autoBan.update(cfg.AutoBan)
+	passwordFile.update(cfg.UsersFile)
+	authHTTP.update(cfg.AuthHTTP)
+	ldapAuth.update(cfg.LDAP)
+	radiusAuth.update(cfg.RADIUS)
+	if *logFile != "" {
+		if err := openLogFile(*logFile); err != nil {
+			logFatal("[main] %v", err)
 		}
-	} else {
-		log.Printf("[main] skipping IPv6 address assignment (not Linux)")
 	}
+	if err := syslogOut.update(cfg.Syslog); err != nil {
+		logFatal("[main] %v", err)
+	}
+	defer syslogOut.close(2 * time.Second)
+	updateLoki(cfg.Loki)
+	updateElasticsearch(cfg.Elastic)
+	defer closeLogShippers(2 * time.Second)
+	logInfo("[main] loaded %d proxy entries from %s", len(cfg.Proxies), *configPath)
+	logInfo("[main] interface: %s", cfg.Interface)
+	logInfo("[main] GOMAXPROCS: %d", runtime.GOMAXPROCS(0))
 
-	// Start all proxy listeners
-	errCh := make(chan error, len(cfg.Proxies))
-	for _, entry := range cfg.Proxies {
-		entry := entry // capture for goroutine
-		go func() {
-			if err := StartProxy(entry); err != nil {
-				errCh <- fmt.Errorf("proxy %s:%d: %w", entry.IPv6, entry.Port, err)
-			}
-		}()
+	prepareHost(cfg)
+
+	webhooks.update(cfg.Webhooks) // before the listeners, to report bind failures
+	defer webhooks.close(5 * time.Second)
+	defer radiusAcct.close(5 * time.Second) // stops the sessions still open
+	srv := newServer()
+	if err := srv.apply(cfg); err != nil {
+		webhooks.close(5 * time.Second)
+		logFatal("[main] fatal: %v", err)
+	}
+	defer srv.stopTracing(5 * time.Second)
+	quotaStop, quotaDone := make(chan struct{}), make(chan struct{})
+	go srv.watchQuotas(state.Dir, quotaStop, quotaDone)
+	defer func() { close(quotaStop); <-quotaDone }()
+	ctl := &controller{srv: srv, admin: &adminServer{}, grpc: &grpcAdmin{}, stats: &statsdSink{}, path: *configPath, opts: opts, state: state, source: src, started: started}
+	if persistEnabled(cfg) {
+		d, err := loadDynamic(state.Dir)
+		if err == nil {
+			err = restoreBans(d.Bans)
+		}
+		if err != nil {
+			logFatal("[main] fatal: %v", err)
+		}
+	}
+	if err := ctl.sec.update(cfg.Admin); err != nil {
+		logFatal("[main] fatal: %v", err)
+	}
+	if err := auditLog.setPath(auditPath(cfg.Admin)); err != nil {
+		logFatal("[main] fatal: audit log: %v", err)
+	}
+	if err := ctl.stats.update(cfg.StatsD, srv); err != nil {
+		logFatal("[main] fatal: %v", err)
+	}
+	defer ctl.stats.update(nil, srv) // last counts
+	if err := flowExport.update(cfg.IPFIX); err != nil {
+		logFatal("[main] fatal: %v", err)
+	}
+	defer flowExport.close(2 * time.Second)
+	if err := ctl.admin.update(cfg.Admin, ctl); err != nil {
+		logFatal("[main] fatal: %v", err)
+	}
+	if err := ctl.grpc.update(cfg.Admin, ctl); err != nil {
+		logFatal("[main] fatal: %v", err)
+	}
+	recordRunning(state, cfg)
+	if state.Dir != "" {
+		closeSocket, err := serveControlSocket(state.Dir, ctl)
+		if err != nil {
+			logFatal("[main] fatal: %v", err)
+		}
+		defer closeSocket()
+		if err := writePIDFile(state.Dir); err != nil {
+			logWarn("[main] %v", err)
+		}
+		defer os.Remove(filepath.Join(state.Dir, pidFile))
 	}
 
 	// Print startup summary
-	log.Println("[main] ─────────────────────────────────────")
+	logInfo("[main] ─────────────────────────────────────")
 	for _, entry := range cfg.Proxies {
-		log.Printf("[main]   socks5://0.0.0.0:%-5d → %s", entry.Port, entry.IPv6)
+		logInfo("[main]   %s", entrySummary(entry))
+	}
+	logInfo("[main] ─────────────────────────────────────")
+	logInfo("[main] all proxies running. Press Ctrl+C to stop.")
+
+	// Optionally reload when the config file changes
+	var changes <-chan struct{} // nil (never ready) unless -watch
+	if *watch {
+		if _, kv := parseKVSource(*configPath); kv {
+			changes, err = watchKV(*configPath, opts.Remote, *watchDebounce)
+		} else if isRemoteConfig(*configPath) {
+			logFatal("[main] -watch requires a local config file or a consul/etcd key; send SIGHUP to re-fetch %s", *configPath)
+		} else {
+			changes, err = watchConfig(*configPath, *format, *watchDebounce)
+		}
+		if err != nil {
+			logFatal("[main] %v", err)
+		}
+		logInfo("[main] watching %s for changes", *configPath)
 	}
-	log.Println("[main] ─────────────────────────────────────")
-	log.Println("[main] all proxies running. Press Ctrl+C to stop.")
 
-	// Wait for shutdown signal or fatal error
+	// Wait for shutdown signal; SIGHUP reloads the configuration, and on
+	// Unix signalActions has the others
+	actions := signalActions(ctl)
+	sigs := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+	for sig := range actions {
+		sigs = append(sigs, sig)
+	}
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, sigs...)
+
+	for {
+		select {
+		case sig := <-sigCh:
+			if action, ok := actions[sig]; ok {
+				action()
+				continue
+			}
+			switch sig {
+			case syscall.SIGHUP:
+				ctl.reload("signal", "SIGHUP received")
+				continue
+			}
+			logInfo("[main] received signal %s, shutting down...", sig)
+			return
+		case <-changes:
+			ctl.reload("watch", "config changed")
+		}
+	}
+}
 
-	select {
-	case sig := <-sigCh:
-		log.Printf("[main] received signal %s, shutting down...", sig)
-	case err := <-errCh:
-		log.Fatalf("[main] fatal: %v", err)
+// prepareHost assigns the configured outbound addresses to the interface.
+func prepareHost(cfg *Config) {
+	if runtime.GOOS == "linux" {
+		if err := EnsureIPv6Addresses(cfg.Interface, outboundEntries(cfg)); err != nil {
+			logFatal("[main] failed to ensure IPv6 addresses: %v", err)
+		}
+		return
+	}
+	logInfo("[main] skipping IPv6 address assignment (not Linux)")
+	for _, entry := range cfg.Proxies {
+		if entry.BindDevice != "" {
+			logWarn("[main] port %s: bind_device is only supported on Linux, ignoring", entry.tag())
+		}
+		if entry.Mark != 0 {
+			logWarn("[main] port %s: mark is only supported on Linux, ignoring", entry.tag())
+		}
+	}
+}
+
+// entrySummary renders a proxy entry for the startup and -t listings.
+func entrySummary(entry ProxyEntry) string {
+	host := "0.0.0.0"
+	if entry.listenHost != "" {
+		host = entry.listenHost
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	s := fmt.Sprintf("socks5://%s:%-5d → %s", host, entry.Port, describeOutbound(entry.Outbound))
+	var opts []string
+	if entry.Paused {
+		opts = append(opts, "paused")
+	}
+	if entry.BindDevice != "" {
+		opts = append(opts, "dev "+entry.BindDevice)
+	}
+	if entry.Mark != 0 {
+		opts = append(opts, fmt.Sprintf("mark %#x", entry.Mark))
+	}
+	if entry.Resolve != resolveIPv6Only {
+		opts = append(opts, entry.Resolve)
+	}
+	if entry.Bandwidth != nil {
+		opts = append(opts, bandwidthSummary(entry.Bandwidth))
+	}
+	if entry.MaxConnections > 0 {
+		opts = append(opts, fmt.Sprintf("max %d connections", entry.MaxConnections))
+	}
+	if entry.Acceptors > 1 {
+		opts = append(opts, fmt.Sprintf("%d acceptors", entry.Acceptors))
+	}
+	if entry.Congestion != "" {
+		opts = append(opts, entry.Congestion)
+	}
+	if entry.dscp > 0 {
+		opts = append(opts, "dscp "+entry.DSCP)
+	}
+	if entry.MPTCP {
+		opts = append(opts, "mptcp")
+	}
+	if f := entry.FastOpen; f != nil && (f.Listen || f.Connect) {
+		switch {
+		case f.Listen && f.Connect:
+			opts = append(opts, "fast open")
+		case f.Listen:
+			opts = append(opts, "fast open (clients)")
+		default:
+			opts = append(opts, "fast open (targets)")
+		}
+	}
+	if w := entry.Workers; w != nil && w.Max > 0 {
+		opts = append(opts, fmt.Sprintf("%d workers, queue %d", w.Max, w.Queue))
+	}
+	if a := entry.Accept; a != nil {
+		if a.Backlog > 0 {
+			opts = append(opts, fmt.Sprintf("backlog %d", a.Backlog))
+		}
+		if a.Defer > 0 {
+			opts = append(opts, "defer accept "+a.Defer.String())
+		}
+	}
+	if entry.bufferSize > 0 && (entry.bufferSize != defaultBufferSize || !entry.bufferPool) {
+		b := formatBytes(int64(entry.bufferSize)) + " buffers"
+		if !entry.bufferPool {
+			b += ", unpooled"
+		}
+		opts = append(opts, b)
+	}
+	if entry.RateLimit != nil {
+		opts = append(opts, rateLimitSummary(entry.RateLimit))
+	}
+	if entry.Quota != nil {
+		opts = append(opts, "quota "+entry.Quota.Limit+" "+entry.Quota.Period)
+	}
+	if entry.Auth {
+		if entry.AuthBackend == authBackendLDAP || entry.AuthBackend == authBackendRADIUS {
+			opts = append(opts, "auth "+entry.AuthBackend)
+		} else {
+			opts = append(opts, "auth")
+		}
+	}
+	if entry.Schedule != nil {
+		opts = append(opts, scheduleSummary(entry.Schedule))
+	}
+	if entry.Resolver != nil {
+		dns := entry.Resolver.Protocol + " " + strings.Join(entry.Resolver.Servers, ",")
+		if entry.Resolver.BindOutbound {
+			dns += " via outbound"
+		}
+		if ecs := entry.Resolver.ECS; ecs != nil {
+			switch ecs.Mode {
+			case ecsOutbound:
+				dns += fmt.Sprintf(" ecs outbound/%d", ecs.Prefix)
+			case ecsSubnet:
+				dns += " ecs " + ecs.Subnet
+			default:
+				dns += " ecs " + ecs.Mode
+			}
+		}
+		opts = append(opts, dns)
+	}
+	if len(opts) > 0 {
+		s += " (" + strings.Join(opts, ", ") + ")"
+	}
+	if entry.Name != "" {
+		s += " [" + entry.Name + "]"
 	}
+	return s
 }
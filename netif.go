@@ -2,13 +2,12 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"os/exec"
 	"strings"
 )
 
-// EnsureIPv6Addresses checks each proxy's IPv6 against the network interface.
+// EnsureIPv6Addresses checks each proxy's outbound IPv6 addresses against the network interface.
 // If an address is not assigned, it adds it with /128 prefix using "ip addr add".
 // This function is idempotent — already-assigned addresses are silently skipped.
 func EnsureIPv6Addresses(iface string, entries []ProxyEntry) error {
@@ -39,32 +38,77 @@ func EnsureIPv6Addresses(iface string, entries []ProxyEntry) error {
 	}
 
 	for _, entry := range entries {
-		ip, err := ParseIPv6(entry.IPv6)
-		if err != nil {
-			return fmt.Errorf("invalid IPv6 %q: %w", entry.IPv6, err)
+		for _, out := range entry.Outbound {
+			if err := ensureIPv6Address(iface, out.IPv6, existing); err != nil {
+				return err
+			}
 		}
+	}
+
+	return nil
+}
+
+// ensureIPv6Address adds a single address to iface unless it is already in
+// existing. Added addresses are recorded in existing, so addresses shared by
+// several pools are only added once.
+func ensureIPv6Address(iface, ipStr string, existing map[string]struct{}) error {
+	ip, err := ParseIPv6(ipStr)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 %q: %w", ipStr, err)
+	}
+
+	normalized := ip.String()
+	if _, ok := existing[normalized]; ok {
+		logDebug("[netif] %s already assigned on %s, skipping", normalized, iface)
+		return nil
+	}
 
-		normalized := ip.String()
-		if _, ok := existing[normalized]; ok {
-			log.Printf("[netif] %s already assigned on %s, skipping", normalized, iface)
-			continue
+	// Add the address with /128
+	addr := normalized + "/128"
+	cmd := exec.Command("ip", "addr", "add", addr, "dev", iface)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// Check if the error is "already exists" (race condition)
+		if strings.Contains(string(output), "RTNETLINK answers: File exists") {
+			logDebug("[netif] %s already exists on %s (concurrent add), skipping", normalized, iface)
+			existing[normalized] = struct{}{}
+			return nil
 		}
+		return fmt.Errorf("ip addr add %s dev %s: %s: %w", addr, iface, strings.TrimSpace(string(output)), err)
+	}
 
-		// Add the address with /128
-		addr := normalized + "/128"
-		cmd := exec.Command("ip", "addr", "add", addr, "dev", iface)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			// Check if the error is "already exists" (race condition)
-			if strings.Contains(string(output), "RTNETLINK answers: File exists") {
-				log.Printf("[netif] %s already exists on %s (concurrent add), skipping", normalized, iface)
+	existing[normalized] = struct{}{}
+	logInfo("[netif] added %s to %s", addr, iface)
+	return nil
+}
+
+// addressProblems returns the outbound addresses of entries that cannot be
+// used yet: not assigned to iface, still in duplicate address detection, or
+// found to be duplicates.
+func addressProblems(iface string, entries []ProxyEntry) ([]string, error) {
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return nil, fmt.Errorf("interface %q: %w", iface, err)
+	}
+	assigned, err := interfaceIPv6(iface)
+	if err != nil {
+		return nil, fmt.Errorf("list addresses on %q: %w", iface, err)
+	}
+	var problems []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		for _, out := range entry.Outbound {
+			ip := net.ParseIP(out.IPv6)
+			if ip == nil || seen[ip.String()] {
 				continue
 			}
-			return fmt.Errorf("ip addr add %s dev %s: %s: %w", addr, iface, strings.TrimSpace(string(output)), err)
+			seen[ip.String()] = true
+			switch usable, ok := assigned[ip.String()]; {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("%s is not assigned to %s", ip, iface))
+			case !usable:
+				problems = append(problems, fmt.Sprintf("%s on %s is tentative or a duplicate (DAD)", ip, iface))
+			}
 		}
-
-		log.Printf("[netif] added %s to %s", addr, iface)
 	}
-
-	return nil
+	return problems, nil
 }
@@ -0,0 +1,44 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Address flags of /proc/net/if_inet6 (IFA_F_*).
+const (
+	ifaDADFailed = 0x08
+	ifaTentative = 0x40
+)
+
+// interfaceIPv6 returns the IPv6 addresses of iface and whether each can be
+// bound: not still in duplicate address detection and not a duplicate.
+func interfaceIPv6(iface string) (map[string]bool, error) {
+	f, err := os.Open("/proc/net/if_inet6")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	addrs := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// address ifindex prefixlen scope flags name
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 6 || fields[5] != iface {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[0])
+		flags, ferr := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil || ferr != nil || len(raw) != net.IPv6len {
+			continue
+		}
+		addrs[net.IP(raw).String()] = flags&(ifaDADFailed|ifaTentative) == 0
+	}
+	return addrs, sc.Err()
+}
@@ -0,0 +1,25 @@
+// +build !linux
+
+package main
+
+import "net"
+
+// interfaceIPv6 returns the IPv6 addresses of iface. Their duplicate
+// address detection state is not available here, so all count as usable.
+func interfaceIPv6(iface string) (map[string]bool, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	list, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]bool, len(list))
+	for _, a := range list {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() == nil {
+			addrs[ipn.IP.String()] = true
+		}
+	}
+	return addrs, nil
+}
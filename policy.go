@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errDestinationDenied rejects destinations blocked by a listener's policy.
+var errDestinationDenied = errors.New("destination not allowed by policy")
+
+// Internal ranges not covered by the net.IP methods.
+var (
+	cgnatNet     = mustCIDR("100.64.0.0/10") // RFC 6598 shared address space
+	thisNet      = mustCIDR("0.0.0.0/8")     // "this network", which Linux routes to the host
+	siteLocalNet = mustCIDR("fec0::/10")     // deprecated site-local, RFC 3879
+)
+
+// Prefixes of IPv6 addresses that carry an IPv4 address: a NAT64 gateway
+// or 6to4 relay dials that IPv4 address.
+var (
+	nat64Net      = mustCIDR("64:ff9b::/96")   // well-known NAT64 prefix, RFC 6052
+	nat64LocalNet = mustCIDR("64:ff9b:1::/48") // local-use NAT64 prefixes, RFC 8215
+	sixToFourNet  = mustCIDR("2002::/16")      // 6to4, RFC 3056
+	v4CompatNet   = mustCIDR("::/96")          // IPv4-compatible, RFC 4291
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// destPolicy decides which destinations a listener may dial. Its address
+// rules are applied to IP-literal targets and again to every address a
+// domain resolves to, so a permitted domain pointing at a blocked address
+// (DNS rebinding) is still refused; its domain rules are applied to domain
+// targets before they are resolved. With an allowlist, only destinations
+// it lists may be dialed at all; the deny rules still apply to them.
+//
+// A nil *destPolicy allows everything.
+type destPolicy struct {
+	denyInternal bool // internal ranges and the host's own addresses
+	deny         []*net.IPNet
+	denyDomains  domainSet
+
+	// allowOnly refuses every destination but domains of allowDomains and
+	// addresses in allow.
+	allowOnly    bool
+	allow        []*net.IPNet
+	allowDomains domainSet
+
+	allowPorts []portRange // empty: all ports not denied
+	denyPorts  []portRange
+
+	sniPorts   map[uint16]bool // IP targets whose TLS server name is checked
+	requireSNI bool
+}
+
+// portRange is an inclusive range of destination ports.
+type portRange struct{ first, last uint16 }
+
+func parsePortRanges(list []string) []portRange {
+	var out []portRange
+	for _, s := range list {
+		first, last, _ := parsePortRange(s)
+		out = append(out, portRange{uint16(first), uint16(last)})
+	}
+	return out
+}
+
+func inPortRanges(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.first && port <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// newDestPolicy builds a policy from a validated config block (nil: no
+// block, so only the internal-range guard), or returns nil if it allows
+// everything.
+func newDestPolicy(cfg *DestinationConfig) *destPolicy {
+	if cfg == nil {
+		cfg = &DestinationConfig{}
+	}
+	if cfg.AllowInternal && !cfg.DenyPrivate && len(cfg.DenyCIDRs) == 0 && len(cfg.DenyDomains) == 0 &&
+		len(cfg.AllowCIDRs) == 0 && len(cfg.AllowDomains) == 0 &&
+		len(cfg.AllowPorts) == 0 && len(cfg.DenyPorts) == 0 && !cfg.SNI {
+		return nil
+	}
+	p := &destPolicy{
+		denyInternal: cfg.DenyPrivate || !cfg.AllowInternal,
+		deny:         parseCIDRs(cfg.DenyCIDRs),
+		denyDomains:  newDomainSet(cfg.DenyDomains),
+		allowOnly:    len(cfg.AllowCIDRs) > 0 || len(cfg.AllowDomains) > 0,
+		allow:        parseCIDRs(cfg.AllowCIDRs),
+		allowDomains: newDomainSet(cfg.AllowDomains),
+		allowPorts:   parsePortRanges(cfg.AllowPorts),
+		denyPorts:    parsePortRanges(cfg.DenyPorts),
+		requireSNI:   cfg.RequireSNI,
+	}
+	if cfg.SNI {
+		p.sniPorts = make(map[uint16]bool, len(cfg.SNIPorts))
+		for _, port := range cfg.SNIPorts {
+			p.sniPorts[uint16(port)] = true
+		}
+	}
+	return p
+}
+
+// parseCIDRs parses validated, normalized ranges.
+func parseCIDRs(list []string) []*net.IPNet {
+	var out []*net.IPNet
+	for _, c := range list {
+		_, n, _ := net.ParseCIDR(c)
+		out = append(out, n)
+	}
+	return out
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowPort reports whether destination port may be dialed.
+func (p *destPolicy) allowPort(port uint16) bool {
+	if p == nil {
+		return true
+	}
+	if inPortRanges(p.denyPorts, port) {
+		return false
+	}
+	return len(p.allowPorts) == 0 || inPortRanges(p.allowPorts, port)
+}
+
+// allowHost reports whether the domain host may be resolved: it is not
+// denied and, with an allowlist, either listed or possibly resolving to
+// allow_cidrs.
+func (p *destPolicy) allowHost(host string) bool {
+	if p == nil || p.denyDomains.empty() && !p.allowOnly {
+		return true
+	}
+	host = normalizeHost(host)
+	if p.denyDomains.match(host) {
+		return false
+	}
+	return !p.allowOnly || len(p.allow) > 0 || p.allowDomains.match(host)
+}
+
+// allowUnresolved reports whether the domain host may be dialed through an
+// upstream, which resolves it: it passes allowHost and, with an allowlist,
+// is listed.
+func (p *destPolicy) allowUnresolved(host string) bool {
+	return p.allowHost(host) && (p == nil || !p.allowOnly || p.allowDomains.match(normalizeHost(host)))
+}
+
+// sniffs reports whether the server name of a connection to host:port is
+// to be checked. It is false on nil.
+func (p *destPolicy) sniffs(host string, port uint16) bool {
+	return p != nil && p.sniPorts[port] && net.ParseIP(host) != nil
+}
+
+// allowServerName reports whether a connection to the IP host the policy
+// sniffs may go on with the server name of its ClientHello ("" if it sent
+// none). With an allowlist, the name must be listed unless the address is.
+func (p *destPolicy) allowServerName(host, name string) bool {
+	listed := !p.allowOnly || inNets(p.allow, net.ParseIP(host))
+	if name == "" {
+		return !p.requireSNI && listed
+	}
+	name = normalizeHost(name)
+	return !p.denyDomains.match(name) && (listed || p.allowDomains.match(name))
+}
+
+// allowIP reports whether ip may be dialed by the deny rules.
+func (p *destPolicy) allowIP(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+	if p.denyInternal && (isInternalIP(ip) || isLocalIP(ip)) {
+		return false
+	}
+	return !inNets(p.deny, ip)
+}
+
+// filterIPs returns the subset of ips, the addresses of the target host, a
+// connection to port may be dialed, or errDestinationDenied if none
+// remain. With an allowlist, they must be in allow_cidrs, unless host is a
+// listed domain or an IP whose server name is checked against
+// allow_domains after connecting.
+func (p *destPolicy) filterIPs(ips []net.IP, host string, port uint16) ([]net.IP, error) {
+	if p == nil {
+		return ips, nil
+	}
+	listed := !p.allowOnly
+	if !listed && net.ParseIP(host) == nil {
+		listed = p.allowDomains.match(normalizeHost(host))
+	} else if !listed {
+		listed = p.sniffs(host, port) && !p.allowDomains.empty()
+	}
+	allowed := ips[:0:0]
+	for _, ip := range ips {
+		if p.allowIP(ip) && (listed || inNets(p.allow, ip)) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errDestinationDenied
+	}
+	return allowed, nil
+}
+
+// isInternalIP reports whether ip is loopback, link-local, private (RFC 1918,
+// ULA, site-local), CGNAT, in 0.0.0.0/8, unspecified or multicast.
+// IPv4-mapped IPv6 addresses are checked as IPv4, and so are the IPv4
+// addresses embedded in NAT64, 6to4 and IPv4-compatible ones.
+func isInternalIP(ip net.IP) bool {
+	if isInternalRange(ip) {
+		return true
+	}
+	for _, v4 := range embeddedIPv4s(ip) {
+		if isInternalRange(v4) {
+			return true
+		}
+	}
+	return false
+}
+
+func isInternalRange(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		cgnatNet.Contains(ip) || thisNet.Contains(ip) || siteLocalNet.Contains(ip)
+}
+
+// embeddedIPv4s returns the IPv4 addresses the IPv6 address ip may carry.
+// A local-use NAT64 prefix may be of any RFC 6052 length from /48, so each
+// of their placements is returned for it.
+func embeddedIPv4s(ip net.IP) []net.IP {
+	b := ip.To16()
+	if b == nil || ip.To4() != nil {
+		return nil
+	}
+	switch {
+	case nat64Net.Contains(b), v4CompatNet.Contains(b):
+		return []net.IP{net.IPv4(b[12], b[13], b[14], b[15])}
+	case sixToFourNet.Contains(b):
+		return []net.IP{net.IPv4(b[2], b[3], b[4], b[5])}
+	case nat64LocalNet.Contains(b):
+		// Bits 64-71 are the reserved "u" octet, skipped by the address
+		return []net.IP{
+			net.IPv4(b[6], b[7], b[9], b[10]),    // /48
+			net.IPv4(b[7], b[9], b[10], b[11]),   // /56
+			net.IPv4(b[9], b[10], b[11], b[12]),  // /64
+			net.IPv4(b[12], b[13], b[14], b[15]), // /96
+		}
+	}
+	return nil
+}
+
+// localAddrsTTL is how long the host's own addresses are cached for the
+// internal-range guard; addresses assigned since are refused once it ends.
+const localAddrsTTL = 10 * time.Second
+
+// localAddrSet is a snapshot of the addresses of the host's interfaces.
+type localAddrSet struct {
+	addrs   map[netip.Addr]bool
+	expires time.Time
+}
+
+var localAddrs struct {
+	cur atomic.Pointer[localAddrSet]
+	mu  sync.Mutex // held while refreshing
+}
+
+// isLocalIP reports whether ip is assigned to one of the host's interfaces,
+// such as its public address or an outbound address of the pool.
+func isLocalIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return currentLocalAddrs().addrs[addr.Unmap()]
+}
+
+// currentLocalAddrs returns the cached interface addresses, reading them
+// again once they expired. If they cannot be read, the previous snapshot
+// is kept.
+func currentLocalAddrs() *localAddrSet {
+	if s := localAddrs.cur.Load(); s != nil && time.Now().Before(s.expires) {
+		return s
+	}
+	localAddrs.mu.Lock()
+	defer localAddrs.mu.Unlock()
+	s := localAddrs.cur.Load()
+	if s != nil && time.Now().Before(s.expires) {
+		return s
+	}
+	next := &localAddrSet{expires: time.Now().Add(localAddrsTTL)}
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logWarn("[policy] cannot list the host's addresses: %v", err)
+		if s != nil {
+			next.addrs = s.addrs
+		}
+		localAddrs.cur.Store(next)
+		return next
+	}
+	next.addrs = make(map[netip.Addr]bool, len(ifAddrs))
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok {
+			if addr, ok := netip.AddrFromSlice(n.IP); ok {
+				next.addrs[addr.Unmap()] = true
+			}
+		}
+	}
+	localAddrs.cur.Store(next)
+	return next
+}
+
+// validateDestinations normalizes and validates a destinations block.
+func validateDestinations(dc *DestinationConfig) error {
+	if dc.DenyPrivate && dc.AllowInternal {
+		return fmt.Errorf("deny_private and allow_internal contradict each other")
+	}
+	if err := normalizeCIDRs("deny_cidrs", dc.DenyCIDRs); err != nil {
+		return err
+	}
+	if err := normalizeCIDRs("allow_cidrs", dc.AllowCIDRs); err != nil {
+		return err
+	}
+	if err := normalizeDomainRules("deny_domains", dc.DenyDomains); err != nil {
+		return err
+	}
+	if err := normalizeDomainRules("allow_domains", dc.AllowDomains); err != nil {
+		return err
+	}
+	for i, s := range dc.AllowPorts {
+		if _, _, err := parsePortRange(s); err != nil {
+			return fmt.Errorf("allow_ports[%d]: %w", i, err)
+		}
+	}
+	for i, s := range dc.DenyPorts {
+		if _, _, err := parsePortRange(s); err != nil {
+			return fmt.Errorf("deny_ports[%d]: %w", i, err)
+		}
+	}
+	if !dc.SNI && (dc.RequireSNI || len(dc.SNIPorts) > 0) {
+		return fmt.Errorf("require_sni and sni_ports need sni: true")
+	}
+	if dc.SNI && len(dc.SNIPorts) == 0 {
+		dc.SNIPorts = []int{443}
+	}
+	for _, p := range dc.SNIPorts {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("invalid sni_ports entry %d", p)
+		}
+	}
+	return nil
+}
+
+// normalizeCIDRs validates the ranges of the list name in place, turning
+// bare addresses into single-host ranges.
+func normalizeCIDRs(name string, list []string) error {
+	for i, c := range list {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return fmt.Errorf("%s[%d]: invalid CIDR %q", name, i, c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		list[i] = n.String()
+	}
+	return nil
+}
+
+// clientPolicy decides which client addresses may use a listener, checked
+// on accept before the SOCKS5 handshake. A deny match always refuses; a
+// non-empty allow list refuses every address outside it.
+//
+// A nil *clientPolicy allows everything.
+type clientPolicy struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newClientPolicy builds a policy from validated allow_clients and
+// deny_clients lists, or returns nil if both are empty.
+func newClientPolicy(allow, deny []string) *clientPolicy {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	p := &clientPolicy{}
+	for _, s := range allow {
+		p.allow = append(p.allow, netip.MustParsePrefix(s))
+	}
+	for _, s := range deny {
+		p.deny = append(p.deny, netip.MustParsePrefix(s))
+	}
+	return p
+}
+
+// allows reports whether the client at addr may connect.
+func (p *clientPolicy) allows(addr net.Addr) bool {
+	if p == nil {
+		return true
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := ta.AddrPort().Addr().Unmap().WithZone("")
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClientList normalizes a list of client CIDRs or bare addresses
+// (allow_clients or deny_clients) in place.
+func validateClientList(name string, list []string) error {
+	for i, s := range list {
+		p, err := parseBanTarget(s)
+		if err != nil {
+			return fmt.Errorf("%s[%d]: %w", name, i, err)
+		}
+		list[i] = p.String()
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsInternalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.1.2.3", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fec0::1", true},
+		{"::ffff:192.168.1.1", true},
+		{"64:ff9b::7f00:1", true},       // NAT64 of 127.0.0.1
+		{"64:ff9b::a9fe:a9fe", true},    // NAT64 of 169.254.169.254
+		{"64:ff9b:1:a00:1:100::", true}, // local-use /48 of 10.0.1.1
+		{"64:ff9b:1::a00:101", true},    // local-use /96 of 10.0.1.1
+		{"2002:7f00:1::1", true},        // 6to4 of 127.0.0.1
+		{"2002:c0a8:101::1", true},      // 6to4 of 192.168.1.1
+		{"::127.0.0.1", true},           // IPv4-compatible
+
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"64:ff9b::808:808", false}, // NAT64 of 8.8.8.8
+		{"2002:808:808::1", false},  // 6to4 of 8.8.8.8
+	}
+	for _, tt := range tests {
+		if got := isInternalIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isInternalIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
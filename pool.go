@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// outboundPool picks the outbound IPv6 for each connection of a listener.
+// Selection uses smooth weighted round-robin (as in nginx), which spreads
+// picks evenly over time: weights 70/30 yield exactly 7 of every 10
+// connections on the first address, interleaved rather than in bursts.
+//
+// Addresses failing health checks are skipped. If every address in the pool
+// is unhealthy, all of them are used rather than refusing every connection.
+type outboundPool struct {
+	mu     sync.Mutex
+	addrs  []poolAddr
+	health *healthChecker
+}
+
+type poolAddr struct {
+	ip      net.IP
+	weight  int
+	current int
+}
+
+// newOutboundPool builds a pool from validated config addresses.
+// health may be nil to disable health-based exclusion.
+func newOutboundPool(addrs []OutboundAddr, health *healthChecker) (*outboundPool, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("empty outbound pool")
+	}
+	p := &outboundPool{addrs: make([]poolAddr, 0, len(addrs)), health: health}
+	for _, a := range addrs {
+		ip, err := ParseIPv6(a.IPv6)
+		if err != nil {
+			return nil, err
+		}
+		p.addrs = append(p.addrs, poolAddr{ip: ip, weight: a.Weight})
+	}
+	return p, nil
+}
+
+// Pick returns the next outbound address. Single-address pools skip the
+// lock, since there is nothing to fail over to.
+func (p *outboundPool) Pick() net.IP {
+	if len(p.addrs) == 1 {
+		return p.addrs[0].ip
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip := p.pick(true); ip != nil {
+		return ip
+	}
+	return p.pick(false)
+}
+
+// pick runs one smooth weighted round-robin step over the pool, restricted
+// to healthy addresses if healthyOnly is set. Returns nil if none qualify.
+func (p *outboundPool) pick(healthyOnly bool) net.IP {
+	best, total := -1, 0
+	for i := range p.addrs {
+		a := &p.addrs[i]
+		if healthyOnly && !p.health.Healthy(a.ip) {
+			continue
+		}
+		a.current += a.weight
+		total += a.weight
+		if best == -1 || a.current > p.addrs[best].current {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	p.addrs[best].current -= total
+	return p.addrs[best].ip
+}
+
+// describeOutbound lists addresses with their weights, e.g.
+// "2001:db8::1 (70), 2001:db8::2 (30)". A single address is printed bare.
+func describeOutbound(addrs []OutboundAddr) string {
+	if len(addrs) == 1 {
+		return addrs[0].IPv6
+	}
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		parts[i] = a.IPv6 + " (" + strconv.Itoa(a.Weight) + ")"
+	}
+	return strings.Join(parts, ", ")
+}
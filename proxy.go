@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -36,9 +38,10 @@ const (
 	repAddrTypeNotSupported = 0x08
 )
 
-// bufPool is a lock-free pool of 32 KiB buffers for relay.
-// On Linux with two *net.TCPConn, io.Copy uses splice(2) and this pool
-// is only the fallback path.
+// bufPool is a lock-free pool of 32 KiB buffers, for reading TLS
+// ClientHellos and for relays of the default buffer size.
+// On Linux with two *net.TCPConn, spliceCopy uses splice(2) and the relay
+// buffers are only the fallback path.
 var bufPool = sync.Pool{
 	New: func() any {
 		buf := make([]byte, 32*1024)
@@ -46,58 +49,409 @@ var bufPool = sync.Pool{
 	},
 }
 
-// StartProxy starts a SOCKS5 listener on the given port, using outboundIP
-// for all outgoing connections. Blocks until the listener is closed.
-func StartProxy(entry ProxyEntry) error {
-	outboundIP, err := ParseIPv6(entry.IPv6)
+// listener is the runtime state shared by all connections of one proxy entry.
+type listener struct {
+	entry    ProxyEntry
+	pool     *outboundPool
+	resolver *dnsResolver
+	policy   *destPolicy // nil: all destinations allowed (allow_internal)
+	fails    *failCache  // nil: failures not cached
+	sockOpts socketOptions
+	routes   []*routeRule // nil: no rules
+	tracer   *tracer      // nil: sessions not traced
+	domains  *domainStats // nil: traffic not counted by domain
+	access   *accessLog   // nil: no access_log
+
+	// clients is the entry's allow_clients / deny_clients policy and
+	// globalClients the top-level one; a client must pass both.
+	clients       *clientPolicy  // nil: all clients allowed
+	globalClients *clientPolicy  // nil: all clients allowed
+	geo           *geoPolicy     // nil: no country or ASN rules
+	limiter       *connLimiter   // nil: no rate_limit
+	users         *userDirectory // auth: the accounts clients log in to
+
+	maxConns, globalMaxConns int // max_connections of the entry and the daemon (0: no cap)
+	bufs                     *relayBufs
+}
+
+// proxyShared is the process-wide state used by every listener.
+type proxyShared struct {
+	health  *healthChecker    // nil: health checks disabled
+	cache   *dnsCache         // nil: DNS cache disabled
+	fails   *failCache        // nil: connection failure cache disabled
+	tracer  *tracer           // nil: tracing disabled
+	domains *domainStats      // nil: domain accounting disabled
+	hosts   map[string]net.IP // static host overrides, consulted before DNS
+	clients *clientPolicy     // nil: no global allow_clients / deny_clients
+	geo     *geoIP            // nil: no geoip databases
+	users   *userDirectory    // nil: no users
+
+	upstreams map[string]*upstream // the upstream chains of rules, by name
+
+	maxConns int // global max_connections (0: no cap)
+}
+
+// newListener builds the runtime state for entry, picking an address from
+// the entry's outbound pool for each outgoing connection.
+func newListener(entry ProxyEntry, shared *proxyShared) (*listener, error) {
+	pool, err := newOutboundPool(entry.Outbound, shared.health)
 	if err != nil {
-		return fmt.Errorf("proxy %d: %w", entry.Port, err)
+		return nil, fmt.Errorf("proxy %d: %w", entry.Port, err)
+	}
+	var access *accessLog
+	if entry.AccessLog != "" {
+		if access, err = openAccessLog(entry.AccessLog); err != nil {
+			return nil, fmt.Errorf("proxy %d: access_log: %w", entry.Port, err)
+		}
 	}
+	return &listener{
+		entry:    entry,
+		pool:     pool,
+		resolver: newDNSResolver(entry.Resolver, shared.cache, shared.hosts),
+		policy:   newDestPolicy(entry.Destinations),
+		routes:   newRoutes(entry.Rules, shared.upstreams),
+		fails:    shared.fails,
+		sockOpts: entry.socketOptions(),
+		tracer:   shared.tracer,
+		domains:  shared.domains,
+		access:   access,
 
-	listenAddr := fmt.Sprintf(":%d", entry.Port)
-	ln, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("listen %s: %w", listenAddr, err)
+		clients:       newClientPolicy(entry.AllowClients, entry.DenyClients),
+		globalClients: shared.clients,
+		geo:           newGeoPolicy(entry, shared.geo),
+		limiter:       newConnLimiter(entry.RateLimit),
+		users:         shared.users,
+
+		maxConns:       entry.MaxConnections,
+		globalMaxConns: shared.maxConns,
+		bufs:           newRelayBufs(entry.bufferSize, entry.bufferPool),
+	}, nil
+}
+
+// listenPort is one listening socket. Each accepted connection is handled
+// by the listener current at accept time, so a reload can swap in new
+// settings without closing the socket or touching active connections.
+type listenPort struct {
+	host    string // "" for all addresses
+	port    int
+	lns     []net.Listener // acceptors > 1: sockets sharing the port with SO_REUSEPORT
+	opts    listenOptions  // options of the sockets
+	current atomic.Pointer[listener]
+	stats   *portStats // carried over when the port moves to a new socket
+	workers workerPool // handlers of the port's connections, with workers
+}
+
+// portStats counts the connections of one port across reloads of its
+// entry. Bytes are added when a connection closes.
+type portStats struct {
+	Total     atomic.Int64 // accepted connections
+	Denied    atomic.Int64 // closed on accept by allow_clients / deny_clients
+	Limited   atomic.Int64 // closed on accept by rate_limit
+	Capped    atomic.Int64 // closed on accept by max_connections
+	Active    atomic.Int64 // connections being served
+	Failed    atomic.Int64 // CONNECT requests whose target could not be dialed
+	BytesUp   atomic.Int64 // client → target
+	BytesDown atomic.Int64 // target → client
+	Spliced   atomic.Int64 // of BytesUp and BytesDown, moved by splice(2) or the sockmap
+	MPTCP     atomic.Int64 // connections to targets using Multipath TCP
+
+	Queued  atomic.Int64 // with workers: connections waiting for a handler
+	Dropped atomic.Int64 // with workers: closed as the queue was full or for waiting too long
+
+	AcceptErrors atomic.Int64 // failed accepts, each followed by a backoff
+	FDExhausted  atomic.Int64 // of AcceptErrors, for want of file descriptors (EMFILE, ENFILE)
+
+	Quota quotaUsage // traffic counted against the entry's quota
+
+	DialErrors dialErrorCounts // Failed by class
+
+	Handshake latencyHistogram // accept to a complete SOCKS5 request
+	DNS       latencyHistogram // resolving domain targets
+	Dial      latencyHistogram // connecting to the target, all attempts
+	Session   latencyHistogram // accept to close, of relayed connections
+}
+
+// listenSOCKS opens the listening sockets for host:port: one, or with
+// several acceptors as many sockets bound with SO_REUSEPORT, each with the
+// options opts.
+func listenSOCKS(host string, port, acceptors int, opts listenOptions) (*listenPort, error) {
+	listenAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if acceptors > 1 {
+			if err := setReusePort(network, address, c); err != nil {
+				return err
+			}
+		}
+		if opts.fastOpen > 0 {
+			if err := setFastOpen(c, opts.fastOpen); err != nil {
+				return err
+			}
+		}
+		if opts.deferAccept > 0 {
+			if err := setDeferAccept(c, opts.deferAccept); err != nil {
+				return err
+			}
+		}
+		return setSocketBuffers(c, opts.sendBuffer, opts.recvBuffer)
+	}}
+	p := &listenPort{host: host, port: port, opts: opts, stats: new(portStats)}
+	for i := 0; i < acceptors; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", listenAddr)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("listen %s: %w", listenAddr, err)
+		}
+		p.lns = append(p.lns, ln)
+		if opts.backlog > 0 {
+			// The runtime listened with its own backlog; listening again
+			// resizes the accept queue.
+			rc, err := ln.(*net.TCPListener).SyscallConn()
+			if err == nil {
+				err = setBacklog(rc, opts.backlog)
+			}
+			if err != nil {
+				p.close()
+				return nil, fmt.Errorf("listen %s: %w", listenAddr, err)
+			}
+		}
 	}
-	defer ln.Close()
+	return p, nil
+}
+
+// setOptions changes the options of the port's sockets to opts, those that
+// differ from the ones they have. Socket buffers stay fixed once set: the
+// kernel cannot go back to autotuning them.
+func (p *listenPort) setOptions(opts listenOptions) error {
+	var kept error
+	if opts.sendBuffer == 0 && p.opts.sendBuffer > 0 || opts.recvBuffer == 0 && p.opts.recvBuffer > 0 {
+		kept = errors.New("removed socket_buffers.client sizes apply on a restart; new connections keep the old ones")
+		if opts.sendBuffer == 0 {
+			opts.sendBuffer = p.opts.sendBuffer
+		}
+		if opts.recvBuffer == 0 {
+			opts.recvBuffer = p.opts.recvBuffer
+		}
+	}
+	for _, ln := range p.lns {
+		rc, err := ln.(*net.TCPListener).SyscallConn()
+		if err != nil {
+			return err
+		}
+		if opts.fastOpen != p.opts.fastOpen {
+			if err := setFastOpen(rc, opts.fastOpen); err != nil {
+				return err
+			}
+		}
+		if opts.deferAccept != p.opts.deferAccept {
+			if err := setDeferAccept(rc, opts.deferAccept); err != nil {
+				return err
+			}
+		}
+		if opts.backlog != p.opts.backlog {
+			if err := setBacklog(rc, opts.backlog); err != nil {
+				return err
+			}
+		}
+		if opts.sendBuffer != p.opts.sendBuffer || opts.recvBuffer != p.opts.recvBuffer {
+			if err := setSocketBuffers(rc, opts.sendBuffer, opts.recvBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	p.opts = opts
+	return kept
+}
 
-	log.Printf("[socks5] listening on %s → outbound %s", listenAddr, outboundIP)
+// close closes the port's sockets; connections waiting in their accept
+// queues are reset.
+func (p *listenPort) close() {
+	for _, ln := range p.lns {
+		ln.Close()
+	}
+}
+
+// serve accepts connections until the sockets are closed, with an accept
+// loop per socket.
+func (p *listenPort) serve() {
+	entry := p.current.Load().entry
+	name := ""
+	if entry.Name != "" {
+		name = " (" + entry.Name + ")"
+	}
+	if len(p.lns) > 1 {
+		name += fmt.Sprintf(" with %d acceptors", len(p.lns))
+	}
+	logInfo("[socks5] listening on %s%s → outbound %s", net.JoinHostPort(p.host, strconv.Itoa(p.port)), name, describeOutbound(entry.Outbound))
 
+	for _, ln := range p.lns[1:] {
+		go p.accept(ln)
+	}
+	p.accept(p.lns[0])
+}
+
+// accept runs the accept loop of one of the port's sockets.
+func (p *listenPort) accept(ln net.Listener) {
+	defer ln.Close()
+
+	var backoff time.Duration
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			// Check if listener was closed (graceful shutdown)
+			// Check if listener was closed (graceful shutdown or reload)
 			if errors.Is(err, net.ErrClosed) {
-				return nil
+				return
+			}
+			backoff = p.acceptFailed(err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		l := p.current.Load()
+		if l.entry.Paused || p.stats.Quota.exceeded.Load() || !l.entry.Schedule.open(time.Now()) {
+			conn.Close()
+			continue
+		}
+		if !l.globalClients.allows(conn.RemoteAddr()) || !l.clients.allows(conn.RemoteAddr()) || !l.geo.allows(conn.RemoteAddr()) {
+			p.stats.Denied.Add(1)
+			if logEnabled(levelDebug) && logSampling.allow(sampleDenied, l.entry.tag(), levelDebug) {
+				logDebug("[socks5:%s] %s is not an allowed client, closing", l.entry.tag(), conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		if clientBans.active() && clientBans.banned(conn.RemoteAddr()) {
+			if logEnabled(levelDebug) && logSampling.allow(sampleBanned, l.entry.tag(), levelDebug) {
+				logDebug("[socks5:%s] %s is banned, closing", l.entry.tag(), conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		if ok, limit := l.limiter.allow(conn.RemoteAddr()); !ok {
+			p.stats.Limited.Add(1)
+			if logEnabled(levelDebug) && logSampling.allow(sampleLimited, l.entry.tag(), levelDebug) {
+				logDebug("[socks5:%s] %s over the %s rate limit, closing", l.entry.tag(), conn.RemoteAddr(), limit)
+			}
+			conn.Close()
+			continue
+		}
+		if ok, limit := l.admit(p.stats); !ok {
+			p.stats.Capped.Add(1)
+			if logSampling.allow(sampleCapped, l.entry.tag(), levelWarn) {
+				logWarn("[socks5:%s] %s max_connections (%d) reached, closing %s", l.entry.tag(), limit, l.maxConnsOf(limit), conn.RemoteAddr())
 			}
-			log.Printf("[socks5:%d] accept error: %v", entry.Port, err)
+			conn.Close()
 			continue
 		}
-		go handleConnection(conn, outboundIP, entry.Port)
+		if !p.dispatch(l, conn) {
+			p.stats.Dropped.Add(1)
+			if logSampling.allow(sampleQueue, l.entry.tag(), levelWarn) {
+				logWarn("[socks5:%s] all %d workers busy and the queue full, closing %s", l.entry.tag(), l.entry.Workers.Max, conn.RemoteAddr())
+			}
+			conn.Close()
+			l.release(p.stats)
+		}
 	}
 }
 
-// handleConnection handles a single SOCKS5 client connection.
-// All buffers are stack-allocated or pooled; no per-connection heap allocations
-// on the hot path.
-func handleConnection(client net.Conn, outboundIP net.IP, port int) {
+// Backoff of an accept loop after errors: from minAcceptBackoff, doubled
+// with each consecutive error up to maxAcceptBackoff. Running out of file
+// descriptors pauses it for fdExhaustedPause at least, since accepting
+// fails the same way until connections close; the kernel keeps queueing
+// new ones meanwhile.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+	fdExhaustedPause = 100 * time.Millisecond
+)
+
+// acceptFailed counts and logs the accept error err and returns how long
+// the loop waits before accepting again, last being its wait after the
+// previous consecutive error.
+func (p *listenPort) acceptFailed(err error, last time.Duration) time.Duration {
+	p.stats.AcceptErrors.Add(1)
+	wait := min(max(2*last, minAcceptBackoff), maxAcceptBackoff)
+	tag := p.current.Load().entry.tag()
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		p.stats.FDExhausted.Add(1)
+		wait = max(wait, fdExhaustedPause)
+		if logSampling.allow(sampleAccept, tag, levelError) {
+			logError("[socks5:%s] accept: out of file descriptors (%v), pausing for %s; raise the limit (ulimit -n, LimitNOFILE) or lower max_connections", tag, err, wait)
+		}
+		return wait
+	}
+	if logSampling.allow(sampleAccept, tag, levelError) {
+		logError("[socks5:%s] accept error: %v, retrying in %s", tag, err, wait)
+	}
+	return wait
+}
+
+// activeSessions counts the connections served by all listeners, for the
+// global max_connections.
+var activeSessions atomic.Int64
+
+// admit counts a new connection as active on the listener and in the
+// daemon, unless that exceeds a max_connections cap; limit then names it,
+// "the listener's" or "the global". handleConnection releases the count.
+func (l *listener) admit(stats *portStats) (ok bool, limit string) {
+	if n := stats.Active.Add(1); l.maxConns > 0 && n > int64(l.maxConns) {
+		stats.Active.Add(-1)
+		return false, "the listener's"
+	}
+	if n := activeSessions.Add(1); l.globalMaxConns > 0 && n > int64(l.globalMaxConns) {
+		activeSessions.Add(-1)
+		stats.Active.Add(-1)
+		return false, "the global"
+	}
+	return true, ""
+}
+
+// release undoes admit for a connection closed before it was handled.
+func (l *listener) release(stats *portStats) {
+	activeSessions.Add(-1)
+	stats.Active.Add(-1)
+}
+
+// maxConnsOf returns the cap named by admit.
+func (l *listener) maxConnsOf(limit string) int {
+	if limit == "the global" {
+		return l.globalMaxConns
+	}
+	return l.maxConns
+}
+
+// handleConnection handles a single SOCKS5 client connection, admitted by
+// admit. All buffers are stack-allocated or pooled; no per-connection heap
+// allocations on the hot path.
+func (l *listener) handleConnection(client net.Conn, stats *portStats) {
 	defer client.Close()
+	stats.Total.Add(1)
+	defer stats.Active.Add(-1)
+	defer activeSessions.Add(-1)
+	accepted := time.Now()
+	trace := l.tracer.session(l.entry, client)
+	defer trace.finish()
+	handshake := trace.phase("socks5.handshake", spanKindInternal)
+
+	l.sockOpts.setClientOptions(client)
 
 	// Set a deadline for the handshake phase only
-	client.SetDeadline(time.Now().Add(10 * time.Second))
+	client.SetDeadline(time.Now().Add(l.entry.handshakeTimeout()))
 
 	// --- Auth negotiation ---
 	// Read: VER | NMETHODS | METHODS...
 	var hdr [2]byte
 	if _, err := io.ReadFull(client, hdr[:]); err != nil {
+		l.handshakeFailed(client, "reading greeting", err)
 		return
 	}
 	if hdr[0] != socks5Version {
+		l.handshakeFailed(client, fmt.Sprintf("version %d, not SOCKS5", hdr[0]), nil)
 		return
 	}
 
 	nmethods := int(hdr[1])
 	if nmethods == 0 || nmethods > 255 {
+		l.handshakeFailed(client, "no auth methods offered", nil)
 		return
 	}
 
@@ -105,42 +459,58 @@ func handleConnection(client net.Conn, outboundIP net.IP, port int) {
 	var methodsBuf [255]byte
 	methods := methodsBuf[:nmethods]
 	if _, err := io.ReadFull(client, methods); err != nil {
+		l.handshakeFailed(client, "reading auth methods", err)
 		return
 	}
 
-	// Check if NO AUTH (0x00) is offered
-	hasNoAuth := false
+	// Check if NO AUTH (0x00) is offered, or USERNAME/PASSWORD (0x02) with auth
+	method, required := byte(authNone), "no auth"
+	if l.entry.Auth {
+		method, required = authUserPass, "username/password"
+	}
+	offered := false
 	for _, m := range methods {
-		if m == authNone {
-			hasNoAuth = true
+		if m == method {
+			offered = true
 			break
 		}
 	}
 
-	if !hasNoAuth {
+	if !offered {
 		// Reject: no acceptable auth method
 		client.Write([]byte{socks5Version, authNoAcceptable})
+		l.handshakeFailed(client, fmt.Sprintf("auth methods %x offered, %s required", methods, required), nil)
 		return
 	}
 
-	// Accept NO AUTH
-	if _, err := client.Write([]byte{socks5Version, authNone}); err != nil {
+	if _, err := client.Write([]byte{socks5Version, method}); err != nil {
+		l.handshakeFailed(client, "writing auth choice", err)
 		return
 	}
+	var user *account // nil without auth
+	if l.entry.Auth {
+		if user = l.authenticate(client); user == nil {
+			return
+		}
+		defer user.release()
+	}
 
 	// --- Request ---
 	// Read: VER | CMD | RSV | ATYP
 	var reqHdr [4]byte
 	if _, err := io.ReadFull(client, reqHdr[:]); err != nil {
+		l.handshakeFailed(client, "reading request", err)
 		return
 	}
 	if reqHdr[0] != socks5Version {
+		l.handshakeFailed(client, fmt.Sprintf("request version %d, not SOCKS5", reqHdr[0]), nil)
 		return
 	}
 
 	// Only CONNECT is supported
 	if reqHdr[1] != cmdConnect {
 		sendReply(client, repCommandNotSupported, nil, 0)
+		l.handshakeFailed(client, fmt.Sprintf("command %d not supported", reqHdr[1]), nil)
 		return
 	}
 
@@ -152,6 +522,7 @@ func handleConnection(client net.Conn, outboundIP net.IP, port int) {
 	case atypIPv4:
 		var addr [4]byte
 		if _, err := io.ReadFull(client, addr[:]); err != nil {
+			l.handshakeFailed(client, "reading target", err)
 			return
 		}
 		destAddr = net.IP(addr[:]).String()
@@ -159,15 +530,18 @@ func handleConnection(client net.Conn, outboundIP net.IP, port int) {
 	case atypDomain:
 		var domainLen [1]byte
 		if _, err := io.ReadFull(client, domainLen[:]); err != nil {
+			l.handshakeFailed(client, "reading target", err)
 			return
 		}
 		if domainLen[0] == 0 {
 			sendReply(client, repGeneralFailure, nil, 0)
+			l.handshakeFailed(client, "empty domain target", nil)
 			return
 		}
 		var domainBuf [255]byte
 		domain := domainBuf[:domainLen[0]]
 		if _, err := io.ReadFull(client, domain); err != nil {
+			l.handshakeFailed(client, "reading target", err)
 			return
 		}
 		destAddr = string(domain)
@@ -175,34 +549,50 @@ func handleConnection(client net.Conn, outboundIP net.IP, port int) {
 	case atypIPv6:
 		var addr [16]byte
 		if _, err := io.ReadFull(client, addr[:]); err != nil {
+			l.handshakeFailed(client, "reading target", err)
 			return
 		}
 		destAddr = net.IP(addr[:]).String()
 
 	default:
 		sendReply(client, repAddrTypeNotSupported, nil, 0)
+		l.handshakeFailed(client, fmt.Sprintf("address type %d not supported", atyp), nil)
 		return
 	}
 
 	// Read destination port (2 bytes, big-endian)
 	var portBuf [2]byte
 	if _, err := io.ReadFull(client, portBuf[:]); err != nil {
+		l.handshakeFailed(client, "reading target", err)
 		return
 	}
 	destPort := binary.BigEndian.Uint16(portBuf[:])
-
-	target := net.JoinHostPort(destAddr, strconv.Itoa(int(destPort)))
+	handshake.endWith(nil)
+	handshakeTime := time.Since(accepted)
+	stats.Handshake.observe(handshakeTime)
+	trace.target(destAddr, destPort)
+	l.checkSlow(slowHandshake, handshakeTime, client, destAddr, destPort, nil, nil)
 
 	// --- Dial outbound ---
+	pool := l.pool
+	if user != nil && user.pool != nil {
+		pool = user.pool
+	}
 	dialer := net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: outboundIP},
-		Timeout:   15 * time.Second,
-		KeepAlive: 30 * time.Second,
-		Control:   setSocketOptions,
+		LocalAddr: &net.TCPAddr{IP: pool.Pick()},
+		Timeout:   l.entry.dialTimeout(),
+		KeepAlive: l.sockOpts.dialerKeepAlive(),
+		Control:   l.sockOpts.setSocketOptions,
+	}
+	if l.entry.MPTCP {
+		dialer.SetMultipathTCP(true)
 	}
 
-	remote, err := dialer.Dial("tcp", target)
+	dialStart := time.Now()
+	remote, err := l.dial(&dialer, destAddr, destPort, stats, trace)
+	l.checkSlow(slowDial, time.Since(dialStart), client, destAddr, destPort, dialer.LocalAddr.(*net.TCPAddr).IP, err)
 	if err != nil {
+		trace.fail(err)
 		rep := repGeneralFailure
 		if errors.Is(err, syscall.ECONNREFUSED) {
 			rep = repConnectionRefused
@@ -210,12 +600,25 @@ func handleConnection(client net.Conn, outboundIP net.IP, port int) {
 			rep = repNetworkUnreachable
 		} else if errors.Is(err, syscall.EHOSTUNREACH) {
 			rep = repHostUnreachable
+		} else if errors.Is(err, errIPv4Target) {
+			rep = repAddrTypeNotSupported
+		} else if errors.Is(err, errDestinationDenied) {
+			rep = repConnectionNotAllowed
+		} else if errors.Is(err, errAllAddrsFailed) {
+			rep = repHostUnreachable
 		}
 		sendReply(client, byte(rep), nil, 0)
+		l.connectFailed(client, user, destAddr, destPort, dialer.LocalAddr.(*net.TCPAddr).IP, err, stats)
 		return
 	}
 	defer remote.Close()
 
+	if tc, ok := remote.(*net.TCPConn); ok && l.entry.MPTCP {
+		if mp, _ := tc.MultipathTCP(); mp {
+			stats.MPTCP.Add(1)
+		}
+	}
+
 	// Get the bound address for the reply
 	boundAddr := remote.LocalAddr().(*net.TCPAddr)
 	sendReply(client, repSuccess, boundAddr.IP, uint16(boundAddr.Port))
@@ -224,8 +627,327 @@ func handleConnection(client net.Conn, outboundIP net.IP, port int) {
 	client.SetDeadline(time.Time{})
 	remote.SetDeadline(time.Time{})
 
+	opened := time.Now()
+	id := activeConns.add(&liveConn{
+		port:     l.entry.Port,
+		name:     l.entry.Name,
+		user:     user.username(),
+		conn:     client,
+		remote:   remote,
+		host:     destAddr,
+		dport:    destPort,
+		outbound: boundAddr,
+		started:  opened,
+	})
+	defer activeConns.remove(id)
+	if connEvents.active() {
+		ev := l.event(eventOpen, client, destAddr, destPort)
+		ev.User = user.username()
+		ev.Outbound = boundAddr.String()
+		connEvents.publish(ev)
+	}
+
+	// The domain of IP targets, for domain_stats and the destination
+	// policy, is the server name the client sends in its TLS ClientHello.
+	// Nothing reaches the target before the policy allows it.
+	domain, sniffed := destAddr, int64(0)
+	if net.ParseIP(destAddr) != nil {
+		domain = ""
+	}
+	checkSNI := l.policy.sniffs(destAddr, destPort)
+	if checkSNI || l.domains.sniffs(destAddr, destPort) {
+		bufp := bufPool.Get().(*[]byte)
+		n, name := readClientHello(client, *bufp)
+		if checkSNI && !l.policy.allowServerName(destAddr, name) {
+			bufPool.Put(bufp)
+			err := fmt.Errorf("%w: server name %q", errDestinationDenied, name)
+			if name == "" {
+				err = fmt.Errorf("%w: no TLS server name", errDestinationDenied)
+			}
+			trace.fail(err)
+			l.connectFailed(client, user, destAddr, destPort, boundAddr.IP, err, stats)
+			return
+		}
+		_, err := remote.Write((*bufp)[:n])
+		bufPool.Put(bufp)
+		if err != nil {
+			return
+		}
+		domain, sniffed = name, int64(n)
+	}
+
+	acct := radiusAcct.start(user, client, l.entry, id)
+
 	// --- Relay (zero-copy on Linux via splice) ---
-	relay(client, remote)
+	relaying := trace.phase("socks5.relay", spanKindInternal)
+	relaying.attr("network.local.address", boundAddr.IP.String())
+	relayStart := time.Now()
+	var firstByte func()
+	if slowThreshold(slowFirstByte) > 0 {
+		firstByte = func() {
+			l.checkSlow(slowFirstByte, time.Since(relayStart), client, destAddr, destPort, boundAddr.IP, nil)
+		}
+	}
+	var upRate, downRate *byteRate
+	bw := l.entry.Bandwidth
+	if user != nil && user.cfg.Bandwidth != nil {
+		bw = user.cfg.Bandwidth
+	}
+	if bw != nil {
+		upRate, downRate = newByteRate(bw.up), newByteRate(bw.down)
+	}
+	if user != nil && user.egress != nil {
+		upRate, downRate = sharedRate(upRate, user.egress), sharedRate(downRate, user.egress)
+	}
+	up, down, spliced := relay(client, remote, l.bufs, firstByte, upRate, downRate)
+	if firstByte != nil && down == 0 {
+		l.checkSlow(slowFirstByte, time.Since(relayStart), client, destAddr, destPort, boundAddr.IP, errNoFirstByte)
+	}
+	up += sniffed
+	l.domains.add(domain, up, down)
+	stats.BytesUp.Add(up)
+	stats.BytesDown.Add(down)
+	stats.Spliced.Add(spliced)
+	if l.entry.Quota != nil {
+		stats.Quota.used.Add(up + down)
+	}
+	if user != nil {
+		user.add(up, down)
+	}
+	radiusAcct.stop(acct, up, down)
+	relaying.attr("superproxy.bytes_up", up)
+	relaying.attr("superproxy.bytes_down", down)
+	relaying.endWith(nil)
+	stats.Session.observe(time.Since(accepted))
+	if flowExport.active() {
+		flowExport.export(flowRecord{
+			client:   addrOf(client.RemoteAddr()),
+			target:   addrOf(remote.RemoteAddr()),
+			outbound: boundAddr,
+			up:       up,
+			down:     down,
+			start:    opened,
+			end:      time.Now(),
+		})
+	}
+
+	if connEvents.active() || l.access != nil || logEnabled(levelDebug) {
+		ev := l.event(eventClose, client, destAddr, destPort)
+		ev.User = user.username()
+		ev.Outbound = boundAddr.String()
+		ev.BytesUp, ev.BytesDown = up, down
+		ev.Duration = ev.Time.Sub(opened)
+		connEvents.publish(ev)
+		msg, fields := "[socks5:"+l.entry.tag()+"] connection closed", []slog.Attr{
+			slog.String("client", ev.Client),
+			slog.String("target", ev.Target),
+			slog.String("outbound_ip", boundAddr.IP.String()),
+			slog.Int64("bytes_up", up),
+			slog.Int64("bytes_down", down),
+			slog.Float64("duration_ms", millis(ev.Duration)),
+		}
+		if user != nil {
+			fields = append(fields, slog.String("user", ev.User))
+		}
+		if sniffed > 0 && domain != "" {
+			fields = append(fields, slog.String("server_name", domain))
+		}
+		logEvent(levelDebug, msg, fields...)
+		l.access.record(msg, fields)
+	}
+}
+
+// connectFailed records a CONNECT of client (logged in as user, or nil) to
+// host:port that failed with err, from outbound: in the listener's
+// counters, the recent failures and the connection events, and at debug
+// level (sampled) and in the access log.
+func (l *listener) connectFailed(client net.Conn, user *account, host string, port uint16, outbound net.IP, err error, stats *portStats) {
+	stats.Failed.Add(1)
+	class := dialErrorClass(err)
+	stats.DialErrors[class].Add(1)
+	if class != classDNS && class != classDenied {
+		outboundErrors.add(outbound, class)
+	}
+	ev := l.event(eventFailed, client, host, port)
+	ev.User = user.username()
+	ev.Error = err.Error()
+	ev.Class = dialErrorClasses[class]
+	if l.access != nil || logEnabled(levelDebug) {
+		msg, fields := "[socks5:"+l.entry.tag()+"] connect failed", []slog.Attr{
+			slog.String("client", ev.Client),
+			slog.String("target", ev.Target),
+			slog.String("outbound_ip", outbound.String()),
+			slog.String("error", ev.Error),
+			slog.String("class", ev.Class),
+		}
+		if user != nil {
+			fields = append(fields, slog.String("user", ev.User))
+		}
+		if logEnabled(levelDebug) && logSampling.allow(sampleConnect, l.entry.tag(), levelDebug) {
+			logEvent(levelDebug, msg, fields...)
+		}
+		l.access.record(msg, fields)
+	}
+	connFailures.add(ev)
+	if connEvents.active() {
+		connEvents.publish(ev)
+	}
+}
+
+// handshakeFailed logs, at debug level and sampled, why the handshake of
+// client was abandoned, and counts it for auto_ban unless the client just
+// closed the connection between messages.
+func (l *listener) handshakeFailed(client net.Conn, reason string, err error) {
+	if !errors.Is(err, io.EOF) {
+		autoBan.failed(client.RemoteAddr(), l.entry.tag())
+	}
+	if !logEnabled(levelDebug) || !logSampling.allow(sampleHandshake, l.entry.tag(), levelDebug) {
+		return
+	}
+	fields := []slog.Attr{slog.String("client", client.RemoteAddr().String()), slog.String("reason", reason)}
+	if err != nil {
+		fields = append(fields, slog.String("error", err.Error()))
+	}
+	logEvent(levelDebug, "[socks5:"+l.entry.tag()+"] handshake failed", fields...)
+}
+
+// event returns a connection event of this listener for client's request
+// to host:port.
+func (l *listener) event(typ string, client net.Conn, host string, port uint16) connEvent {
+	return connEvent{
+		Type:   typ,
+		Time:   time.Now(),
+		Port:   l.entry.Port,
+		Name:   l.entry.Name,
+		Client: client.RemoteAddr().String(),
+		Target: net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}
+}
+
+// errIPv4Target rejects IPv4 destinations on ipv6-only listeners.
+var errIPv4Target = errors.New("IPv4 destination not allowed by resolve policy ipv6-only")
+
+// errAllAddrsFailed marks a domain target none of whose addresses connected.
+var errAllAddrsFailed = errors.New("all resolved addresses failed")
+
+// errNoFirstByte is logged for relays that ended before the target sent
+// anything.
+var errNoFirstByte = errors.New("the target sent nothing")
+
+// minAttemptTimeout is the least time given to one address when the dial
+// deadline is split across several (as net.Dialer does internally).
+const minAttemptTimeout = 2 * time.Second
+
+// dial connects to host:port, resolving domain targets according to the
+// listener's address-family policy and trying each address the destination
+// policy allows in turn, up to dial_attempts of them. The dialer timeout is
+// the total budget; each attempt gets an equal share of what remains, so a
+// blackholed first address cannot consume all of it. Addresses that failed
+// recently (see failCache) are skipped without dialing. IPv6 destinations
+// are dialed from the outbound address; IPv4 destinations (only allowed by
+// ipv4-only and prefer-ipv6) cannot use it and go out from the host's
+// default IPv4 instead. The time spent resolving and connecting is counted
+// in stats; resolution and connect attempts are recorded in trace, which
+// may be nil. The first of the listener's rules matching host:port may
+// block it, rewrite it, dial it from another outbound address or send it
+// through an upstream chain; the destination policy applies to the target
+// that results.
+func (l *listener) dial(dialer *net.Dialer, host string, port uint16, stats *portStats, trace *sessionTrace) (net.Conn, error) {
+	dialer.Deadline = time.Now().Add(dialer.Timeout)
+	r := matchRoute(l.routes, host, port)
+	if r != nil {
+		to, toPort := r.target(host, port)
+		logDebug("[socks5:%s] %s: rules[%d] %s", l.entry.tag(), net.JoinHostPort(host, strconv.Itoa(int(port))), r.index, r.describe(to, toPort))
+		if r.action == routeBlock {
+			return nil, fmt.Errorf("%w: rules[%d]", errDestinationDenied, r.index)
+		}
+		host, port = to, toPort
+		if r.outbound != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: r.outbound}
+		}
+	}
+	if !l.policy.allowPort(port) {
+		return nil, errDestinationDenied
+	}
+	if r != nil && r.upstream != nil {
+		return l.dialUpstream(r.upstream, dialer, host, port)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil && l.entry.Resolve == resolveIPv6Only {
+			return nil, errIPv4Target
+		}
+		ips = []net.IP{ip}
+	} else {
+		if !l.policy.allowHost(host) {
+			return nil, errDestinationDenied
+		}
+		resolve := trace.phase("dns.resolve", spanKindClient)
+		resolve.attr("dns.question.name", host)
+		var err error
+		start := time.Now()
+		ips, err = l.resolver.Lookup(context.Background(), host, l.entry.Resolve, dialer.LocalAddr.(*net.TCPAddr).IP)
+		stats.DNS.observe(time.Since(start))
+		resolve.attr("superproxy.dns.answers", len(ips))
+		resolve.endWith(err)
+		if err != nil {
+			return nil, dnsFailure{err}
+		}
+	}
+	ips, err := l.policy.filterIPs(ips, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) > l.entry.DialAttempts {
+		ips = ips[:l.entry.DialAttempts]
+	}
+
+	connect := trace.phase("tcp.connect", spanKindClient)
+	start := time.Now()
+	defer func() {
+		stats.Dial.observe(time.Since(start))
+		connect.endWith(err)
+	}()
+	portStr := strconv.Itoa(int(port))
+	deadline := dialer.Deadline
+	for i, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), portStr)
+		if err = l.fails.check(addr); err != nil {
+			connect.event("skipped", otlpAttr("server.address", addr), otlpAttr("error", err.Error()))
+			continue
+		}
+		d := *dialer
+		if ip.To4() != nil {
+			d.LocalAddr = nil
+		}
+		if remaining := len(ips) - i; remaining > 1 {
+			share := time.Until(deadline) / time.Duration(remaining)
+			if share < minAttemptTimeout {
+				share = minAttemptTimeout
+			}
+			if t := time.Now().Add(share); t.Before(deadline) {
+				d.Deadline = t
+			}
+		}
+		var conn net.Conn
+		conn, err = d.Dial("tcp", addr)
+		if err == nil {
+			connect.attr("server.address", addr)
+			connect.attr("superproxy.connect.attempts", i+1)
+			return conn, nil
+		}
+		connect.event("attempt failed", otlpAttr("server.address", addr), otlpAttr("error", err.Error()))
+		l.fails.record(addr, err)
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(ips) > 1 || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("%w: %w", errAllAddrsFailed, err)
+	}
+	return nil, err
 }
 
 // sendReply sends a SOCKS5 reply to the client.
@@ -258,35 +980,91 @@ func sendReply(conn net.Conn, rep byte, bindIP net.IP, bindPort uint16) {
 	conn.Write(buf[:n])
 }
 
-// relay copies data bidirectionally between client and remote.
-// On Linux, when both sides are *net.TCPConn, Go's io.Copy uses splice(2)
-// for zero-copy kernel-to-kernel data transfer.
-func relay(client, remote net.Conn) {
+// relay copies data bidirectionally between client and remote and returns
+// the bytes sent each way, and how many of them were spliced; bufs holds
+// the buffers of copies that are not spliced. firstByte, if
+// not nil, is called when the first data from remote arrives; upRate and
+// downRate, if not nil, pace the two directions, and so does the
+// egress_limit if set.
+// On Linux, when both sides are *net.TCPConn, spliceCopy uses splice(2)
+// for zero-copy kernel-to-kernel data transfer, unless it is paced; with
+// relay.sockmap, unpaced connections are forwarded by the kernel itself.
+func relay(client, remote net.Conn, bufs *relayBufs, firstByte func(), upRate, downRate *byteRate) (up, down, spliced int64) {
+	var pair *sockPair
+	if upRate == nil && downRate == nil && egressLimit.Load() == nil {
+		pair = relaySocks.Load().pair(client, remote)
+		defer pair.close()
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	// client → remote
+	var upSpliced, downSpliced int64
 	go func() {
 		defer wg.Done()
-		copyAndClose(remote, client)
+		up, upSpliced = copyAndClose(remote, client, bufs, upRate, pair)
 	}()
 
 	// remote → client
 	go func() {
 		defer wg.Done()
-		copyAndClose(client, remote)
+		if firstByte != nil {
+			down = copyFirst(client, remote, bufs, firstByte, downRate)
+		}
+		n, s := copyAndClose(client, remote, bufs, downRate, pair)
+		down, downSpliced = down+n, s
 	}()
 
 	wg.Wait()
+	return up, down, upSpliced + downSpliced
 }
 
-// copyAndClose copies from src to dst, then signals write-done via CloseWrite.
-// Uses pooled buffers as fallback when splice is not available.
-func copyAndClose(dst, src net.Conn) {
-	bufp := bufPool.Get().(*[]byte)
-	defer bufPool.Put(bufp)
+// copyFirst copies the first read from src to dst, calling notify once it
+// arrived, and returns the number of bytes copied. The rest is left to
+// copyAndClose, so it can still splice.
+func copyFirst(dst, src net.Conn, bufs *relayBufs, notify func(), rate *byteRate) int64 {
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+
+	egress := egressLimit.Load()
+	buf := *bufp
+	if (rate != nil || egress != nil) && len(buf) > bandwidthChunk {
+		buf = buf[:bandwidthChunk]
+	}
+	n, _ := src.Read(buf)
+	if n == 0 {
+		return 0
+	}
+	notify()
+	rate.wait(n)
+	egress.wait(n)
+	m, _ := dst.Write(buf[:n])
+	return int64(m)
+}
 
-	io.CopyBuffer(dst, src, *bufp)
+// copyAndClose copies from src to dst, then signals write-done via
+// CloseWrite, and returns the number of bytes copied and how many of them
+// were spliced or forwarded in the kernel. If rate is not nil or an
+// egress_limit is set, the copy is paced by them. With a sockmap pair, the
+// kernel forwards it; with relay.io_uring, the copy goes through the ring.
+// Uses pooled buffers as fallback when splice is not available.
+func copyAndClose(dst, src net.Conn, bufs *relayBufs, rate *byteRate, pair *sockPair) (n, spliced int64) {
+	var ok bool
+	ring := relayRing.Load()
+	if n, spliced, ok = pair.copy(dst, src, bufs); ok {
+		// forwarded by the sockmap
+	} else if rate != nil || egressLimit.Load() != nil {
+		n = copyBuffered(shapedWriter{dst, rate}, src, bufs, bandwidthChunk)
+	} else if ring != nil {
+		if n, ok = ring.copy(dst, src, bufs); !ok {
+			n = copyBuffered(dst, src, bufs, 0)
+		}
+	} else if spliced, ok = spliceCopy(dst, src); ok {
+		n = spliced
+	} else {
+		n = copyBuffered(dst, src, bufs, 0)
+	}
 
 	// Graceful half-close: signal that no more data will be written
 	if tc, ok := dst.(*net.TCPConn); ok {
@@ -295,4 +1073,5 @@ func copyAndClose(dst, src net.Conn) {
 	if tc, ok := src.(*net.TCPConn); ok {
 		tc.CloseRead()
 	}
+	return n, spliced
 }
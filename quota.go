@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Quota periods.
+const (
+	quotaDaily   = "daily"
+	quotaMonthly = "monthly"
+)
+
+// quotaCheckInterval is how often the traffic of listeners is compared to
+// their quotas; a listener can exceed its quota by what it relays in that
+// time.
+const quotaCheckInterval = 10 * time.Second
+
+// quotaFile is the name, inside -state-dir, of the traffic the listeners
+// with a quota used in the current period, so a restart does not reset it.
+const quotaFile = "quotas.yaml"
+
+// sizeUnits are the units of quota limits, in bytes.
+var sizeUnits = map[string]float64{
+	"b": 1, "kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// quotaUsage is the traffic of one port or user in the current period of
+// its quota. Connections add their bytes when they close; the quota watcher
+// adds those of the connections still open at each check.
+type quotaUsage struct {
+	used     atomic.Int64 // bytes of connections closed in the period
+	exceeded atomic.Bool  // new connections are closed
+
+	mu     sync.Mutex
+	period time.Time // start of the period counted (zero: no quota)
+	live   int64     // bytes of open connections at the last check
+}
+
+// quotaStatus is the state of a quota, as listed by the admin API.
+type quotaStatus struct {
+	Limit    int64     `json:"limit"`
+	Used     int64     `json:"used"`
+	Period   string    `json:"period"`
+	Resets   time.Time `json:"resets"`
+	Exceeded bool      `json:"exceeded"`
+}
+
+// status returns the state of the quota q counted by u.
+func (u *quotaUsage) status(q *QuotaConfig) *quotaStatus {
+	u.mu.Lock()
+	live := u.live
+	u.mu.Unlock()
+	_, end := quotaPeriod(q.Period, time.Now())
+	return &quotaStatus{Limit: q.limit, Used: u.used.Load() + live, Period: q.Period, Resets: end, Exceeded: u.exceeded.Load()}
+}
+
+// quotaPeriod returns the start and end of the period containing t.
+func quotaPeriod(period string, t time.Time) (start, end time.Time) {
+	t = t.UTC()
+	if period == quotaDaily {
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// quotaRecord is the usage of one port as saved in quotas.yaml.
+type quotaRecord struct {
+	Period time.Time `yaml:"period"`
+	Used   int64     `yaml:"used"`
+}
+
+// userQuotaFile is the name, inside -state-dir, of the traffic the users
+// with a quota used in the current period.
+const userQuotaFile = "user_quotas.yaml"
+
+// watchQuotas checks the quotas of the running listeners and users every
+// quotaCheckInterval until stop is closed. With a state directory, usage
+// is restored from it first and saved to it after each check and on stop.
+func (s *server) watchQuotas(dir string, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if dir != "" {
+		if err := s.restoreQuotas(dir); err != nil {
+			logWarn("[quota] %v", err)
+		}
+	}
+	save := func(ports map[int]quotaRecord, users map[string]quotaRecord) {
+		if dir == "" {
+			return
+		}
+		if ports != nil {
+			if err := saveQuotas(dir, quotaFile, ports); err != nil {
+				logWarn("[quota] %v", err)
+			}
+		}
+		if users != nil {
+			if err := saveQuotas(dir, userQuotaFile, users); err != nil {
+				logWarn("[quota] %v", err)
+			}
+		}
+	}
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		ports, users := s.checkQuotas(time.Now())
+		save(ports, users)
+		select {
+		case <-stop:
+			if ports != nil || users != nil {
+				// The last check, with the connections about to be dropped
+				save(s.checkQuotas(time.Now()))
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkQuotas brings the usage of every port and user with a quota up to
+// date, closing those that used it up and reopening those starting a new
+// period. It returns the usage to save (nil: none has a quota).
+func (s *server) checkQuotas(now time.Time) (ports map[int]quotaRecord, users map[string]quotaRecord) {
+	s.mu.Lock()
+	listening := make(map[int]*listenPort, len(s.ports))
+	for port, p := range s.ports {
+		listening[port] = p
+	}
+	var accounts *userDirectory
+	if s.shared != nil {
+		accounts = s.shared.users
+	}
+	s.mu.Unlock()
+
+	var byPort map[int]int64 // bytes of open connections
+	var byUser map[string]int64
+	live := func() {
+		if byPort == nil {
+			byPort, byUser = liveBytes()
+		}
+	}
+	for port, p := range listening {
+		l := p.current.Load()
+		q := l.entry.Quota
+		rec, ok := p.stats.Quota.check(q, now, ":"+l.entry.tag(), func() int64 { live(); return byPort[port] }, func(total int64, end time.Time) {
+			closed := activeConns.killPort(port)
+			logWarn("[quota] :%s used %s of its %s %s quota, closed until %s (%d connections dropped)", l.entry.tag(),
+				formatSize(total), q.Limit, q.Period, end.Format(time.RFC3339), closed)
+			webhooks.notify(hookQuotaExceeded, fmt.Sprintf("proxy :%s used its %s %s quota, closed until %s", l.entry.tag(), q.Limit, q.Period, end.Format(time.RFC3339)),
+				map[string]any{"port": port, "name": l.entry.Name, "limit": q.limit, "used": total, "period": q.Period, "resets": end})
+		})
+		if ok {
+			if ports == nil {
+				ports = make(map[int]quotaRecord)
+			}
+			ports[port] = rec
+		}
+	}
+	if accounts == nil {
+		return ports, nil
+	}
+	for name, a := range accounts.accounts {
+		q := a.cfg.Quota
+		rec, ok := a.stats.Quota.check(q, now, "user "+name, func() int64 { live(); return byUser[name] }, func(total int64, end time.Time) {
+			closed := activeConns.killUser(name)
+			logWarn("[quota] user %s used %s of its %s %s quota, refused until %s (%d connections dropped)", name,
+				formatSize(total), q.Limit, q.Period, end.Format(time.RFC3339), closed)
+			webhooks.notify(hookUserQuotaExceeded, fmt.Sprintf("user %s used its %s %s quota, refused until %s", name, q.Limit, q.Period, end.Format(time.RFC3339)),
+				map[string]any{"user": name, "limit": q.limit, "used": total, "period": q.Period, "resets": end})
+		})
+		if ok {
+			if users == nil {
+				users = make(map[string]quotaRecord)
+			}
+			users[name] = rec
+		}
+	}
+	return ports, users
+}
+
+// check brings u up to date at now for the quota q (nil: none) of what,
+// ":port" or "user name" in logs; live returns the bytes of its open
+// connections. exceeded is called when the quota has just been used up. It
+// returns the usage to save, if there is a quota.
+func (u *quotaUsage) check(q *QuotaConfig, now time.Time, what string, live func() int64, exceeded func(total int64, end time.Time)) (quotaRecord, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if q == nil {
+		if !u.period.IsZero() {
+			u.period, u.live = time.Time{}, 0
+			u.used.Store(0)
+			if u.exceeded.Swap(false) {
+				logInfo("[quota] %s has no quota any more, accepting connections", what)
+			}
+		}
+		return quotaRecord{}, false
+	}
+	start, end := quotaPeriod(q.Period, now)
+	if u.period != start {
+		// A new period, unless this is the first check: bytes counted
+		// (or restored) before it are in the current period
+		if !u.period.IsZero() {
+			u.used.Store(0)
+		}
+		u.period = start
+		if u.exceeded.Swap(false) {
+			logInfo("[quota] %s starts a new %s period, accepting connections", what, q.Period)
+		}
+	}
+	used := u.used.Load() // before the live bytes: a closing connection is counted once at most
+	u.live = live()
+	total := used + u.live
+	switch over := u.exceeded.Load(); {
+	case total >= q.limit && !over:
+		u.exceeded.Store(true)
+		exceeded(total, end)
+	case total < q.limit && over:
+		u.exceeded.Store(false)
+		logInfo("[quota] %s is within its %s quota again, accepting connections", what, q.Limit)
+	}
+	return quotaRecord{Period: start, Used: total}, true
+}
+
+// liveBytes returns the bytes relayed so far by the open connections of
+// each port and of each user, as counted by the kernel (Linux only;
+// elsewhere quotas see connections when they close).
+func liveBytes() (byPort map[int]int64, byUser map[string]int64) {
+	byPort, byUser = make(map[int]int64), make(map[string]int64)
+	for _, c := range activeConns.snapshot() {
+		if up, down, ok := connBytes(c.conn); ok {
+			byPort[c.port] += up + down
+			if c.user != "" {
+				byUser[c.user] += up + down
+			}
+		}
+	}
+	return byPort, byUser
+}
+
+// restoreQuotas adds the usage saved in dir to the ports and users whose
+// quota is still in the saved period.
+func (s *server) restoreQuotas(dir string) error {
+	var ports map[int]quotaRecord
+	var users map[string]quotaRecord
+	if err := readQuotas(dir, quotaFile, &ports); err != nil {
+		return err
+	}
+	if err := readQuotas(dir, userQuotaFile, &users); err != nil {
+		return err
+	}
+	now := time.Now()
+	restore := func(u *quotaUsage, q *QuotaConfig, rec quotaRecord) {
+		if q == nil {
+			return
+		}
+		if start, _ := quotaPeriod(q.Period, now); rec.Period.Equal(start) {
+			u.used.Add(rec.Used)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for port, rec := range ports {
+		if p, ok := s.ports[port]; ok {
+			restore(&p.stats.Quota, p.current.Load().entry.Quota, rec)
+		}
+	}
+	if s.shared != nil && s.shared.users != nil {
+		for name, rec := range users {
+			if a, ok := s.shared.users.accounts[name]; ok {
+				restore(&a.stats.Quota, a.cfg.Quota, rec)
+			}
+		}
+	}
+	return nil
+}
+
+// readQuotas decodes the usage saved in file in dir into v, if any.
+func readQuotas(dir, file string, v any) error {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// saveQuotas replaces file in dir atomically with usage.
+func saveQuotas(dir, file string, usage any) error {
+	data, err := yaml.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# Traffic used in the current quota period\n"), data...)
+
+	tmp, err := os.CreateTemp(dir, "."+file+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, file))
+}
+
+// parseSize parses an amount of data such as "500GB" or "1.5TiB" into
+// bytes.
+func parseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(v, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 500GB or 2TiB)", s)
+	}
+	n, err := strconv.ParseFloat(v[:i], 64)
+	unit, ok := sizeUnits[strings.TrimSpace(v[i:])]
+	if err != nil || !ok || n <= 0 || n*unit >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 500GB or 2TiB)", s)
+	}
+	return int64(math.Ceil(n * unit)), nil
+}
+
+// formatSize formats bytes in decimal units, e.g. "1.25GB".
+func formatSize(n int64) string {
+	for _, u := range []struct {
+		name string
+		size float64
+	}{{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"kB", 1e3}} {
+		if float64(n) >= u.size {
+			return strconv.FormatFloat(math.Round(float64(n)/u.size*100)/100, 'f', -1, 64) + u.name
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// validateQuota validates a quota block and fills in its period.
+func validateQuota(q *QuotaConfig) error {
+	if q.Limit == "" {
+		return fmt.Errorf("limit is required")
+	}
+	limit, err := parseSize(q.Limit)
+	if err != nil {
+		return fmt.Errorf("limit: %w", err)
+	}
+	q.limit = limit
+	switch q.Period {
+	case "":
+		q.Period = quotaMonthly
+	case quotaDaily, quotaMonthly:
+	default:
+		return fmt.Errorf("period %q must be %s or %s", q.Period, quotaDaily, quotaMonthly)
+	}
+	return nil
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// radius defaults, for the options a radius block leaves out.
+const (
+	defaultRADIUSTimeout = 3 * time.Second
+	defaultRADIUSRetries = 2
+	radiusAcctQueue      = 4096 // unsent accounting records; more are dropped
+)
+
+// Values of proxies[].auth_backend, continued.
+const authBackendRADIUS = "radius"
+
+// RADIUS packet codes (RFC 2865, RFC 2866).
+const (
+	radiusAccessRequest      = 1
+	radiusAccessAccept       = 2
+	radiusAccessReject       = 3
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+	radiusAccessChallenge    = 11
+)
+
+// RADIUS attributes.
+const (
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusNASPort              = 5
+	radiusClass                = 25
+	radiusCalledStationID      = 30
+	radiusCallingStationID     = 31
+	radiusNASIdentifier        = 32
+	radiusAcctStatusType       = 40
+	radiusAcctDelayTime        = 41
+	radiusAcctInputOctets      = 42
+	radiusAcctOutputOctets     = 43
+	radiusAcctSessionID        = 44
+	radiusAcctSessionTime      = 46
+	radiusAcctTerminateCause   = 49
+	radiusAcctInputGigawords   = 52
+	radiusAcctOutputGigawords  = 53
+	radiusNASPortType          = 61
+	radiusMessageAuthenticator = 80
+)
+
+// Attribute values.
+const (
+	radiusAcctStart       = 1
+	radiusAcctStop        = 2
+	radiusCauseUser       = 1  // User-Request: the session ended
+	radiusCauseNASReboot  = 11 // NAS-Reboot: the daemon shut down
+	radiusPortTypeVirtual = 5
+)
+
+// radiusSessionPrefix starts the Acct-Session-Id of every session, so IDs
+// stay unique across restarts.
+var radiusSessionPrefix = fmt.Sprintf("%08x", time.Now().Unix())
+
+// radiusLogin is a login a RADIUS server accepted.
+type radiusLogin struct {
+	class [][]byte // Class attributes of the Access-Accept, echoed in accounting
+}
+
+// radiusBackend checks the logins of listeners with auth_backend radius
+// with an Access-Request per login: Access-Accept allows it,
+// Access-Reject (or a challenge, which SOCKS cannot answer) denies it,
+// and no answer is an outage that refuses the login without counting
+// against the client. Nothing is cached: the server sees every login.
+type radiusBackend struct {
+	mu  sync.Mutex
+	cfg *RADIUSConfig // nil: off
+}
+
+// radiusAuth is the radius backend of the running daemon.
+var radiusAuth radiusBackend
+
+// update applies a validated radius block (nil: off).
+func (b *radiusBackend) update(cfg *RADIUSConfig) {
+	b.mu.Lock()
+	b.cfg = cfg
+	b.mu.Unlock()
+	radiusAcct.update(cfg)
+}
+
+// check sends an Access-Request for name and password from client on
+// entry. It returns the login if the server accepted it, nil if it
+// rejected it, and an error if it did not answer.
+func (b *radiusBackend) check(name string, password []byte, client net.Addr, entry ProxyEntry) (*radiusLogin, error) {
+	b.mu.Lock()
+	cfg := b.cfg
+	b.mu.Unlock()
+	if cfg == nil {
+		return nil, fmt.Errorf("radius is off")
+	}
+	if name == "" || len(name) > 253 || len(password) == 0 || len(password) > 128 {
+		return nil, nil // not representable in an Access-Request
+	}
+	p := newRADIUSPacket(radiusAccessRequest)
+	rand.Read(p.auth[:])
+	p.add(radiusUserName, []byte(name))
+	p.add(radiusUserPassword, hideRADIUSPassword(password, cfg.Secret, p.auth))
+	p.addSessionAttrs(cfg, client, entry)
+	p.add(radiusMessageAuthenticator, make([]byte, md5.Size))
+	pkt := p.encode()
+	mac := hmac.New(md5.New, []byte(cfg.Secret))
+	mac.Write(pkt)
+	copy(pkt[len(pkt)-md5.Size:], mac.Sum(nil))
+
+	resp, err := radiusExchange(cfg.Server, cfg.Secret, pkt, cfg.Timeout, cfg.attempts())
+	if err != nil {
+		return nil, err
+	}
+	switch resp[0] {
+	case radiusAccessAccept:
+		login := &radiusLogin{}
+		for _, a := range radiusAttributes(resp[20:]) {
+			if a.typ == radiusClass {
+				login.class = append(login.class, a.value)
+			}
+		}
+		return login, nil
+	case radiusAccessReject, radiusAccessChallenge:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("radius: %s answered with code %d", cfg.Server, resp[0])
+}
+
+// radiusSession is a session reported to the accounting server.
+type radiusSession struct {
+	id      string // Acct-Session-Id
+	conn    net.Conn
+	started time.Time
+	attrs   []byte // identifying the session, in its Start and Stop
+}
+
+// radiusAccounting sends Accounting-Start and -Stop records of the
+// sessions logged in with RADIUS. One goroutine sends them in order, so a
+// session never waits for the server: when the queue is full, a record is
+// dropped and logged. At shutdown, the sessions still open are stopped
+// with the bytes relayed so far.
+type radiusAccounting struct {
+	mu       sync.Mutex
+	cfg      *RADIUSConfig // nil or without accounting: off
+	queue    chan radiusRecord
+	done     chan struct{}
+	closed   bool
+	sessions map[*radiusSession]bool
+}
+
+type radiusRecord struct {
+	cfg   *RADIUSConfig
+	attrs []byte
+	time  time.Time // of the event, for Acct-Delay-Time
+}
+
+// radiusAcct is the accounting of the running daemon.
+var radiusAcct radiusAccounting
+
+func (r *radiusAccounting) update(cfg *RADIUSConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = cfg
+	if cfg != nil && cfg.Accounting && r.queue == nil && !r.closed {
+		r.queue, r.done = make(chan radiusRecord, radiusAcctQueue), make(chan struct{})
+		r.sessions = make(map[*radiusSession]bool)
+		go r.run(r.queue, r.done)
+	}
+}
+
+// start reports the session of user on entry, relayed on client as
+// connection id, and returns it for stop; nil if the user did not log in
+// with RADIUS or accounting is off.
+func (r *radiusAccounting) start(user *account, client net.Conn, entry ProxyEntry, id uint64) *radiusSession {
+	if user == nil || user.radius == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.cfg == nil || !r.cfg.Accounting {
+		return nil
+	}
+	s := &radiusSession{id: fmt.Sprintf("%s-%x", radiusSessionPrefix, id), conn: client, started: time.Now()}
+	p := newRADIUSPacket(radiusAccountingRequest)
+	p.add(radiusAcctSessionID, []byte(s.id))
+	p.add(radiusUserName, []byte(user.cfg.Name))
+	for _, class := range user.radius.class {
+		p.add(radiusClass, class)
+	}
+	p.addSessionAttrs(r.cfg, client.RemoteAddr(), entry)
+	s.attrs = p.attrs
+	r.sessions[s] = true
+	r.send(s.attrs, radiusAcctStart, s.started)
+	return s
+}
+
+// stop reports the end of session s (nil: none) after up and down bytes.
+func (r *radiusAccounting) stop(s *radiusSession, up, down int64) {
+	if s == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.sessions[s] {
+		return // stopped at shutdown
+	}
+	delete(r.sessions, s)
+	r.send(s.stopAttrs(up, down, radiusCauseUser), radiusAcctStop, time.Now())
+}
+
+// send queues a record of attrs with status; r.mu is held.
+func (r *radiusAccounting) send(attrs []byte, status uint32, at time.Time) {
+	if r.closed || r.cfg == nil || !r.cfg.Accounting {
+		return
+	}
+	p := &radiusPacket{attrs: attrs}
+	p.addInt(radiusAcctStatusType, status)
+	select {
+	case r.queue <- radiusRecord{cfg: r.cfg, attrs: p.attrs, time: at}:
+	default:
+		logWarn("[radius] accounting queue full, dropping a record")
+	}
+}
+
+// stopAttrs returns the attributes of the Stop of s.
+func (s *radiusSession) stopAttrs(up, down int64, cause uint32) []byte {
+	p := &radiusPacket{attrs: append([]byte(nil), s.attrs...)}
+	p.addInt(radiusAcctInputOctets, uint32(up))
+	p.addInt(radiusAcctInputGigawords, uint32(up>>32))
+	p.addInt(radiusAcctOutputOctets, uint32(down))
+	p.addInt(radiusAcctOutputGigawords, uint32(down>>32))
+	p.addInt(radiusAcctSessionTime, uint32(time.Since(s.started)/time.Second))
+	p.addInt(radiusAcctTerminateCause, cause)
+	return p.attrs
+}
+
+// close stops the open sessions, stops accepting records and waits up to
+// timeout for the queued ones to be sent.
+func (r *radiusAccounting) close(timeout time.Duration) {
+	r.mu.Lock()
+	if r.closed || r.queue == nil {
+		r.closed = true
+		r.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	for s := range r.sessions {
+		up, down, _ := connBytes(s.conn)
+		r.send(s.stopAttrs(up, down, radiusCauseNASReboot), radiusAcctStop, now)
+	}
+	r.sessions = nil
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		logWarn("[radius] gave up on unsent accounting records at shutdown")
+	}
+}
+
+func (r *radiusAccounting) run(queue <-chan radiusRecord, done chan<- struct{}) {
+	defer close(done)
+	for rec := range queue {
+		p := &radiusPacket{code: radiusAccountingRequest, attrs: rec.attrs}
+		if delay := time.Since(rec.time); delay >= time.Second {
+			p.addInt(radiusAcctDelayTime, uint32(delay/time.Second))
+		}
+		p.id = randomByte()
+		pkt := p.encode()
+		sum := md5.Sum(append(pkt, rec.cfg.Secret...)) // over a zero authenticator
+		copy(pkt[4:20], sum[:])
+		resp, err := radiusExchange(rec.cfg.AccountingServer, rec.cfg.Secret, pkt, rec.cfg.Timeout, rec.cfg.attempts())
+		if err == nil && resp[0] != radiusAccountingResponse {
+			err = fmt.Errorf("radius: %s answered with code %d", rec.cfg.AccountingServer, resp[0])
+		}
+		if err != nil {
+			logWarn("[radius] accounting: %v; record dropped", err)
+		}
+	}
+}
+
+// radiusPacket is a RADIUS packet being built.
+type radiusPacket struct {
+	code, id byte
+	auth     [md5.Size]byte // Request Authenticator
+	attrs    []byte
+}
+
+func newRADIUSPacket(code byte) *radiusPacket {
+	return &radiusPacket{code: code, id: randomByte()}
+}
+
+func randomByte() byte {
+	var b [1]byte
+	rand.Read(b[:])
+	return b[0]
+}
+
+// add appends an attribute; value is at most 253 bytes.
+func (p *radiusPacket) add(typ byte, value []byte) {
+	p.attrs = append(p.attrs, typ, byte(2+len(value)))
+	p.attrs = append(p.attrs, value...)
+}
+
+func (p *radiusPacket) addInt(typ byte, v uint32) {
+	p.add(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// addSessionAttrs adds the attributes naming the NAS, listener and client.
+func (p *radiusPacket) addSessionAttrs(cfg *RADIUSConfig, client net.Addr, entry ProxyEntry) {
+	ip := client.String()
+	if ta, ok := client.(*net.TCPAddr); ok {
+		ip = ta.AddrPort().Addr().Unmap().String()
+	}
+	p.add(radiusNASIdentifier, []byte(nasIdentifier(cfg)))
+	p.addInt(radiusNASPort, uint32(entry.Port))
+	p.addInt(radiusNASPortType, radiusPortTypeVirtual)
+	p.add(radiusCalledStationID, []byte(entry.tag()))
+	p.add(radiusCallingStationID, []byte(ip))
+}
+
+// nasIdentifier returns the NAS-Identifier of cfg: nas_identifier or the
+// hostname.
+func nasIdentifier(cfg *RADIUSConfig) string {
+	if cfg.NASIdentifier != "" {
+		return cfg.NASIdentifier
+	}
+	if h, err := os.Hostname(); err == nil && h != "" && len(h) <= 253 {
+		return h
+	}
+	return "superproxy"
+}
+
+func (p *radiusPacket) encode() []byte {
+	pkt := make([]byte, 20, 20+len(p.attrs))
+	pkt[0], pkt[1] = p.code, p.id
+	binary.BigEndian.PutUint16(pkt[2:], uint16(20+len(p.attrs)))
+	copy(pkt[4:20], p.auth[:])
+	return append(pkt, p.attrs...)
+}
+
+// hideRADIUSPassword encrypts password for the User-Password attribute
+// (RFC 2865 section 5.2).
+func hideRADIUSPassword(password []byte, secret string, auth [md5.Size]byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	copy(padded, password)
+	prev := auth[:]
+	for i := 0; i < len(padded); i += 16 {
+		b := md5.Sum(append([]byte(secret), prev...))
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= b[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
+
+type radiusAttribute struct {
+	typ   byte
+	value []byte
+}
+
+// radiusAttributes splits the attributes of a packet; a malformed tail is
+// ignored.
+func radiusAttributes(b []byte) []radiusAttribute {
+	var out []radiusAttribute
+	for len(b) >= 2 && int(b[1]) >= 2 && int(b[1]) <= len(b) {
+		out = append(out, radiusAttribute{typ: b[0], value: b[2:b[1]]})
+		b = b[b[1]:]
+	}
+	return out
+}
+
+// radiusExchange sends the request pkt to server and returns the first
+// response the shared secret authenticates, retransmitting it after each
+// timeout for attempts in all.
+func radiusExchange(server, secret string, pkt []byte, timeout time.Duration, attempts int) ([]byte, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("radius: %w", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	var last error
+	for i := 0; i < attempts; i++ {
+		if _, err := conn.Write(pkt); err != nil {
+			return nil, fmt.Errorf("radius: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if !errors.As(err, &ne) || !ne.Timeout() {
+					last = err // e.g. ICMP port unreachable
+				}
+				break
+			}
+			if resp := buf[:n]; validRADIUSResponse(resp, pkt, secret) {
+				return append([]byte(nil), resp[:binary.BigEndian.Uint16(resp[2:])]...), nil
+			}
+		}
+	}
+	if last != nil {
+		return nil, fmt.Errorf("radius: %s: %w", server, last)
+	}
+	return nil, fmt.Errorf("radius: no answer from %s after %d attempts", server, attempts)
+}
+
+// validRADIUSResponse reports whether resp answers the request req, by its
+// Response Authenticator and Message-Authenticator. Access-Accept, -Reject
+// and -Challenge must carry the latter, which the Access-Request does, so
+// that they cannot be forged by an MD5 collision of the Response
+// Authenticator (BlastRADIUS, CVE-2024-3596); accounting responses may
+// leave it out.
+func validRADIUSResponse(resp, req []byte, secret string) bool {
+	if len(resp) < 20 || resp[1] != req[1] {
+		return false
+	}
+	n := int(binary.BigEndian.Uint16(resp[2:]))
+	if n < 20 || n > len(resp) {
+		return false
+	}
+	resp = resp[:n]
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(req[4:20])
+	h.Write(resp[20:])
+	h.Write([]byte(secret))
+	if !hmac.Equal(h.Sum(nil), resp[4:20]) {
+		return false
+	}
+	for off := 20; off+2 <= n && resp[off+1] >= 2; off += int(resp[off+1]) {
+		if resp[off] != radiusMessageAuthenticator || resp[off+1] != 2+md5.Size || off+2+md5.Size > n {
+			continue
+		}
+		check := append([]byte(nil), resp...)
+		copy(check[4:20], req[4:20])
+		clear(check[off+2 : off+2+md5.Size])
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(check)
+		return hmac.Equal(mac.Sum(nil), resp[off+2:off+2+md5.Size])
+	}
+	return resp[0] == radiusAccountingResponse
+}
+
+// radiusAddress returns s as host:port, with port if s has none.
+func radiusAddress(s, port string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	return net.JoinHostPort(strings.Trim(s, "[]"), port)
+}
+
+// validateRADIUS validates the radius block and fills in its defaults.
+func validateRADIUS(c *RADIUSConfig) error {
+	switch {
+	case c.Server == "":
+		return fmt.Errorf("config: radius: server is required")
+	case c.Secret == "":
+		return fmt.Errorf("config: radius: secret is required")
+	case c.Timeout < 0 || c.Retries != nil && *c.Retries < 0:
+		return fmt.Errorf("config: radius: values must not be negative")
+	case len(c.NASIdentifier) > 253:
+		return fmt.Errorf("config: radius: nas_identifier is longer than 253 bytes")
+	}
+	c.Server = radiusAddress(c.Server, "1812")
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("config: radius: server: %w", err)
+	}
+	if c.AccountingServer == "" {
+		host, _, _ := net.SplitHostPort(c.Server)
+		c.AccountingServer = net.JoinHostPort(host, "1813")
+	}
+	c.AccountingServer = radiusAddress(c.AccountingServer, "1813")
+	if _, _, err := net.SplitHostPort(c.AccountingServer); err != nil {
+		return fmt.Errorf("config: radius: accounting_server: %w", err)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultRADIUSTimeout
+	}
+	return nil
+}
+
+// attempts returns how many times a packet is sent before giving up: once,
+// and once more for each of retries.
+func (c *RADIUSConfig) attempts() int {
+	if c.Retries == nil {
+		return defaultRADIUSRetries + 1
+	}
+	return *c.Retries + 1
+}
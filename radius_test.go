@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+)
+
+// testRADIUSResponse signs a response of code to req, with a
+// Message-Authenticator if withMA is set.
+func testRADIUSResponse(code byte, req []byte, secret string, withMA bool) []byte {
+	resp := []byte{code, req[1], 0, 0}
+	resp = append(resp, req[4:20]...)
+	if withMA {
+		resp = append(resp, radiusMessageAuthenticator, 2+md5.Size)
+		resp = append(resp, make([]byte, md5.Size)...)
+	}
+	binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)))
+	if withMA {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(resp)
+		copy(resp[22:], mac.Sum(nil))
+	}
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(req[4:20])
+	h.Write(resp[20:])
+	h.Write([]byte(secret))
+	copy(resp[4:20], h.Sum(nil))
+	return resp
+}
+
+func TestValidRADIUSResponse(t *testing.T) {
+	const secret = "s3cret"
+	req := make([]byte, 20)
+	req[0], req[1] = radiusAccessRequest, 7
+	for i := 4; i < 20; i++ {
+		req[i] = byte(i)
+	}
+	tests := []struct {
+		name string
+		resp []byte
+		want bool
+	}{
+		{"accept", testRADIUSResponse(radiusAccessAccept, req, secret, true), true},
+		{"reject", testRADIUSResponse(radiusAccessReject, req, secret, true), true},
+		{"accept without Message-Authenticator", testRADIUSResponse(radiusAccessAccept, req, secret, false), false},
+		{"reject without Message-Authenticator", testRADIUSResponse(radiusAccessReject, req, secret, false), false},
+		{"challenge without Message-Authenticator", testRADIUSResponse(radiusAccessChallenge, req, secret, false), false},
+		{"accounting without Message-Authenticator", testRADIUSResponse(radiusAccountingResponse, req, secret, false), true},
+		{"wrong secret", testRADIUSResponse(radiusAccessAccept, req, "other", true), false},
+	}
+	for _, tt := range tests {
+		if got := validRADIUSResponse(tt.resp, req, secret); got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
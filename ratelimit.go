@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connLimiter limits the rate of new connections to a listener, per client
+// IP and in total, with token buckets. Connections over the limit are
+// closed on accept, before the handshake.
+//
+// A nil *connLimiter allows everything.
+type connLimiter struct {
+	rate, listenerRate   float64 // tokens per second (0: no limit)
+	burst, listenerBurst float64
+
+	mu       sync.Mutex
+	clients  map[netip.Addr]*tokenBucket
+	listener tokenBucket
+	sweepAt  int // sweep idle client buckets when the map grows past this
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// minSweep is the number of client buckets below which none is swept.
+const minSweep = 1024
+
+// take refills b for the time since its last use and takes a token if
+// there is one.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether b would be full at now, and can be forgotten.
+func (b *tokenBucket) full(now time.Time, rate, burst float64) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+// newConnLimiter returns a limiter for a validated rate_limit block, or nil
+// if rl is nil.
+func newConnLimiter(rl *RateLimitConfig) *connLimiter {
+	if rl == nil {
+		return nil
+	}
+	return &connLimiter{
+		rate:          rl.Rate,
+		burst:         float64(rl.Burst),
+		listenerRate:  rl.ListenerRate,
+		listenerBurst: float64(rl.ListenerBurst),
+		clients:       make(map[netip.Addr]*tokenBucket),
+		sweepAt:       minSweep,
+	}
+}
+
+// allow reports whether a new connection from addr may be served; if not,
+// limit names the limit it exceeded, "client" or "listener".
+func (c *connLimiter) allow(addr net.Addr) (ok bool, limit string) {
+	if c == nil {
+		return true, ""
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rate > 0 {
+		if ta, isTCP := addr.(*net.TCPAddr); isTCP {
+			ip := ta.AddrPort().Addr().Unmap().WithZone("")
+			b := c.clients[ip]
+			if b == nil {
+				if len(c.clients) >= c.sweepAt {
+					c.sweep(now)
+				}
+				b = new(tokenBucket)
+				c.clients[ip] = b
+			}
+			if !b.take(now, c.rate, c.burst) {
+				return false, "client"
+			}
+		}
+	}
+	if c.listenerRate > 0 && !c.listener.take(now, c.listenerRate, c.listenerBurst) {
+		return false, "listener"
+	}
+	return true, ""
+}
+
+// sweep forgets the client buckets that refilled completely, which behave
+// like new ones; c.mu is held.
+func (c *connLimiter) sweep(now time.Time) {
+	for ip, b := range c.clients {
+		if b.full(now, c.rate, c.burst) {
+			delete(c.clients, ip)
+		}
+	}
+	c.sweepAt = 2 * len(c.clients)
+	if c.sweepAt < minSweep {
+		c.sweepAt = minSweep
+	}
+}
+
+// rateLimitSummary describes rl for entry summaries, e.g. "rate 10/s per
+// client, 500/s in total".
+func rateLimitSummary(rl *RateLimitConfig) string {
+	var parts []string
+	if rl.Rate > 0 {
+		parts = append(parts, strconv.FormatFloat(rl.Rate, 'f', -1, 64)+"/s per client")
+	}
+	if rl.ListenerRate > 0 {
+		parts = append(parts, strconv.FormatFloat(rl.ListenerRate, 'f', -1, 64)+"/s in total")
+	}
+	return "rate " + strings.Join(parts, ", ")
+}
+
+// validateRateLimit validates a rate_limit block and fills in the bursts.
+func validateRateLimit(rl *RateLimitConfig) error {
+	if rl.Rate < 0 || rl.Burst < 0 || rl.ListenerRate < 0 || rl.ListenerBurst < 0 {
+		return fmt.Errorf("values must not be negative")
+	}
+	if rl.Rate == 0 && rl.ListenerRate == 0 {
+		return fmt.Errorf("set rate and/or listener_rate")
+	}
+	if rl.Burst == 0 && rl.Rate > 0 {
+		rl.Burst = defaultBurst(rl.Rate)
+	}
+	if rl.ListenerBurst == 0 && rl.ListenerRate > 0 {
+		rl.ListenerBurst = defaultBurst(rl.ListenerRate)
+	}
+	return nil
+}
+
+// defaultBurst is the burst of a rate without one: a second's worth, at
+// least 1.
+func defaultBurst(rate float64) int {
+	return int(math.Max(1, math.Ceil(rate)))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPipeSize bounds relay.pipe_size; the kernel caps unprivileged pipes
+// at /proc/sys/fs/pipe-max-size (1 MiB by default) anyway.
+const maxPipeSize = 64 << 20
+
+// Bounds of relay.ring_entries; the kernel rounds the size up to a power
+// of two.
+const (
+	defaultRingEntries = 4096
+	maxRingEntries     = 32768
+)
+
+// Bounds of relay.sockmap_size.
+const (
+	defaultSockmapSize = 16384
+	maxSockmapSize     = 1 << 20
+)
+
+// maxIdlePipes is how many empty splice pipes are kept for new relays.
+const maxIdlePipes = 256
+
+// Bounds of buffer.size.
+const (
+	defaultBufferSize = 32 << 10
+	minBufferSize     = 1 << 10
+	maxBufferSize     = 16 << 20
+)
+
+// Relay modes, as reported by the status.
+const (
+	relaySplice   = "splice"
+	relayBuffered = "buffered"
+	relayIOUring  = "io_uring"
+	relaySockmap  = "sockmap"
+)
+
+// relayBuffers is relay.buffered of the running configuration: relay
+// through userspace buffers even where splice(2) is available.
+var relayBuffers atomic.Bool
+
+// relayPipeSize is the capacity of the splice pipes in effect, in bytes
+// (0: the kernel's default).
+var relayPipeSize atomic.Int64
+
+// relayRing is the io_uring ring unpaced connections are relayed through
+// (nil: relay.io_uring is off, or no ring could be set up).
+var relayRing atomic.Pointer[uring]
+
+// openRing is the ring set up for relay.io_uring. It lives as long as the
+// process: relays started before a reload turned io_uring off still use it.
+var openRing *uring
+
+// uringRingEntries is the relay.ring_entries openRing was set up with.
+var uringRingEntries int
+
+// relaySocks is the sockmap unpaced connections are forwarded through in
+// the kernel (nil: relay.sockmap is off, or it could not be set up).
+var relaySocks atomic.Pointer[sockmap]
+
+// openSockmap is the sockmap set up for relay.sockmap, which lives as long
+// as the process like openRing.
+var openSockmap *sockmap
+
+// validateRelay validates the relay block.
+func validateRelay(rc *RelayConfig) error {
+	if rc.Buffer != nil {
+		if err := validateBuffer(rc.Buffer); err != nil {
+			return fmt.Errorf("config: relay.%w", err)
+		}
+	}
+	if rc.IOUring && rc.Buffered {
+		return fmt.Errorf("config: relay.io_uring and relay.buffered are exclusive")
+	}
+	if rc.RingEntries != 0 && !rc.IOUring {
+		return fmt.Errorf("config: relay.ring_entries is only used with relay.io_uring")
+	}
+	if rc.RingEntries < 0 || rc.RingEntries > maxRingEntries {
+		return fmt.Errorf("config: relay.ring_entries %d out of range (1-%d)", rc.RingEntries, maxRingEntries)
+	}
+	if rc.IOUring && rc.RingEntries == 0 {
+		rc.RingEntries = defaultRingEntries
+	}
+	if rc.Sockmap && rc.Buffered {
+		return fmt.Errorf("config: relay.sockmap and relay.buffered are exclusive")
+	}
+	if rc.SockmapSize != 0 && !rc.Sockmap {
+		return fmt.Errorf("config: relay.sockmap_size is only used with relay.sockmap")
+	}
+	if rc.SockmapSize < 0 || rc.SockmapSize > maxSockmapSize {
+		return fmt.Errorf("config: relay.sockmap_size %d out of range (1-%d)", rc.SockmapSize, maxSockmapSize)
+	}
+	if rc.Sockmap && rc.SockmapSize == 0 {
+		rc.SockmapSize = defaultSockmapSize
+	}
+	rc.pipeSize = 0
+	if rc.PipeSize == "" {
+		return nil
+	}
+	n, err := parseSize(rc.PipeSize)
+	if err != nil {
+		return fmt.Errorf("config: relay.pipe_size: %w", err)
+	}
+	if n < 4096 || n > maxPipeSize {
+		return fmt.Errorf("config: relay.pipe_size %s out of range (4KiB-64MiB)", rc.PipeSize)
+	}
+	rc.pipeSize = int(n)
+	return nil
+}
+
+// validateBuffer validates a buffer block.
+func validateBuffer(b *BufferConfig) error {
+	b.size = 0
+	if b.Size == "" {
+		return nil
+	}
+	n, err := parseSize(b.Size)
+	if err != nil {
+		return fmt.Errorf("buffer.size: %w", err)
+	}
+	if n < minBufferSize || n > maxBufferSize {
+		return fmt.Errorf("buffer.size %s out of range (1KiB-16MiB)", b.Size)
+	}
+	b.size = int(n)
+	return nil
+}
+
+// resolveBuffer returns the buffer size and pooling of an entry with the
+// buffer block b, whose unset fields fall back to those of the relay
+// block rc (either may be nil).
+func resolveBuffer(b *BufferConfig, rc *RelayConfig) (size int, pool bool) {
+	size, pool = defaultBufferSize, true
+	var global *BufferConfig
+	if rc != nil {
+		global = rc.Buffer
+	}
+	for _, c := range []*BufferConfig{global, b} {
+		if c == nil {
+			continue
+		}
+		if c.size > 0 {
+			size = c.size
+		}
+		if c.Pool != nil {
+			pool = *c.Pool
+		}
+	}
+	return size, pool
+}
+
+// relayBufs hands out the buffers a listener relays through: of its
+// buffer size, from a pool shared by the listeners of that size, or
+// allocated for each copy if the listener does not pool them.
+type relayBufs struct {
+	size int
+	pool *sync.Pool // nil: not pooled
+}
+
+// bufPools are the buffer pools by size; the default size uses bufPool.
+var (
+	bufPoolsMu sync.Mutex
+	bufPools   = map[int]*sync.Pool{defaultBufferSize: &bufPool}
+)
+
+func newRelayBufs(size int, pooled bool) *relayBufs {
+	b := &relayBufs{size: size}
+	if !pooled {
+		return b
+	}
+	bufPoolsMu.Lock()
+	defer bufPoolsMu.Unlock()
+	if b.pool = bufPools[size]; b.pool == nil {
+		b.pool = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		bufPools[size] = b.pool
+	}
+	return b
+}
+
+func (b *relayBufs) get() *[]byte {
+	if b.pool == nil {
+		buf := make([]byte, b.size)
+		return &buf
+	}
+	return b.pool.Get().(*[]byte)
+}
+
+func (b *relayBufs) put(buf *[]byte) {
+	if b.pool != nil {
+		b.pool.Put(buf)
+	}
+}
+
+// setRelayConfig applies the relay block of a validated configuration. A
+// pipe_size the kernel refuses is logged, and pipes keep its default.
+func setRelayConfig(cfg *Config) {
+	rc := cfg.Relay
+	if rc == nil {
+		rc = &RelayConfig{}
+	}
+	if relayBuffers.Swap(rc.Buffered) != rc.Buffered && rc.Buffered {
+		logInfo("[main] relaying through userspace buffers (relay.buffered)")
+	}
+	size := 0
+	if rc.pipeSize > 0 && spliceSupported && !rc.Buffered {
+		got, err := probePipeSize(rc.pipeSize)
+		if err != nil {
+			logWarn("[main] relay.pipe_size %s: %v; splice pipes keep the kernel's default size", rc.PipeSize, err)
+		}
+		size = got
+	}
+	if relayPipeSize.Swap(int64(size)) != int64(size) && size > 0 {
+		logInfo("[main] splice pipes of %s", formatBytes(int64(size)))
+	}
+	setRelayRing(rc)
+	setRelaySockmap(rc)
+}
+
+// setRelayRing sets up the ring of relay.io_uring the first time it is on,
+// or falls back to the other relays if the kernel does not provide one.
+func setRelayRing(rc *RelayConfig) {
+	if !rc.IOUring {
+		if relayRing.Swap(nil) != nil {
+			logInfo("[main] stopped relaying through io_uring")
+		}
+		return
+	}
+	if openRing == nil {
+		r, err := newURing(rc.RingEntries)
+		if err != nil {
+			logWarn("[main] relay.io_uring: %v; relaying without it", err)
+			return
+		}
+		openRing = r
+		uringRingEntries = rc.RingEntries
+	} else if rc.RingEntries != uringRingEntries {
+		logWarn("[main] relay.ring_entries %d: the ring keeps %d entries until a restart", rc.RingEntries, uringRingEntries)
+	}
+	if relayRing.Swap(openRing) == nil {
+		logInfo("[main] relaying through io_uring (%s)", openRing.mode())
+	}
+}
+
+// setRelaySockmap sets up the sockmap of relay.sockmap the first time it is
+// on, or leaves connections to the other relays if it cannot be.
+func setRelaySockmap(rc *RelayConfig) {
+	if !rc.Sockmap {
+		if relaySocks.Swap(nil) != nil {
+			logInfo("[main] stopped forwarding relays through the sockmap")
+		}
+		return
+	}
+	if openSockmap == nil {
+		m, err := newSockmap(rc.SockmapSize)
+		if err != nil {
+			logWarn("[main] relay.sockmap: %v; relaying without it", err)
+			return
+		}
+		openSockmap = m
+	} else if rc.SockmapSize != openSockmap.entries {
+		logWarn("[main] relay.sockmap_size %d: the sockmap keeps %d relays until a restart", rc.SockmapSize, openSockmap.entries)
+	}
+	if relaySocks.Swap(openSockmap) == nil {
+		logInfo("[main] forwarding relays in the kernel through a sockmap (%d relays at once)", openSockmap.entries)
+	}
+}
+
+// relayMode returns how unpaced connections are relayed.
+func relayMode() string {
+	if relaySocks.Load() != nil {
+		return relaySockmap
+	}
+	if relayRing.Load() != nil {
+		return relayIOUring
+	}
+	if spliceSupported && !relayBuffers.Load() {
+		return relaySplice
+	}
+	return relayBuffered
+}
+
+// copyBuffered copies from src to dst through a buffer of bufs, or at
+// most its first size bytes if size is not 0, and returns the number of
+// bytes copied. Hiding both from io.CopyBuffer keeps it from splicing on
+// its own, so the bytes it moves are counted as buffered.
+func copyBuffered(dst io.Writer, src net.Conn, bufs *relayBufs, size int) int64 {
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	if size > 0 && size < len(buf) {
+		buf = buf[:size]
+	}
+	n, _ := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+	return n
+}
@@ -0,0 +1,164 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSupported reports whether spliceCopy can relay.
+const spliceSupported = true
+
+// idlePipes keeps empty pipes of finished relays for new ones.
+var idlePipes = make(chan *splicePipe, maxIdlePipes)
+
+// splicePipe is a pipe data is spliced through, from the source socket
+// into w and from r to the destination socket.
+type splicePipe struct {
+	r, w int
+	size int // requested capacity (0: the kernel's default)
+	cap  int // actual capacity
+}
+
+func newSplicePipe(size int) (*splicePipe, error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+	p := &splicePipe{r: fds[0], w: fds[1], size: size}
+	if size > 0 {
+		unix.FcntlInt(uintptr(p.w), unix.F_SETPIPE_SZ, size) // probed by setRelayConfig
+	}
+	n, err := unix.FcntlInt(uintptr(p.w), unix.F_GETPIPE_SZ, 0)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.cap = n
+	return p, nil
+}
+
+func (p *splicePipe) close() {
+	unix.Close(p.r)
+	unix.Close(p.w)
+}
+
+// getPipe returns an idle pipe of the size in effect, or a new one.
+func getPipe() (*splicePipe, error) {
+	size := int(relayPipeSize.Load())
+	for {
+		select {
+		case p := <-idlePipes:
+			if p.size == size {
+				return p, nil
+			}
+			p.close()
+		default:
+			return newSplicePipe(size)
+		}
+	}
+}
+
+// putPipe keeps the empty pipe p for another relay, or closes it.
+func putPipe(p *splicePipe) {
+	select {
+	case idlePipes <- p:
+	default:
+		p.close()
+	}
+}
+
+// probePipeSize creates a pipe of size bytes and returns the capacity the
+// kernel gives it, which is rounded up to a power of two pages, or an
+// error if it refuses the size (above /proc/sys/fs/pipe-max-size without
+// CAP_SYS_RESOURCE).
+func probePipeSize(size int) (int, error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC); err != nil {
+		return 0, err
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	n, err := unix.FcntlInt(uintptr(fds[1]), unix.F_SETPIPE_SZ, size)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// spliceCopy copies from src to dst with splice(2), from the socket into a
+// pipe and from the pipe into the other socket, so the data never enters
+// the process, waiting for the sockets in the runtime's netpoller. It
+// returns the number of bytes copied; ok is false, with nothing copied, if
+// the sockets cannot be spliced, relay.buffered is set or src and dst are
+// not both TCP connections, for the caller to copy through a buffer.
+func spliceCopy(dst, src net.Conn) (n int64, ok bool) {
+	sc, isTCP := src.(*net.TCPConn)
+	dc, dstTCP := dst.(*net.TCPConn)
+	if !isTCP || !dstTCP || relayBuffers.Load() {
+		return 0, false
+	}
+	rsrc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	rdst, err := dc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	p, err := getPipe()
+	if err != nil {
+		return 0, false
+	}
+
+	const flags = unix.SPLICE_F_MOVE | unix.SPLICE_F_NONBLOCK
+	for {
+		// Fill the pipe from src, waiting while it has nothing to read.
+		var in int64
+		var serr error
+		err := rsrc.Read(func(fd uintptr) bool {
+			for {
+				in, serr = unix.Splice(int(fd), nil, p.w, nil, p.cap, flags)
+				if serr != unix.EINTR {
+					return serr != unix.EAGAIN
+				}
+			}
+		})
+		if err == nil {
+			err = serr
+		}
+		if n == 0 && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS)) {
+			putPipe(p)
+			return 0, false
+		}
+		if err != nil || in == 0 {
+			putPipe(p) // empty: everything read was written
+			return n, true
+		}
+
+		// Drain it into dst, waiting while dst cannot take more.
+		for in > 0 {
+			var out int64
+			err := rdst.Write(func(fd uintptr) bool {
+				for {
+					out, serr = unix.Splice(p.r, nil, int(fd), nil, int(in), flags)
+					if serr != unix.EINTR {
+						return serr != unix.EAGAIN
+					}
+				}
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil || out == 0 {
+				p.close() // data left in it
+				return n, true
+			}
+			in -= out
+			n += out
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+package main
+
+import "net"
+
+// spliceSupported reports whether spliceCopy can relay: splice(2) is Linux only.
+const spliceSupported = false
+
+// probePipeSize is not called off Linux.
+func probePipeSize(size int) (int, error) {
+	return 0, nil
+}
+
+// spliceCopy leaves every copy to copyBuffered off Linux.
+func spliceCopy(dst, src net.Conn) (n int64, ok bool) {
+	return 0, false
+}
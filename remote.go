@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// remoteConfigTimeout bounds fetching a remote config (and its checksum).
+	remoteConfigTimeout = 30 * time.Second
+
+	// maxRemoteConfig is the largest remote config accepted.
+	maxRemoteConfig = 16 << 20
+)
+
+// remoteOptions control fetching a config from a URL.
+type remoteOptions struct {
+	// Headers are sent with the request, e.g. "Authorization: Bearer ...",
+	// after ${VAR} expansion.
+	Headers []string
+
+	// SHA256 pins the config's checksum: a hex digest, or an http(s) URL of
+	// a file whose first word is the digest (sha256sum output), fetched with
+	// the same headers. Empty: no check.
+	SHA256 string
+}
+
+// isRemoteConfig reports whether path is an http(s) URL or a key-value
+// store source.
+func isRemoteConfig(path string) bool {
+	if _, ok := parseKVSource(path); ok {
+		return true
+	}
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// fetchConfig downloads the config at url and verifies its checksum.
+func fetchConfig(url string, opts remoteOptions) ([]byte, error) {
+	var data []byte
+	var err error
+	if s, ok := parseKVSource(url); ok {
+		s.headers = opts.Headers
+		data, err = s.get()
+	} else {
+		data, err = fetchURL(url, opts.Headers)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	if opts.SHA256 == "" {
+		return data, nil
+	}
+
+	want := opts.SHA256
+	if isRemoteConfig(want) {
+		sum, err := fetchURL(want, opts.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("read config checksum: %w", err)
+		}
+		fields := strings.Fields(string(sum))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("read config checksum: %s is empty", want)
+		}
+		want = fields[0]
+	}
+	digest := sha256.Sum256(data)
+	if got := hex.EncodeToString(digest[:]); !strings.EqualFold(got, want) {
+		return nil, fmt.Errorf("config %s: sha256 %s does not match pinned %s", url, got, want)
+	}
+	return data, nil
+}
+
+// fetchURL GETs url with the given "Name: value" headers.
+func fetchURL(url string, headers []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+	body, _, err := requestURL(ctx, http.MethodGet, url, nil, headers)
+	return body, err
+}
+
+// requestURL sends a request with the given "Name: value" headers and
+// returns the body of a 200 response, with the response headers.
+func requestURL(ctx context.Context, method, url string, payload []byte, headers []string) ([]byte, http.Header, error) {
+	resp, err := openURL(ctx, method, url, payload, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfig+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) > maxRemoteConfig {
+		return nil, nil, fmt.Errorf("%s %s: response exceeds %d bytes", method, url, maxRemoteConfig)
+	}
+	return body, resp.Header, nil
+}
+
+// openURL sends a request and returns the response if its status is 200;
+// the caller closes the body.
+func openURL(ctx context.Context, method, url string, payload []byte, headers []string) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range headers {
+		// ${VAR} keeps tokens out of the process list.
+		expanded, err := expandEnv([]byte(h))
+		if err != nil {
+			return nil, err
+		}
+		name, value, ok := strings.Cut(string(expanded), ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q (expected \"Name: value\")", h)
+		}
+		req.Header.Add(name, strings.TrimSpace(value))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: HTTP %s", method, url, resp.Status)
+	}
+	return resp, nil
+}
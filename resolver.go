@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultResolverTimeout bounds a whole lookup when resolver.timeout is omitted.
+const defaultResolverTimeout = 5 * time.Second
+
+// Address-family policies for domain targets (proxies[].resolve).
+const (
+	resolveIPv6Only   = "ipv6-only"   // AAAA only (default): matches the IPv6 outbound
+	resolveIPv4Only   = "ipv4-only"   // A only, dialed from the host's default IPv4
+	resolvePreferIPv6 = "prefer-ipv6" // AAAA first, then A from the host's default IPv4
+)
+
+// Resolver protocols.
+const (
+	resolverDNS    = "dns" // plain DNS over UDP, TCP on truncation (default)
+	resolverDoT    = "dot" // DNS-over-TLS (RFC 7858)
+	resolverDoH    = "doh" // DNS-over-HTTPS (RFC 8484)
+	resolverSystem = ""    // internal: resolv.conf servers, used only to route through the cache
+)
+
+// dnsResolver resolves domain targets for one listener. It wraps a pure-Go
+// net.Resolver whose Dial hook ignores /etc/resolv.conf and rotates through
+// the configured servers, so a failing server is skipped on retry.
+//
+// The Go resolver frames messages by connection type: a net.PacketConn gets
+// plain datagrams, anything else gets 2-byte length-prefixed messages as on
+// TCP. Dial therefore returns a msgConn, which hands each whole query to an
+// exchange function. That is where the transport (dns, dot, doh) and the
+// shared cache plug in.
+type dnsResolver struct {
+	protocol string
+	servers  []string // host:port (IP literals) for dns/dot, URLs for doh
+	timeout  time.Duration
+	next     atomic.Uint32
+	r        *net.Resolver
+	cache    *dnsCache
+	hosts    map[string]net.IP
+
+	// bindOutbound sources queries from the connection's outbound address,
+	// passed down through the lookup context (see dnsSourceKey).
+	bindOutbound bool
+	ecs          *ecsPolicy
+
+	tlsConfig *tls.Config  // dot
+	client    *http.Client // doh
+	clients   sync.Map     // doh with bindOutbound: source IP string → *http.Client
+}
+
+// dnsSourceKey is the context key carrying the source IP for DNS queries.
+type dnsSourceKey struct{}
+
+// newDNSResolver returns a resolver for cfg. With cfg nil it uses the system
+// resolver: net.DefaultResolver, or its resolv.conf servers queried through
+// the cache if cache is set. hosts are static overrides checked first.
+func newDNSResolver(cfg *ResolverConfig, cache *dnsCache, hosts map[string]net.IP) *dnsResolver {
+	if cfg == nil {
+		d := &dnsResolver{protocol: resolverSystem, timeout: defaultResolverTimeout, cache: cache, hosts: hosts, r: net.DefaultResolver}
+		if cache != nil {
+			d.r = &net.Resolver{PreferGo: true, Dial: d.dial}
+		}
+		return d
+	}
+	d := &dnsResolver{
+		protocol:     cfg.Protocol,
+		servers:      cfg.Servers,
+		timeout:      cfg.Timeout,
+		cache:        cache,
+		hosts:        hosts,
+		bindOutbound: cfg.BindOutbound,
+		ecs:          newECSPolicy(cfg.ECS),
+	}
+	switch d.protocol {
+	case resolverDoT:
+		d.tlsConfig = &tls.Config{ServerName: cfg.ServerName, MinVersion: tls.VersionTLS12}
+	case resolverDoH:
+		d.client = &http.Client{Timeout: cfg.Timeout}
+	}
+	d.r = &net.Resolver{PreferGo: true, Dial: d.dial}
+	return d
+}
+
+// dial is the net.Resolver.Dial hook. The server chosen by the Go resolver
+// (from resolv.conf) is replaced by the next configured server, except for
+// the system resolver.
+func (d *dnsResolver) dial(ctx context.Context, _, server string) (net.Conn, error) {
+	if d.protocol != resolverSystem {
+		server = d.servers[int(d.next.Add(1)-1)%len(d.servers)]
+	}
+	outbound, _ := ctx.Value(dnsSourceKey{}).(net.IP)
+	var src net.IP
+	if d.bindOutbound {
+		src = outbound
+	}
+	// ECS is applied before the cache so the subnet is part of the cache key.
+	cached := d.cache.wrap(d.cacheID(), func(ctx context.Context, msg []byte) ([]byte, error) {
+		return d.exchange(ctx, server, src, msg)
+	})
+	return newMsgConn(func(ctx context.Context, msg []byte) ([]byte, error) {
+		return cached(ctx, d.ecs.apply(msg, outbound))
+	}), nil
+}
+
+// cacheID identifies the resolver in the cache keys of its responses: its
+// protocol and servers, or "system" for the resolv.conf servers.
+func (d *dnsResolver) cacheID() string {
+	if d.protocol == resolverSystem {
+		return "system"
+	}
+	return d.protocol + " " + strings.Join(d.servers, ",")
+}
+
+// exchange sends msg to server using the resolver's protocol, from src if
+// it is non-nil.
+func (d *dnsResolver) exchange(ctx context.Context, server string, src net.IP, msg []byte) ([]byte, error) {
+	switch d.protocol {
+	case resolverDoT:
+		return exchangeDoT(ctx, src, d.tlsConfig, server, msg)
+	case resolverDoH:
+		return exchangeDoH(ctx, d.clientFor(src), server, msg)
+	default:
+		return exchangeDNS(ctx, src, server, msg)
+	}
+}
+
+// clientFor returns the DoH client for queries sourced from src. Each
+// source gets its own client so pooled connections never carry queries for
+// another outbound identity.
+func (d *dnsResolver) clientFor(src net.IP) *http.Client {
+	if src == nil {
+		return d.client
+	}
+	key := src.String()
+	if c, ok := d.clients.Load(key); ok {
+		return c.(*http.Client)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{LocalAddr: &net.TCPAddr{IP: src}}).DialContext
+	c, _ := d.clients.LoadOrStore(key, &http.Client{Timeout: d.timeout, Transport: tr})
+	return c.(*http.Client)
+}
+
+// Lookup returns the addresses of host allowed by policy (one of the
+// resolve* constants). ipv6-only and ipv4-only query only AAAA or A records;
+// prefer-ipv6 queries both and orders IPv6 addresses first. A static hosts
+// override short-circuits DNS, subject to the same policy. source is the
+// connection's outbound address, used for bind_outbound and ECS.
+func (d *dnsResolver) Lookup(ctx context.Context, host, policy string, source net.IP) ([]net.IP, error) {
+	if ip, ok := d.hosts[normalizeHost(host)]; ok {
+		if (ip.To4() != nil && policy == resolveIPv6Only) || (ip.To4() == nil && policy == resolveIPv4Only) {
+			return nil, fmt.Errorf("lookup %s: static override %s not allowed by resolve policy %s", host, ip, policy)
+		}
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	if source != nil {
+		ctx = context.WithValue(ctx, dnsSourceKey{}, source)
+	}
+
+	network := "ip6"
+	switch policy {
+	case resolveIPv4Only:
+		network = "ip4"
+	case resolvePreferIPv6:
+		network = "ip"
+	}
+	ips, err := d.r.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	if policy == resolvePreferIPv6 {
+		sort.SliceStable(ips, func(i, j int) bool { return ips[i].To4() == nil && ips[j].To4() != nil })
+	}
+	return ips, nil
+}
+
+// normalizeHost lowercases a domain name and strips the trailing dot.
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// parseHosts converts validated static overrides to IPs.
+func parseHosts(hosts map[string]string) map[string]net.IP {
+	m := make(map[string]net.IP, len(hosts))
+	for name, ip := range hosts {
+		m[name] = net.ParseIP(ip)
+	}
+	return m
+}
+
+// validateHosts normalizes static override names and checks addresses.
+func validateHosts(hosts map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(hosts))
+	for name, addr := range hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("config: hosts: %q: invalid IP address %q", name, addr)
+		}
+		key := normalizeHost(name)
+		if key == "" || net.ParseIP(key) != nil {
+			return nil, fmt.Errorf("config: hosts: %q is not a domain name", name)
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("config: hosts: duplicate entry for %q", key)
+		}
+		out[key] = ip.String()
+	}
+	return out, nil
+}
+
+// validateResolver applies defaults and normalizes server addresses to
+// host:port form (port 53 for dns, 853 for dot if omitted). DoH servers
+// must be https URLs.
+func validateResolver(rc *ResolverConfig) error {
+	if rc.Protocol == "" {
+		rc.Protocol = resolverDNS
+	}
+	defaultPort := "53"
+	switch rc.Protocol {
+	case resolverDNS:
+	case resolverDoT:
+		defaultPort = "853"
+	case resolverDoH:
+	default:
+		return fmt.Errorf("unknown protocol %q (expected dns, dot or doh)", rc.Protocol)
+	}
+	if rc.ServerName != "" && rc.Protocol != resolverDoT {
+		return fmt.Errorf("server_name is only valid with protocol dot")
+	}
+
+	if rc.ECS != nil {
+		if err := validateECS(rc.ECS); err != nil {
+			return err
+		}
+	}
+
+	if len(rc.Servers) == 0 {
+		return fmt.Errorf("at least one server is required")
+	}
+	for i, s := range rc.Servers {
+		if rc.Protocol == resolverDoH {
+			u, err := url.Parse(s)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("servers[%d]: %q must be an https:// URL", i, s)
+			}
+			continue
+		}
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host, port = s, defaultPort
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("servers[%d]: %q must be an IP address", i, s)
+		}
+		if rc.BindOutbound && ip.To4() != nil {
+			return fmt.Errorf("servers[%d]: %q is IPv4, bind_outbound requires IPv6 servers", i, s)
+		}
+		rc.Servers[i] = net.JoinHostPort(host, port)
+	}
+	if rc.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if rc.Timeout == 0 {
+		rc.Timeout = defaultResolverTimeout
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import "fmt"
+
+// Descriptors the daemon holds besides those of listeners and
+// connections: logs, the state directory, admin and DNS sockets.
+const fileLimitReserve = 64
+
+// assumedConnections is the concurrency the open file limit is checked
+// against when no max_connections caps it.
+const assumedConnections = 1024
+
+// raiseFileLimit raises the open file limit (RLIMIT_NOFILE) of the process
+// to max_open_files, or else to its hard limit. The limit is never
+// lowered, as descriptors above it stay open.
+func raiseFileLimit(cfg *Config) {
+	cur, hard, err := fileLimit()
+	if err != nil {
+		return // not limited this way
+	}
+	target := hard
+	if cfg.MaxOpenFiles > 0 {
+		target = uint64(cfg.MaxOpenFiles)
+	} else if cur+1 >= hard {
+		return // the runtime raised it to one below, to tell changes by prlimit
+	}
+	if target > cur {
+		if err := setFileLimit(target, max(target, hard)); err == nil {
+			logInfo("[main] open file limit raised from %d to %d", cur, target)
+			cur = target
+		} else if target > hard && hard > cur && setFileLimit(hard, hard) == nil {
+			logWarn("[main] max_open_files %d: %v (above the hard limit, which needs CAP_SYS_RESOURCE and fs.nr_open); raised to the hard limit %d", target, err, hard)
+			cur = hard
+		} else {
+			logWarn("[main] max_open_files %d: %v (above the hard limit %d, which needs CAP_SYS_RESOURCE and fs.nr_open); the limit stays %d", target, err, hard, cur)
+		}
+	}
+}
+
+// checkFileLimit warns if the open file limit is too low for the listeners
+// and connections cfg may have open at once.
+func checkFileLimit(cfg *Config) {
+	cur, _, err := fileLimit()
+	if err != nil {
+		return
+	}
+	if need, basis := filesNeeded(cfg); cur < uint64(need) {
+		logWarn("[main] open file limit %d is below the %d descriptors needed for %s; raise max_open_files or LimitNOFILE, or lower max_connections", cur, need, basis)
+	}
+}
+
+// filesNeeded estimates the descriptors cfg may need at once: the
+// listening sockets, and for each connection its two sockets plus the
+// pipes or duplicates the relays copy through. basis describes what it
+// counts, for the warning.
+func filesNeeded(cfg *Config) (int, string) {
+	sockets, capped, sum := 0, 0, 0
+	for _, p := range cfg.Proxies {
+		sockets += max(p.Acceptors, 1)
+		if p.MaxConnections > 0 {
+			capped++
+			sum += p.MaxConnections
+		}
+	}
+	conns, assumed := cfg.MaxConnections, ""
+	switch {
+	case capped == len(cfg.Proxies) && (conns == 0 || sum < conns):
+		conns = sum
+	case conns == 0:
+		conns, assumed = assumedConnections, ", assumed without max_connections"
+	}
+	perConn, reserve := 2, fileLimitReserve
+	switch relayMode() {
+	case relaySplice, relaySockmap:
+		perConn += 4 // a pipe per direction, of those the sockmap does not take
+		reserve += 2 * maxIdlePipes
+	case relayIOUring:
+		perConn += 4 // duplicates of both sockets per direction
+	}
+	return sockets + conns*perConn + reserve, fmt.Sprintf("%d listening sockets and %d connections%s", sockets, conns, assumed)
+}
@@ -0,0 +1,20 @@
+// +build linux
+
+package main
+
+import "syscall"
+
+// fileLimit returns the soft and hard open file limits of the process.
+func fileLimit() (cur, hard uint64, err error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, 0, err
+	}
+	return rl.Cur, rl.Max, nil
+}
+
+// setFileLimit sets the open file limits of the process; raising the hard
+// one needs CAP_SYS_RESOURCE, and neither may exceed fs.nr_open.
+func setFileLimit(cur, hard uint64) error {
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: cur, Max: hard})
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// fileLimit fails: the open file limit is only managed on Linux.
+func fileLimit() (cur, hard uint64, err error) {
+	return 0, 0, errors.New("RLIMIT_NOFILE is managed on Linux only")
+}
+
+// setFileLimit fails, like fileLimit.
+func setFileLimit(cur, hard uint64) error {
+	return errors.New("RLIMIT_NOFILE is managed on Linux only")
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Actions of a rule.
+const (
+	routeDirect   = "direct"
+	routeBlock    = "block"
+	routeUpstream = "upstream"
+	routeRewrite  = "rewrite"
+)
+
+// maxProxyResponse bounds the response header of an HTTP upstream.
+const maxProxyResponse = 16 << 10
+
+// routeRule is a compiled rule of a listener.
+type routeRule struct {
+	index   int // in the entry's rules, for logs
+	domains domainSet
+	cidrs   []*net.IPNet
+	ports   []portRange // empty: all
+	any     bool        // no domains or cidrs: every target
+
+	action   string
+	upstream *upstream // upstream
+	host     string    // rewrite: new host ("": kept)
+	port     uint16    // rewrite: new port (0: kept)
+	outbound net.IP    // nil: the pool's
+}
+
+// newRoutes compiles the validated rules of an entry, resolving their
+// upstreams by name.
+func newRoutes(rules []RouteRule, upstreams map[string]*upstream) []*routeRule {
+	var out []*routeRule
+	for i, rc := range rules {
+		r := &routeRule{
+			index:    i,
+			domains:  newDomainSet(rc.Domains),
+			cidrs:    parseCIDRs(rc.CIDRs),
+			ports:    parsePortRanges(rc.Ports),
+			any:      len(rc.Domains) == 0 && len(rc.CIDRs) == 0,
+			action:   rc.Action,
+			upstream: upstreams[rc.Upstream],
+			outbound: net.ParseIP(rc.Outbound),
+		}
+		if r.action == "" {
+			r.action = routeDirect
+		}
+		if rc.Rewrite != "" {
+			host, port, _ := parseRewrite(rc.Rewrite)
+			r.host, r.port = host, port
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// matchRoute returns the first of rules matching host:port, or nil.
+func matchRoute(rules []*routeRule, host string, port uint16) *routeRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	name := ""
+	if ip == nil {
+		name = normalizeHost(host)
+	}
+	for _, r := range rules {
+		if len(r.ports) > 0 && !inPortRanges(r.ports, port) {
+			continue
+		}
+		if r.any || ip != nil && inNets(r.cidrs, ip) || ip == nil && r.domains.match(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// target returns the target a matching rule dials instead of host:port.
+func (r *routeRule) target(host string, port uint16) (string, uint16) {
+	if r.host != "" {
+		host = r.host
+	}
+	if r.port != 0 {
+		port = r.port
+	}
+	return host, port
+}
+
+// describe tells what the rule does with a target it rewrites to
+// host:port, for logs.
+func (r *routeRule) describe(host string, port uint16) string {
+	s := r.action
+	switch r.action {
+	case routeUpstream:
+		s += " " + r.upstream.name
+	case routeRewrite:
+		s += " to " + net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	if r.outbound != nil {
+		s += " from " + r.outbound.String()
+	}
+	return s
+}
+
+// parseRewrite parses the rewrite of a rule: host, host:port or :port.
+func parseRewrite(s string) (host string, port uint16, err error) {
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return "", 0, fmt.Errorf("invalid port in %q", s)
+		}
+		return h, uint16(n), nil
+	}
+	if strings.HasPrefix(s, ":") || strings.Count(s, ":") == 1 {
+		return "", 0, fmt.Errorf("invalid rewrite %q (expected host, host:port or :port)", s)
+	}
+	return strings.Trim(s, "[]"), 0, nil
+}
+
+// upstream is a chain of proxies a rule sends CONNECTs through.
+type upstream struct {
+	name string
+	hops []upstreamHop
+}
+
+// upstreamHop is one proxy of a chain.
+type upstreamHop struct {
+	scheme     string // socks5 or http
+	addr       string // host:port
+	user, pass string // "": no login
+}
+
+// newUpstreams builds the validated upstreams by name.
+func newUpstreams(cfgs []UpstreamConfig) map[string]*upstream {
+	out := make(map[string]*upstream, len(cfgs))
+	for _, c := range cfgs {
+		u := &upstream{name: c.Name}
+		for _, s := range c.Chain {
+			hop, _ := parseUpstreamHop(s)
+			u.hops = append(u.hops, hop)
+		}
+		out[c.Name] = u
+	}
+	return out
+}
+
+func parseUpstreamHop(s string) (upstreamHop, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return upstreamHop{}, fmt.Errorf("invalid URL") // the error would show the password
+	}
+	hop := upstreamHop{scheme: u.Scheme, addr: u.Host}
+	switch {
+	case u.Scheme != "socks5" && u.Scheme != "http":
+		return hop, fmt.Errorf("%q: scheme must be socks5 or http", u.Redacted())
+	case u.Port() == "" || u.Hostname() == "":
+		return hop, fmt.Errorf("%q: expected host:port", u.Redacted())
+	case u.Path != "" && u.Path != "/" || u.RawQuery != "":
+		return hop, fmt.Errorf("%q: unexpected path", u.Redacted())
+	}
+	if u.User != nil {
+		hop.user = u.User.Username()
+		hop.pass, _ = u.User.Password()
+		if hop.scheme == "socks5" && (len(hop.user) > 255 || len(hop.pass) > 255) {
+			return hop, fmt.Errorf("%q: SOCKS5 credentials are longer than 255 bytes", u.Redacted())
+		}
+	}
+	return hop, nil
+}
+
+// dial connects to host:port through the chain: to its first proxy from
+// the outbound address of dialer (the host's default IPv4 for an IPv4
+// proxy), then through each proxy to the next and finally to the target.
+// The handshakes share the deadline of dialer.
+func (u *upstream) dial(dialer *net.Dialer, host string, port uint16) (net.Conn, error) {
+	d := *dialer
+	if h, _, _ := net.SplitHostPort(u.hops[0].addr); net.ParseIP(h).To4() != nil {
+		d.LocalAddr = nil
+	}
+	conn, err := d.Dial("tcp", u.hops[0].addr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", u.name, err)
+	}
+	conn.SetDeadline(dialer.Deadline)
+	for i, hop := range u.hops {
+		th, tp := host, port
+		if i+1 < len(u.hops) {
+			h, p, _ := net.SplitHostPort(u.hops[i+1].addr)
+			n, _ := strconv.ParseUint(p, 10, 16)
+			th, tp = h, uint16(n)
+		}
+		if hop.scheme == "socks5" {
+			err = hop.socks5Connect(conn, th, tp)
+		} else {
+			err = hop.httpConnect(conn, th, tp)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream %s via %s: %w", u.name, hop.addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// dialUpstream connects to host:port through u if the destination policy
+// allows it. A domain target is passed on unresolved, so with an allowlist
+// it must be listed: the addresses the upstream resolves it to cannot be
+// checked.
+func (l *listener) dialUpstream(u *upstream, dialer *net.Dialer, host string, port uint16) (net.Conn, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if _, err := l.policy.filterIPs([]net.IP{ip}, host, port); err != nil {
+			return nil, err
+		}
+	} else if !l.policy.allowUnresolved(host) {
+		return nil, errDestinationDenied
+	}
+	return u.dial(dialer, host, port)
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to host:port.
+func (h upstreamHop) socks5Connect(conn net.Conn, host string, port uint16) error {
+	greeting := []byte{socks5Version, 1, authNone}
+	if h.user != "" {
+		greeting = []byte{socks5Version, 2, authNone, authUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	switch {
+	case resp[0] != socks5Version:
+		return fmt.Errorf("not a SOCKS5 proxy")
+	case resp[1] == authUserPass && h.user != "":
+		msg := append([]byte{userPassVersion, byte(len(h.user))}, h.user...)
+		msg = append(append(msg, byte(len(h.pass))), h.pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return fmt.Errorf("SOCKS5 login refused")
+		}
+	case resp[1] != authNone:
+		return fmt.Errorf("no acceptable SOCKS5 auth method")
+	}
+
+	req := []byte{socks5Version, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		req = append(append(req, atypIPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, atypIPv6), ip.To16()...)
+	} else if len(host) <= 255 {
+		req = append(append(req, atypDomain, byte(len(host))), host...)
+	} else {
+		return fmt.Errorf("target name too long")
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != repSuccess {
+		return socks5ReplyError(hdr[1])
+	}
+	var skip int
+	switch hdr[3] {
+	case atypIPv4:
+		skip = 4 + 2
+	case atypIPv6:
+		skip = 16 + 2
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("SOCKS5 reply with address type %d", hdr[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socks5ReplyError turns the failure reply of a SOCKS5 proxy into the
+// error the listener answers its own client with.
+func socks5ReplyError(rep byte) error {
+	switch rep {
+	case repConnectionNotAllowed:
+		return fmt.Errorf("refused by the proxy: %w", errDestinationDenied)
+	case repNetworkUnreachable:
+		return fmt.Errorf("SOCKS5 reply: %w", syscall.ENETUNREACH)
+	case repHostUnreachable:
+		return fmt.Errorf("SOCKS5 reply: %w", syscall.EHOSTUNREACH)
+	case repConnectionRefused:
+		return fmt.Errorf("SOCKS5 reply: %w", syscall.ECONNREFUSED)
+	}
+	return fmt.Errorf("SOCKS5 reply %d", rep)
+}
+
+// httpConnect asks the HTTP proxy on conn to connect to host:port with a
+// CONNECT request. The response is read byte by byte, so no data the
+// target sends right after it is lost.
+func (h upstreamHop) httpConnect(conn net.Conn, host string, port uint16) error {
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if h.user != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(h.user+":"+h.pass)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return err
+	}
+	var resp []byte
+	var b [1]byte
+	for !strings.HasSuffix(string(resp), "\r\n\r\n") {
+		if len(resp) >= maxProxyResponse {
+			return fmt.Errorf("HTTP proxy response too long")
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		resp = append(resp, b[0])
+	}
+	status, _, _ := strings.Cut(string(resp), "\r\n")
+	proto, code, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(proto, "HTTP/1.") {
+		return fmt.Errorf("not an HTTP proxy")
+	}
+	switch {
+	case strings.HasPrefix(code, "2"):
+		return nil
+	case strings.HasPrefix(code, "403"):
+		return fmt.Errorf("refused by the proxy: %w", errDestinationDenied)
+	}
+	return fmt.Errorf("HTTP proxy: %s", code)
+}
+
+// validateUpstreams validates the upstreams section.
+func validateUpstreams(ups []UpstreamConfig) error {
+	seen := make(map[string]bool, len(ups))
+	for i, u := range ups {
+		switch {
+		case u.Name == "":
+			return fmt.Errorf("config: upstreams[%d]: name is required", i)
+		case seen[u.Name]:
+			return fmt.Errorf("config: upstreams[%d]: duplicate name %q", i, u.Name)
+		case len(u.Chain) == 0:
+			return fmt.Errorf("config: upstream %s: chain is empty", u.Name)
+		}
+		seen[u.Name] = true
+		for j, s := range u.Chain {
+			if _, err := parseUpstreamHop(s); err != nil {
+				return fmt.Errorf("config: upstream %s: chain[%d]: %w", u.Name, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRules validates and normalizes the rules of an entry; upstreams
+// are the validated upstreams they may name.
+func validateRules(rules []RouteRule, upstreams []UpstreamConfig) error {
+	for i := range rules {
+		r := &rules[i]
+		name := fmt.Sprintf("rules[%d]", i)
+		if err := normalizeDomainRules(name+".domains", r.Domains); err != nil {
+			return err
+		}
+		if err := normalizeCIDRs(name+".cidrs", r.CIDRs); err != nil {
+			return err
+		}
+		for j, s := range r.Ports {
+			if _, _, err := parsePortRange(s); err != nil {
+				return fmt.Errorf("%s.ports[%d]: %w", name, j, err)
+			}
+		}
+		switch r.Action {
+		case "", routeDirect, routeBlock, routeUpstream, routeRewrite:
+		default:
+			return fmt.Errorf("%s: unknown action %q (expected direct, block, upstream or rewrite)", name, r.Action)
+		}
+		switch {
+		case r.Action == routeUpstream && r.Upstream == "":
+			return fmt.Errorf("%s: action upstream needs an upstream", name)
+		case r.Action != routeUpstream && r.Upstream != "":
+			return fmt.Errorf("%s: upstream is only used with action upstream", name)
+		case r.Upstream != "" && !hasUpstream(upstreams, r.Upstream):
+			return fmt.Errorf("%s: unknown upstream %q", name, r.Upstream)
+		case r.Action == routeRewrite && r.Rewrite == "":
+			return fmt.Errorf("%s: action rewrite needs a rewrite", name)
+		case r.Action != routeRewrite && r.Rewrite != "":
+			return fmt.Errorf("%s: rewrite is only used with action rewrite", name)
+		}
+		if r.Rewrite != "" {
+			if _, _, err := parseRewrite(r.Rewrite); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if r.Outbound != "" {
+			ip := net.ParseIP(r.Outbound)
+			switch {
+			case ip == nil || ip.To4() != nil:
+				return fmt.Errorf("%s: outbound %q is not an IPv6 address", name, r.Outbound)
+			case r.Action == routeBlock:
+				return fmt.Errorf("%s: outbound is not used with action block", name)
+			}
+		}
+	}
+	return nil
+}
+
+func hasUpstream(ups []UpstreamConfig, name string) bool {
+	for _, u := range ups {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdays are the day names of schedule windows.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduleWindow is one weekly window of a schedule: the days it starts on
+// (a bit per time.Weekday) and its start and end in minutes of the day. A
+// window whose end is not after its start runs past midnight into the next
+// day.
+type scheduleWindow struct {
+	days     uint8
+	from, to int
+}
+
+// open reports whether the schedule s (nil: always open) accepts
+// connections at t.
+func (s *ScheduleConfig) open(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	t = t.In(s.loc)
+	day, minute := t.Weekday(), t.Hour()*60+t.Minute()
+	yesterday := (day + 6) % 7
+	for _, w := range s.windows {
+		if w.from < w.to {
+			if w.days&(1<<day) != 0 && minute >= w.from && minute < w.to {
+				return true
+			}
+			continue
+		}
+		if w.days&(1<<day) != 0 && minute >= w.from || w.days&(1<<yesterday) != 0 && minute < w.to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWindow parses a window such as "mon-fri 09:00-18:00",
+// "sat,sun 10:00-14:00" or "fri 22:00-02:00"; the days may be left out
+// for every day.
+func parseWindow(s string) (scheduleWindow, error) {
+	var w scheduleWindow
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 1 {
+		fields = []string{"mon-sun", fields[0]}
+	}
+	if len(fields) != 2 {
+		return w, fmt.Errorf("invalid window %q (expected e.g. \"mon-fri 09:00-18:00\")", s)
+	}
+	for _, part := range strings.Split(fields[0], ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		d1, ok1 := weekdays[first]
+		d2, ok2 := d1, true
+		if isRange {
+			d2, ok2 = weekdays[last]
+		}
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("invalid days %q in window %q (expected e.g. mon-fri or sat,sun)", fields[0], s)
+		}
+		for d := d1; ; d = (d + 1) % 7 {
+			w.days |= 1 << d
+			if d == d2 {
+				break
+			}
+		}
+	}
+	from, to, ok := strings.Cut(fields[1], "-")
+	var err error
+	if !ok {
+		return w, fmt.Errorf("invalid times %q in window %q (expected e.g. 09:00-18:00)", fields[1], s)
+	}
+	if w.from, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.to, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.from == 24*60 {
+		return w, fmt.Errorf("window %q: a window cannot start at 24:00", s)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day, "HH:MM" (24:00 for the end of the day),
+// into minutes.
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || len(mm) != 2 || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// validateSchedule parses a schedule block.
+func validateSchedule(s *ScheduleConfig) error {
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("windows is required")
+	}
+	tz := s.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	s.loc, s.windows = loc, nil
+	for _, ws := range s.Windows {
+		w, err := parseWindow(ws)
+		if err != nil {
+			return err
+		}
+		s.windows = append(s.windows, w)
+	}
+	return nil
+}
+
+// scheduleSummary describes s for entry summaries, e.g.
+// "open mon-fri 09:00-18:00 Europe/Berlin".
+func scheduleSummary(s *ScheduleConfig) string {
+	sum := "open " + strings.Join(s.Windows, ", ")
+	if s.Timezone != "" {
+		sum += " " + s.Timezone
+	}
+	return sum
+}
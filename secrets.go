@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret references: a config string of one of these forms is replaced by
+// the secret it names when the config is loaded. In YAML the matching tag
+// may be used instead, e.g. `!vault secret/data/proxy#password`.
+const (
+	secretFile  = "file:"  // file:/run/secrets/name  → file contents
+	secretVault = "vault:" // vault:<kv path>#<field> → HashiCorp Vault KV (VAULT_ADDR, VAULT_TOKEN)
+	secretSOPS  = "sops:"  // sops:<file>#<key>       → value decrypted by the sops CLI
+)
+
+// secretTags maps YAML tags to the reference prefix they stand for.
+var secretTags = map[string]string{"!file": secretFile, "!vault": secretVault, "!sops": secretSOPS}
+
+// rewriteSecretTags turns tagged scalars in a YAML document into plain
+// string references, so they decode into ordinary string fields.
+func rewriteSecretTags(n *yaml.Node) {
+	if prefix, ok := secretTags[n.Tag]; ok && n.Kind == yaml.ScalarNode {
+		n.Tag, n.Value = "!!str", prefix+n.Value
+	}
+	for _, c := range n.Content {
+		rewriteSecretTags(c)
+	}
+}
+
+// maskSecrets replaces scalars holding a resolved secret by the reference
+// it came from, so secrets are never written to disk in plaintext.
+func maskSecrets(n *yaml.Node, refs map[string]string) {
+	if ref, ok := refs[n.Value]; ok && n.Kind == yaml.ScalarNode && n.Value != "" {
+		n.Tag, n.Value = "!!str", ref
+	}
+	for _, c := range n.Content {
+		maskSecrets(c, refs)
+	}
+}
+
+// resolveSecrets replaces every secret reference in cfg by its value. The
+// references are remembered so the running-config snapshot can write them
+// back instead of the plaintext (see maskSecrets).
+func resolveSecrets(cfg *Config) error {
+	return walkStrings(reflect.ValueOf(cfg).Elem(), func(s string) (string, error) {
+		value, ok, err := lookupSecret(s)
+		if err != nil || !ok {
+			return s, err
+		}
+		if cfg.secretRefs == nil {
+			cfg.secretRefs = make(map[string]string)
+		}
+		cfg.secretRefs[value] = s
+		return value, nil
+	})
+}
+
+// lookupSecret resolves ref if it is a secret reference.
+func lookupSecret(ref string) (value string, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(ref, secretFile):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, secretFile))
+		if err != nil {
+			return "", true, fmt.Errorf("config: secret %s: %w", ref, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+
+	case strings.HasPrefix(ref, secretVault):
+		path, field, found := strings.Cut(strings.TrimPrefix(ref, secretVault), "#")
+		if !found || path == "" || field == "" {
+			return "", true, fmt.Errorf("config: secret %s: expected vault:<path>#<field>", ref)
+		}
+		value, err := vaultSecret(path, field)
+		if err != nil {
+			return "", true, fmt.Errorf("config: secret %s: %w", ref, err)
+		}
+		return value, true, nil
+
+	case strings.HasPrefix(ref, secretSOPS):
+		file, key, found := strings.Cut(strings.TrimPrefix(ref, secretSOPS), "#")
+		if !found || file == "" || key == "" {
+			return "", true, fmt.Errorf("config: secret %s: expected sops:<file>#<key>", ref)
+		}
+		// Nested keys are dotted: a.b → ["a"]["b"]
+		extract := `["` + strings.Join(strings.Split(key, "."), `"]["`) + `"]`
+		out, err := exec.Command("sops", "--decrypt", "--extract", extract, file).Output()
+		if err != nil {
+			if ee, ok := err.(*exec.ExitError); ok {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(ee.Stderr)))
+			}
+			return "", true, fmt.Errorf("config: secret %s: sops: %w", ref, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
+
+// vaultSecret reads field from the KV secret at path (v1 or v2 engine).
+func vaultSecret(path, field string) (string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	body, err := fetchURL(strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), []string{"X-Vault-Token: " + token})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok { // KV v2 nests the secret
+		data = inner
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %q not found", field)
+	}
+	return v, nil
+}
+
+// walkStrings calls fn on every string reachable from v (struct fields,
+// pointers, slices and map values) and stores the result.
+func walkStrings(v reflect.Value, fn func(string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := fn(v.String())
+		if err != nil {
+			return err
+		}
+		if v.CanSet() {
+			v.SetString(s)
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return walkStrings(v.Elem(), fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				if err := walkStrings(v.Field(i), fn); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkStrings(v.Index(i), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err := walkStrings(e, fn); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// server owns the listening sockets of the running configuration and
+// applies new configurations to them in place, whether they come from a
+// reload or an admin API edit. It is the only place listeners are opened
+// and closed.
+type server struct {
+	mu     sync.Mutex
+	cfg    *Config
+	shared *proxyShared
+	ports  map[int]*listenPort
+}
+
+func newServer() *server {
+	return &server{ports: make(map[int]*listenPort)}
+}
+
+// apply makes cfg the running configuration:
+//   - ports new in cfg are opened,
+//   - ports no longer in cfg are closed; their active connections finish
+//     undisturbed,
+//   - ports whose entry changed get new settings for future connections,
+//     while active connections keep the outbound address they started with,
+//   - ports whose listen_host changed move to a new socket on the new
+//     address, keeping their counters; active connections continue.
+//
+// All new sockets are opened before anything else changes, so a failed
+// apply (e.g. a port already in use) leaves the running state untouched.
+// This includes moved ports: a move between overlapping addresses (to or
+// from all addresses) conflicts with the old socket and needs a restart.
+func (s *server) apply(cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shared, sharedChanged, err := s.sharedFor(cfg)
+	if err != nil {
+		return err
+	}
+
+	raiseFileLimit(cfg) // before the listening sockets
+	listeners := make(map[int]*listener, len(cfg.Proxies))
+	opened := make(map[int]*listenPort)
+	moved := make(map[int]bool) // opened on a new listen_host or with other acceptors
+	abort := func(err error) error {
+		for _, p := range opened {
+			p.close()
+		}
+		if shared.health != s.sharedHealth() {
+			shared.health.Stop()
+		}
+		if shared.tracer != s.sharedTracer() {
+			shared.tracer.Stop()
+		}
+		if s.cfg != nil {
+			closeAccessLogs(s.cfg) // those opened for cfg only
+		}
+		return err
+	}
+	for _, entry := range cfg.Proxies {
+		l, err := newListener(entry, shared)
+		if err != nil {
+			return abort(err)
+		}
+		listeners[entry.Port] = l
+		old, ok := s.ports[entry.Port]
+		if ok && old.host == entry.listenHost && len(old.lns) == entry.Acceptors {
+			continue
+		}
+		p, err := listenSOCKS(entry.listenHost, entry.Port, entry.Acceptors, entry.listenOptions())
+		if err != nil {
+			if ok && old.host != entry.listenHost {
+				return abort(fmt.Errorf("proxy :%d: moving to listen_host %q: %w (restart to move between overlapping addresses)", entry.Port, entry.listenHost, err))
+			}
+			if ok {
+				return abort(fmt.Errorf("proxy :%d: changing acceptors to %d: %w (restart to change to or from a single acceptor)", entry.Port, entry.Acceptors, err))
+			}
+			webhooks.notify(hookBindFailed, fmt.Sprintf("proxy :%s cannot listen: %v", entry.tag(), err),
+				map[string]any{"port": entry.Port, "name": entry.Name, "listen_host": entry.listenHost, "error": err.Error()})
+			return abort(fmt.Errorf("proxy :%d: %w", entry.Port, err))
+		}
+		if ok {
+			p.stats = old.stats
+			moved[entry.Port] = true
+		}
+		opened[entry.Port] = p
+	}
+
+	// Commit.
+	for port, p := range s.ports {
+		l, ok := listeners[port]
+		if !ok {
+			p.close()
+			delete(s.ports, port)
+			logInfo("[reload] :%s removed, active connections continue", p.current.Load().entry.tag())
+			continue
+		}
+		if moved[port] {
+			p.close() // replaced below
+			continue
+		}
+		if o := l.entry.listenOptions(); o != p.opts {
+			if err := p.setOptions(o); err != nil {
+				logWarn("[reload] :%s: listening socket: %v", l.entry.tag(), err)
+			}
+		}
+		if old := p.current.Load(); sharedChanged || !reflect.DeepEqual(old.entry, l.entry) {
+			p.current.Store(l)
+			p.resumeQueued()
+			if !reflect.DeepEqual(old.entry, l.entry) {
+				logInfo("[reload] :%s updated: %s", l.entry.tag(), entrySummary(l.entry))
+			}
+		}
+	}
+	for _, port := range sortedPorts(opened) {
+		p := opened[port]
+		p.current.Store(listeners[port])
+		old := s.ports[port]
+		s.ports[port] = p
+		switch {
+		case moved[port] && old.host == p.host:
+			logInfo("[reload] :%s reopened with %d acceptors, active connections continue", listeners[port].entry.tag(), len(p.lns))
+		case moved[port]:
+			logInfo("[reload] :%s moved: %s, active connections continue", listeners[port].entry.tag(), entrySummary(listeners[port].entry))
+		case s.cfg != nil:
+			logInfo("[reload] :%s added: %s", listeners[port].entry.tag(), entrySummary(listeners[port].entry))
+		}
+		go p.serve()
+	}
+
+	if shared.health != s.sharedHealth() {
+		s.sharedHealth().Stop()
+		if shared.health != nil {
+			go shared.health.Run()
+		}
+	}
+	if shared.tracer != s.sharedTracer() {
+		s.sharedTracer().Stop()
+		if shared.tracer != nil {
+			go shared.tracer.Run()
+		}
+	}
+	s.cfg, s.shared = cfg, shared
+	setEgressLimit(cfg)
+	setRelayConfig(cfg)
+	checkFastOpen(cfg)
+	checkMPTCP(cfg)
+	checkCongestion(cfg)
+	checkMark(cfg)
+	checkBacklog(cfg)
+	checkSocketBuffers(cfg)
+	checkFileLimit(cfg)
+	closeAccessLogs(cfg)
+	return nil
+}
+
+// sharedFor returns the process-wide state for cfg, reusing the running
+// caches when their settings are unchanged so reloads keep them warm.
+// changed reports whether listeners must be rebuilt to pick it up. It fails,
+// before anything is started, if a GeoIP database cannot be read.
+func (s *server) sharedFor(cfg *Config) (shared *proxyShared, changed bool, err error) {
+	old := s.shared
+	var oldGeo *geoIP
+	if old != nil {
+		oldGeo = old.geo
+	}
+	geo := oldGeo
+	if !oldGeo.same(cfg.GeoIP) {
+		if geo, err = loadGeoIP(cfg.GeoIP, oldGeo); err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	if old == nil {
+		shared = &proxyShared{
+			health:  newHealthChecker(cfg.HealthCheck, outboundEntries(cfg)), // nil when disabled
+			cache:   newDNSCache(cfg.DNSCache),                               // nil when disabled
+			fails:   newFailCache(cfg.FailCache),                             // nil when disabled
+			tracer:  newTracer(cfg.Tracing),                                  // nil when disabled
+			domains: newDomainStats(cfg.DomainStats),                         // nil when disabled
+			hosts:   parseHosts(cfg.Hosts),
+			clients: newClientPolicy(cfg.AllowClients, cfg.DenyClients),
+			geo:     geo,
+
+			upstreams: newUpstreams(cfg.Upstreams),
+
+			maxConns: cfg.MaxConnections,
+		}
+		if shared.users, err = newUserDirectory(cfg.Users, shared.health); err != nil {
+			return nil, false, err
+		}
+		return shared, true, nil
+	}
+
+	shared = &proxyShared{cache: old.cache, fails: old.fails, hosts: old.hosts, health: old.health, tracer: old.tracer, domains: old.domains, clients: old.clients, geo: geo, users: old.users, upstreams: old.upstreams, maxConns: cfg.MaxConnections}
+	if !reflect.DeepEqual(cfg.DNSCache, s.cfg.DNSCache) {
+		shared.cache, changed = newDNSCache(cfg.DNSCache), true
+	}
+	if !reflect.DeepEqual(cfg.FailCache, s.cfg.FailCache) {
+		shared.fails, changed = newFailCache(cfg.FailCache), true
+	}
+	if !reflect.DeepEqual(cfg.Tracing, s.cfg.Tracing) {
+		shared.tracer, changed = newTracer(cfg.Tracing), true
+	}
+	if !reflect.DeepEqual(cfg.DomainStats, s.cfg.DomainStats) {
+		shared.domains, changed = newDomainStats(cfg.DomainStats), true
+	}
+	if !reflect.DeepEqual(cfg.Hosts, s.cfg.Hosts) {
+		shared.hosts, changed = parseHosts(cfg.Hosts), true
+	}
+	if !reflect.DeepEqual(cfg.Upstreams, s.cfg.Upstreams) {
+		shared.upstreams, changed = newUpstreams(cfg.Upstreams), true
+	}
+	if cfg.MaxConnections != s.cfg.MaxConnections {
+		changed = true
+	}
+	if !reflect.DeepEqual(cfg.AllowClients, s.cfg.AllowClients) || !reflect.DeepEqual(cfg.DenyClients, s.cfg.DenyClients) {
+		shared.clients, changed = newClientPolicy(cfg.AllowClients, cfg.DenyClients), true
+	}
+	if !reflect.DeepEqual(cfg.HealthCheck, s.cfg.HealthCheck) || !sameOutbounds(outboundEntries(cfg), outboundEntries(s.cfg)) {
+		shared.health, changed = newHealthChecker(cfg.HealthCheck, outboundEntries(cfg)), true
+		shared.health.inherit(old.health)
+	}
+	if shared.health != old.health || !reflect.DeepEqual(cfg.Users, s.cfg.Users) {
+		if shared.users, err = newUserDirectory(cfg.Users, shared.health); err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	return shared, changed, nil
+}
+
+// health returns the running health checker (nil when disabled).
+func (s *server) health() *healthChecker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sharedHealth()
+}
+
+// sharedHealth returns the running health checker, if any; s.mu is held.
+func (s *server) sharedHealth() *healthChecker {
+	if s.shared == nil {
+		return nil
+	}
+	return s.shared.health
+}
+
+// users returns the running user accounts (nil without users).
+func (s *server) users() *userDirectory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shared == nil {
+		return nil
+	}
+	return s.shared.users
+}
+
+// domains returns the running domain accounting (nil when disabled).
+func (s *server) domains() *domainStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shared == nil {
+		return nil
+	}
+	return s.shared.domains
+}
+
+// sharedTracer returns the running tracer, if any; s.mu is held.
+func (s *server) sharedTracer() *tracer {
+	if s.shared == nil {
+		return nil
+	}
+	return s.shared.tracer
+}
+
+// stopTracing exports the traces of finished sessions before shutdown,
+// waiting up to timeout for the collector.
+func (s *server) stopTracing(timeout time.Duration) {
+	s.mu.Lock()
+	t := s.sharedTracer()
+	s.mu.Unlock()
+	t.Stop()
+	t.wait(timeout)
+}
+
+// sameOutbounds reports whether a and b use the same set of outbound addresses.
+func sameOutbounds(a, b []ProxyEntry) bool {
+	set := func(entries []ProxyEntry) map[string]struct{} {
+		m := make(map[string]struct{})
+		for _, e := range entries {
+			for _, out := range e.Outbound {
+				m[out.IPv6] = struct{}{}
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(set(a), set(b))
+}
+
+func sortedPorts(m map[int]*listenPort) []int {
+	ports := make([]int, 0, len(m))
+	for port := range m {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// config returns the running configuration.
+func (s *server) config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// unbound returns the ports of the running configuration that have no
+// listening socket.
+func (s *server) unbound() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg == nil {
+		return nil
+	}
+	var ports []int
+	for _, e := range s.cfg.Proxies {
+		if _, ok := s.ports[e.Port]; !ok {
+			ports = append(ports, e.Port)
+		}
+	}
+	return ports
+}
+
+// portStatus is the entry and counters of one open port.
+type portStatus struct {
+	entry ProxyEntry
+	stats *portStats
+}
+
+// status returns the open ports in port order.
+func (s *server) status() []portStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]portStatus, 0, len(s.ports))
+	for _, port := range sortedPorts(s.ports) {
+		p := s.ports[port]
+		out = append(out, portStatus{entry: p.current.Load().entry, stats: p.stats})
+	}
+	return out
+}
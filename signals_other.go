@@ -0,0 +1,11 @@
+// +build !unix
+
+package main
+
+import "os"
+
+// signalActions returns no actions: reopening the logs, rollbacks and
+// stepping the log level take Unix signals.
+func signalActions(ctl *controller) map[os.Signal]func() {
+	return nil
+}
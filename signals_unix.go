@@ -0,0 +1,21 @@
+// +build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalActions returns what the daemon does on the signals that neither
+// stop it nor reload it: SIGUSR1 reopens the logs (as ctl rotate), SIGUSR2
+// applies the version staged by ctl rollback, SIGTTIN and SIGTTOU make the
+// log more or less verbose.
+func signalActions(ctl *controller) map[os.Signal]func() {
+	return map[os.Signal]func(){
+		syscall.SIGUSR1: reopenLogs,
+		syscall.SIGUSR2: ctl.rollback,
+		syscall.SIGTTIN: func() { stepLogLevel(-1) },
+		syscall.SIGTTOU: func() { stepLogLevel(+1) },
+	}
+}
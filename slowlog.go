@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Slow session phases, as logged.
+const (
+	slowHandshake = "handshake"
+	slowDial      = "dial"
+	slowFirstByte = "first byte"
+)
+
+// stallCheckInterval is how often the kernel byte counters of relays are
+// read under slow_log.stall.
+const stallCheckInterval = time.Second
+
+// slowLog is the slow_log block of the running configuration (nil: off).
+var slowLog atomic.Pointer[SlowLogConfig]
+
+// stallWatch is the goroutine detecting stalled relays, running while
+// slow_log.stall is set.
+var stallWatch struct {
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// setSlowLog applies a validated slow_log block (nil: none), starting or
+// stopping stall detection.
+func setSlowLog(sc *SlowLogConfig) {
+	slowLog.Store(sc)
+	stallWatch.mu.Lock()
+	defer stallWatch.mu.Unlock()
+	running := stallWatch.stop != nil
+	if want := sc != nil && sc.Stall > 0; want == running {
+		return
+	}
+	if running {
+		close(stallWatch.stop)
+		<-stallWatch.done
+		stallWatch.stop, stallWatch.done = nil, nil
+		return
+	}
+	stallWatch.stop, stallWatch.done = make(chan struct{}), make(chan struct{})
+	go watchStalls(stallWatch.stop, stallWatch.done)
+}
+
+// slowThreshold returns the threshold of phase (0: not checked).
+func slowThreshold(phase string) time.Duration {
+	sc := slowLog.Load()
+	if sc == nil {
+		return 0
+	}
+	switch phase {
+	case slowHandshake:
+		return sc.Handshake
+	case slowDial:
+		return sc.Dial
+	case slowFirstByte:
+		return sc.FirstByte
+	}
+	return 0
+}
+
+// checkSlow logs, at warning level and sampled, a phase of a session to
+// host:port that took d, if that exceeds its slow_log threshold. outbound
+// may be nil; err is the error the phase ended with, if any.
+func (l *listener) checkSlow(phase string, d time.Duration, client net.Conn, host string, port uint16, outbound net.IP, err error) {
+	threshold := slowThreshold(phase)
+	if threshold <= 0 || d < threshold {
+		return
+	}
+	tag := l.entry.tag()
+	if !logSampling.allow(sampleSlow, tag, levelWarn) {
+		return
+	}
+	fields := []slog.Attr{
+		slog.String("client", client.RemoteAddr().String()),
+		slog.String("target", net.JoinHostPort(host, strconv.Itoa(int(port)))),
+	}
+	if outbound != nil {
+		fields = append(fields, slog.String("outbound_ip", outbound.String()))
+	}
+	fields = append(fields, slog.Float64("duration_ms", millis(d)), slog.Float64("threshold_ms", millis(threshold)))
+	if err != nil {
+		fields = append(fields, slog.String("error", err.Error()))
+	}
+	logEvent(levelWarn, "[socks5:"+tag+"] slow "+phase, fields...)
+}
+
+// watchStalls logs relays whose target stays silent for slow_log.stall
+// after data was sent to it, and again when such a relay resumes. It reads
+// the kernel's TCP_INFO of the target socket, so it works on Linux only.
+func watchStalls(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	stalled := make(map[uint64]time.Time) // relays logged as stalled, by id: since when
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sc := slowLog.Load()
+		if sc == nil || sc.Stall <= 0 {
+			continue
+		}
+		now := time.Now()
+		live := activeConns.snapshot()
+		alive := make(map[uint64]bool, len(live))
+		for _, c := range live {
+			alive[c.id] = true
+			sent, received, ok := connIdle(c.remote)
+			if !ok {
+				continue
+			}
+			since, logged := stalled[c.id]
+			switch {
+			case sent < received && sent >= sc.Stall && !logged:
+				// Data went to the target after its last data, and that
+				// was long ago
+				stalled[c.id] = now.Add(-sent)
+				logStall(c, "relay stalled", sent)
+			case received < sent && logged:
+				delete(stalled, c.id)
+				logStall(c, "relay resumed", now.Add(-received).Sub(since))
+			}
+		}
+		for id := range stalled {
+			if !alive[id] {
+				delete(stalled, id)
+			}
+		}
+	}
+}
+
+// logStall logs a stalled or resumed relay, and how long the target was
+// silent.
+func logStall(c liveConn, msg string, silent time.Duration) {
+	tag := ProxyEntry{Port: c.port, Name: c.name}.tag()
+	if !logSampling.allow(sampleSlow, tag, levelWarn) {
+		return
+	}
+	outbound := c.outbound.String()
+	if ta, ok := c.outbound.(*net.TCPAddr); ok {
+		outbound = ta.IP.String()
+	}
+	logEvent(levelWarn, "[socks5:"+tag+"] "+msg,
+		slog.String("client", c.conn.RemoteAddr().String()),
+		slog.String("target", net.JoinHostPort(c.host, strconv.Itoa(int(c.dport)))),
+		slog.String("outbound_ip", outbound),
+		slog.Float64("silent_ms", millis(silent.Round(time.Millisecond))))
+}
+
+// validateSlowLog validates the slow_log block.
+func validateSlowLog(sc *SlowLogConfig) error {
+	if sc.Handshake < 0 || sc.Dial < 0 || sc.FirstByte < 0 || sc.Stall < 0 {
+		return fmt.Errorf("config: slow_log: values must not be negative")
+	}
+	if sc.Handshake == 0 && sc.Dial == 0 && sc.FirstByte == 0 && sc.Stall == 0 {
+		return fmt.Errorf("config: slow_log: set at least one of handshake, dial, first_byte and stall")
+	}
+	if sc.Stall > 0 && sc.Stall < 2*stallCheckInterval {
+		return fmt.Errorf("config: slow_log: stall must be at least %s, got %s", 2*stallCheckInterval, sc.Stall)
+	}
+	return nil
+}
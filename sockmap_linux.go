@@ -0,0 +1,624 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/bpf.h.
+const (
+	bpfFuncMapLookupElem   = 1
+	bpfFuncGetSocketCookie = 46
+	bpfFuncSkRedirectMap   = 52
+
+	skDrop = 0
+	skPass = 1
+)
+
+// From linux/tcp_states.h.
+const (
+	tcpEstablished = 1
+	tcpCloseWait   = 8
+)
+
+// sockmapCredit bounds how many bytes a direction may redirect to its
+// destination beyond what the process saw it take. The kernel queues
+// redirected data that does not fit the destination's send buffer without
+// limit, and in order with what the program passes on to the destination's
+// own reader, so a direction only gets as much as fits.
+const sockmapCredit = 1 << 20
+
+// Intervals at which a relay checks on what its destination took of the
+// data redirected to it: the shortest and longest while waiting for it to
+// take all of it, and the longest between grants while the relay is idle.
+const (
+	sockmapMinPoll  = time.Millisecond
+	sockmapMaxPoll  = 20 * time.Millisecond
+	sockmapIdlePoll = time.Second
+)
+
+// sockmapPeer is a value of the peers map, keyed by the cookie of a socket.
+// The program adds to its counters.
+type sockmapPeer struct {
+	index  uint32 // of the socket's peer in the out map
+	_      uint32
+	bytes  uint64 // redirected to the peer
+	passed uint64 // passed on to the process instead
+}
+
+// sockmapGrant is a value of the grants map, keyed by the cookie of a
+// socket, which only the process writes.
+type sockmapGrant struct {
+	limit    uint64 // of sockmapPeer.bytes
+	consumed uint64 // of sockmapPeer.passed, the bytes the process relayed
+}
+
+// sockmap relays connections in the kernel: a stream verdict program
+// attached to the in map redirects what a socket in it receives to its peer
+// in the out map, which it finds in the peers map by the socket's cookie.
+// Past the limit the grants map sets, and until the process relayed what
+// was passed on to it, the program passes data on to the socket's own
+// queue instead, where it counts against the receive buffer and so closes
+// the TCP window, and the process relays it and grants more. Each relay
+// holds a pair of slots in both maps, the client's and the one after it,
+// the target's.
+type sockmap struct {
+	in, out, peers, grants, prog int
+	entries                      int // relays at once
+
+	mu     sync.Mutex
+	free   []uint32 // slots of the client sockets of free pairs
+	active int
+}
+
+// newSockmap sets up the maps and the program for entries relays at once.
+// It needs Linux 5.10 or later, where the verdict program works without a
+// stream parser, and CAP_BPF and CAP_NET_ADMIN (or root).
+func newSockmap(entries int) (*sockmap, error) {
+	m := &sockmap{in: -1, out: -1, peers: -1, grants: -1, prog: -1, entries: entries}
+	for _, spec := range []struct {
+		fd                     *int
+		typ, key, value, count int
+	}{
+		{&m.in, unix.BPF_MAP_TYPE_SOCKMAP, 4, 4, 2 * entries},
+		{&m.out, unix.BPF_MAP_TYPE_SOCKMAP, 4, 4, 2 * entries},
+		{&m.peers, unix.BPF_MAP_TYPE_HASH, 8, int(unsafe.Sizeof(sockmapPeer{})), 2 * entries},
+		{&m.grants, unix.BPF_MAP_TYPE_HASH, 8, int(unsafe.Sizeof(sockmapGrant{})), 2 * entries},
+	} {
+		fd, err := bpfMapCreate(spec.typ, spec.key, spec.value, spec.count)
+		if err != nil {
+			m.closeFDs()
+			if errors.Is(err, unix.EPERM) {
+				return nil, errors.New("creating the maps: not permitted (needs CAP_BPF and CAP_NET_ADMIN)")
+			}
+			return nil, fmt.Errorf("creating the maps: %w", err)
+		}
+		*spec.fd = fd
+	}
+	var err error
+	if m.prog, err = bpfProgLoad(unix.BPF_PROG_TYPE_SK_SKB, verdictProgram(m.peers, m.grants, m.out)); err != nil {
+		m.closeFDs()
+		return nil, fmt.Errorf("loading the verdict program: %w", err)
+	}
+	if err := bpfProgAttach(m.prog, m.in, unix.BPF_SK_SKB_STREAM_VERDICT); err != nil {
+		m.closeFDs()
+		return nil, fmt.Errorf("attaching the verdict program: %w", err)
+	}
+	m.free = make([]uint32, entries)
+	for i := range m.free {
+		m.free[i] = uint32(2 * (entries - 1 - i)) // the lowest first
+	}
+	return m, nil
+}
+
+func (m *sockmap) closeFDs() {
+	for _, fd := range []int{m.prog, m.grants, m.peers, m.out, m.in} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// relays returns the number of relays holding a pair of slots.
+func (m *sockmap) relays() int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// verdictProgram returns the stream verdict program:
+//
+//	cookie = bpf_get_socket_cookie(skb)
+//	peer = bpf_map_lookup_elem(peers, &cookie)
+//	grant = bpf_map_lookup_elem(grants, &cookie)
+//	if peer == NULL || grant == NULL:
+//		return SK_PASS
+//	if skb->len == 0:
+//		return SK_DROP
+//	if peer->passed > grant->consumed || peer->bytes+skb->len > grant->limit:
+//		peer->passed += skb->len  (atomically)
+//		return SK_PASS
+//	peer->bytes += skb->len  (atomically)
+//	return bpf_sk_redirect_map(skb, out, peer->index, 0)
+//
+// An empty skb carries the FIN, which the socket already took, so the
+// process sees the end of the stream; queued behind redirected data for
+// the socket, the kernel would fail it as a broken pipe.
+func verdictProgram(peers, grants, out int) []bpfInsn {
+	const (
+		mov64X   = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X
+		mov64K   = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+		add64X   = 0x0f // BPF_ALU64 | BPF_ADD | BPF_X
+		add64K   = 0x07 // BPF_ALU64 | BPF_ADD | BPF_K
+		ldImm64  = 0x18 // BPF_LD | BPF_DW | BPF_IMM
+		ldxW     = 0x61 // BPF_LDX | BPF_MEM | BPF_W
+		ldxDW    = 0x79 // BPF_LDX | BPF_MEM | BPF_DW
+		stxDW    = 0x7b // BPF_STX | BPF_MEM | BPF_DW
+		atomicDW = 0xdb // BPF_STX | BPF_ATOMIC | BPF_DW, an add with imm 0
+		jeqK     = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+		jgtX     = 0x2d // BPF_JMP | BPF_JGT | BPF_X
+		call     = 0x85 // BPF_JMP | BPF_CALL
+		exit     = 0x95 // BPF_JMP | BPF_EXIT
+	)
+	ldMap := func(dst uint8, fd int) []bpfInsn {
+		return []bpfInsn{insn(ldImm64, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd)), {}}
+	}
+	lookup := func(fd int) []bpfInsn { // of the cookie on the stack, into r0
+		p := []bpfInsn{insn(mov64X, 2, 10, 0, 0), insn(add64K, 2, 0, 0, -8)}
+		p = append(p, ldMap(1, fd)...)
+		return append(p, insn(call, 0, 0, 0, bpfFuncMapLookupElem))
+	}
+	var p []bpfInsn
+	p = append(p,
+		insn(mov64X, 6, 1, 0, 0), // r6 = skb
+		insn(call, 0, 0, 0, bpfFuncGetSocketCookie),
+		insn(stxDW, 10, 0, -8, 0))
+	p = append(p, lookup(peers)...)
+	p = append(p,
+		insn(jeqK, 0, 0, 25, 0),  // 8: to pass
+		insn(mov64X, 7, 0, 0, 0)) // r7 = peer
+	p = append(p, lookup(grants)...) // r0 = grant
+	p = append(p,
+		insn(jeqK, 0, 0, 18, 0), // 15: to pass
+		insn(ldxW, 1, 6, 0, 0),  // r1 = skb->len
+		insn(jeqK, 1, 0, 18, 0), // 17: to drop
+		insn(ldxDW, 2, 7, 16, 0),
+		insn(ldxDW, 3, 0, 8, 0),
+		insn(jgtX, 2, 3, 12, 0), // 20: to passing
+		insn(ldxDW, 2, 7, 8, 0),
+		insn(add64X, 2, 1, 0, 0),
+		insn(ldxDW, 3, 0, 0, 0),
+		insn(jgtX, 2, 3, 8, 0), // 24: to passing
+		insn(atomicDW, 7, 1, 8, 0),
+		insn(ldxW, 3, 7, 0, 0),
+		insn(mov64X, 1, 6, 0, 0))
+	p = append(p, ldMap(2, out)...)
+	return append(p,
+		insn(mov64K, 4, 0, 0, 0),
+		insn(call, 0, 0, 0, bpfFuncSkRedirectMap),
+		insn(exit, 0, 0, 0, 0),
+		insn(atomicDW, 7, 1, 16, 0),   // 33: passing
+		insn(mov64K, 0, 0, 0, skPass), // 34: pass
+		insn(exit, 0, 0, 0, 0),
+		insn(mov64K, 0, 0, 0, skDrop), // 36: drop
+		insn(exit, 0, 0, 0, 0))
+}
+
+// bpfInsn is an instruction of a BPF program.
+type bpfInsn struct {
+	code uint8
+	regs uint8 // destination in the low nibble, source in the high one
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+type bpfMapCreateAttr struct {
+	mapType, keySize, valueSize, maxEntries, mapFlags uint32
+}
+
+type bpfMapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType, insnCnt uint32
+	insns, license    uint64
+	logLevel, logSize uint32
+	logBuf            uint64
+	kernVersion       uint32
+	progFlags         uint32
+}
+
+type bpfProgAttachAttr struct {
+	targetFD, attachBPFFD, attachType, attachFlags uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+func bpfMapCreate(typ, keySize, valueSize, entries int) (int, error) {
+	attr := bpfMapCreateAttr{mapType: uint32(typ), keySize: uint32(keySize), valueSize: uint32(valueSize), maxEntries: uint32(entries)}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfProgLoad(typ int, prog []bpfInsn) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	attr := bpfProgLoadAttr{
+		progType: uint32(typ),
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	return fd, err
+}
+
+func bpfProgAttach(prog, target, typ int) error {
+	attr := bpfProgAttachAttr{targetFD: uint32(target), attachBPFFD: uint32(prog), attachType: uint32(typ)}
+	_, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// bpfMapElem runs the element command cmd on the map fd.
+func bpfMapElem(cmd, fd int, key, value unsafe.Pointer) error {
+	attr := bpfMapElemAttr{mapFD: uint32(fd), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// setSock puts the socket of c into slot of the sockmap fd.
+func setSock(fd int, slot uint32, c *net.TCPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var uerr error
+	if err := rc.Control(func(s uintptr) {
+		sock := uint32(s)
+		uerr = bpfMapElem(unix.BPF_MAP_UPDATE_ELEM, fd, unsafe.Pointer(&slot), unsafe.Pointer(&sock))
+	}); err != nil {
+		return err
+	}
+	return uerr
+}
+
+func clearSlot(fd int, slot uint32) {
+	bpfMapElem(unix.BPF_MAP_DELETE_ELEM, fd, unsafe.Pointer(&slot), nil)
+}
+
+// sockPair is a relay holding a pair of slots of the sockmap: its client
+// socket and its target socket are in the out map, each with the other's
+// slot in the peers map. A direction is forwarded in the kernel once its
+// source is in the in map as well.
+type sockPair struct {
+	m       *sockmap
+	slot    uint32 // the client's; the target's is the next one
+	conns   [2]*net.TCPConn
+	cookies [2]uint64
+}
+
+// pair takes a pair of slots for a relay between client and remote, or
+// returns nil, for the caller to relay another way, if they are not both
+// TCP connections or all slots are taken.
+func (m *sockmap) pair(client, remote net.Conn) *sockPair {
+	c, isTCP := client.(*net.TCPConn)
+	r, remoteTCP := remote.(*net.TCPConn)
+	if m == nil || !isTCP || !remoteTCP {
+		return nil
+	}
+	p := &sockPair{m: m, conns: [2]*net.TCPConn{c, r}}
+	for i, conn := range p.conns {
+		var err error
+		if p.cookies[i], err = socketCookie(conn); err != nil {
+			return nil
+		}
+	}
+	m.mu.Lock()
+	n := len(m.free)
+	if n == 0 {
+		m.mu.Unlock()
+		logDebug("[relay] all %d sockmap slots taken, relaying %s in userspace", m.entries, client.RemoteAddr())
+		return nil
+	}
+	p.slot = m.free[n-1]
+	m.free = m.free[:n-1]
+	m.active++
+	m.mu.Unlock()
+
+	for i, conn := range p.conns {
+		peer := sockmapPeer{index: p.slot + uint32(1-i)}
+		err := setSock(m.out, p.slot+uint32(i), conn)
+		if err == nil {
+			err = bpfMapElem(unix.BPF_MAP_UPDATE_ELEM, m.peers, unsafe.Pointer(&p.cookies[i]), unsafe.Pointer(&peer))
+		}
+		if err == nil {
+			err = p.grant(i, sockmapGrant{limit: uint64(sendRoom(p.conns[1-i]))})
+		}
+		if err != nil {
+			logDebug("[relay] sockmap: %v, relaying %s in userspace", err, client.RemoteAddr())
+			p.close()
+			return nil
+		}
+	}
+	return p
+}
+
+// copy forwards what src receives to dst in the kernel until src reaches
+// its end, relaying what the program passes on, then waits for dst to have
+// taken all of it, and returns the number of bytes forwarded and how many
+// of them the kernel moved without the process. ok is false, with nothing
+// forwarded, if src could not join the in map, for the caller to copy
+// another way. A nil pair forwards nothing.
+func (p *sockPair) copy(dst, src net.Conn, bufs *relayBufs) (n, inKernel int64, ok bool) {
+	if p == nil {
+		return 0, 0, false
+	}
+	f := &sockFlow{p: p, dst: dst}
+	if src == net.Conn(p.conns[1]) {
+		f.i = 1
+	}
+	var open bool
+	if f.base, open = bytesWritten(dst); !open {
+		return 0, 0, false
+	}
+	conn := p.conns[f.i]
+	if setSock(p.m.in, p.slot+uint32(f.i), conn) != nil {
+		return 0, 0, false
+	}
+	// The program only sees the data src received before once more
+	// arrives; setting SO_RCVLOWAT signals the socket readable if it holds
+	// any, which runs it.
+	sockOpt(conn, unix.SOL_SOCKET, unix.SO_RCVLOWAT, 1)
+
+	f.relayPassed(bufs)
+	f.drain()
+	inKernel = int64(p.peer(f.i).bytes)
+	return f.user + inKernel, inKernel, true
+}
+
+// sockFlow is a direction of a sockPair, from side i to dst.
+type sockFlow struct {
+	p       *sockPair
+	i       int
+	dst     net.Conn
+	base    int64  // bytes written to dst before the direction started
+	user    int64  // bytes the process relayed
+	drained uint64 // redirected bytes dst took at the last drain
+}
+
+// relayPassed grants the direction what fits dst's send buffer beyond
+// what dst took, at intervals that follow the rate of the relay and grow
+// while it is idle, and relays what the program passes on to the process
+// until the source reaches its end, each read after dst took all that was
+// redirected before it. While that waits, the passed data fills the
+// source's receive buffer, which holds the sender back. The kernel may
+// still be queueing passed data for the source once it reads the FIN,
+// which it reports as the end of the stream, so that is only taken as one
+// once the process got all of it.
+func (f *sockFlow) relayPassed(bufs *relayBufs) {
+	src := f.p.conns[f.i]
+	defer src.SetReadDeadline(time.Time{})
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	delay, last := sockmapMinPoll, uint64(0)
+	for {
+		src.SetReadDeadline(time.Now().Add(delay))
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !f.drain() {
+				return
+			}
+			if _, err := f.dst.Write(buf[:n]); err != nil {
+				return
+			}
+			f.user += int64(n)
+			if !f.regrant() {
+				return
+			}
+		}
+		peer := f.p.peer(f.i)
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if !f.regrant() {
+				return
+			}
+			if peer.bytes != last {
+				delay = max(delay/2, sockmapMinPoll)
+			} else {
+				delay = min(2*delay, sockmapIdlePoll)
+			}
+			last = peer.bytes
+		case err == io.EOF && peer.passed > uint64(f.user):
+			if _, open := bytesWritten(f.dst); !open {
+				return
+			}
+			time.Sleep(sockmapMinPoll)
+		case err != nil:
+			return
+		}
+	}
+}
+
+// regrant lets the direction redirect what fits dst's send buffer beyond
+// the data dst took, and reports whether dst can still send.
+func (f *sockFlow) regrant() bool {
+	written, open := bytesWritten(f.dst)
+	if !open {
+		return false
+	}
+	taken := max(written-f.base-f.user, 0)
+	grant := sockmapGrant{limit: uint64(taken + sendRoom(f.dst)), consumed: uint64(f.user)}
+	return f.p.grant(f.i, grant) == nil
+}
+
+// drain waits until dst took all that was redirected to it, unless nothing
+// was since the last time, or it can no longer send, and reports whether it
+// can.
+func (f *sockFlow) drain() bool {
+	bytes := f.p.peer(f.i).bytes
+	if bytes == f.drained {
+		return true
+	}
+	for delay := sockmapMinPoll; ; delay = min(2*delay, sockmapMaxPoll) {
+		written, open := bytesWritten(f.dst)
+		if !open {
+			return false
+		}
+		if written >= f.base+f.user+int64(bytes) {
+			f.drained = bytes
+			return true
+		}
+		time.Sleep(delay)
+	}
+}
+
+// peer returns the counters of side i.
+func (p *sockPair) peer(i int) sockmapPeer {
+	var peer sockmapPeer
+	bpfMapElem(unix.BPF_MAP_LOOKUP_ELEM, p.m.peers, unsafe.Pointer(&p.cookies[i]), unsafe.Pointer(&peer))
+	return peer
+}
+
+// grant replaces the grant of side i.
+func (p *sockPair) grant(i int, g sockmapGrant) error {
+	return bpfMapElem(unix.BPF_MAP_UPDATE_ELEM, p.m.grants, unsafe.Pointer(&p.cookies[i]), unsafe.Pointer(&g))
+}
+
+// close drops the cookies of the sockets, so the program passes on
+// whatever they receive, takes them out of the maps and frees the pair's
+// slots. A nil pair does nothing.
+func (p *sockPair) close() {
+	if p == nil {
+		return
+	}
+	m := p.m
+	for i := range p.conns {
+		bpfMapElem(unix.BPF_MAP_DELETE_ELEM, m.peers, unsafe.Pointer(&p.cookies[i]), nil)
+		bpfMapElem(unix.BPF_MAP_DELETE_ELEM, m.grants, unsafe.Pointer(&p.cookies[i]), nil)
+	}
+	for i := range p.conns {
+		clearSlot(m.in, p.slot+uint32(i))
+		clearSlot(m.out, p.slot+uint32(i))
+	}
+	m.mu.Lock()
+	m.free = append(m.free, p.slot)
+	m.active--
+	m.mu.Unlock()
+}
+
+// socketCookie returns the cookie the kernel identifies the socket of c by.
+func socketCookie(c *net.TCPConn) (uint64, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cookie uint64
+	var errno unix.Errno
+	if err := rc.Control(func(s uintptr) {
+		size := uint32(unsafe.Sizeof(cookie))
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, s, unix.SOL_SOCKET, unix.SO_COOKIE, uintptr(unsafe.Pointer(&cookie)), uintptr(unsafe.Pointer(&size)), 0)
+	}); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return cookie, nil
+}
+
+// sockOpt sets the integer socket option level/opt of c to v.
+func sockOpt(c *net.TCPConn, level, opt, v int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(s uintptr) {
+		serr = unix.SetsockoptInt(int(s), level, opt, v)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// bytesWritten returns the bytes written to the connection c so far, those
+// its peer acknowledged and those still queued, and whether c can still
+// send: it is open and has not been shut down for writing.
+func bytesWritten(c net.Conn) (int64, bool) {
+	tc, isTCP := c.(*net.TCPConn)
+	if !isTCP {
+		return 0, false
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var info *unix.TCPInfo
+	queued := 0
+	var serr error
+	if err := rc.Control(func(s uintptr) {
+		if info, serr = unix.GetsockoptTCPInfo(int(s), unix.IPPROTO_TCP, unix.TCP_INFO); serr == nil {
+			queued, serr = unix.IoctlGetInt(int(s), unix.SIOCOUTQ)
+		}
+	}); err != nil || serr != nil {
+		return 0, false
+	}
+	if info.State != tcpEstablished && info.State != tcpCloseWait {
+		return 0, false
+	}
+	return int64(info.Bytes_acked) + int64(queued), true
+}
+
+// sendRoom returns how many bytes fit the send buffer of the connection c
+// now, at most sockmapCredit. Half the buffer is taken for the kernel's
+// overhead, as for SO_SNDBUF.
+func sendRoom(c net.Conn) int64 {
+	tc, isTCP := c.(*net.TCPConn)
+	if !isTCP {
+		return 0
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var size, queued int
+	var serr error
+	if err := rc.Control(func(s uintptr) {
+		if size, serr = unix.GetsockoptInt(int(s), unix.SOL_SOCKET, unix.SO_SNDBUF); serr == nil {
+			queued, serr = unix.IoctlGetInt(int(s), unix.SIOCOUTQ)
+		}
+	}); err != nil || serr != nil {
+		return 0
+	}
+	return min(max(int64(size/2-queued), 0), sockmapCredit)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// socketOptions holds the per-entry options applied to outbound sockets by
+// setSocketOptions. The zero value applies only the built-in TCP tuning,
+// without keepalive.
+type socketOptions struct {
+	// BindDevice, if set, pins the socket to a network interface
+	// (SO_BINDTODEVICE) regardless of the routing table.
+	BindDevice string
+
+	// Mark, if set, is the firewall mark of the socket (SO_MARK), which ip
+	// rules and netfilter can route and filter its packets by.
+	Mark uint32
+
+	// KeepAlive is the keepalive of the socket.
+	KeepAlive KeepAliveConfig
+
+	// Congestion is the TCP congestion control algorithm of the socket, and
+	// of the client's (TCP_CONGESTION; "": the system default).
+	Congestion string
+
+	// DSCP is the Differentiated Services code point of the socket's
+	// packets, and of the client's (IP_TOS and IPV6_TCLASS; 0: unmarked).
+	DSCP int
+
+	// FastOpenConnect sends the first data in the SYN to targets whose
+	// cookie the kernel holds (TCP_FASTOPEN_CONNECT).
+	FastOpenConnect bool
+
+	// SendBuffer and ReceiveBuffer, if set, size the socket's buffers
+	// (SO_SNDBUF, SO_RCVBUF) in place of the kernel's autotuning.
+	SendBuffer, ReceiveBuffer int
+}
+
+// socketOptions returns the outbound socket options configured for e.
+func (e ProxyEntry) socketOptions() socketOptions {
+	o := socketOptions{
+		BindDevice:      e.BindDevice,
+		Mark:            e.Mark,
+		KeepAlive:       e.keepAlive(),
+		Congestion:      e.Congestion,
+		DSCP:            e.dscp,
+		FastOpenConnect: e.FastOpen != nil && e.FastOpen.Connect,
+	}
+	_, target := e.socketBuffers()
+	o.SendBuffer, o.ReceiveBuffer = target.send, target.receive
+	return o
+}
+
+// dialerKeepAlive returns the net.Dialer.KeepAlive for the options: -1
+// where setSocketOptions sets keepalive itself, which the dialer would
+// otherwise override once connected.
+func (o socketOptions) dialerKeepAlive() time.Duration {
+	if controlsKeepAlive || o.KeepAlive.Disable {
+		return -1
+	}
+	return o.KeepAlive.Idle
+}
+
+// defaultFastOpenQueue is the fast_open.queue of listeners with
+// fast_open.listen.
+const defaultFastOpenQueue = 256
+
+// validateFastOpen validates a fast_open block.
+func validateFastOpen(f *FastOpenConfig) error {
+	switch {
+	case f.Queue < 0:
+		return fmt.Errorf("queue %d must not be negative", f.Queue)
+	case f.Queue > 0 && !f.Listen:
+		return fmt.Errorf("queue is only used with listen")
+	case f.Listen && f.Queue == 0:
+		f.Queue = defaultFastOpenQueue
+	}
+	return nil
+}
+
+// maxDeferAccept bounds accept.defer.
+const maxDeferAccept = time.Hour
+
+// validateAccept validates an accept block.
+func validateAccept(a *AcceptConfig) error {
+	if a.Backlog < 0 || a.Backlog > math.MaxInt32 {
+		return fmt.Errorf("backlog %d out of range (1-%d)", a.Backlog, math.MaxInt32)
+	}
+	if a.Defer < 0 || a.Defer > maxDeferAccept || a.Defer%time.Second != 0 {
+		return fmt.Errorf("defer %s must be whole seconds of 1s-%s", a.Defer, maxDeferAccept)
+	}
+	return nil
+}
+
+// Bounds of the socket_buffers sizes. The kernel doubles a size, which
+// must still fit its int.
+const (
+	minSocketBuffer = 4 << 10
+	maxSocketBuffer = 1 << 30
+)
+
+// validateSocketBuffers validates a socket_buffers block.
+func validateSocketBuffers(b *SocketBuffersConfig) error {
+	if b.Client != nil {
+		if err := validateSocketBufferSizes(b.Client); err != nil {
+			return fmt.Errorf("client.%w", err)
+		}
+	}
+	if b.Target != nil {
+		if err := validateSocketBufferSizes(b.Target); err != nil {
+			return fmt.Errorf("target.%w", err)
+		}
+	}
+	return nil
+}
+
+// validateSocketBufferSizes parses the sizes of one side of socket_buffers.
+func validateSocketBufferSizes(s *SocketBufferSizes) error {
+	var err error
+	if s.send, err = parseSocketBuffer("send", s.Send); err != nil {
+		return err
+	}
+	s.receive, err = parseSocketBuffer("receive", s.Receive)
+	return err
+}
+
+// parseSocketBuffer parses the socket buffer size s of the option name
+// ("": 0, autotuned).
+func parseSocketBuffer(name, s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if n < minSocketBuffer || n > maxSocketBuffer {
+		return 0, fmt.Errorf("%s %s out of range (4KiB-1GiB)", name, s)
+	}
+	return int(n), nil
+}
+
+// socketBuffers returns the client and target buffer sizes of e, zero
+// where unset.
+func (e ProxyEntry) socketBuffers() (client, target SocketBufferSizes) {
+	if b := e.SocketBuffers; b != nil {
+		if b.Client != nil {
+			client = *b.Client
+		}
+		if b.Target != nil {
+			target = *b.Target
+		}
+	}
+	return client, target
+}
+
+// checkSocketBuffers warns about socket_buffers sizes above
+// net.core.wmem_max and net.core.rmem_max, to which the kernel caps them.
+func checkSocketBuffers(cfg *Config) {
+	wmem, wok := sysctlInt("net.core.wmem_max")
+	rmem, rok := sysctlInt("net.core.rmem_max")
+	if !wok || !rok {
+		return
+	}
+	for _, p := range cfg.Proxies {
+		client, target := p.socketBuffers()
+		for i, s := range []SocketBufferSizes{client, target} {
+			side := [...]string{"client", "target"}[i]
+			if s.send > wmem {
+				logWarn("[main] port %s: socket_buffers.%s.send %s is capped at net.core.wmem_max (%d); raise the sysctl for a larger buffer", p.tag(), side, s.Send, wmem)
+			}
+			if s.receive > rmem {
+				logWarn("[main] port %s: socket_buffers.%s.receive %s is capped at net.core.rmem_max (%d); raise the sysctl for a larger buffer", p.tag(), side, s.Receive, rmem)
+			}
+		}
+	}
+}
+
+// listenOptions are the options of an entry's listening sockets, of which
+// a reload changes those that differ.
+type listenOptions struct {
+	fastOpen    int           // TCP Fast Open queue (0: off)
+	backlog     int           // accept queue length (0: the runtime's, net.core.somaxconn)
+	deferAccept time.Duration // hold connections until data arrives, at most this long (0: off)
+	sendBuffer  int           // SO_SNDBUF accepted connections inherit (0: autotuned)
+	recvBuffer  int           // SO_RCVBUF, likewise
+}
+
+// listenOptions returns the options of e's listening sockets.
+func (e ProxyEntry) listenOptions() listenOptions {
+	client, _ := e.socketBuffers()
+	o := listenOptions{fastOpen: e.fastOpenQueue(), sendBuffer: client.send, recvBuffer: client.receive}
+	if e.Accept != nil {
+		o.backlog, o.deferAccept = e.Accept.Backlog, e.Accept.Defer
+	}
+	return o
+}
+
+// checkBacklog warns about accept.backlog values above net.core.somaxconn,
+// to which the kernel truncates them.
+func checkBacklog(cfg *Config) {
+	somaxconn, ok := sysctlInt("net.core.somaxconn")
+	if !ok {
+		return
+	}
+	for _, p := range cfg.Proxies {
+		if p.Accept != nil && p.Accept.Backlog > somaxconn {
+			logWarn("[main] port %s: accept.backlog %d is capped at net.core.somaxconn (%d); raise the sysctl for a longer queue", p.tag(), p.Accept.Backlog, somaxconn)
+		}
+	}
+}
+
+// fastOpenQueue returns the TCP Fast Open queue of e's listening sockets
+// (0: fast open off).
+func (e ProxyEntry) fastOpenQueue() int {
+	if e.FastOpen == nil || !e.FastOpen.Listen {
+		return 0
+	}
+	return e.FastOpen.Queue
+}
+
+// checkFastOpen warns about entries using TCP Fast Open in a way the
+// net.ipv4.tcp_fastopen sysctl (which covers IPv6 too) turns off.
+func checkFastOpen(cfg *Config) {
+	mode, ok := sysctlInt("net.ipv4.tcp_fastopen") // 0x1: for connections made, 0x2: accepted
+	if !ok {
+		return
+	}
+	var listen, connect bool
+	for _, p := range cfg.Proxies {
+		listen = listen || p.fastOpenQueue() > 0
+		connect = connect || p.FastOpen != nil && p.FastOpen.Connect
+	}
+	if listen && mode&0x2 == 0 {
+		logWarn("[main] fast_open.listen: net.ipv4.tcp_fastopen is %d, which refuses data in SYNs; set it to 3", mode)
+	}
+	if connect && mode&0x1 == 0 {
+		logWarn("[main] fast_open.connect: net.ipv4.tcp_fastopen is %d, which sends no data in SYNs; set it to 1 or 3", mode)
+	}
+}
+
+// checkMPTCP warns if entries dial with mptcp while the kernel creates no
+// Multipath TCP sockets, so they dial plain TCP.
+func checkMPTCP(cfg *Config) {
+	for _, p := range cfg.Proxies {
+		if !p.MPTCP {
+			continue
+		}
+		if on, ok := sysctlInt("net.mptcp.enabled"); !ok || on == 0 {
+			logWarn("[main] mptcp: the kernel provides no Multipath TCP (net.mptcp.enabled, Linux 5.6+); dialing plain TCP")
+		}
+		return
+	}
+}
+
+// validCongestion reports whether name can be a congestion control
+// algorithm: the kernel's names are short, lower-case identifiers.
+func validCongestion(name string) bool {
+	if name == "" || len(name) > 15 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCongestion warns about congestion control algorithms entries set
+// that the kernel refuses, whose connections keep the system default.
+func checkCongestion(cfg *Config) {
+	checked := make(map[string]bool)
+	for _, p := range cfg.Proxies {
+		if p.Congestion == "" || checked[p.Congestion] {
+			continue
+		}
+		checked[p.Congestion] = true
+		if err := probeCongestion(p.Congestion); err != nil {
+			logWarn("[main] congestion %s: %v; connections keep the system default", p.Congestion, err)
+		}
+	}
+}
+
+// dscpNames are the code points of RFC 4594 and RFC 8622 by name.
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1, "default": 0,
+}
+
+// parseDSCP parses a code point given by name or as a number 0-63.
+func parseDSCP(s string) (int, error) {
+	if v, ok := dscpNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("invalid code point %q (a name such as ef, af41 or cs1, or 0-63)", s)
+	}
+	return v, nil
+}
+
+// checkMark warns if entries set a mark the process may not set, which
+// fails their dials.
+func checkMark(cfg *Config) {
+	for _, p := range cfg.Proxies {
+		if p.Mark == 0 {
+			continue
+		}
+		if err := probeMark(p.Mark); err != nil {
+			logWarn("[main] mark: %v; connections of entries with a mark fail (setting it needs CAP_NET_ADMIN)", err)
+		}
+		return
+	}
+}
@@ -3,48 +3,135 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+// controlsKeepAlive reports whether setSocketOptions sets keepalive.
+const controlsKeepAlive = true
+
 // setSocketOptions configures TCP performance options on the raw socket fd.
 // Called via net.Dialer.Control before connect(2).
-func setSocketOptions(network, address string, c syscall.RawConn) error {
+func (o socketOptions) setSocketOptions(network, address string, c syscall.RawConn) error {
 	var sysErr error
 	err := c.Control(func(fd uintptr) {
+		// Multipath TCP sockets take a subset of the TCP options, which
+		// varies with the kernel; they do without the others
+		proto, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PROTOCOL)
+		setsockopt := func(level, opt, value int) error {
+			e := unix.SetsockoptInt(int(fd), level, opt, value)
+			if proto == unix.IPPROTO_MPTCP && (e == unix.EOPNOTSUPP || e == unix.ENOPROTOOPT) {
+				return nil
+			}
+			return e
+		}
+
+		// Pin the socket to a specific NIC, bypassing route selection
+		if o.BindDevice != "" {
+			if e := unix.BindToDevice(int(fd), o.BindDevice); e != nil {
+				sysErr = fmt.Errorf("bind to device %s: %w", o.BindDevice, e)
+				return
+			}
+		}
+
+		// Mark the socket for policy routing; on failure it would leave by
+		// the main table, so the dial fails instead
+		if o.Mark != 0 {
+			if e := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.Mark)); e != nil {
+				sysErr = fmt.Errorf("SO_MARK %#x: %w", o.Mark, e)
+				return
+			}
+		}
+
 		// Allow address reuse for rapid restart
-		if e := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); e != nil {
+		if e := setsockopt(unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); e != nil {
 			sysErr = e
 			return
 		}
 
 		// Disable Nagle's algorithm for lower latency
-		if e := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); e != nil {
+		if e := setsockopt(unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); e != nil {
 			sysErr = e
 			return
 		}
 
-		// Enable TCP keepalive
-		if e := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); e != nil {
+		// Fixed buffers in place of autotuning; the receive buffer is set
+		// before connect(2), which announces its window scale
+		if o.SendBuffer > 0 {
+			if e := setsockopt(unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer); e != nil {
+				sysErr = fmt.Errorf("SO_SNDBUF: %w", e)
+				return
+			}
+		}
+		if o.ReceiveBuffer > 0 {
+			if e := setsockopt(unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReceiveBuffer); e != nil {
+				sysErr = fmt.Errorf("SO_RCVBUF: %w", e)
+				return
+			}
+		}
+
+		// connect(2) returns at once for a target with a cookie, and the SYN
+		// carries the first write
+		if o.FastOpenConnect {
+			if e := setsockopt(unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); e != nil {
+				sysErr = fmt.Errorf("TCP_FASTOPEN_CONNECT: %w", e)
+				return
+			}
+		}
+
+		// Drop the connection when sent data or probes go unacknowledged
+		// this long
+		if o.KeepAlive.UserTimeout > 0 {
+			if e := setsockopt(unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.KeepAlive.UserTimeout/time.Millisecond)); e != nil {
+				sysErr = fmt.Errorf("TCP_USER_TIMEOUT: %w", e)
+				return
+			}
+		}
+
+		// Congestion control of the socket; a name the kernel refuses keeps
+		// the default, as checkCongestion warned
+		if o.Congestion != "" {
+			unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, o.Congestion)
+		}
+
+		// Mark the packets for QoS
+		if o.DSCP > 0 {
+			setDSCP(int(fd), o.DSCP)
+		}
+
+		// TCP keepalive, unless disabled or unset: 30s idle, then a probe
+		// every 10s, 3 probes by default
+		ka := o.KeepAlive
+		if ka.Disable || ka.Count == 0 {
+			return
+		}
+		if e := setsockopt(unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); e != nil {
 			sysErr = e
 			return
 		}
 
-		// Keepalive idle time: 30 seconds
-		if e := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 30); e != nil {
+		// Keepalive idle time
+		if e := setsockopt(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, int(ka.Idle/time.Second)); e != nil {
 			sysErr = e
 			return
 		}
 
-		// Keepalive interval: 10 seconds
-		if e := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 10); e != nil {
+		// Keepalive interval
+		if e := setsockopt(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(ka.Interval/time.Second)); e != nil {
 			sysErr = e
 			return
 		}
 
-		// Keepalive probes: 3
-		if e := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3); e != nil {
+		// Keepalive probes
+		if e := setsockopt(unix.IPPROTO_TCP, unix.TCP_KEEPCNT, ka.Count); e != nil {
 			sysErr = e
 			return
 		}
@@ -54,3 +141,176 @@ func setSocketOptions(network, address string, c syscall.RawConn) error {
 	}
 	return sysErr
 }
+
+// setClientOptions applies the options that also concern clients to the
+// accepted connection c: TCP_USER_TIMEOUT, the congestion control and the
+// DSCP marking.
+func (o socketOptions) setClientOptions(c net.Conn) {
+	if o.KeepAlive.UserTimeout == 0 && o.Congestion == "" && o.DSCP == 0 {
+		return
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		if o.KeepAlive.UserTimeout > 0 {
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.KeepAlive.UserTimeout/time.Millisecond))
+		}
+		if o.Congestion != "" {
+			unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, o.Congestion) // probed by checkCongestion
+		}
+		if o.DSCP > 0 {
+			setDSCP(int(fd), o.DSCP)
+		}
+	})
+}
+
+// setDSCP marks the packets of the TCP socket fd with the code point dscp:
+// its traffic class, and the TOS of packets to IPv4 peers, which IPv6
+// sockets reach through mapped addresses. The kernel keeps the ECN bits.
+func setDSCP(fd, dscp int) {
+	tos := dscp << 2
+	if domain, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN); domain == unix.AF_INET6 {
+		unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
+
+// probeCongestion reports whether a TCP socket can use the congestion
+// control algorithm name: the kernel must have it, and allow it to the
+// process (net.ipv4.tcp_allowed_congestion_control, unless it has
+// CAP_NET_ADMIN, with which it also loads the module if needed).
+func probeCongestion(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	switch err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, name); err {
+	case unix.ENOENT:
+		return errors.New("not available in the kernel")
+	case unix.EPERM:
+		return errors.New("not in net.ipv4.tcp_allowed_congestion_control")
+	default:
+		return err
+	}
+}
+
+// probeMark reports whether the process may set the mark of its sockets.
+func probeMark(mark uint32) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
+
+// setReusePort sets SO_REUSEPORT on a listening socket before bind(2), so
+// the acceptors of a port can share it. Called via net.ListenConfig.Control.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sysErr error
+	err := c.Control(func(fd uintptr) {
+		sysErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// setFastOpen sets the TCP Fast Open queue of a listening socket, before or
+// after listen(2); 0 turns fast open off for new SYNs.
+func setFastOpen(c syscall.RawConn, queue int) error {
+	var sysErr error
+	err := c.Control(func(fd uintptr) {
+		sysErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, queue)
+	})
+	if err != nil {
+		return err
+	}
+	if sysErr != nil {
+		return fmt.Errorf("TCP_FASTOPEN: %w", sysErr)
+	}
+	return nil
+}
+
+// setDeferAccept makes a listening socket hold new connections until the
+// client sends data, at most d (rounded to retransmissions of the SYN-ACK
+// by the kernel), before or after listen(2); 0 turns it off.
+func setDeferAccept(c syscall.RawConn, d time.Duration) error {
+	var sysErr error
+	err := c.Control(func(fd uintptr) {
+		sysErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, int(d/time.Second))
+	})
+	if err != nil {
+		return err
+	}
+	if sysErr != nil {
+		return fmt.Errorf("TCP_DEFER_ACCEPT: %w", sysErr)
+	}
+	return nil
+}
+
+// setSocketBuffers sets the send and receive buffers of a listening socket,
+// those that are not 0, which the connections it accepts inherit. Set
+// before listen(2), the receive buffer also sizes the window scale the
+// listener offers.
+func setSocketBuffers(c syscall.RawConn, send, recv int) error {
+	var sysErr error
+	err := c.Control(func(fd uintptr) {
+		if send > 0 {
+			if e := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, send); e != nil {
+				sysErr = fmt.Errorf("SO_SNDBUF: %w", e)
+				return
+			}
+		}
+		if recv > 0 {
+			if e := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, recv); e != nil {
+				sysErr = fmt.Errorf("SO_RCVBUF: %w", e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// setBacklog resizes the accept queue of a listening socket by listening
+// again, with backlog or, if 0, net.core.somaxconn like the runtime.
+func setBacklog(c syscall.RawConn, backlog int) error {
+	if backlog == 0 {
+		backlog = unix.SOMAXCONN
+		if n, ok := sysctlInt("net.core.somaxconn"); ok {
+			backlog = n
+		}
+	}
+	var sysErr error
+	err := c.Control(func(fd uintptr) {
+		sysErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	if sysErr != nil {
+		return fmt.Errorf("listen backlog %d: %w", backlog, sysErr)
+	}
+	return nil
+}
+
+// sysctlInt returns the value of the integer sysctl name, such as
+// net.ipv4.tcp_fastopen.
+func sysctlInt(name string) (int, bool) {
+	b, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n, err == nil
+}
@@ -2,11 +2,79 @@
 
 package main
 
-import "syscall"
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// controlsKeepAlive reports whether setSocketOptions sets keepalive: off
+// Linux the dialer does, with the idle time as its period.
+const controlsKeepAlive = false
 
 // setSocketOptions is a no-op on non-Linux platforms.
 // The Linux-specific version in sockopt_linux.go sets TCP_NODELAY,
-// SO_REUSEADDR, and keepalive options.
-func setSocketOptions(network, address string, c syscall.RawConn) error {
+// SO_REUSEADDR, keepalive options, SO_BINDTODEVICE, TCP_FASTOPEN_CONNECT
+// and the socket buffers.
+func (o socketOptions) setSocketOptions(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// setClientOptions is a no-op: TCP_USER_TIMEOUT, TCP_CONGESTION and DSCP
+// marking are Linux only here.
+func (o socketOptions) setClientOptions(c net.Conn) {}
+
+// probeCongestion fails: congestion is Linux only.
+func probeCongestion(name string) error {
+	return errors.New("TCP_CONGESTION is Linux only")
+}
+
+// probeMark succeeds: SO_MARK is Linux only, which prepareHost warns of.
+func probeMark(mark uint32) error {
 	return nil
 }
+
+// setReusePort fails: several acceptors per port need Linux's SO_REUSEPORT,
+// which spreads connections across the sockets.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("acceptors > 1 need SO_REUSEPORT load balancing (Linux only)")
+}
+
+// setFastOpen fails unless queue is 0: fast_open.listen is Linux only.
+func setFastOpen(c syscall.RawConn, queue int) error {
+	if queue == 0 {
+		return nil
+	}
+	return errors.New("fast_open.listen needs TCP_FASTOPEN (Linux only)")
+}
+
+// setDeferAccept fails unless d is 0: accept.defer is Linux only.
+func setDeferAccept(c syscall.RawConn, d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+	return errors.New("accept.defer needs TCP_DEFER_ACCEPT (Linux only)")
+}
+
+// setBacklog fails unless backlog is 0: accept.backlog is Linux only.
+func setBacklog(c syscall.RawConn, backlog int) error {
+	if backlog == 0 {
+		return nil
+	}
+	return errors.New("accept.backlog is Linux only")
+}
+
+// setSocketBuffers fails unless both sizes are 0: socket_buffers.client is
+// Linux only.
+func setSocketBuffers(c syscall.RawConn, send, recv int) error {
+	if send == 0 && recv == 0 {
+		return nil
+	}
+	return errors.New("socket_buffers.client is Linux only")
+}
+
+// sysctlInt reports that there are no sysctls to read.
+func sysctlInt(name string) (int, bool) {
+	return 0, false
+}
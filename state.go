@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runningConfigFile is the name, inside -state-dir, of the snapshot of the
+// configuration the daemon is running.
+const runningConfigFile = "running.yaml"
+
+// effectiveConfig returns cfg as a loadable config with every include,
+// default, template, range and prefix already resolved: one entry per
+// listener.
+func effectiveConfig(cfg *Config) *Config {
+	out := *cfg
+	out.Include, out.Defaults, out.Vars = nil, nil, nil
+	out.Proxies = make([]ProxyEntry, len(cfg.Proxies))
+	for i, e := range cfg.Proxies {
+		if e.IPv6 != "" {
+			e.Outbound = nil // normalized from ipv6; the two are exclusive
+		}
+		out.Proxies[i] = e
+	}
+	if len(cfg.Users) > 0 {
+		out.Users = make([]UserConfig, len(cfg.Users))
+		for i, u := range cfg.Users {
+			if u.IPv6 != "" {
+				u.Outbound = nil
+			}
+			out.Users[i] = u
+		}
+	}
+	return &out
+}
+
+// saveRunningConfig records cfg as the running configuration in dir,
+// replacing the previous snapshot atomically, and adds it to the history
+// of the last keep applied configurations.
+func saveRunningConfig(dir string, keep int, cfg *Config) error {
+	var doc yaml.Node
+	if err := doc.Encode(effectiveConfig(cfg)); err != nil {
+		return err
+	}
+	maskSecrets(&doc, cfg.secretRefs)
+	pruneEmpty(&doc)
+	data, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	// The snapshot is loaded like any config; keep literal ${ literal.
+	data = bytes.ReplaceAll(data, []byte("${"), []byte("$${"))
+	header := fmt.Sprintf("# Running configuration of superproxy (pid %d), recorded %s\n",
+		os.Getpid(), time.Now().Format(time.RFC3339))
+	data = append([]byte(header), data...)
+
+	tmp, err := os.CreateTemp(dir, "."+runningConfigFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, runningConfigFile)); err != nil {
+		return err
+	}
+	return recordVersion(dir, data, keep)
+}
+
+// pruneEmpty drops mapping entries with empty values (null, "", 0, false,
+// [] and {}), so the snapshot lists only what is set and loads back into
+// values equal to those it was written from (nil rather than empty lists).
+func pruneEmpty(n *yaml.Node) {
+	for _, c := range n.Content {
+		pruneEmpty(c)
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	kept := n.Content[:0]
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		v := n.Content[i+1]
+		empty := (v.Kind == yaml.SequenceNode || v.Kind == yaml.MappingNode) && len(v.Content) == 0
+		if v.Kind == yaml.ScalarNode {
+			switch v.Value {
+			case "", "0", "0s", "false", "null":
+				empty = v.Tag != "!!str" || v.Value == ""
+			}
+		}
+		if !empty {
+			kept = append(kept, n.Content[i], v)
+		}
+	}
+	n.Content = kept
+}
+
+// loadRunningConfig loads the running configuration recorded in dir.
+func loadRunningConfig(dir string) (*Config, error) {
+	path := filepath.Join(dir, runningConfigFile)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no running configuration recorded: %w", err)
+	}
+	return LoadConfig(path, loadOptions{})
+}
+
+// printRunningConfig writes the running configuration recorded in dir.
+func printRunningConfig(w io.Writer, dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, runningConfigFile))
+	if err != nil {
+		return fmt.Errorf("no running configuration recorded: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// diffConfigs lists what applying next over running would change, one line
+// per item: "+ " for added listeners, "- " for removed ones, "~ " for
+// changed listeners (with the changed fields) and changed global settings.
+func diffConfigs(running, next *Config) []string {
+	var lines []string
+
+	oldDoc, newDoc := yamlFields(effectiveConfig(running)), yamlFields(effectiveConfig(next))
+	delete(oldDoc, "proxies")
+	delete(newDoc, "proxies")
+	for _, key := range changedKeys(oldDoc, newDoc) {
+		note := ""
+		switch key {
+		case "listen_host":
+			if running.ListenHost == "" || next.ListenHost == "" {
+				note = " (requires a restart)"
+			}
+		}
+		lines = append(lines, fmt.Sprintf("~ %s%s", key, note))
+	}
+
+	oldPorts := make(map[int]ProxyEntry, len(running.Proxies))
+	for _, e := range running.Proxies {
+		oldPorts[e.Port] = e
+	}
+	newPorts := make(map[int]bool, len(next.Proxies))
+	for _, e := range next.Proxies {
+		newPorts[e.Port] = true
+		old, ok := oldPorts[e.Port]
+		if !ok {
+			lines = append(lines, "+ "+entrySummary(e))
+			continue
+		}
+		if fields := changedKeys(yamlFields(effectiveEntry(old)), yamlFields(effectiveEntry(e))); len(fields) > 0 {
+			lines = append(lines, fmt.Sprintf("~ %s: %v", entrySummary(e), fields))
+		}
+	}
+	for _, e := range running.Proxies {
+		if !newPorts[e.Port] {
+			lines = append(lines, "- "+entrySummary(e))
+		}
+	}
+	return lines
+}
+
+// effectiveEntry applies the effectiveConfig normalization to one entry.
+func effectiveEntry(e ProxyEntry) ProxyEntry {
+	return effectiveConfig(&Config{Proxies: []ProxyEntry{e}}).Proxies[0]
+}
+
+// yamlFields returns v as a map of its YAML fields.
+func yamlFields(v any) map[string]any {
+	data, _ := yaml.Marshal(v)
+	var m map[string]any
+	yaml.Unmarshal(data, &m)
+	return m
+}
+
+// changedKeys returns the sorted keys whose values differ between a and b.
+func changedKeys(a, b map[string]any) []string {
+	var keys []string
+	for k, v := range a {
+		if !reflect.DeepEqual(v, b[k]) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
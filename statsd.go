@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD defaults and limits.
+const (
+	defaultStatsDPrefix   = "superproxy"
+	defaultStatsDInterval = 10 * time.Second
+	statsdMaxPacket       = 1432 // keeps datagrams within a 1500-byte MTU
+)
+
+// statsdCounters is the part of portStats last sent to StatsD.
+type statsdCounters struct {
+	total, failed, up, down int64
+	spliced                 int64 // of up and down
+	denied, limited, capped int64 // closed on accept
+	acceptErrors, fds       int64 // failed accepts, of which for want of descriptors
+	dropped                 int64 // by the worker queue
+	errors                  [numDialErrorClasses]int64
+	latency                 [len(latencyPhases)]latencySnapshot
+}
+
+// statsdSink publishes the listener counters of the admin API to a StatsD
+// or DogStatsD server every interval: connections, connect_errors (and
+// connect_errors.<class>), connections_denied, connections_rate_limited,
+// connections_capped, connections_dropped, accept_errors,
+// accept_fd_exhausted, bytes_up, bytes_down and bytes_spliced as counters
+// of what changed since the last flush, connections_active,
+// connections_queued and listeners as gauges, and the percentiles
+// of the latencies observed since the last flush as gauges in
+// milliseconds (<phase>_ms.p50, .p90, .p99).
+type statsdSink struct {
+	cfg  *StatsDConfig // nil: disabled
+	stop chan struct{}
+	done chan struct{}
+}
+
+// update starts, restarts or stops publishing to match sc (nil: disabled).
+// The running emitter sends its last counts before a new one starts, so
+// nothing is counted twice.
+func (s *statsdSink) update(sc *StatsDConfig, srv *server) error {
+	if reflect.DeepEqual(sc, s.cfg) {
+		return nil
+	}
+	var conn net.Conn
+	if sc != nil {
+		var err error
+		if conn, err = net.Dial("udp", sc.Address); err != nil {
+			return fmt.Errorf("statsd: %w", err)
+		}
+	}
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop, s.done = nil, nil
+	}
+	s.cfg = sc
+	if sc == nil {
+		logInfo("[statsd] stopped")
+		return nil
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	e := &statsdEmitter{cfg: sc, conn: conn, srv: srv, last: make(map[*portStats]statsdCounters)}
+	for _, ps := range srv.status() {
+		e.last[ps.stats] = snapshotCounters(ps.stats)
+	}
+	go e.run(s.stop, s.done)
+	logInfo("[statsd] sending listener metrics to %s every %s", sc.Address, sc.Interval)
+	return nil
+}
+
+// statsdEmitter is the goroutine behind a statsdSink.
+type statsdEmitter struct {
+	cfg  *StatsDConfig
+	conn net.Conn
+	srv  *server
+	last map[*portStats]statsdCounters // by port across reloads; a new port starts at 0
+	tags string                        // ",k:v,..." of cfg.Tags
+	buf  []byte
+}
+
+func (e *statsdEmitter) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer e.conn.Close()
+	e.tags = formatTags(e.cfg.Tags)
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+// formatTags returns the DogStatsD tags of tags in name order, as
+// ",k:v,..." to follow the per-listener ones.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString("," + k + ":" + tags[k])
+	}
+	return b.String()
+}
+
+func snapshotCounters(st *portStats) statsdCounters {
+	spliced := st.Spliced.Load() // first: bytes are added to it last
+	c := statsdCounters{total: st.Total.Load(), failed: st.Failed.Load(), up: st.BytesUp.Load(), down: st.BytesDown.Load(), spliced: spliced,
+		denied: st.Denied.Load(), limited: st.Limited.Load(), capped: st.Capped.Load(),
+		acceptErrors: st.AcceptErrors.Load(), fds: st.FDExhausted.Load(), dropped: st.Dropped.Load()}
+	for i := range c.errors {
+		c.errors[i] = st.DialErrors[i].Load()
+	}
+	for i, h := range st.latencies() {
+		c.latency[i] = h.snapshot()
+	}
+	return c
+}
+
+// flush sends the metrics of every open port. Counters that did not
+// change are left out.
+func (e *statsdEmitter) flush() {
+	status := e.srv.status()
+	seen := make(map[*portStats]bool, len(status))
+	e.buf = e.buf[:0]
+	for _, ps := range status {
+		seen[ps.stats] = true
+		now := snapshotCounters(ps.stats)
+		prev := e.last[ps.stats]
+		e.last[ps.stats] = now
+		e.metric(ps.entry, "connections", now.total-prev.total, "c")
+		e.metric(ps.entry, "connect_errors", now.failed-prev.failed, "c")
+		for i, class := range dialErrorClasses {
+			e.metric(ps.entry, "connect_errors."+class, now.errors[i]-prev.errors[i], "c")
+		}
+		e.metric(ps.entry, "connections_denied", now.denied-prev.denied, "c")
+		e.metric(ps.entry, "connections_rate_limited", now.limited-prev.limited, "c")
+		e.metric(ps.entry, "connections_capped", now.capped-prev.capped, "c")
+		e.metric(ps.entry, "connections_dropped", now.dropped-prev.dropped, "c")
+		e.metric(ps.entry, "accept_errors", now.acceptErrors-prev.acceptErrors, "c")
+		e.metric(ps.entry, "accept_fd_exhausted", now.fds-prev.fds, "c")
+		e.metric(ps.entry, "bytes_up", now.up-prev.up, "c")
+		e.metric(ps.entry, "bytes_down", now.down-prev.down, "c")
+		e.metric(ps.entry, "bytes_spliced", now.spliced-prev.spliced, "c")
+		e.metric(ps.entry, "connections_active", ps.stats.Active.Load(), "g")
+		e.metric(ps.entry, "connections_queued", ps.stats.Queued.Load(), "g")
+		for i, phase := range latencyPhases {
+			d := now.latency[i].since(prev.latency[i])
+			if d.count() == 0 {
+				continue
+			}
+			for _, p := range [...]struct {
+				name string
+				q    float64
+			}{{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}} {
+				e.gauge(ps.entry, phase+"_ms."+p.name, millis(d.quantile(p.q)))
+			}
+		}
+	}
+	for st := range e.last {
+		if !seen[st] {
+			delete(e.last, st)
+		}
+	}
+	e.line(e.cfg.Prefix+".listeners", strconv.Itoa(len(status)), "g", "")
+	e.send()
+}
+
+// metric adds one metric of the listener of entry; counters that are 0 are
+// left out.
+func (e *statsdEmitter) metric(entry ProxyEntry, name string, value int64, typ string) {
+	if typ == "c" && value == 0 {
+		return
+	}
+	e.listenerLine(entry, name, strconv.FormatInt(value, 10), typ)
+}
+
+// gauge adds a fractional gauge of the listener of entry.
+func (e *statsdEmitter) gauge(entry ProxyEntry, name string, value float64) {
+	e.listenerLine(entry, name, strconv.FormatFloat(value, 'f', -1, 64), "g")
+}
+
+// listenerLine adds a line for the listener of entry. DogStatsD identifies
+// the listener by tags, plain StatsD by a name component.
+func (e *statsdEmitter) listenerLine(entry ProxyEntry, name, value, typ string) {
+	if !e.cfg.DogStatsD {
+		e.line(e.cfg.Prefix+".listener."+strconv.Itoa(entry.Port)+"."+name, value, typ, "")
+		return
+	}
+	tags := "port:" + strconv.Itoa(entry.Port)
+	if entry.Name != "" {
+		tags += ",name:" + entry.Name
+	}
+	e.line(e.cfg.Prefix+"."+name, value, typ, tags)
+}
+
+// line appends "name:value|typ[|#tags]" to the packet being built, sending
+// the packet first if the line would not fit.
+func (e *statsdEmitter) line(name, value, typ, tags string) {
+	l := name + ":" + value + "|" + typ
+	if e.cfg.DogStatsD {
+		if tags += e.tags; tags != "" {
+			l += "|#" + strings.TrimPrefix(tags, ",")
+		}
+	}
+	if len(e.buf) > 0 && len(e.buf)+1+len(l) > statsdMaxPacket {
+		e.send()
+	}
+	if len(e.buf) > 0 {
+		e.buf = append(e.buf, '\n')
+	}
+	e.buf = append(e.buf, l...)
+}
+
+func (e *statsdEmitter) send() {
+	if len(e.buf) == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf); err != nil {
+		logDebug("[statsd] sending to %s: %v", e.cfg.Address, err)
+	}
+	e.buf = e.buf[:0]
+}
+
+// validateStatsD validates the statsd block and fills in its defaults.
+func validateStatsD(sc *StatsDConfig) error {
+	if sc.Address == "" {
+		return fmt.Errorf("config: statsd: 'address' is required (e.g. \"127.0.0.1:8125\")")
+	}
+	if _, _, err := net.SplitHostPort(sc.Address); err != nil {
+		return fmt.Errorf("config: statsd: invalid address %q: %w", sc.Address, err)
+	}
+	if sc.Interval < 0 {
+		return fmt.Errorf("config: statsd: interval must not be negative")
+	}
+	if sc.Interval == 0 {
+		sc.Interval = defaultStatsDInterval
+	}
+	if sc.Prefix == "" {
+		sc.Prefix = defaultStatsDPrefix
+	}
+	sc.Prefix = strings.TrimSuffix(sc.Prefix, ".")
+	if len(sc.Tags) > 0 && !sc.DogStatsD {
+		return fmt.Errorf("config: statsd: 'tags' needs dogstatsd: true (plain StatsD has no tags)")
+	}
+	for k, v := range sc.Tags {
+		if k == "" || strings.ContainsAny(k, ",|#:\n") || strings.ContainsAny(v, ",|#\n") {
+			return fmt.Errorf("config: statsd: tag %q: names may not contain ',', '|', '#', ':' or newlines, values all but ':'", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// minNoFile is the open-files limit below which -strict warns: every
+// proxied connection holds two descriptors.
+const minNoFile = 4096
+
+// strictWarnings returns the non-fatal issues of cfg reported by -t
+// -strict: problems that do not stop the daemon from starting but are
+// likely to break it in production.
+func strictWarnings(cfg *Config) []string {
+	var warnings []string
+
+	if !canBindPrivileged() {
+		var low []string
+		for _, e := range cfg.Proxies {
+			if e.Port < 1024 {
+				low = append(low, fmt.Sprintf(":%d", e.Port))
+			}
+		}
+		if len(low) > 0 {
+			warnings = append(warnings, fmt.Sprintf("ports below 1024 (%s) need root or CAP_NET_BIND_SERVICE", strings.Join(low, ", ")))
+		}
+	}
+
+	if prefixes, err := routedPrefixes(cfg.Interface); err != nil {
+		warnings = append(warnings, fmt.Sprintf("cannot check outbound addresses against %s: %v", cfg.Interface, err))
+	} else {
+		for _, ip := range outboundAddresses(cfg) {
+			if addr := net.ParseIP(ip); !addr.IsLoopback() && !prefixesContain(prefixes, addr) {
+				warnings = append(warnings, fmt.Sprintf("%s is outside the prefixes routed to %s; replies may never arrive", ip, cfg.Interface))
+			}
+		}
+	}
+
+	// Entries sharing an address share its egress identity and reputation.
+	users := make(map[string][]string)
+	for _, e := range cfg.Proxies {
+		for _, a := range e.Outbound {
+			users[a.IPv6] = append(users[a.IPv6], fmt.Sprintf(":%d", e.Port))
+		}
+	}
+	for _, ip := range outboundAddresses(cfg) {
+		if ports := users[ip]; len(ports) > 1 {
+			warnings = append(warnings, fmt.Sprintf("%s is in the pools of %d listeners (%s)", ip, len(ports), strings.Join(ports, ", ")))
+		}
+	}
+
+	if soft, err := openFileLimit(); err == nil && soft < minNoFile {
+		warnings = append(warnings, fmt.Sprintf("open files limit is %d (at least %d recommended; LimitNOFILE= in the unit, ulimit -n in a shell)", soft, minNoFile))
+	}
+	return warnings
+}
+
+// outboundAddresses returns every outbound address of cfg, sorted.
+func outboundAddresses(cfg *Config) []string {
+	seen := make(map[string]struct{})
+	for _, e := range outboundEntries(cfg) {
+		for _, a := range e.Outbound {
+			seen[a.IPv6] = struct{}{}
+		}
+	}
+	addrs := make([]string, 0, len(seen))
+	for ip := range seen {
+		addrs = append(addrs, ip)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// prefixesContain reports whether ip is in one of prefixes.
+func prefixesContain(prefixes []*net.IPNet, ip net.IP) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNetBindService is the CAP_NET_BIND_SERVICE capability bit.
+const capNetBindService = 10
+
+// canBindPrivileged reports whether the process may listen on ports below
+// 1024: its effective capabilities include CAP_NET_BIND_SERVICE.
+func canBindPrivileged() bool {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if hexCaps, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(hexCaps), 16, 64)
+			return err == nil && caps&(1<<capNetBindService) != 0
+		}
+	}
+	return false
+}
+
+// routedPrefixes returns the IPv6 prefixes an outbound address of iface
+// can be taken from: the on-link prefixes of its addresses, and routes via
+// iface or local (AnyIP) routes via lo, excluding the default route.
+func routedPrefixes(iface string) ([]*net.IPNet, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []*net.IPNet
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() == nil && !n.IP.IsLinkLocalUnicast() {
+			if ones, _ := n.Mask.Size(); ones < 128 {
+				prefixes = append(prefixes, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+			}
+		}
+	}
+
+	// /proc/net/ipv6_route: destination, prefix length, ..., device
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return prefixes, nil
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 || (fields[9] != iface && fields[9] != "lo") {
+			continue
+		}
+		dst, err := hex.DecodeString(fields[0])
+		ones, err2 := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil || err2 != nil || len(dst) != net.IPv6len || ones == 0 || ones == 128 {
+			continue
+		}
+		ip := net.IP(dst)
+		if ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+			continue
+		}
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(ones), 128)})
+	}
+	return prefixes, sc.Err()
+}
+
+// openFileLimit returns the soft RLIMIT_NOFILE.
+func openFileLimit() (uint64, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, fmt.Errorf("getrlimit: %w", err)
+	}
+	return rl.Cur, nil
+}
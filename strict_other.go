@@ -0,0 +1,24 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// canBindPrivileged approximates the Linux capability check with root.
+func canBindPrivileged() bool {
+	return os.Geteuid() == 0
+}
+
+// routedPrefixes is only implemented on Linux.
+func routedPrefixes(iface string) ([]*net.IPNet, error) {
+	return nil, errors.New("routes are only inspected on Linux")
+}
+
+// openFileLimit is only implemented on Linux.
+func openFileLimit() (uint64, error) {
+	return 0, errors.New("not supported")
+}
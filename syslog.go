@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Syslog defaults and limits.
+const (
+	defaultSyslogTag = "superproxy"
+	syslogQueue      = 4096            // unsent messages; more are dropped
+	syslogRetry      = 5 * time.Second // after a failed connect, before the next attempt
+	syslogTimeout    = 5 * time.Second // connecting and writing
+	syslogSDID       = "superproxy@32473"
+)
+
+// syslogFacilities are the facility names of syslog.facility.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the severities of the log levels.
+var syslogSeverities = [...]int{7, 6, 4, 3} // debug, info, warning, error
+
+// localSyslogSockets are tried in order for syslog.address local.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogSink ships log messages as RFC 5424 records to syslog. Logging
+// never blocks on it: a goroutine sends them, and when the queue is full
+// messages are dropped.
+type syslogSink struct {
+	mu     sync.Mutex
+	cfg    *SyslogConfig
+	queue  chan []byte // nil while syslog is off
+	done   chan struct{}
+	host   string
+	only   atomic.Bool
+	closed bool
+}
+
+// syslogOut is the syslog target of the running daemon.
+var syslogOut syslogSink
+
+// update applies a validated syslog block (nil: none). Messages already
+// queued go out over the previous connection.
+func (s *syslogSink) update(cfg *SyslogConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || reflect.DeepEqual(cfg, s.cfg) {
+		return nil
+	}
+	var w *syslogWriter
+	if cfg != nil {
+		var err error
+		if w, err = newSyslogWriter(cfg); err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+	}
+	if s.queue != nil {
+		close(s.queue)
+		s.queue = nil
+	}
+	s.cfg = cfg
+	s.only.Store(cfg != nil && cfg.Only)
+	if w != nil {
+		s.host, _ = os.Hostname()
+		s.queue, s.done = make(chan []byte, syslogQueue), make(chan struct{})
+		go w.run(s.queue, s.done)
+	}
+	return nil
+}
+
+// exclusive reports whether the log goes to syslog only (syslog.only).
+func (s *syslogSink) exclusive() bool { return s.only.Load() }
+
+// close stops syslog output, waiting up to timeout for queued messages.
+func (s *syslogSink) close(timeout time.Duration) {
+	s.mu.Lock()
+	if s.closed || s.queue == nil {
+		s.closed = true
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.only.Store(false)
+	close(s.queue)
+	s.queue = nil
+	done := s.done
+	s.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// send queues msg ("[component:port/name] text", as logged) with fields.
+func (s *syslogSink) send(level int32, msg string, fields []slog.Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil {
+		return
+	}
+	select {
+	case s.queue <- formatSyslog(s.cfg, s.host, level, msg, fields):
+	default:
+	}
+}
+
+// formatSyslog returns the RFC 5424 record of a message: the component is
+// its MSGID, and the listener and fields are structured data.
+func formatSyslog(cfg *SyslogConfig, host string, level int32, msg string, fields []slog.Attr) []byte {
+	msgID := "-"
+	var params []slog.Attr
+	if tag, text, ok := strings.Cut(msg, "] "); ok && strings.HasPrefix(tag, "[") {
+		component, listener, _ := strings.Cut(tag[1:], ":")
+		msgID = component
+		if listener != "" {
+			port, name, _ := strings.Cut(listener, "/")
+			params = append(params, slog.String("port", port))
+			if name != "" {
+				params = append(params, slog.String("listener", name))
+			}
+		}
+		msg = text
+	}
+	params = append(params, fields...)
+	var b strings.Builder
+	pri := syslogFacilities[cfg.Facility]*8 + syslogSeverities[level]
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ", pri, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		orNil(host), cfg.Tag, os.Getpid(), msgID)
+	if len(params) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + syslogSDID)
+		for _, p := range params {
+			fmt.Fprintf(&b, ` %s="%s"`, p.Key, sdEscaper.Replace(p.Value.String()))
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" " + msg)
+	return []byte(b.String())
+}
+
+// sdEscaper escapes structured data parameter values (RFC 5424 6.3.3).
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+func orNil(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// syslogWriter is the connection to the syslog server of one syslog block.
+type syslogWriter struct {
+	network string // unixgram, udp, tcp or tls
+	addrs   []string
+	tls     *tls.Config
+	conn    net.Conn
+	retryAt time.Time
+	dropped int // messages lost since the last successful write
+}
+
+func newSyslogWriter(cfg *SyslogConfig) (*syslogWriter, error) {
+	network, addr, err := parseSyslogAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	w := &syslogWriter{network: network, addrs: []string{addr}}
+	if network == "unixgram" && addr == "" {
+		w.addrs = localSyslogSockets
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		w.tls = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if cfg.CA != "" {
+			pem, err := os.ReadFile(cfg.CA)
+			if err != nil {
+				return nil, err
+			}
+			w.tls.RootCAs = x509.NewCertPool()
+			if !w.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no PEM certificates", cfg.CA)
+			}
+		}
+	}
+	return w, nil
+}
+
+// parseSyslogAddress splits a syslog.address into the network and address
+// ("" for the local socket).
+func parseSyslogAddress(s string) (network, addr string, err error) {
+	if s == "" || s == "local" {
+		return "unixgram", "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" && u.Scheme != "unix" {
+		return "", "", fmt.Errorf("address %q must be local, unix:///path, udp://host[:port], tcp://host[:port] or tls://host[:port]", s)
+	}
+	port := "514"
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("address %q: missing socket path", s)
+		}
+		return "unixgram", u.Path, nil
+	case "udp", "tcp":
+	case "tls":
+		port = "6514"
+	default:
+		return "", "", fmt.Errorf("address %q: unknown scheme %q (udp, tcp, tls or unix)", s, u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return u.Scheme, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func (w *syslogWriter) run(queue <-chan []byte, done chan<- struct{}) {
+	defer close(done)
+	for msg := range queue {
+		w.write(msg)
+	}
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// write sends msg, connecting first if needed and retrying once on a new
+// connection. Its errors go to the local log only, so a broken syslog
+// server cannot feed itself.
+func (w *syslogWriter) write(msg []byte) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if time.Now().Before(w.retryAt) {
+				break
+			}
+			if err := w.connect(); err != nil {
+				logLocal(levelWarn, fmt.Sprintf("[syslog] %v; retrying in %s", err, syslogRetry), nil)
+				w.retryAt = time.Now().Add(syslogRetry)
+				break
+			}
+		}
+		frame := msg
+		if w.network == "tcp" || w.network == "tls" {
+			frame = append([]byte(strconv.Itoa(len(msg))+" "), msg...) // octet counting (RFC 6587, RFC 5425)
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := w.conn.Write(frame); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			continue
+		}
+		if w.dropped > 0 {
+			logLocal(levelWarn, fmt.Sprintf("[syslog] %d messages lost while syslog was unreachable", w.dropped), nil)
+			w.dropped = 0
+		}
+		return
+	}
+	w.dropped++
+}
+
+func (w *syslogWriter) connect() error {
+	d := net.Dialer{Timeout: syslogTimeout}
+	var errs []error
+	for _, addr := range w.addrs {
+		var conn net.Conn
+		var err error
+		if w.tls != nil {
+			conn, err = tls.DialWithDialer(&d, "tcp", addr, w.tls)
+		} else {
+			conn, err = d.Dial(w.network, addr)
+		}
+		if err == nil {
+			w.conn = conn
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// validateSyslog validates the syslog block and fills in its defaults.
+func validateSyslog(sc *SyslogConfig) error {
+	if _, _, err := parseSyslogAddress(sc.Address); err != nil {
+		return fmt.Errorf("config: syslog: %w", err)
+	}
+	sc.Facility = strings.ToLower(sc.Facility)
+	if sc.Facility == "" {
+		sc.Facility = "daemon"
+	}
+	if _, ok := syslogFacilities[sc.Facility]; !ok {
+		return fmt.Errorf("config: syslog: unknown facility %q", sc.Facility)
+	}
+	if sc.Tag == "" {
+		sc.Tag = defaultSyslogTag
+	}
+	if strings.ContainsAny(sc.Tag, " \t\n") || len(sc.Tag) > 48 {
+		return fmt.Errorf("config: syslog: tag %q must be at most 48 characters without spaces", sc.Tag)
+	}
+	if sc.CA != "" && !strings.HasPrefix(sc.Address, "tls://") {
+		return fmt.Errorf("config: syslog: ca requires a tls:// address")
+	}
+	return nil
+}
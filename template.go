@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Template variables set per entry, besides those of the vars block.
+const (
+	templateIndex    = "i"        // position of the entry in its range or prefix, from 1
+	templatePort     = "port"     // the entry's port
+	templateListener = "listener" // the entry's name, or its port if unnamed
+)
+
+// templateFuncs are the functions available in entry templates.
+var templateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"hex": func(n int) string { return fmt.Sprintf("%x", n) },
+}
+
+// validateVars checks that the vars block does not shadow a per-entry variable.
+func validateVars(vars map[string]string) error {
+	for _, name := range []string{templateIndex, templatePort, templateListener} {
+		if _, ok := vars[name]; ok {
+			return fmt.Errorf("config: vars: %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// isTemplate reports whether s contains a {{ }} action.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// renderEntry expands the {{ }} templates in the string values of e, with
+// the vars block and the entry's index and port as data. The entry is
+// rebuilt through YAML, so entries generated from one range do not share
+// the nested blocks their templates are rendered into.
+func renderEntry(e *ProxyEntry, vars map[string]string, index int) error {
+	var doc yaml.Node
+	if err := doc.Encode(e); err != nil {
+		return err
+	}
+	if !hasTemplates(&doc) {
+		return nil
+	}
+
+	data := make(map[string]any, len(vars)+3)
+	for k, v := range vars {
+		data[k] = v
+	}
+	data[templateIndex], data[templatePort] = index, e.Port
+	listener := strconv.Itoa(e.Port)
+	if e.Name != "" {
+		name, err := renderString("name", e.Name, data) // the name cannot use .listener
+		if err != nil {
+			return err
+		}
+		listener = name
+	}
+	data[templateListener] = listener
+	if err := renderNode(&doc, "", data); err != nil {
+		return err
+	}
+
+	out := ProxyEntry{origin: e.origin, listenHost: e.listenHost}
+	if err := doc.Decode(&out); err != nil {
+		return err
+	}
+	*e = out
+	return nil
+}
+
+// hasTemplates reports whether any scalar below n is a template.
+func hasTemplates(n *yaml.Node) bool {
+	if n.Kind == yaml.ScalarNode && isTemplate(n.Value) {
+		return true
+	}
+	for _, c := range n.Content {
+		if hasTemplates(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderString renders the template s; key names it in errors.
+func renderString(key, s string, data map[string]any) (string, error) {
+	if !isTemplate(s) {
+		return s, nil
+	}
+	t, err := template.New(key).Option("missingkey=error").Funcs(templateFuncs).Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderNode renders the template scalars below n; key is the mapping key
+// of n, used to name the value in errors.
+func renderNode(n *yaml.Node, key string, data map[string]any) error {
+	if n.Kind == yaml.ScalarNode {
+		if !isTemplate(n.Value) {
+			return nil
+		}
+		s, err := renderString(key, n.Value, data)
+		if err != nil {
+			return err
+		}
+		n.Tag, n.Value = "!!str", s
+		return nil
+	}
+	for i, c := range n.Content {
+		if n.Kind == yaml.MappingNode {
+			if i%2 == 0 {
+				continue // key
+			}
+			key = n.Content[i-1].Value
+		}
+		if err := renderNode(c, key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Defaults of the timeouts and keepalive blocks.
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultDialTimeout      = 15 * time.Second
+
+	defaultKeepAliveIdle     = 30 * time.Second
+	defaultKeepAliveInterval = 10 * time.Second
+	defaultKeepAliveCount    = 3
+)
+
+// The kernel's limits of TCP_KEEPIDLE / TCP_KEEPINTVL (in seconds) and
+// TCP_KEEPCNT.
+const (
+	maxKeepAliveSeconds = 32767
+	maxKeepAliveCount   = 127
+	maxUserTimeout      = math.MaxInt32 * time.Millisecond
+)
+
+// validateTimeouts validates a timeouts block and fills in its defaults.
+func validateTimeouts(t *TimeoutConfig) error {
+	if t.Handshake < 0 || t.Dial < 0 {
+		return fmt.Errorf("values must not be negative")
+	}
+	if t.Handshake == 0 {
+		t.Handshake = defaultHandshakeTimeout
+	}
+	if t.Dial == 0 {
+		t.Dial = defaultDialTimeout
+	}
+	return nil
+}
+
+// validateKeepAlive validates a keepalive block and fills in its defaults.
+func validateKeepAlive(k *KeepAliveConfig) error {
+	if k.UserTimeout < 0 || k.UserTimeout > maxUserTimeout {
+		return fmt.Errorf("user_timeout %s out of range (0-%s)", k.UserTimeout, maxUserTimeout)
+	}
+	if k.UserTimeout > 0 && k.UserTimeout < time.Millisecond {
+		return fmt.Errorf("user_timeout %s is under a millisecond", k.UserTimeout)
+	}
+	if k.Disable {
+		if k.Idle != 0 || k.Interval != 0 || k.Count != 0 {
+			return fmt.Errorf("idle, interval and count do not go with disable")
+		}
+		return nil
+	}
+	for _, d := range []struct {
+		name string
+		v    *time.Duration
+		def  time.Duration
+	}{{"idle", &k.Idle, defaultKeepAliveIdle}, {"interval", &k.Interval, defaultKeepAliveInterval}} {
+		switch {
+		case *d.v == 0:
+			*d.v = d.def
+		case *d.v < time.Second || *d.v > maxKeepAliveSeconds*time.Second:
+			return fmt.Errorf("%s %s out of range (1s-%ds)", d.name, *d.v, maxKeepAliveSeconds)
+		case *d.v%time.Second != 0:
+			return fmt.Errorf("%s %s must be whole seconds", d.name, *d.v)
+		}
+	}
+	switch {
+	case k.Count == 0:
+		k.Count = defaultKeepAliveCount
+	case k.Count < 0 || k.Count > maxKeepAliveCount:
+		return fmt.Errorf("count %d out of range (1-%d)", k.Count, maxKeepAliveCount)
+	}
+	return nil
+}
+
+// handshakeTimeout returns how long clients of e have from accept to a
+// complete SOCKS5 request.
+func (e ProxyEntry) handshakeTimeout() time.Duration {
+	if e.Timeouts == nil {
+		return defaultHandshakeTimeout
+	}
+	return e.Timeouts.Handshake
+}
+
+// dialTimeout returns how long e's dials to a target may take, all
+// attempts together.
+func (e ProxyEntry) dialTimeout() time.Duration {
+	if e.Timeouts == nil {
+		return defaultDialTimeout
+	}
+	return e.Timeouts.Dial
+}
+
+// keepAlive returns the keepalive of e's connections to targets.
+func (e ProxyEntry) keepAlive() KeepAliveConfig {
+	if e.KeepAlive == nil {
+		return KeepAliveConfig{Idle: defaultKeepAliveIdle, Interval: defaultKeepAliveInterval, Count: defaultKeepAliveCount}
+	}
+	return *e.KeepAlive
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Tracing defaults and limits.
+const (
+	defaultTraceService = "superproxy"
+	traceQueueSize      = 4096 // finished sessions waiting for export
+	traceBatchSpans     = 512  // spans per export request
+	traceFlushInterval  = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+)
+
+// OTLP span kinds and status codes (opentelemetry/proto/trace/v1).
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	statusError      = 2
+)
+
+// tracer exports a trace of each sampled SOCKS5 session to an OTLP/HTTP
+// collector: a server span for the session with child spans for the
+// handshake, DNS resolution, connect and relay phases. Spans are sent in
+// batches when the session ends, by OTLP's JSON encoding, so no SDK is
+// needed.
+//
+// A nil *tracer traces nothing.
+type tracer struct {
+	url      string
+	headers  map[string]string
+	rate     float64
+	resource otlpResource
+	client   *http.Client
+
+	queue   chan []otlpSpan
+	dropped atomic.Int64 // sessions lost to a full queue
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newTracer returns a tracer for cfg, or nil if cfg is nil (tracing disabled).
+func newTracer(cfg *TracingConfig) *tracer {
+	if cfg == nil {
+		return nil
+	}
+	u, _ := otlpTracesURL(cfg.Endpoint) // checked by validateTracing
+	return &tracer{
+		url:      u,
+		headers:  cfg.Headers,
+		rate:     cfg.SampleRate,
+		resource: otlpResource{Attributes: []otlpKeyValue{otlpAttr("service.name", cfg.ServiceName)}},
+		client:   &http.Client{Timeout: traceExportTimeout},
+		queue:    make(chan []otlpSpan, traceQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// otlpTracesURL returns the traces URL of an OTLP/HTTP endpoint: a bare
+// collector address gets the standard /v1/traces path.
+func otlpTracesURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("expected an http:// or https:// URL")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// Run exports finished sessions until Stop, then flushes what is queued.
+func (t *tracer) Run() {
+	defer close(t.done)
+	logInfo("[trace] exporting %s to %s", sampledSessions(t.rate), t.url)
+
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	failing := false
+	flush := func() {
+		if n := t.dropped.Swap(0); n > 0 {
+			logWarn("[trace] export queue full, dropped %d sessions", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		err := t.export(batch)
+		switch {
+		case err != nil && !failing:
+			logWarn("[trace] export to %s failed: %v (repeats are logged at debug level)", t.url, err)
+			failing = true
+		case err != nil:
+			logDebug("[trace] export to %s failed: %v", t.url, err)
+		case failing:
+			logInfo("[trace] export to %s recovered", t.url)
+			failing = false
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case spans := <-t.queue:
+			batch = append(batch, spans...)
+			if len(batch) >= traceBatchSpans {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue...)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// Stop ends Run after a last export. Sessions still open are not
+// exported. It is a no-op on nil.
+func (t *tracer) Stop() {
+	if t != nil {
+		close(t.stop)
+	}
+}
+
+// wait waits up to timeout for Run to finish its last export.
+func (t *tracer) wait(timeout time.Duration) {
+	if t == nil {
+		return
+	}
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+	}
+}
+
+// export sends spans to the collector in one request.
+func (t *tracer) export(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   t.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "superproxy"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// session starts the trace of a connection accepted by listener entry, or
+// returns nil if the tracer is nil or the session is not sampled.
+func (t *tracer) session(entry ProxyEntry, client net.Conn) *sessionTrace {
+	if t == nil || (t.rate < 1 && mrand.Float64() >= t.rate) {
+		return nil
+	}
+	s := &sessionTrace{t: t}
+	rand.Read(s.traceID[:])
+	s.root = s.newSpan("socks5.session", spanKindServer)
+	s.root.attr("superproxy.listener.port", entry.Port)
+	if entry.Name != "" {
+		s.root.attr("superproxy.listener.name", entry.Name)
+	}
+	if host, port, err := net.SplitHostPort(client.RemoteAddr().String()); err == nil {
+		s.root.attr("client.address", host)
+		if n, err := strconv.Atoi(port); err == nil {
+			s.root.attr("client.port", n)
+		}
+	}
+	return s
+}
+
+// sessionTrace collects the spans of one session until it ends. It is only
+// used by the connection's goroutine.
+//
+// A nil *sessionTrace records nothing, and its phases are nil spans.
+type sessionTrace struct {
+	t       *tracer
+	traceID [16]byte
+	root    *traceSpan
+	spans   []*traceSpan // phases, in start order
+}
+
+// traceSpan is one span of a session. A nil *traceSpan records nothing.
+type traceSpan struct {
+	id         [8]byte
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      []otlpKeyValue
+	events     []otlpEvent
+	err        string
+}
+
+func (s *sessionTrace) newSpan(name string, kind int) *traceSpan {
+	sp := &traceSpan{name: name, kind: kind, start: time.Now()}
+	rand.Read(sp.id[:])
+	return sp
+}
+
+// phase starts a child span of the session.
+func (s *sessionTrace) phase(name string, kind int) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	sp := s.newSpan(name, kind)
+	s.spans = append(s.spans, sp)
+	return sp
+}
+
+// target records the destination the client asked for once it is known.
+func (s *sessionTrace) target(host string, port uint16) {
+	if s == nil {
+		return
+	}
+	s.root.attr("server.address", host)
+	s.root.attr("server.port", int(port))
+}
+
+// fail marks the session as failed with err.
+func (s *sessionTrace) fail(err error) {
+	if s != nil && s.root.err == "" {
+		s.root.err = err.Error()
+	}
+}
+
+// finish ends the session and queues its spans for export. A phase still
+// open means the session ended in it (the client went away or sent
+// something invalid), which fails both it and the session.
+func (s *sessionTrace) finish() {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	out := make([]otlpSpan, 0, len(s.spans)+1)
+	for _, sp := range s.spans {
+		if sp.end.IsZero() {
+			sp.end, sp.err = now, "session ended during "+sp.name
+			s.fail(fmt.Errorf("ended during %s", sp.name))
+		}
+		out = append(out, sp.otlp(s.traceID, s.root.id[:]))
+	}
+	s.root.end = now
+	out = append(out, s.root.otlp(s.traceID, nil))
+	select {
+	case s.t.queue <- out:
+	default:
+		s.t.dropped.Add(1)
+	}
+}
+
+// endWith ends the span, failed if err is not nil.
+func (sp *traceSpan) endWith(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	if err != nil {
+		sp.err = err.Error()
+	}
+}
+
+// attr sets an attribute; value is a string or an integer.
+func (sp *traceSpan) attr(key string, value any) {
+	if sp == nil {
+		return
+	}
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	sp.attrs = append(sp.attrs, kv)
+}
+
+// event records a point in time within the span, e.g. a failed attempt.
+func (sp *traceSpan) event(name string, attrs ...otlpKeyValue) {
+	if sp != nil {
+		sp.events = append(sp.events, otlpEvent{Time: unixNano(time.Now()), Name: name, Attributes: attrs})
+	}
+}
+
+func (sp *traceSpan) otlp(traceID [16]byte, parent []byte) otlpSpan {
+	out := otlpSpan{
+		TraceID:      hex.EncodeToString(traceID[:]),
+		SpanID:       hex.EncodeToString(sp.id[:]),
+		ParentSpanID: hex.EncodeToString(parent),
+		Name:         sp.name,
+		Kind:         sp.kind,
+		Start:        unixNano(sp.start),
+		End:          unixNano(sp.end),
+		Attributes:   sp.attrs,
+		Events:       sp.events,
+	}
+	if sp.err != "" {
+		out.Status = otlpStatus{Code: statusError, Message: sp.err}
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// sampledSessions describes a sample rate for logs, e.g. "25% of sessions".
+func sampledSessions(rate float64) string {
+	if rate >= 1 {
+		return "all sessions"
+	}
+	return strconv.FormatFloat(rate*100, 'g', 3, 64) + "% of sessions"
+}
+
+// OTLP/HTTP JSON request (opentelemetry/proto/collector/trace/v1). IDs are
+// hex and 64-bit integers decimal strings, as the JSON mapping requires.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Events       []otlpEvent    `json:"events,omitempty"`
+	Status       otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpEvent struct {
+	Time       string         `json:"timeUnixNano"`
+	Name       string         `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpAttr returns a string attribute.
+func otlpAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+// validateTracing validates the tracing block and fills in its defaults.
+func validateTracing(tc *TracingConfig) error {
+	if tc.Endpoint == "" {
+		return fmt.Errorf("config: tracing: 'endpoint' is required (e.g. \"http://localhost:4318\")")
+	}
+	if _, err := otlpTracesURL(tc.Endpoint); err != nil {
+		return fmt.Errorf("config: tracing: endpoint %q: %w", tc.Endpoint, err)
+	}
+	if tc.SampleRate == 0 {
+		tc.SampleRate = 1
+	}
+	if tc.SampleRate < 0 || tc.SampleRate > 1 {
+		return fmt.Errorf("config: tracing: sample_rate must be between 0 and 1")
+	}
+	if tc.ServiceName == "" {
+		tc.ServiceName = defaultTraceService
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/io_uring.h.
+const (
+	uringOpSend = 26
+	uringOpRecv = 27
+
+	uringSetupSQPoll = 1 << 1
+	uringSetupClamp  = 1 << 4
+
+	uringEnterGetEvents = 1 << 0
+	uringEnterSQWakeup  = 1 << 1
+
+	uringSQNeedWakeup = 1 << 0
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatNoDrop     = 1 << 1
+	uringFeatFastPoll   = 1 << 5
+
+	uringOffSQRing = 0
+	uringOffSQEs   = 0x10000000
+)
+
+// uringSQIdle is how long, in milliseconds, the kernel's submission thread
+// polls an idle ring before it sleeps until woken.
+const uringSQIdle = 50
+
+type uringParams struct {
+	sqEntries, cqEntries, flags uint32
+	sqThreadCPU, sqThreadIdle   uint32
+	features, wqFD              uint32
+	resv                        [3]uint32
+	sqOff                       uringSQOffsets
+	cqOff                       uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringSQE is a submission queue entry, as far as recv and send use it.
+type uringSQE struct {
+	opcode, flags         uint8
+	ioprio                uint16
+	fd                    int32
+	off, addr             uint64
+	len, opFlags          uint32
+	userData              uint64
+	bufIndex, personality uint16
+	spliceFDIn            int32
+	addr3, pad            uint64
+}
+
+// uringCQE is a completion queue entry.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring instance the relays share. Submitters fill entries
+// under mu; one goroutine reaps the completions and hands each result to
+// the slot its operation waits on, the entry's user data. Only relays use
+// it: connections are still accepted through the netpoller.
+type uring struct {
+	fd      int
+	entries uint32
+	sqpoll  bool // the kernel polls the submission queue itself
+
+	mu      sync.Mutex
+	sqHead  *uint32
+	sqTail  *uint32
+	sqFlags *uint32
+	sqMask  uint32
+	sqes    []uringSQE
+	pending uint32 // entries not yet passed to io_uring_enter (without sqpoll)
+	slots   []chan int32
+	free    []uint32
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+}
+
+// newURing sets up a ring of entries submission entries, with a kernel
+// thread polling it if the kernel lets the process have one. It needs
+// Linux 5.7 or later, which waits for sockets to be ready on its own.
+func newURing(entries int) (*uring, error) {
+	p := uringParams{flags: uringSetupSQPoll | uringSetupClamp, sqThreadIdle: uringSQIdle}
+	fd, err := uringSetup(entries, &p)
+	if err != nil {
+		p = uringParams{flags: uringSetupClamp}
+		fd, err = uringSetup(entries, &p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("io_uring_setup: %w", err)
+	}
+	const need = uringFeatSingleMmap | uringFeatNoDrop | uringFeatFastPoll
+	if p.features&need != need {
+		unix.Close(fd)
+		return nil, errors.New("the kernel's io_uring lacks features this relay needs (Linux 5.7 or later)")
+	}
+
+	size := max(p.sqOff.array+p.sqEntries*4, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	const prot, flags = unix.PROT_READ | unix.PROT_WRITE, unix.MAP_SHARED | unix.MAP_POPULATE
+	ring, err := unix.Mmap(fd, uringOffSQRing, int(size), prot, flags)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("mapping the rings: %w", err)
+	}
+	sqes, err := unix.Mmap(fd, uringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), prot, flags)
+	if err != nil {
+		unix.Munmap(ring)
+		unix.Close(fd)
+		return nil, fmt.Errorf("mapping the submission entries: %w", err)
+	}
+
+	at := func(off uint32) *uint32 { return (*uint32)(unsafe.Pointer(&ring[off])) }
+	r := &uring{
+		fd:      fd,
+		entries: p.sqEntries,
+		sqpoll:  p.flags&uringSetupSQPoll != 0,
+		sqHead:  at(p.sqOff.head),
+		sqTail:  at(p.sqOff.tail),
+		sqFlags: at(p.sqOff.flags),
+		sqMask:  *at(p.sqOff.ringMask),
+		sqes:    unsafe.Slice((*uringSQE)(unsafe.Pointer(&sqes[0])), p.sqEntries),
+		cqHead:  at(p.cqOff.head),
+		cqTail:  at(p.cqOff.tail),
+		cqMask:  *at(p.cqOff.ringMask),
+		cqes:    unsafe.Slice((*uringCQE)(unsafe.Pointer(&ring[p.cqOff.cqes])), p.cqEntries),
+	}
+	// Submission entry i always sits in slot i of the array.
+	array := unsafe.Slice(at(p.sqOff.array), p.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+	go r.reap()
+	return r, nil
+}
+
+func uringSetup(entries int, p *uringParams) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func (r *uring) enter(submit, wait, flags uint32) (int, error) {
+	n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(wait), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// mode describes how the ring is driven, for the log.
+func (r *uring) mode() string {
+	if r.sqpoll {
+		return fmt.Sprintf("%d entries, polled by the kernel", r.entries)
+	}
+	return fmt.Sprintf("%d entries", r.entries)
+}
+
+// do submits the operation op (recv or send) on fd with buf and waits for
+// its result: the bytes moved, or a negated errno.
+func (r *uring) do(op uint8, fd int, buf []byte, opFlags uint32) int32 {
+	r.mu.Lock()
+	var id uint32
+	if n := len(r.free); n > 0 {
+		id = r.free[n-1]
+		r.free = r.free[:n-1]
+	} else {
+		id = uint32(len(r.slots))
+		r.slots = append(r.slots, make(chan int32, 1))
+	}
+	for *r.sqTail-atomic.LoadUint32(r.sqHead) == r.entries {
+		// Full, which only happens while the kernel thread catches up.
+		r.wakeup()
+		r.mu.Unlock()
+		runtime.Gosched()
+		r.mu.Lock()
+	}
+	tail := *r.sqTail
+	r.sqes[tail&r.sqMask] = uringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		opFlags:  opFlags,
+		userData: uint64(id),
+	}
+	atomic.StoreUint32(r.sqTail, tail+1)
+	if r.sqpoll {
+		r.wakeup()
+	} else {
+		r.pending++
+		r.submit()
+	}
+	ch := r.slots[id]
+	r.mu.Unlock()
+
+	res := <-ch
+	runtime.KeepAlive(buf)
+	r.mu.Lock()
+	r.free = append(r.free, id)
+	r.mu.Unlock()
+	return res
+}
+
+// submit passes the pending entries to the kernel; r.mu is held. While it
+// takes no more (EAGAIN, or EBUSY with completions overflowing), submit
+// yields to reap, which makes room, and tries again: an entry left pending
+// would wait for another relay's submission, and its operation with it.
+func (r *uring) submit() {
+	for r.pending > 0 {
+		n, err := r.enter(r.pending, 0, 0)
+		switch err {
+		case nil:
+			r.pending -= uint32(n)
+		case unix.EINTR:
+		case unix.EAGAIN, unix.EBUSY:
+			r.mu.Unlock()
+			runtime.Gosched()
+			r.mu.Lock()
+		default:
+			logWarn("[main] io_uring: submitting: %v", err)
+			return
+		}
+	}
+}
+
+// wakeup wakes the kernel thread polling the submission queue if it went
+// to sleep.
+func (r *uring) wakeup() {
+	if r.sqpoll && atomic.LoadUint32(r.sqFlags)&uringSQNeedWakeup != 0 {
+		r.enter(0, 0, uringEnterSQWakeup)
+	}
+}
+
+// reap waits for completions and delivers them to their slots.
+func (r *uring) reap() {
+	for {
+		if _, err := r.enter(0, 1, uringEnterGetEvents); err != nil && err != unix.EINTR && err != unix.EBUSY {
+			logWarn("[main] io_uring: waiting for completions: %v", err)
+			return
+		}
+		head := *r.cqHead
+		tail := atomic.LoadUint32(r.cqTail)
+		if head == tail {
+			continue
+		}
+		r.mu.Lock()
+		for ; head != tail; head++ {
+			c := &r.cqes[head&r.cqMask]
+			r.slots[c.userData] <- c.res
+		}
+		r.mu.Unlock()
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+// copy copies from src to dst through the ring, a recv from src and sends
+// to dst of what it got at a time, and returns the number of bytes copied;
+// ok is false, with nothing copied, if src and dst are not both TCP
+// connections, for the caller to copy another way. The ring works on
+// duplicates of their descriptors, so closing the connections cannot hand
+// their numbers to other files while an operation is pending; a connection
+// killed through the table is shut down first, which ends them.
+func (r *uring) copy(dst, src net.Conn, bufs *relayBufs) (n int64, ok bool) {
+	sfd, err := dupConnFD(src)
+	if err != nil {
+		return 0, false
+	}
+	defer unix.Close(sfd)
+	dfd, err := dupConnFD(dst)
+	if err != nil {
+		return 0, false
+	}
+	defer unix.Close(dfd)
+
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	for {
+		got := r.do(uringOpRecv, sfd, buf, 0)
+		if got <= 0 {
+			return n, true
+		}
+		for off := int32(0); off < got; {
+			sent := r.do(uringOpSend, dfd, buf[off:got], unix.MSG_NOSIGNAL)
+			if sent <= 0 {
+				return n, true
+			}
+			off += sent
+			n += int64(sent)
+		}
+	}
+}
+
+// dupConnFD returns a duplicate of the descriptor of the TCP connection c.
+func dupConnFD(c net.Conn) (int, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return -1, errors.New("not a TCP connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	var derr error
+	if err := rc.Control(func(s uintptr) {
+		fd, derr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return -1, err
+	}
+	return fd, derr
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Username/password authentication (RFC 1929)
+const (
+	authUserPass = 0x02
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+)
+
+// userStats counts the sessions of one user on all listeners, across
+// reloads.
+type userStats struct {
+	Total     atomic.Int64 // sessions logged in
+	Active    atomic.Int64 // sessions being served
+	BytesUp   atomic.Int64 // client → target
+	BytesDown atomic.Int64 // target → client
+
+	Quota quotaUsage // traffic counted against the user's quota
+
+	egress atomic.Pointer[byteRate] // of the user's egress_limit
+}
+
+// userCounters holds the stats of every user seen since the start, by name,
+// so a reload that keeps a user keeps its counters and quota usage.
+var userCounters struct {
+	mu     sync.Mutex
+	byName map[string]*userStats
+}
+
+// statsOfUser returns the counters of the user name.
+func statsOfUser(name string) *userStats {
+	userCounters.mu.Lock()
+	defer userCounters.mu.Unlock()
+	if userCounters.byName == nil {
+		userCounters.byName = make(map[string]*userStats)
+	}
+	st := userCounters.byName[name]
+	if st == nil {
+		st = new(userStats)
+		userCounters.byName[name] = st
+	}
+	return st
+}
+
+// egressBucket returns the limiter pacing all connections of the user to
+// rate bytes per second (nil if 0), keeping the running one if its rate did
+// not change, so a reload does not refill it.
+func (st *userStats) egressBucket(rate float64) *byteRate {
+	if cur := st.egress.Load(); cur != nil && cur.rate == rate {
+		return cur
+	}
+	b := newByteRate(rate)
+	st.egress.Store(b)
+	return b
+}
+
+// account is a user of the running configuration.
+type account struct {
+	cfg    UserConfig
+	pool   *outboundPool // nil: the listener's
+	ports  map[int]bool  // nil: every listener with auth
+	stats  *userStats
+	egress *byteRate    // shared by all its sessions (nil: no egress_limit)
+	radius *radiusLogin // the Access-Accept of a radius login, for accounting
+}
+
+// username returns the name of a, or "" for sessions without a login.
+func (a *account) username() string {
+	if a == nil {
+		return ""
+	}
+	return a.cfg.Name
+}
+
+// admit counts a new session of the user as active unless that exceeds its
+// max_connections. The session releases the count with release.
+func (a *account) admit() bool {
+	if n := a.stats.Active.Add(1); a.cfg.MaxConnections > 0 && n > int64(a.cfg.MaxConnections) {
+		a.stats.Active.Add(-1)
+		return false
+	}
+	a.stats.Total.Add(1)
+	return true
+}
+
+func (a *account) release() {
+	a.stats.Active.Add(-1)
+}
+
+// add counts the bytes of a closed session of the user.
+func (a *account) add(up, down int64) {
+	a.stats.BytesUp.Add(up)
+	a.stats.BytesDown.Add(down)
+	if a.cfg.Quota != nil {
+		a.stats.Quota.used.Add(up + down)
+	}
+}
+
+// externalUsers holds the accounts of the users an external backend
+// (auth_http, ldap, radius) allowed and the users section does not have,
+// by name.
+var externalUsers struct {
+	mu       sync.Mutex
+	accounts map[string]*account
+}
+
+// externalAccount returns the account, without limits, of the user name
+// allowed by an external backend.
+func externalAccount(name string) *account {
+	externalUsers.mu.Lock()
+	defer externalUsers.mu.Unlock()
+	if externalUsers.accounts == nil {
+		externalUsers.accounts = make(map[string]*account)
+	}
+	a := externalUsers.accounts[name]
+	if a == nil {
+		a = &account{cfg: UserConfig{Name: name}, stats: statsOfUser(name)}
+		externalUsers.accounts[name] = a
+	}
+	return a
+}
+
+// loginCache remembers the decisions of an external backend by a hash of
+// the login (see loginKey), allows and denies each for their own TTL. Like
+// the fail cache, it makes room by dropping expired decisions first, then
+// arbitrary ones.
+type loginCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]loginDecision
+	size    int
+}
+
+type loginDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+func newLoginCache(size int) *loginCache {
+	return &loginCache{entries: make(map[[sha256.Size]byte]loginDecision), size: size}
+}
+
+// loginSecret keys loginKey. It is drawn afresh by every process, so a
+// key found in memory or a core dump is no unsalted hash of a password
+// that could be looked up or brute-forced offline.
+var loginSecret = newLoginSecret()
+
+func newLoginSecret() []byte {
+	b := make([]byte, sha256.Size)
+	if _, err := rand.Read(b); err != nil {
+		panic("login cache key: " + err.Error())
+	}
+	return b
+}
+
+// loginKey is the HMAC-SHA256, under loginSecret, of the parts of a login
+// a decision depends on.
+func loginKey(parts ...string) [sha256.Size]byte {
+	h := hmac.New(sha256.New, loginSecret)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// get returns the cached decision for key, if there is one.
+func (c *loginCache) get(key [sha256.Size]byte) (allow, ok bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[key]
+	if ok && !now.Before(d.expires) {
+		delete(c.entries, key)
+		return false, false
+	}
+	return d.allow, ok
+}
+
+// put caches a decision for allowTTL if it allows, else for denyTTL.
+func (c *loginCache) put(key [sha256.Size]byte, allow bool, allowTTL, denyTTL time.Duration) {
+	now := time.Now()
+	ttl := denyTTL
+	if allow {
+		ttl = allowTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, d := range c.entries {
+			if !now.Before(d.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = loginDecision{allow: allow, expires: now.Add(ttl)}
+}
+
+// userDirectory is the accounts of the users section.
+type userDirectory struct {
+	accounts map[string]*account
+	names    []string // sorted
+}
+
+// newUserDirectory builds the accounts of validated users, whose outbound
+// pools skip the addresses health marks unhealthy. It returns nil without
+// users.
+func newUserDirectory(users []UserConfig, health *healthChecker) (*userDirectory, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	d := &userDirectory{accounts: make(map[string]*account, len(users))}
+	for _, u := range users {
+		a := &account{cfg: u, stats: statsOfUser(u.Name)}
+		a.egress = a.stats.egressBucket(u.egressRate)
+		if len(u.Outbound) > 0 {
+			pool, err := newOutboundPool(u.Outbound, health)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", u.Name, err)
+			}
+			a.pool = pool
+		}
+		if len(u.Ports) > 0 {
+			a.ports = make(map[int]bool, len(u.Ports))
+			for _, port := range u.Ports {
+				a.ports[port] = true
+			}
+		}
+		d.accounts[u.Name] = a
+		d.names = append(d.names, u.Name)
+	}
+	sort.Strings(d.names)
+	return d, nil
+}
+
+// login returns the account name logs in to with password on entry from
+// client, or nil and the reason it is refused. On a listener with
+// auth_backend ldap or radius, that server decides; otherwise a user of the users
+// section with a password logs in with it, and any other user with the
+// hash in the users_file or, failing that, if auth_http allows it. Users
+// keep the limits of their users entry, if they have one. err reports that
+// an external backend could not decide.
+func (d *userDirectory) login(name string, password []byte, entry ProxyEntry, client net.Addr) (a *account, reason string, err error) {
+	if d != nil {
+		a = d.accounts[name]
+	}
+	switch {
+	case entry.AuthBackend == authBackendLDAP:
+		ok, err := ldapAuth.check(name, password)
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			return nil, fmt.Sprintf("ldap denied user %q", name), nil
+		}
+		if a == nil {
+			a = externalAccount(name)
+		}
+	case entry.AuthBackend == authBackendRADIUS:
+		login, err := radiusAuth.check(name, password, client, entry)
+		if err != nil {
+			return nil, "", err
+		}
+		if login == nil {
+			return nil, fmt.Sprintf("radius denied user %q", name), nil
+		}
+		if a == nil {
+			a = externalAccount(name)
+		}
+		session := *a // the same user, stats and limits, with this login's Class
+		session.radius = login
+		a = &session
+	case a != nil && a.cfg.Password != "":
+		if subtle.ConstantTimeCompare([]byte(a.cfg.Password), password) != 1 {
+			return nil, fmt.Sprintf("wrong password for user %q", name), nil
+		}
+	default:
+		fa, known, ok := passwordFile.verify(name, password)
+		if !known && authHTTP.enabled() {
+			fa, ok, err = authHTTP.check(name, password, client, entry)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				return nil, fmt.Sprintf("auth_http denied user %q", name), nil
+			}
+			known = true
+		}
+		switch {
+		case !known:
+			return nil, fmt.Sprintf("unknown user %q", name), nil
+		case !ok:
+			return nil, fmt.Sprintf("wrong password for user %q", name), nil
+		case a == nil:
+			a = fa
+		}
+	}
+	if a.ports != nil && !a.ports[entry.Port] {
+		return nil, fmt.Sprintf("user %q may not use this listener", name), nil
+	}
+	return a, "", nil
+}
+
+// authenticate runs the username/password subnegotiation with client
+// (RFC 1929) and returns the account it logged in to, counted as active,
+// or nil after replying failure. Wrong credentials count as a failed
+// handshake for auto_ban; a user over its limits or an auth_http outage
+// does not.
+func (l *listener) authenticate(client net.Conn) *account {
+	// VER | ULEN | UNAME | PLEN | PASSWD
+	var hdr [2]byte
+	if _, err := io.ReadFull(client, hdr[:]); err != nil {
+		l.handshakeFailed(client, "reading credentials", err)
+		return nil
+	}
+	if hdr[0] != userPassVersion {
+		l.handshakeFailed(client, fmt.Sprintf("username/password version %d, not 1", hdr[0]), nil)
+		return nil
+	}
+	var nameBuf, passBuf [255]byte
+	name := nameBuf[:hdr[1]]
+	if _, err := io.ReadFull(client, name); err != nil {
+		l.handshakeFailed(client, "reading credentials", err)
+		return nil
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(client, plen[:]); err != nil {
+		l.handshakeFailed(client, "reading credentials", err)
+		return nil
+	}
+	password := passBuf[:plen[0]]
+	if _, err := io.ReadFull(client, password); err != nil {
+		l.handshakeFailed(client, "reading credentials", err)
+		return nil
+	}
+
+	a, reason, err := l.users.login(string(name), password, l.entry, client.RemoteAddr())
+	if err != nil {
+		client.Write([]byte{userPassVersion, userPassFailure})
+		if logSampling.allow(sampleUser, l.entry.tag(), levelWarn) {
+			logWarn("[socks5:%s] %v; refusing user %q from %s", l.entry.tag(), err, name, client.RemoteAddr())
+		}
+		return nil
+	}
+	if a == nil {
+		client.Write([]byte{userPassVersion, userPassFailure})
+		l.handshakeFailed(client, reason, nil)
+		return nil
+	}
+	switch {
+	case a.stats.Quota.exceeded.Load():
+		reason = "is over its quota"
+	case !a.admit():
+		reason = fmt.Sprintf("max_connections (%d) reached", a.cfg.MaxConnections)
+	}
+	if reason != "" {
+		client.Write([]byte{userPassVersion, userPassFailure})
+		if logSampling.allow(sampleUser, l.entry.tag(), levelWarn) {
+			logWarn("[socks5:%s] user %q %s, closing %s", l.entry.tag(), a.cfg.Name, reason, client.RemoteAddr())
+		}
+		return nil
+	}
+	if _, err := client.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+		a.release()
+		l.handshakeFailed(client, "writing authentication status", err)
+		return nil
+	}
+	return a
+}
+
+// userInfo is the API representation of a user.
+type userInfo struct {
+	Name              string       `json:"name"`
+	Outbound          []string     `json:"outbound,omitempty"` // default: the listener's
+	Ports             []int        `json:"ports,omitempty"`    // default: every listener with auth
+	MaxConnections    int          `json:"max_connections,omitempty"`
+	Bandwidth         string       `json:"bandwidth,omitempty"`    // of each connection, e.g. "10Mbit/s up, 50Mbit/s down"
+	EgressLimit       string       `json:"egress_limit,omitempty"` // of all connections together, e.g. "100Mbit/s"
+	ConnectionsTotal  int64        `json:"connections_total"`
+	ConnectionsActive int64        `json:"connections_active"`
+	BytesUp           int64        `json:"bytes_up"`
+	BytesDown         int64        `json:"bytes_down"`
+	Quota             *quotaStatus `json:"quota,omitempty"` // with a quota: its use in the current period
+}
+
+// list returns the users with their stats, by name: those of the users
+// section, those only in the users_file and those an external backend
+// allowed.
+func (d *userDirectory) list() []userInfo {
+	out := []userInfo{}
+	var names []string
+	accounts := make(map[string]*account)
+	if d != nil {
+		names = append(names, d.names...)
+		for name, a := range d.accounts {
+			accounts[name] = a
+		}
+	}
+	if c := passwordFile.creds.Load(); c != nil {
+		for _, name := range c.names {
+			if accounts[name] == nil {
+				names = append(names, name)
+				accounts[name] = c.accounts[name]
+			}
+		}
+	}
+	externalUsers.mu.Lock()
+	for name, a := range externalUsers.accounts {
+		if accounts[name] == nil {
+			names = append(names, name)
+			accounts[name] = a
+		}
+	}
+	externalUsers.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		a := accounts[name]
+		info := userInfo{
+			Name:              name,
+			Ports:             a.cfg.Ports,
+			MaxConnections:    a.cfg.MaxConnections,
+			ConnectionsTotal:  a.stats.Total.Load(),
+			ConnectionsActive: a.stats.Active.Load(),
+			BytesUp:           a.stats.BytesUp.Load(),
+			BytesDown:         a.stats.BytesDown.Load(),
+		}
+		for _, out := range a.cfg.Outbound {
+			info.Outbound = append(info.Outbound, out.IPv6)
+		}
+		if bw := a.cfg.Bandwidth; bw != nil {
+			info.Bandwidth = bandwidthSummary(bw)
+		}
+		if a.cfg.egressRate > 0 {
+			info.EgressLimit = formatRate(a.cfg.egressRate)
+		}
+		if a.cfg.Quota != nil {
+			info.Quota = a.stats.Quota.status(a.cfg.Quota)
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// outboundEntries returns the proxy entries of cfg followed by one entry,
+// without a port, per user with its own outbound addresses: everything
+// that provisions, health-checks or inspects outbound addresses takes them
+// from here.
+func outboundEntries(cfg *Config) []ProxyEntry {
+	entries := cfg.Proxies
+	for _, u := range cfg.Users {
+		if len(u.Outbound) > 0 {
+			entries = append(entries[:len(entries):len(entries)], ProxyEntry{Name: "user " + u.Name, Outbound: u.Outbound})
+		}
+	}
+	return entries
+}
+
+// validateUsers validates the users section and reads the users_file;
+// listeners with auth need one of them or auth_http, unless they use ldap
+// or radius.
+func validateUsers(cfg *Config) error {
+	auth, local := make(map[int]bool), false
+	for _, p := range cfg.Proxies {
+		if p.Auth {
+			auth[p.Port] = true
+			local = local || (p.AuthBackend != authBackendLDAP && p.AuthBackend != authBackendRADIUS)
+		}
+	}
+	if local && len(cfg.Users) == 0 && cfg.UsersFile == "" && cfg.AuthHTTP == nil {
+		return fmt.Errorf("config: listeners with auth need users, a users_file or auth_http")
+	}
+	if cfg.UsersFile != "" {
+		if _, err := readUsersFile(cfg.UsersFile); err != nil {
+			return fmt.Errorf("config: users_file: %w", err)
+		}
+	}
+	seen := make(map[string]bool, len(cfg.Users))
+	for i := range cfg.Users {
+		u := &cfg.Users[i]
+		name := fmt.Sprintf("users[%d]", i)
+		switch {
+		case u.Name == "":
+			return fmt.Errorf("config: %s: name is required", name)
+		case len(u.Name) > 255:
+			return fmt.Errorf("config: %s: name is longer than 255 bytes", name)
+		case seen[u.Name]:
+			return fmt.Errorf("config: %s: duplicate name %q", name, u.Name)
+		}
+		seen[u.Name] = true
+		name = "user " + u.Name
+		if u.Password == "" && cfg.UsersFile == "" && cfg.AuthHTTP == nil && cfg.LDAP == nil && cfg.RADIUS == nil {
+			return fmt.Errorf("config: %s: password is required without a users_file, auth_http, ldap or radius", name)
+		}
+		if len(u.Password) > 255 {
+			return fmt.Errorf("config: %s: password is longer than 255 bytes", name)
+		}
+		switch {
+		case u.IPv6 != "" && len(u.Outbound) > 0:
+			return fmt.Errorf("config: %s: 'ipv6' and 'outbound' are mutually exclusive", name)
+		case u.IPv6 != "":
+			ip, err := parseEntryIPv6(u.IPv6)
+			if err != nil {
+				return fmt.Errorf("config: %s: %w", name, err)
+			}
+			u.IPv6, u.Outbound = ip, []OutboundAddr{{IPv6: ip, Weight: 1}}
+		case len(u.Outbound) > 0:
+			if err := validatePool(u.Outbound); err != nil {
+				return fmt.Errorf("config: %s.%w", name, err)
+			}
+		}
+		for _, port := range u.Ports {
+			if !auth[port] {
+				return fmt.Errorf("config: %s: port %d is not a listener with auth", name, port)
+			}
+		}
+		if u.MaxConnections < 0 {
+			return fmt.Errorf("config: %s: max_connections %d must not be negative", name, u.MaxConnections)
+		}
+		if u.Bandwidth != nil {
+			if err := validateBandwidth(u.Bandwidth); err != nil {
+				return fmt.Errorf("config: %s.bandwidth: %w", name, err)
+			}
+		}
+		if u.Quota != nil {
+			if err := validateQuota(u.Quota); err != nil {
+				return fmt.Errorf("config: %s.quota: %w", name, err)
+			}
+		}
+		u.egressRate = 0
+		if u.EgressLimit != "" {
+			rate, err := parseRate(u.EgressLimit)
+			if err != nil {
+				return fmt.Errorf("config: %s: egress_limit: %w", name, err)
+			}
+			u.egressRate = rate
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchConfig watches the config file and the files it includes, and
+// signals on the returned channel when their contents have changed and no
+// further changes arrived for debounce, so a burst of writes triggers a
+// single reload.
+//
+// Parent directories are watched rather than the files themselves: editors
+// and Kubernetes ConfigMap updates replace a file (or a symlink to it)
+// instead of writing in place, which would silently end a watch on the old
+// inode, and a directory watch also sees files added to an include glob.
+// Any event rechecks the files, and only a real content change is reported.
+func watchConfig(path, format string, debounce time.Duration) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+	last, dirs := configSnapshot(path, format)
+	if err := w.Add(dirs[0]); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+	for _, dir := range dirs[1:] {
+		w.Add(dir) // best effort: an include directory may not exist yet
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		for {
+			select {
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				timer.Reset(debounce)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logWarn("[watch] %v", err)
+			case <-timer.C:
+				data, dirs := configSnapshot(path, format)
+				if data == nil || bytes.Equal(data, last) {
+					continue // mid-replace, or touched without changes
+				}
+				last = data
+				for _, dir := range dirs {
+					w.Add(dir) // directories of newly included files
+				}
+				select {
+				case changes <- struct{}{}:
+				default: // a reload is already pending
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// configSnapshot returns the contents of the config file followed by those
+// of its included files, and the directories holding them, the main file's
+// first. data is nil if the main file cannot be read.
+func configSnapshot(path, format string) (data []byte, dirs []string) {
+	dirs = []string{filepath.Dir(path)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, dirs
+	}
+	var files []string
+	if cfg, err := readConfigFile(path, format); err == nil {
+		files, _ = includedFiles(path, cfg.Include)
+		for _, pattern := range cfg.Include {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			dirs = append(dirs, filepath.Dir(pattern))
+		}
+	}
+	for _, f := range files {
+		b, _ := os.ReadFile(f)
+		data = append(data, 0)
+		data = append(data, f...)
+		data = append(data, 0)
+		data = append(data, b...)
+	}
+	return data, dirs
+}
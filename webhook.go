@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook events.
+const (
+	hookBindFailed        = "listener.bind_failed"    // a listener's port could not be opened
+	hookUnhealthy         = "outbound.unhealthy"      // health checks took an outbound address out of its pools
+	hookRecovered         = "outbound.recovered"      // ... and returned it
+	hookAuthFailures      = "admin.auth_failures"     // repeated failed admin API authentication from one IP
+	hookQuotaExceeded     = "listener.quota_exceeded" // a listener used up its traffic quota and closed
+	hookUserQuotaExceeded = "user.quota_exceeded"     // a user used up its traffic quota and is refused
+)
+
+// webhookEvents are the events webhooks can subscribe to.
+var webhookEvents = []string{hookBindFailed, hookUnhealthy, hookRecovered, hookAuthFailures, hookQuotaExceeded, hookUserQuotaExceeded}
+
+// Webhook defaults and limits.
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	webhookQueue          = 256 // undelivered notifications; more are dropped
+	webhookAttempts       = 3   // per notification and webhook, 1s and 2s apart
+
+	authFailureAlert  = 5               // failures from one IP within authFailureWindow that send admin.auth_failures
+	authFailureWindow = 5 * time.Minute // at most one alert per IP per window
+)
+
+// webhookPayload is the JSON body POSTed to webhooks.
+type webhookPayload struct {
+	Event string         `json:"event"`
+	Time  time.Time      `json:"time"`
+	Host  string         `json:"host"` // hostname of the daemon
+	Text  string         `json:"text"` // one-line summary, shown by Slack and Mattermost incoming webhooks
+	Data  map[string]any `json:"data,omitempty"`
+}
+
+type webhookDelivery struct {
+	hook    WebhookConfig
+	payload webhookPayload
+}
+
+// notifier sends operational events to the configured webhooks. One
+// goroutine delivers them in order, so raising an event never blocks: when
+// the queue is full the notification is dropped and logged.
+type notifier struct {
+	mu       sync.Mutex
+	hooks    []WebhookConfig
+	queue    chan webhookDelivery // nil until the first webhook is configured
+	done     chan struct{}
+	closed   bool
+	failures map[string]*authFailures // admin API authentication failures by client IP
+}
+
+type authFailures struct {
+	first time.Time
+	count int
+}
+
+// webhooks is the notifier of the running daemon.
+var webhooks notifier
+
+// update replaces the webhooks (nil: none). Queued notifications are still
+// sent to the webhooks they were queued for.
+func (n *notifier) update(hooks []WebhookConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hooks = hooks
+	if len(hooks) > 0 && n.queue == nil && !n.closed {
+		n.queue, n.done = make(chan webhookDelivery, webhookQueue), make(chan struct{})
+		go n.run(n.queue, n.done)
+	}
+}
+
+// close stops accepting notifications and waits up to timeout for the
+// queued ones to be delivered.
+func (n *notifier) close(timeout time.Duration) {
+	n.mu.Lock()
+	if n.closed || n.queue == nil {
+		n.closed = true
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.queue)
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+	case <-time.After(timeout):
+		logWarn("[webhook] gave up on undelivered notifications at shutdown")
+	}
+}
+
+// notify queues event for every webhook subscribed to it.
+func (n *notifier) notify(event, text string, data map[string]any) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed || len(n.hooks) == 0 {
+		return
+	}
+	host, _ := os.Hostname()
+	p := webhookPayload{Event: event, Time: time.Now().UTC(), Host: host, Text: text, Data: data}
+	for _, h := range n.hooks {
+		if !h.wants(event) {
+			continue
+		}
+		select {
+		case n.queue <- webhookDelivery{hook: h, payload: p}:
+		default:
+			logWarn("[webhook] queue full, dropping %s for %s", event, redactURL(h.URL))
+		}
+	}
+}
+
+// authFailed counts a failed admin API authentication from remote and sends
+// admin.auth_failures when the same IP fails authFailureAlert times within
+// authFailureWindow.
+func (n *notifier) authFailed(remote string) {
+	ip := remote
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		ip = host
+	}
+	now := time.Now()
+	n.mu.Lock()
+	if n.failures == nil {
+		n.failures = make(map[string]*authFailures)
+	}
+	f := n.failures[ip]
+	if f == nil || now.Sub(f.first) > authFailureWindow {
+		if len(n.failures) >= 4096 {
+			for k, old := range n.failures {
+				if now.Sub(old.first) > authFailureWindow {
+					delete(n.failures, k)
+				}
+			}
+		}
+		f = &authFailures{first: now}
+		n.failures[ip] = f
+	}
+	f.count++
+	alert := f.count == authFailureAlert
+	n.mu.Unlock()
+	if alert {
+		n.notify(hookAuthFailures, fmt.Sprintf("%d failed admin API authentications from %s within %s", authFailureAlert, ip, authFailureWindow),
+			map[string]any{"client": ip, "failures": authFailureAlert, "window": authFailureWindow.String()})
+	}
+}
+
+func (n *notifier) run(queue <-chan webhookDelivery, done chan<- struct{}) {
+	defer close(done)
+	client := &http.Client{}
+	for d := range queue {
+		body, err := json.Marshal(d.payload)
+		if err != nil {
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = postWebhook(client, d.hook, body)
+			if err == nil {
+				logDebug("[webhook] sent %s to %s", d.payload.Event, redactURL(d.hook.URL))
+				break
+			}
+			if attempt == webhookAttempts {
+				logWarn("[webhook] %s to %s: %v (giving up after %d attempts)", d.payload.Event, redactURL(d.hook.URL), err, attempt)
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func postWebhook(client *http.Client, h WebhookConfig, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "superproxy")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// wants reports whether h is subscribed to event.
+func (h WebhookConfig) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns u without its path and query, which often hold the
+// credential of a webhook (Slack, Discord, ...), for logs.
+func redactURL(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return "webhook"
+	}
+	return p.Scheme + "://" + p.Host + "/..."
+}
+
+// validateWebhooks validates the webhooks list and fills in its defaults.
+func validateWebhooks(hooks []WebhookConfig) error {
+	for i := range hooks {
+		h := &hooks[i]
+		u, err := url.Parse(h.URL)
+		if h.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("config: webhooks[%d]: 'url' must be an http:// or https:// URL", i)
+		}
+		for _, e := range h.Events {
+			if !(WebhookConfig{Events: webhookEvents}).wants(e) {
+				return fmt.Errorf("config: webhooks[%d]: unknown event %q (one of %s)", i, e, strings.Join(webhookEvents, ", "))
+			}
+		}
+		if h.Timeout < 0 {
+			return fmt.Errorf("config: webhooks[%d]: timeout must not be negative", i)
+		}
+		if h.Timeout == 0 {
+			h.Timeout = defaultWebhookTimeout
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// validateWorkers validates a workers block and fills in its defaults.
+func validateWorkers(w *WorkersConfig) error {
+	switch {
+	case w.Max < 0 || w.Queue < 0 || w.QueueTimeout < 0:
+		return fmt.Errorf("values must not be negative")
+	case w.Max == 0 && (w.Queue > 0 || w.QueueTimeout > 0):
+		return fmt.Errorf("queue and queue_timeout are only used with max")
+	case w.Max > 0 && w.Queue == 0:
+		w.Queue = w.Max
+	}
+	return nil
+}
+
+// workerLimits returns the workers.max of e (0: a goroutine per
+// connection) and how long a connection may wait for a handler, by default
+// as long as its handshake may take.
+func (e ProxyEntry) workerLimits() (max, queue int, wait time.Duration) {
+	w := e.Workers
+	if w == nil || w.Max == 0 {
+		return 0, 0, 0
+	}
+	wait = w.QueueTimeout
+	if wait == 0 {
+		wait = e.handshakeTimeout()
+	}
+	return w.Max, w.Queue, wait
+}
+
+// workerPool runs the handlers of a port's connections: at most
+// workers.max at once, each handling the connections queued beyond that
+// one after another, in the order they were accepted. It belongs to the
+// port, so a reload changes its limits without losing the queue.
+type workerPool struct {
+	mu      sync.Mutex
+	running int
+	queue   []queuedConn
+	expiry  *time.Timer // closes the head of the queue once it waited too long
+}
+
+// queuedConn is a connection waiting for a handler, admitted by l.
+type queuedConn struct {
+	l     *listener
+	conn  net.Conn
+	until time.Time
+}
+
+// dispatch hands conn, admitted by l, to a handler: a new goroutine if
+// fewer than workers.max are running, or a place in the queue. It returns
+// false, for the caller to close conn, if the queue is full.
+func (p *listenPort) dispatch(l *listener, conn net.Conn) bool {
+	max, queue, wait := l.entry.workerLimits()
+	if max == 0 {
+		go l.handleConnection(conn, p.stats)
+		return true
+	}
+	w := &p.workers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running < max && len(w.queue) == 0 {
+		w.running++
+		go p.work(l, conn)
+		return true
+	}
+	if len(w.queue) >= queue {
+		return false
+	}
+	w.queue = append(w.queue, queuedConn{l: l, conn: conn, until: time.Now().Add(wait)})
+	w.startQueued(p, max)
+	w.armExpiry(p)
+	return true
+}
+
+// resumeQueued starts handlers for queued connections up to the workers.max
+// of the current listener, after a reload that raised it or removed it.
+func (p *listenPort) resumeQueued() {
+	w := &p.workers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	max, _, _ := p.current.Load().entry.workerLimits()
+	if max == 0 {
+		max = w.running + len(w.queue)
+	}
+	w.startQueued(p, max)
+}
+
+// startQueued starts handlers on the oldest queued connections while fewer
+// than max run.
+func (w *workerPool) startQueued(p *listenPort, max int) {
+	for w.running < max && len(w.queue) > 0 {
+		w.running++
+		q := w.pop()
+		go p.work(q.l, q.conn)
+	}
+	p.stats.Queued.Store(int64(len(w.queue)))
+}
+
+// work handles conn, then queued connections while there are any and no
+// more handlers run than workers.max allows.
+func (p *listenPort) work(l *listener, conn net.Conn) {
+	for {
+		l.handleConnection(conn, p.stats)
+		var ok bool
+		if l, conn, ok = p.next(); !ok {
+			return
+		}
+	}
+}
+
+// next returns the next queued connection for a handler that finished one,
+// or false if the handler is to stop.
+func (p *listenPort) next() (*listener, net.Conn, bool) {
+	w := &p.workers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	max, _, _ := p.current.Load().entry.workerLimits()
+	if len(w.queue) == 0 || max > 0 && w.running > max {
+		w.running--
+		return nil, nil, false
+	}
+	q := w.pop()
+	p.stats.Queued.Store(int64(len(w.queue)))
+	return q.l, q.conn, true
+}
+
+// pop removes the head of the queue.
+func (w *workerPool) pop() queuedConn {
+	q := w.queue[0]
+	w.queue[0] = queuedConn{}
+	w.queue = w.queue[1:]
+	return q
+}
+
+// armExpiry sets the timer of the queue's head, unless it is set.
+func (w *workerPool) armExpiry(p *listenPort) {
+	if w.expiry != nil || len(w.queue) == 0 {
+		return
+	}
+	w.expiry = time.AfterFunc(time.Until(w.queue[0].until), p.expireQueued)
+}
+
+// expireQueued closes the queued connections that waited too long for a
+// handler.
+func (p *listenPort) expireQueued() {
+	w := &p.workers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expiry = nil
+	now := time.Now()
+	for len(w.queue) > 0 && !w.queue[0].until.After(now) {
+		q := w.pop()
+		q.conn.Close()
+		q.l.release(p.stats)
+		p.stats.Dropped.Add(1)
+		if logSampling.allow(sampleQueue, q.l.entry.tag(), levelWarn) {
+			logWarn("[socks5:%s] %s waited too long for a worker, closing", q.l.entry.tag(), q.conn.RemoteAddr())
+		}
+	}
+	p.stats.Queued.Store(int64(len(w.queue)))
+	w.armExpiry(p)
+}